@@ -0,0 +1,42 @@
+package ble
+
+// IOCapability is the input and output capability of a device, which
+// determines how the user is involved in pairing [Vol 3, Part H, 2.3.2].
+type IOCapability uint8
+
+// IO capabilities
+const (
+	IOCapDisplayOnly     IOCapability = 0x00 // Display only
+	IOCapDisplayYesNo    IOCapability = 0x01 // Display, and Yes or No input
+	IOCapKeyboardOnly    IOCapability = 0x02 // Keyboard only
+	IOCapNoInputNoOutput IOCapability = 0x03 // No input and no output
+	IOCapKeyboardDisplay IOCapability = 0x04 // Keyboard and display
+)
+
+// PairingAgent involves the application in pairing.
+type PairingAgent interface {
+	// IOCapability returns the IO capability of the device.
+	IOCapability() IOCapability
+
+	// AuthRequirements returns whether MITM protection and bonding are required.
+	AuthRequirements() (mitm, bond bool)
+
+	// OOBData returns the 128-bit Temporary Key exchanged with the remote
+	// device out of band, least significant octet first, if available.
+	// It is used in LE legacy pairing only.
+	OOBData(c Conn) (tk []byte, ok bool)
+
+	// AuthorizePairing is called when the remote device requests pairing,
+	// and returns true to proceed.
+	AuthorizePairing(c Conn) bool
+
+	// DisplayPasskey displays the passkey, which the user inputs on the remote device.
+	DisplayPasskey(c Conn, passkey uint32)
+
+	// RequestPasskey asks the user to input the passkey displayed on the remote device.
+	RequestPasskey(c Conn) (uint32, error)
+
+	// ConfirmNumber asks the user to confirm that the number is identical to
+	// the one displayed on the remote device, and returns true if confirmed.
+	ConfirmNumber(c Conn, number uint32) bool
+}
@@ -37,9 +37,21 @@ type Client interface {
 	// ReadLongCharacteristic reads a characteristic value which is longer than the MTU. [Vol 3, Part G, 4.8.3]
 	ReadLongCharacteristic(c *Characteristic) ([]byte, error)
 
+	// ReadMultipleCharacteristics reads the values of characteristics of known fixed sizes, and returns them concatenated. [Vol 3, Part G, 4.8.4]
+	ReadMultipleCharacteristics(cs []*Characteristic) ([]byte, error)
+
+	// ReadMultipleVariableCharacteristics reads the values of characteristics, which can have variable lengths. [Vol 3, Part G, 4.8.5]
+	ReadMultipleVariableCharacteristics(cs []*Characteristic) ([][]byte, error)
+
 	// WriteCharacteristic writes a characteristic value to a server. [Vol 3, Part G, 4.9.3]
 	WriteCharacteristic(c *Characteristic, value []byte, noRsp bool) error
 
+	// WriteLongCharacteristic writes a characteristic value which is longer than the MTU. [Vol 3, Part G, 4.9.4]
+	WriteLongCharacteristic(c *Characteristic, value []byte) error
+
+	// BeginReliableWrite starts a transaction of writes to several characteristics, which are written together. [Vol 3, Part G, 4.9.5]
+	BeginReliableWrite() (ReliableWrite, error)
+
 	// ReadDescriptor reads a characteristic descriptor from a server. [Vol 3, Part G, 4.12.1]
 	ReadDescriptor(d *Descriptor) ([]byte, error)
 
@@ -70,3 +82,17 @@ type Client interface {
 	// Conn returns the client's current connection.
 	Conn() Conn
 }
+
+// ReliableWrite is a transaction of writes to characteristic values, which are
+// written together when it's committed. [Vol 3, Part G, 4.9.5]
+type ReliableWrite interface {
+	// Write queues a value to write to a characteristic.
+	Write(c *Characteristic, value []byte) error
+
+	// Commit writes all the queued values together. None of them is written
+	// if any is corrupted on the way to the server.
+	Commit() error
+
+	// Cancel discards all the queued values.
+	Cancel() error
+}
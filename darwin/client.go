@@ -185,6 +185,16 @@ func (cln *Client) ReadLongCharacteristic(c *ble.Characteristic) ([]byte, error)
 	return nil, ble.ErrNotImplemented
 }
 
+// ReadMultipleCharacteristics reads the values of characteristics of known fixed sizes, and returns them concatenated. [Vol 3, Part G, 4.8.4]
+func (cln *Client) ReadMultipleCharacteristics(cs []*ble.Characteristic) ([]byte, error) {
+	return nil, ble.ErrNotImplemented
+}
+
+// ReadMultipleVariableCharacteristics reads the values of characteristics, which can have variable lengths. [Vol 3, Part G, 4.8.5]
+func (cln *Client) ReadMultipleVariableCharacteristics(cs []*ble.Characteristic) ([][]byte, error) {
+	return nil, ble.ErrNotImplemented
+}
+
 // WriteCharacteristic writes a characteristic value to a server. [Vol 3, Part G, 4.9.3]
 func (cln *Client) WriteCharacteristic(c *ble.Characteristic, b []byte, noRsp bool) error {
 	args := xpc.Dict{
@@ -204,6 +214,16 @@ func (cln *Client) WriteCharacteristic(c *ble.Characteristic, b []byte, noRsp bo
 	return m.err()
 }
 
+// WriteLongCharacteristic writes a characteristic value which is longer than the MTU. [Vol 3, Part G, 4.9.4]
+func (cln *Client) WriteLongCharacteristic(c *ble.Characteristic, b []byte) error {
+	return ble.ErrNotImplemented
+}
+
+// BeginReliableWrite starts a transaction of writes to several characteristics, which are written together. [Vol 3, Part G, 4.9.5]
+func (cln *Client) BeginReliableWrite() (ble.ReliableWrite, error) {
+	return nil, ble.ErrNotImplemented
+}
+
 // ReadDescriptor reads a characteristic descriptor from a server. [Vol 3, Part G, 4.12.1]
 func (cln *Client) ReadDescriptor(d *ble.Descriptor) ([]byte, error) {
 	rsp, err := cln.conn.sendReq(cmdReadDescriptor, xpc.Dict{
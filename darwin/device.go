@@ -282,7 +282,7 @@ func (d *Device) AddService(s *ble.Service) error {
 		perm := 0
 		if c.Property&ble.CharRead != 0 {
 			props |= 0x02
-			if ble.CharRead&c.Secure != 0 {
+			if ble.CharRead&c.Secure != 0 || c.Permission&(ble.PermReadEncrypt|ble.PermReadAuthenticate) != 0 {
 				perm |= 0x04
 			} else {
 				perm |= 0x01
@@ -290,7 +290,7 @@ func (d *Device) AddService(s *ble.Service) error {
 		}
 		if c.Property&ble.CharWriteNR != 0 {
 			props |= 0x04
-			if c.Secure&ble.CharWriteNR != 0 {
+			if c.Secure&ble.CharWriteNR != 0 || c.Permission&(ble.PermWriteEncrypt|ble.PermWriteAuthenticate) != 0 {
 				perm |= 0x08
 			} else {
 				perm |= 0x02
@@ -298,7 +298,7 @@ func (d *Device) AddService(s *ble.Service) error {
 		}
 		if c.Property&ble.CharWrite != 0 {
 			props |= 0x08
-			if c.Secure&ble.CharWrite != 0 {
+			if c.Secure&ble.CharWrite != 0 || c.Permission&(ble.PermWriteEncrypt|ble.PermWriteAuthenticate) != 0 {
 				perm |= 0x08
 			} else {
 				perm |= 0x02
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"time"
 
+	"github.com/go-ble/ble"
 	"github.com/go-ble/ble/linux/hci/cmd"
 	"github.com/go-ble/ble/linux/hci/evt"
 )
@@ -59,3 +60,8 @@ func (d *Device) SetScanParams(param cmd.LESetScanParameters) error {
 func (d *Device) SetAdvParams(param cmd.LESetAdvertisingParameters) error {
 	return errors.New("Not supported")
 }
+
+// SetPairingAgent sets the agent, which involves the application in pairing.
+func (d *Device) SetPairingAgent(a ble.PairingAgent) error {
+	return errors.New("Not supported")
+}
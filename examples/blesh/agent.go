@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-ble/ble"
+	"github.com/pkg/errors"
+)
+
+// agent is an interactive pairing agent, which displays and prompts on the terminal.
+type agent struct{}
+
+func (a *agent) IOCapability() ble.IOCapability { return ble.IOCapKeyboardDisplay }
+
+func (a *agent) AuthRequirements() (mitm, bond bool) { return false, true }
+
+func (a *agent) OOBData(c ble.Conn) ([]byte, bool) { return nil, false }
+
+func (a *agent) AuthorizePairing(c ble.Conn) bool {
+	return yes(ask(fmt.Sprintf("\nAccept pairing with %s? (yes/no): ", c.RemoteAddr())))
+}
+
+func (a *agent) DisplayPasskey(c ble.Conn, passkey uint32) {
+	fmt.Printf("\nPasskey for %s: %06d\n", c.RemoteAddr(), passkey)
+}
+
+func (a *agent) RequestPasskey(c ble.Conn) (uint32, error) {
+	s := ask(fmt.Sprintf("\nEnter passkey displayed on %s: ", c.RemoteAddr()))
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n > 999999 {
+		return 0, errors.Errorf("invalid passkey %q", s)
+	}
+	return uint32(n), nil
+}
+
+func (a *agent) ConfirmNumber(c ble.Conn, number uint32) bool {
+	return yes(ask(fmt.Sprintf("\nConfirm %06d is displayed on %s (yes/no): ", number, c.RemoteAddr())))
+}
+
+func yes(s string) bool {
+	s = strings.ToLower(s)
+	return s == "y" || s == "yes"
+}
+
+// The terminal input is shared between the shell and the agent. Each line is
+// handed to a pending prompt of the agent, if any, or to whichever of them
+// asks for it first, so none is dropped.
+var input struct {
+	once    sync.Once
+	lines   chan string // Lines for the shell.
+	answers chan string // Lines for the prompts of the agent.
+}
+
+func readInput() {
+	input.lines = make(chan string)
+	input.answers = make(chan string)
+	go func() {
+		r := bufio.NewReader(os.Stdin)
+		for {
+			s, err := r.ReadString('\n')
+			if err != nil {
+				// The prompts pending are answered with empty lines.
+				close(input.lines)
+				close(input.answers)
+				return
+			}
+			s = strings.TrimSpace(s)
+			select {
+			case input.answers <- s:
+				continue
+			default:
+			}
+			// The shell may be busy with a command, which prompts the user
+			// while the line is pending.
+			select {
+			case input.answers <- s:
+			case input.lines <- s:
+			}
+		}
+	}()
+}
+
+// readLine returns the next line of the terminal input for the shell.
+func readLine() (string, bool) {
+	input.once.Do(readInput)
+	s, ok := <-input.lines
+	return s, ok
+}
+
+// ask prints the question, and returns the answer from the terminal input.
+func ask(q string) string {
+	input.once.Do(readInput)
+	fmt.Print(q)
+	return <-input.answers
+}
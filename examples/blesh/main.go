@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"os"
@@ -91,6 +90,14 @@ func main() {
 			Action:  cmdDisconnect,
 			Flags:   []cli.Flag{flgAddr},
 		},
+		{
+			Name:    "pair",
+			Aliases: []string{"p"},
+			Usage:   "Pair with a connected peripheral device",
+			Before:  setup,
+			Action:  cmdPair,
+			Flags:   []cli.Flag{flgTimeout, flgName, flgAddr},
+		},
 		{
 			Name:    "discover",
 			Aliases: []string{"d"},
@@ -155,7 +162,7 @@ func setup(c *cli.Context) error {
 		return nil
 	}
 	fmt.Printf("Initializing device ...\n")
-	d, err := dev.NewDevice("default")
+	d, err := dev.NewDevice("default", ble.OptPairingAgent(&agent{}))
 	if err != nil {
 		return errors.Wrap(err, "can't new device")
 	}
@@ -281,6 +288,18 @@ func cmdDisconnect(c *cli.Context) error {
 	return curr.client.CancelConnection()
 }
 
+func cmdPair(c *cli.Context) error {
+	if err := doConnect(c); err != nil {
+		return err
+	}
+	p, ok := curr.client.Conn().(interface{ Pair() error })
+	if !ok {
+		return fmt.Errorf("pairing is not supported")
+	}
+	fmt.Printf("Pairing with %s...\n", curr.client.Addr())
+	return errors.Wrap(p.Pair(), "can't pair")
+}
+
 func cmdDiscover(c *cli.Context) error {
 	curr.profile = nil
 	if curr.client == nil {
@@ -398,7 +417,6 @@ func cmdUnsub(c *cli.Context) error {
 
 func cmdShell(app *cli.App) {
 	cli.OsExiter = func(c int) {}
-	reader := bufio.NewReader(os.Stdin)
 	sigs := make(chan os.Signal, 1)
 	go func() {
 		for range sigs {
@@ -409,8 +427,10 @@ func cmdShell(app *cli.App) {
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	for {
 		fmt.Print("blesh > ")
-		text, _ := reader.ReadString('\n')
-		text = strings.TrimSpace(text)
+		text, ok := readLine()
+		if !ok {
+			break
+		}
 		if text == "" {
 			continue
 		}
@@ -32,6 +32,16 @@ func (f WriteHandlerFunc) ServeWrite(req Request, rsp ResponseWriter) {
 	f(req, rsp)
 }
 
+// A WriteValidator is implemented by the WriteHandlers, which validate the
+// values before they're written. The writes of an Execute Write Request are
+// all validated before any of them is served, so an invalid value leaves none
+// of the attributes written. The values of the handlers not implementing it
+// aren't validated, though. If one of them fails the write, the writes served
+// before it are left written.
+type WriteValidator interface {
+	ValidateWrite(req Request) ATTError
+}
+
 // A NotifyHandler handles GATT requests.
 type NotifyHandler interface {
 	ServeNotify(req Request, n Notifier)
@@ -45,6 +55,21 @@ func (f NotifyHandlerFunc) ServeNotify(req Request, n Notifier) {
 	f(req, n)
 }
 
+// An Authorizer authorizes the accesses to attributes which require authorization.
+type Authorizer interface {
+	// Authorize reports whether the peer device of conn is allowed to read the
+	// attribute, or to write it if write is true.
+	Authorize(conn Conn, write bool) bool
+}
+
+// AuthorizerFunc is an adapter to allow the use of ordinary functions as Authorizers.
+type AuthorizerFunc func(conn Conn, write bool) bool
+
+// Authorize returns f(conn, write).
+func (f AuthorizerFunc) Authorize(conn Conn, write bool) bool {
+	return f(conn, write)
+}
+
 // Request ...
 type Request interface {
 	Conn() Conn
@@ -155,17 +180,23 @@ type Notifier interface {
 
 type notifier struct {
 	ctx    context.Context
-	maxlen int
+	maxlen func() int
 	cancel func()
 	send   func([]byte) (int, error)
 }
 
 // NewNotifier ...
 func NewNotifier(send func([]byte) (int, error)) Notifier {
+	return NewNotifierWithCap(send, nil)
+}
+
+// NewNotifierWithCap returns a Notifier, whose Cap reports the result of
+// maxlen, which can change along with the MTU of the connection.
+func NewNotifierWithCap(send func([]byte) (int, error), maxlen func() int) Notifier {
 	n := &notifier{}
 	n.ctx, n.cancel = context.WithCancel(context.Background())
 	n.send = send
-	// n.maxlen = cap
+	n.maxlen = maxlen
 	return n
 }
 
@@ -183,5 +214,8 @@ func (n *notifier) Close() error {
 }
 
 func (n *notifier) Cap() int {
-	return n.maxlen
+	if n.maxlen == nil {
+		return 0
+	}
+	return n.maxlen()
 }
@@ -12,6 +12,10 @@ var (
 	// ErrSeqProtoTimeout means the request hasn't been acknowledged in 30 seconds.
 	// [Vol 3, Part F, 3.3.3]
 	ErrSeqProtoTimeout = errors.New("req timeout")
+
+	// ErrNotSubscribed means the client hasn't subscribed to the notifications
+	// or the indications of the characteristic.
+	ErrNotSubscribed = errors.New("not subscribed")
 )
 
 var rspOfReq = map[byte]byte{
@@ -27,4 +31,6 @@ var rspOfReq = map[byte]byte{
 	PrepareWriteRequestCode:    PrepareWriteResponseCode,
 	ExecuteWriteRequestCode:    ExecuteWriteResponseCode,
 	HandleValueIndicationCode:  HandleValueConfirmationCode,
+
+	ReadMultipleVariableRequestCode: ReadMultipleVariableResponseCode,
 }
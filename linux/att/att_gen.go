@@ -637,3 +637,57 @@ func (r HandleValueConfirmation) AttributeOpcode() uint8 { return r[0] }
 
 // SetAttributeOpcode ...
 func (r HandleValueConfirmation) SetAttributeOpcode() { r[0] = 0x1E }
+
+// ReadMultipleVariableRequestCode ...
+const ReadMultipleVariableRequestCode = 0x20
+
+// ReadMultipleVariableRequest implements Read Multiple Variable Request (0x20) [Vol 3, Part F, 3.4.4.11].
+type ReadMultipleVariableRequest []byte
+
+// AttributeOpcode ...
+func (r ReadMultipleVariableRequest) AttributeOpcode() uint8 { return r[0] }
+
+// SetAttributeOpcode ...
+func (r ReadMultipleVariableRequest) SetAttributeOpcode() { r[0] = 0x20 }
+
+// SetOfHandles ...
+func (r ReadMultipleVariableRequest) SetOfHandles() []byte { return r[1:] }
+
+// SetSetOfHandles ...
+func (r ReadMultipleVariableRequest) SetSetOfHandles(v []byte) { copy(r[1:], v) }
+
+// ReadMultipleVariableResponseCode ...
+const ReadMultipleVariableResponseCode = 0x21
+
+// ReadMultipleVariableResponse implements Read Multiple Variable Response (0x21) [Vol 3, Part F, 3.4.4.12].
+type ReadMultipleVariableResponse []byte
+
+// AttributeOpcode ...
+func (r ReadMultipleVariableResponse) AttributeOpcode() uint8 { return r[0] }
+
+// SetAttributeOpcode ...
+func (r ReadMultipleVariableResponse) SetAttributeOpcode() { r[0] = 0x21 }
+
+// LengthValueTupleList ...
+func (r ReadMultipleVariableResponse) LengthValueTupleList() []byte { return r[1:] }
+
+// SetLengthValueTupleList ...
+func (r ReadMultipleVariableResponse) SetLengthValueTupleList(v []byte) { copy(r[1:], v) }
+
+// MultipleHandleValueNotificationCode ...
+const MultipleHandleValueNotificationCode = 0x23
+
+// MultipleHandleValueNotification implements Multiple Handle Value Notification (0x23) [Vol 3, Part F, 3.4.7.4].
+type MultipleHandleValueNotification []byte
+
+// AttributeOpcode ...
+func (r MultipleHandleValueNotification) AttributeOpcode() uint8 { return r[0] }
+
+// SetAttributeOpcode ...
+func (r MultipleHandleValueNotification) SetAttributeOpcode() { r[0] = 0x23 }
+
+// HandleLengthValueTupleList ...
+func (r MultipleHandleValueNotification) HandleLengthValueTupleList() []byte { return r[1:] }
+
+// SetHandleLengthValueTupleList ...
+func (r MultipleHandleValueNotification) SetHandleLengthValueTupleList(v []byte) { copy(r[1:], v) }
@@ -2,6 +2,9 @@ package att
 
 import "github.com/go-ble/ble"
 
+// maxValueLen is the maximum length of an attribute value [Vol 3, Part F, 3.2.9].
+const maxValueLen = 512
+
 // attr is a BLE attribute.
 type attr struct {
 	h    uint16
@@ -11,4 +14,12 @@ type attr struct {
 	v  []byte
 	rh ble.ReadHandler
 	wh ble.WriteHandler
+
+	// Security requirements of accessing the value.
+	perm    ble.Permission
+	keySize int
+	az      ble.Authorizer
+
+	// signed is set if the value accepts Signed Write Commands.
+	signed bool
 }
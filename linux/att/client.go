@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/crypto"
 	"github.com/pkg/errors"
 )
 
@@ -291,6 +292,50 @@ func (c *Client) ReadMultiple(handles []uint16) ([]byte, error) {
 	return rsp.SetOfValues(), nil
 }
 
+// ReadMultipleVariable requests the server to read two or more values of a set
+// of attributes, which can have variable lengths, and returns the Length Value
+// Tuple List of the Read Multiple Variable Response. Each value is preceded by
+// its length, and the list is truncated to (ATT_MTU - 1) octets. So the last
+// value can be shorter than its length, and the values of the last handles can
+// be missing. [Vol 3, Part F, 3.4.4.11 & 3.4.4.12]
+func (c *Client) ReadMultipleVariable(handles []uint16) ([]byte, error) {
+	// Should request to read two or more values.
+	if len(handles) < 2 || len(handles)*2 > c.l2c.TxMTU()-1 {
+		return nil, ErrInvalidArgument
+	}
+
+	// Acquire and reuse the txBuf, and release it after usage.
+	txBuf := <-c.chTxBuf
+	defer func() { c.chTxBuf <- txBuf }()
+
+	req := ReadMultipleVariableRequest(txBuf[:1+len(handles)*2])
+	req.SetAttributeOpcode()
+	p := req.SetOfHandles()
+	for _, h := range handles {
+		binary.LittleEndian.PutUint16(p, h)
+		p = p[2:]
+	}
+
+	b, err := c.sendReq(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert and validate the response.
+	rsp := ReadMultipleVariableResponse(b)
+	switch {
+	case rsp[0] == ErrorResponseCode && len(rsp) == 5:
+		return nil, ble.ATTError(rsp[4])
+	case rsp[0] == ErrorResponseCode && len(rsp) != 5:
+		fallthrough
+	case rsp[0] != rsp.AttributeOpcode():
+		fallthrough
+	case len(rsp) < 3:
+		return nil, ErrInvalidResponse
+	}
+	return rsp.LengthValueTupleList(), nil
+}
+
 // ReadByGroupType obtains the values of attributes where the attribute type is known,
 // the type of a grouping attribute as defined by a higher layer specification, but
 // the handle is not known. [Vol 3, Part F, 3.4.4.9 & 3.4.4.10]
@@ -386,8 +431,9 @@ func (c *Client) WriteCommand(handle uint16, value []byte) error {
 }
 
 // SignedWrite requests the server to write the value of an attribute with an authentication
-// signature, typically into a control-point attribute. [Vol 3, Part F, 3.4.5.4]
-func (c *Client) SignedWrite(handle uint16, value []byte, signature [12]byte) error {
+// signature, typically into a control-point attribute. The signature is computed with the
+// CSRK and the sign counter distributed by the local device. [Vol 3, Part F, 3.4.5.4]
+func (c *Client) SignedWrite(handle uint16, value []byte, csrk [16]byte, counter uint32) error {
 	if len(value) > c.l2c.TxMTU()-15 {
 		return ErrInvalidArgument
 	}
@@ -396,11 +442,16 @@ func (c *Client) SignedWrite(handle uint16, value []byte, signature [12]byte) er
 	txBuf := <-c.chTxBuf
 	defer func() { c.chTxBuf <- txBuf }()
 
-	req := SignedWriteCommand(txBuf[:15+len(value)])
+	// The Attribute Value is variable-length, and followed by the signature.
+	req := SignedWriteCommand(txBuf[:3+len(value)+signatureLen])
 	req.SetAttributeOpcode()
 	req.SetAttributeHandle(handle)
-	req.SetAttributeValue(value)
-	req.SetAuthenticationSignature(signature)
+	copy(req[3:], value)
+	sig, err := crypto.Default.Sign(csrk, counter, req[:3+len(value)])
+	if err != nil {
+		return err
+	}
+	copy(req[3+len(value):], sig[:])
 
 	return c.sendCmd(req)
 }
@@ -422,6 +473,7 @@ func (c *Client) PrepareWrite(handle uint16, offset uint16, value []byte) (uint1
 	req.SetAttributeOpcode()
 	req.SetAttributeHandle(handle)
 	req.SetValueOffset(offset)
+	req.SetPartAttributeValue(value)
 
 	b, err := c.sendReq(req)
 	if err != nil {
@@ -452,7 +504,7 @@ func (c *Client) ExecuteWrite(flags uint8) error {
 	txBuf := <-c.chTxBuf
 	defer func() { c.chTxBuf <- txBuf }()
 
-	req := ExecuteWriteRequest(txBuf[:1])
+	req := ExecuteWriteRequest(txBuf[:2])
 	req.SetAttributeOpcode()
 	req.SetFlags(flags)
 
@@ -538,6 +590,18 @@ func (c *Client) Loop() {
 		b := make([]byte, n)
 		copy(b, c.rxBuf)
 
+		if b[0] == MultipleHandleValueNotificationCode {
+			// Deliver the values as individual notifications.
+			for _, n := range splitNotifications(b) {
+				select {
+				case ch <- asyncWork{handle: c.handler.HandleNotification, data: n}:
+				default:
+					_ = logger.Error("client", "req", "can't enqueue incoming notification.")
+				}
+			}
+			continue
+		}
+
 		if (b[0] != HandleValueNotificationCode) && (b[0] != HandleValueIndicationCode) {
 			c.rspc <- b
 			continue
@@ -558,3 +622,24 @@ func (c *Client) Loop() {
 		}
 	}
 }
+
+// splitNotifications converts a Multiple Handle Value Notification into Handle
+// Value Notifications. A truncated tuple, which only the last one can be, is
+// discarded. [Vol 3, Part F, 3.4.7.4]
+func splitNotifications(b []byte) [][]byte {
+	var ns [][]byte
+	l := MultipleHandleValueNotification(b).HandleLengthValueTupleList()
+	for len(l) >= 4 {
+		n := int(binary.LittleEndian.Uint16(l[2:4]))
+		if len(l) < 4+n {
+			break
+		}
+		r := HandleValueNotification(make([]byte, 3+n))
+		r.SetAttributeOpcode()
+		r.SetAttributeHandle(binary.LittleEndian.Uint16(l[0:2]))
+		copy(r.AttributeValue(), l[4:4+n])
+		ns = append(ns, r)
+		l = l[4+n:]
+	}
+	return ns
+}
@@ -1,18 +1,34 @@
 package att
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/go-ble/ble"
 )
 
-// A DB is a contiguous range of attributes.
+// A DB is a range of attributes. The services keep their handles, unless they
+// are changed, so there can be gaps between them.
 type DB struct {
+	mu    sync.RWMutex
+	attrs []*attr // nil for the handles not in use.
+	base  uint16  // handle for first attr in attrs
+	svcs  []svcAttrs
+	chars map[*ble.Characteristic]bool
+}
+
+// svcAttrs are the attributes of a service, in the order of the handles.
+type svcAttrs struct {
+	s     *ble.Service
 	attrs []*attr
-	base  uint16 // handle for first attr in attrs
 }
 
+func (sa svcAttrs) start() uint16 { return sa.attrs[0].h }
+func (sa svcAttrs) end() uint16   { return sa.attrs[len(sa.attrs)-1].h }
+
 const (
 	tooSmall = -1
 	tooLarge = -2
@@ -33,8 +49,10 @@ func (r *DB) idx(h int) int {
 
 // at returns attr a.
 func (r *DB) at(h uint16) (a *attr, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	i := r.idx(int(h))
-	if i < 0 {
+	if i < 0 || r.attrs[i] == nil {
 		return nil, false
 	}
 	return r.attrs[i], true
@@ -43,6 +61,8 @@ func (r *DB) at(h uint16) (a *attr, ok bool) {
 // subrange returns attributes in range [start, end]; it may return an empty slice.
 // subrange does not panic for out-of-range start or end.
 func (r *DB) subrange(start, end uint16) []*attr {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	startidx := r.idx(int(start))
 	switch startidx {
 	case tooSmall:
@@ -58,23 +78,158 @@ func (r *DB) subrange(start, end uint16) []*attr {
 	case tooLarge:
 		endidx = len(r.attrs)
 	}
-	return r.attrs[startidx:endidx]
+	attrs := make([]*attr, 0, endidx-startidx)
+	for _, a := range r.attrs[startidx:endidx] {
+		if a != nil {
+			attrs = append(attrs, a)
+		}
+	}
+	return attrs
 }
 
 // NewDB ...
 func NewDB(ss []*ble.Service, base uint16) *DB {
-	h := base
+	r := &DB{base: base}
+	r.Update(ss)
+	return r
+}
+
+// Update replaces the services of the DB, which takes effect on the servers
+// using it right away. The services, which were in the DB and haven't changed,
+// keep their handles, and the others take the first gaps which fit them. It
+// returns the range of the handles affected, which is reported to the clients
+// in Service Changed indications [Vol 3, Part G, 7.1].
+func (r *DB) Update(ss []*ble.Service) (start, end uint16, changed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Keep the handles of the services unchanged.
+	old := r.svcs
+	used := make([]bool, len(old))
+	var placed []svcAttrs
+	var pending []*ble.Service
+	for _, s := range ss {
+		if i := findSvc(old, used, s); i >= 0 {
+			if _, aa := genSvcAttr(s, old[i].start()); sameAttrs(aa, old[i].attrs) {
+				used[i] = true
+				placed = append(placed, svcAttrs{s: s, attrs: aa})
+				continue
+			}
+		}
+		pending = append(pending, s)
+	}
+	sort.Slice(placed, func(i, j int) bool { return placed[i].start() < placed[j].start() })
+
+	affect := func(s, e uint16) {
+		if !changed || s < start {
+			start = s
+		}
+		if !changed || e > end {
+			end = e
+		}
+		changed = true
+	}
+	for i, sa := range old {
+		if !used[i] {
+			affect(sa.start(), sa.end())
+		}
+	}
+
+	// Place the other services in the first gaps fitting them.
+	for _, s := range pending {
+		_, aa := genSvcAttr(s, 0)
+		h := r.base
+		i := 0
+		for ; i < len(placed); i++ {
+			if int(h)+len(aa) <= int(placed[i].start()) {
+				break
+			}
+			h = placed[i].end() + 1
+		}
+		_, aa = genSvcAttr(s, h)
+		placed = append(placed, svcAttrs{})
+		copy(placed[i+1:], placed[i:])
+		placed[i] = svcAttrs{s: s, attrs: aa}
+		affect(placed[i].start(), placed[i].end())
+	}
+
+	// The group of the last service ends at 0xFFFF, so the groups of the old
+	// and the new last services change, if they're not the same.
+	if n, o := len(placed), len(old); o > 0 && (n == 0 || placed[n-1].start() != old[o-1].start()) {
+		affect(old[o-1].start(), 0xFFFF)
+		if n > 0 {
+			affect(placed[n-1].start(), placed[n-1].end())
+		}
+	}
+
 	var attrs []*attr
-	var aa []*attr
-	for i, s := range ss {
-		h, aa = genSvcAttr(s, h)
-		if i == len(ss)-1 {
-			aa[0].endh = 0xFFFF
+	if len(placed) > 0 {
+		attrs = make([]*attr, int(placed[len(placed)-1].end())-int(r.base)+1)
+	}
+	for i, sa := range placed {
+		sa.s.Handle, sa.s.EndHandle = sa.start(), sa.end()
+		if i == len(placed)-1 {
+			sa.attrs[0].endh = 0xFFFF
+		}
+		for _, a := range sa.attrs {
+			attrs[int(a.h)-int(r.base)] = a
 		}
-		attrs = append(attrs, aa...)
 	}
+	chars := make(map[*ble.Characteristic]bool)
+	for _, sa := range placed {
+		for _, c := range sa.s.Characteristics {
+			chars[c] = true
+		}
+	}
+	r.attrs, r.svcs, r.chars = attrs, placed, chars
 	DumpAttributes(attrs)
-	return &DB{attrs: attrs, base: base}
+	return start, end, changed
+}
+
+// has reports whether the characteristic is in the DB.
+func (r *DB) has(c *ble.Characteristic) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.chars[c]
+}
+
+// findSvc returns the index of the service in the DB, which is s, or has the
+// same UUID if s is not. It returns -1 if none is found.
+func findSvc(old []svcAttrs, used []bool, s *ble.Service) int {
+	for i, sa := range old {
+		if !used[i] && sa.s == s {
+			return i
+		}
+	}
+	for i, sa := range old {
+		if !used[i] && sa.s.UUID.Equal(s.UUID) {
+			return i
+		}
+	}
+	return -1
+}
+
+// sameAttrs reports whether the attributes have the same handles, types and
+// declarations, so a client doesn't need to discover them again.
+func sameAttrs(a, b []*attr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].h != b[i].h || !a[i].typ.Equal(b[i].typ) {
+			return false
+		}
+		switch {
+		case a[i].typ.Equal(ble.PrimaryServiceUUID),
+			a[i].typ.Equal(ble.SecondaryServiceUUID),
+			a[i].typ.Equal(ble.IncludeUUID),
+			a[i].typ.Equal(ble.CharacteristicUUID):
+			if !bytes.Equal(a[i].v, b[i].v) {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 func genSvcAttr(s *ble.Service, h uint16) (uint16, []*attr) {
@@ -105,17 +260,30 @@ func genCharAttr(c *ble.Characteristic, h uint16) (uint16, []*attr) {
 		v:   append([]byte{byte(c.Property), byte(vh), byte((vh) >> 8)}, c.UUID...),
 	}
 
+	// Secure is the shorthand of requiring encryption for the properties.
+	perm := c.Permission
+	if c.Secure&ble.CharRead != 0 {
+		perm |= ble.PermReadEncrypt
+	}
+	if c.Secure&(ble.CharWrite|ble.CharWriteNR) != 0 {
+		perm |= ble.PermWriteEncrypt
+	}
+
 	va := &attr{
-		h:   vh,
-		typ: c.UUID,
-		v:   c.Value,
-		rh:  c.ReadHandler,
-		wh:  c.WriteHandler,
+		h:       vh,
+		typ:     c.UUID,
+		v:       c.Value,
+		rh:      c.ReadHandler,
+		wh:      c.WriteHandler,
+		perm:    perm,
+		keySize: c.MinKeySize,
+		az:      c.Authorizer,
+		signed:  c.Property&ble.CharSignedWrite != 0,
 	}
 
 	c.Handle = h
 	c.ValueHandle = vh
-	if c.NotifyHandler != nil || c.IndicateHandler != nil {
+	if c.Property&(ble.CharNotify|ble.CharIndicate) != 0 && c.CCCD == nil {
 		c.CCCD = newCCCD(c)
 		c.Descriptors = append(c.Descriptors, c.CCCD)
 	}
@@ -139,6 +307,10 @@ func genDescAttr(d *ble.Descriptor, h uint16) *attr {
 		v:   d.Value,
 		rh:  d.ReadHandler,
 		wh:  d.WriteHandler,
+
+		perm:    d.Permission,
+		keySize: d.MinKeySize,
+		az:      d.Authorizer,
 	}
 }
 
@@ -147,6 +319,9 @@ func DumpAttributes(aa []*attr) {
 	logger.Debug("server", "db", "Generating attribute table:")
 	logger.Debug("server", "db", "handle   endh   type")
 	for _, a := range aa {
+		if a == nil {
+			continue
+		}
 		if a.v != nil {
 			logger.Debug("server", "db", fmt.Sprintf("0x%04X 0x%04X 0x%s [% X]", a.h, a.endh, a.typ, a.v))
 			continue
@@ -164,14 +339,18 @@ func newCCCD(c *ble.Characteristic) *ble.Descriptor {
 	d := ble.NewDescriptor(ble.ClientCharacteristicConfigUUID)
 
 	d.HandleRead(ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
-		cccs := req.Conn().(*conn).cccs
-		ccc := cccs[c.Handle]
+		cn := req.Conn().(*conn)
+		cn.mu.Lock()
+		ccc := cn.cccs[c]
+		cn.mu.Unlock()
 		binary.Write(rsp, binary.LittleEndian, ccc)
 	}))
 
 	d.HandleWrite(ble.WriteHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
 		cn := req.Conn().(*conn)
-		old := cn.cccs[c.Handle]
+		cn.mu.Lock()
+		defer cn.mu.Unlock()
+		old := cn.cccs[c]
 		ccc := binary.LittleEndian.Uint16(req.Data())
 
 		oldNotify := old&cccNotify != 0
@@ -184,12 +363,14 @@ func newCCCD(c *ble.Characteristic) *ble.Descriptor {
 				rsp.SetStatus(ble.ErrUnlikely)
 				return
 			}
-			send := func(b []byte) (int, error) { return cn.svr.notify(c.ValueHandle, b) }
-			cn.nn[c.Handle] = ble.NewNotifier(send)
-			go c.NotifyHandler.ServeNotify(req, cn.nn[c.Handle])
+			send := func(b []byte) (int, error) { return cn.push(c, cccNotify, b) }
+			cn.nn[c] = ble.NewNotifierWithCap(send, cn.svr.maxNotifyLen)
+			if c.NotifyHandler != nil {
+				go c.NotifyHandler.ServeNotify(req, cn.nn[c])
+			}
 		}
 		if !newNotify && oldNotify {
-			cn.nn[c.Handle].Close()
+			cn.nn[c].Close()
 		}
 
 		if newIndicate && !oldIndicate {
@@ -197,14 +378,25 @@ func newCCCD(c *ble.Characteristic) *ble.Descriptor {
 				rsp.SetStatus(ble.ErrUnlikely)
 				return
 			}
-			send := func(b []byte) (int, error) { return cn.svr.indicate(c.ValueHandle, b) }
-			cn.in[c.Handle] = ble.NewNotifier(send)
-			go c.IndicateHandler.ServeNotify(req, cn.in[c.Handle])
+			send := func(b []byte) (int, error) { return cn.push(c, cccIndicate, b) }
+			cn.in[c] = ble.NewNotifierWithCap(send, cn.svr.maxNotifyLen)
+			if c.IndicateHandler != nil {
+				go c.IndicateHandler.ServeNotify(req, cn.in[c])
+			}
 		}
 		if !newIndicate && oldIndicate {
-			cn.in[c.Handle].Close()
+			cn.in[c].Close()
 		}
-		cn.cccs[c.Handle] = ccc
+		cn.cccs[c] = ccc
 	}))
+
+	// Subscribing delivers the value, so it requires the security of reading it.
+	if c.Secure&(ble.CharNotify|ble.CharIndicate) != 0 || c.Permission&ble.PermReadEncrypt != 0 {
+		d.Permission |= ble.PermWriteEncrypt
+	}
+	if c.Permission&ble.PermReadAuthenticate != 0 {
+		d.Permission |= ble.PermWriteAuthenticate
+	}
+	d.MinKeySize = c.MinKeySize
 	return d
 }
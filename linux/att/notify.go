@@ -0,0 +1,208 @@
+package att
+
+import (
+	"errors"
+	"io"
+
+	"github.com/go-ble/ble"
+)
+
+// QueuePolicy is what's done when a notification or an indication is sent,
+// and the queue of the server is full.
+type QueuePolicy int
+
+// Policies of the full queues.
+const (
+	// QueueBlock waits until there is room in the queue.
+	QueueBlock QueuePolicy = iota
+
+	// QueueDropOldest drops the oldest value in the queue, which fails with
+	// ErrQueueFull, to make room for the new one.
+	QueueDropOldest
+
+	// QueueError fails the new value with ErrQueueFull.
+	QueueError
+)
+
+// defaultQueueSize is the default size of the queues of the notifications
+// and the indications of a server.
+const defaultQueueSize = 16
+
+var (
+	// ErrQueueFull means the value isn't sent, since the queue is full.
+	ErrQueueFull = errors.New("queue full")
+
+	// ErrValueTooLong means the value doesn't fit in the ATT_MTU.
+	ErrValueTooLong = errors.New("value too long")
+)
+
+// outValue is a notification or an indication queued to send.
+type outValue struct {
+	h    uint16
+	v    []byte
+	done chan error // receives the result, if it's not nil.
+}
+
+func (o *outValue) finish(err error) {
+	if o.done != nil {
+		o.done <- err
+	}
+}
+
+// SetNotifyQueue sets the size of each of the queues of the notifications and
+// the indications, and what's done when one is full. It must be called before
+// Loop. Once it's set, the Write of a Notifier returns as soon as the value is
+// queued, if it's a notification, without waiting for the result. Indications
+// are still written once they're confirmed.
+func (s *Server) SetNotifyQueue(size int, policy QueuePolicy) error {
+	if size < 1 || policy < QueueBlock || policy > QueueError {
+		return ErrInvalidArgument
+	}
+	s.chNotify = make(chan *outValue, size)
+	s.chIndicate = make(chan *outValue, size)
+	s.policy = policy
+	s.queued = true
+	return nil
+}
+
+// maxNotifyLen returns the maximum length of a notified or indicated value,
+// which is ATT_MTU - 3. The ATT_MTU is the smaller of the MTUs of the client
+// and the server [Vol 3, Part F, 3.4.2.2].
+func (s *Server) maxNotifyLen() int {
+	mtu := s.l2c.TxMTU()
+	if s.rxMTU < mtu {
+		mtu = s.rxMTU
+	}
+	return mtu - 3
+}
+
+// enqueue queues the value to send with the policy of the server. If done
+// is not nil, it receives the result once the value is sent, or dropped.
+func (s *Server) enqueue(ch chan *outValue, h uint16, v []byte, done chan error) error {
+	if len(v) > s.maxNotifyLen() {
+		return ErrValueTooLong
+	}
+	o := &outValue{h: h, v: append([]byte(nil), v...), done: done}
+	for {
+		select {
+		case <-s.chDone:
+			return io.ErrClosedPipe
+		default:
+		}
+		select {
+		case ch <- o:
+			return nil
+		default:
+		}
+		switch s.policy {
+		case QueueBlock:
+			select {
+			case <-s.chDone:
+				return io.ErrClosedPipe
+			case ch <- o:
+				return nil
+			}
+		case QueueDropOldest:
+			select {
+			case old := <-ch:
+				old.finish(ErrQueueFull)
+			default:
+			}
+		default:
+			return ErrQueueFull
+		}
+	}
+}
+
+// push sends the value of the characteristic for a Notifier, as long as the
+// client is subscribed to it, as the bit of the CCCD value.
+func (cn *conn) push(c *ble.Characteristic, bit uint16, v []byte) (int, error) {
+	cn.mu.Lock()
+	ccc := cn.cccs[c]
+	cn.mu.Unlock()
+	if ccc&bit == 0 {
+		return 0, ErrNotSubscribed
+	}
+	if bit == cccIndicate {
+		return cn.svr.push(cn.svr.chIndicate, c.ValueHandle, v)
+	}
+	return cn.svr.push(cn.svr.chNotify, c.ValueHandle, v)
+}
+
+// push sends the value for a Notifier. It waits for the result, unless the
+// value is a notification, and the queue is set by SetNotifyQueue.
+func (s *Server) push(ch chan *outValue, h uint16, v []byte) (int, error) {
+	var done chan error
+	if ch == s.chIndicate || !s.queued {
+		done = make(chan error, 1)
+	}
+	if err := s.enqueue(ch, h, v, done); err != nil {
+		return 0, err
+	}
+	if done != nil {
+		if err := s.wait(done); err != nil {
+			return 0, err
+		}
+	}
+	return len(v), nil
+}
+
+// wait waits for the result of a queued value.
+func (s *Server) wait(done chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-s.chDone:
+		return io.ErrClosedPipe
+	}
+}
+
+// sendNotifications sends the queued notifications until the bearer closes.
+func (s *Server) sendNotifications() {
+	for {
+		select {
+		case <-s.chDone:
+			s.drain(s.chNotify)
+			return
+		case o := <-s.chNotify:
+			_, err := s.notify(o.h, o.v)
+			o.finish(err)
+		}
+	}
+}
+
+// sendIndications sends the queued indications one at a time, each after the
+// previous one is confirmed [Vol 3, Part F, 3.4.7.2]. Once an indication is
+// not confirmed in time, no more is sent on the bearer [Vol 3, Part F, 3.3.3].
+func (s *Server) sendIndications() {
+	var failed error
+	for {
+		select {
+		case <-s.chDone:
+			s.drain(s.chIndicate)
+			return
+		case o := <-s.chIndicate:
+			if failed != nil {
+				o.finish(failed)
+				continue
+			}
+			_, err := s.indicate(o.h, o.v)
+			if err == ErrSeqProtoTimeout {
+				failed = err
+			}
+			o.finish(err)
+		}
+	}
+}
+
+// drain fails the values left in the queue, once the bearer is closed.
+func (s *Server) drain(ch chan *outValue) {
+	for {
+		select {
+		case o := <-ch:
+			o.finish(io.ErrClosedPipe)
+		default:
+			return
+		}
+	}
+}
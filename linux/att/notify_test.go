@@ -0,0 +1,184 @@
+package att
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-ble/ble"
+)
+
+// newIndicateServer returns a running server of a characteristic, to whose
+// indications the client is subscribed.
+func newIndicateServer(t *testing.T, onWrite func(conn *testConn, b []byte)) (*Server, *testConn, *ble.Characteristic) {
+	t.Helper()
+	svc := ble.NewService(ble.UUID16(0x1800))
+	c := svc.NewCharacteristic(ble.UUID16(0x2a00))
+	c.HandleIndicate(nil)
+	s, conn := newTestServer(t, []*ble.Service{svc}, ble.DefaultMTU)
+	if onWrite != nil {
+		conn.onWrite = func(b []byte) { onWrite(conn, b) }
+	}
+	go s.Loop()
+	if err := s.SetCCC(c, cccIndicate); err != nil {
+		t.Fatal(err)
+	}
+	return s, conn, c
+}
+
+// notifyAsync calls Notify, and returns the channel of its result.
+func notifyAsync(s *Server, c *ble.Characteristic, v []byte) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- s.Notify(c, v) }()
+	return done
+}
+
+func TestIndicateEarlyConfirmation(t *testing.T) {
+	// The client confirms each indication before the server waits for it.
+	// The requests are handled in order, so the confirmation is taken once
+	// the response to the next request is written.
+	read := make(chan struct{})
+	s, conn, c := newIndicateServer(t, func(conn *testConn, b []byte) {
+		switch b[0] {
+		case HandleValueIndicationCode:
+			conn.rx <- []byte{HandleValueConfirmationCode}
+			conn.rx <- []byte{ReadRequestCode, 0x01, 0x00}
+			<-read
+		case ReadResponseCode:
+			read <- struct{}{}
+		}
+	})
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-notifyAsync(s, c, []byte{byte(i)}):
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("confirmation of indication %d lost", i)
+		}
+	}
+}
+
+func TestIndicateSpuriousConfirmation(t *testing.T) {
+	s, conn, c := newIndicateServer(t, nil)
+	defer conn.Close()
+
+	// The spurious confirmation is taken once the next request is responded
+	// to, and doesn't confirm the next indication.
+	conn.rx <- []byte{HandleValueConfirmationCode}
+	conn.send(t, ReadRequestCode, 0x01, 0x00)
+	done := notifyAsync(s, c, []byte{1})
+	<-conn.tx
+	select {
+	case err := <-done:
+		t.Fatalf("indication not confirmed, but written: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.rx <- []byte{HandleValueConfirmationCode}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueuePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy QueuePolicy
+		err    error  // of queueing the second value.
+		oldest error  // of the first value, if it's dropped.
+		queued []byte // the value left in the queue.
+	}{
+		{QueueBlock, nil, nil, []byte{2}},
+		{QueueDropOldest, nil, ErrQueueFull, []byte{2}},
+		{QueueError, ErrQueueFull, nil, []byte{1}},
+	} {
+		// The queue of the size 1 is full with the first value, as the
+		// server doesn't send it without Loop.
+		s, _ := newTestServer(t, nil, ble.DefaultMTU)
+		if err := s.SetNotifyQueue(1, tc.policy); err != nil {
+			t.Fatal(err)
+		}
+		done1 := make(chan error, 1)
+		if err := s.enqueue(s.chNotify, 3, []byte{1}, done1); err != nil {
+			t.Fatal(err)
+		}
+		errc := make(chan error, 1)
+		go func() { errc <- s.enqueue(s.chNotify, 3, []byte{2}, nil) }()
+		if tc.policy == QueueBlock {
+			select {
+			case err := <-errc:
+				t.Fatalf("policy %d: not blocked: %v", tc.policy, err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			// The value is queued, once there is room.
+			(<-s.chNotify).finish(nil)
+			if err := <-done1; err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := <-errc; err != tc.err {
+			t.Errorf("policy %d: error %v, want %v", tc.policy, err, tc.err)
+		}
+		if tc.oldest != nil {
+			if err := <-done1; err != tc.oldest {
+				t.Errorf("policy %d: oldest %v, want %v", tc.policy, err, tc.oldest)
+			}
+		}
+		if o := <-s.chNotify; !bytes.Equal(o.v, tc.queued) {
+			t.Errorf("policy %d: queued % X, want % X", tc.policy, o.v, tc.queued)
+		}
+
+		// Nothing is queued once the bearer is closed.
+		close(s.chDone)
+		if err := s.enqueue(s.chNotify, 3, []byte{3}, nil); err != io.ErrClosedPipe {
+			t.Errorf("policy %d: closed: %v", tc.policy, err)
+		}
+	}
+}
+
+func TestNotifyLen(t *testing.T) {
+	for _, tc := range []struct {
+		rxMTU, txMTU int
+		max          int
+	}{
+		{ble.DefaultMTU, ble.DefaultMTU, ble.DefaultMTU - 3},
+		{100, 50, 47},
+		{50, 100, 47},
+	} {
+		// The server exchanges its rxMTU, and the client the txMTU.
+		svc := ble.NewService(ble.UUID16(0x1800))
+		c := svc.NewCharacteristic(ble.UUID16(0x2a00))
+		nc := make(chan ble.Notifier, 1)
+		c.HandleNotify(ble.NotifyHandlerFunc(func(req ble.Request, n ble.Notifier) { nc <- n }))
+		conn := newTestConn()
+		conn.rxMTU = tc.rxMTU
+		s, err := NewServer(NewDB([]*ble.Service{svc}, 1), conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.handleRequest([]byte{ExchangeMTURequestCode, byte(tc.txMTU), byte(tc.txMTU >> 8)})
+		go s.Loop()
+		if err := s.SetCCC(c, cccNotify); err != nil {
+			t.Fatal(err)
+		}
+		n := <-nc
+		if n.Cap() != tc.max {
+			t.Errorf("MTUs %d, %d: cap %d, want %d", tc.rxMTU, tc.txMTU, n.Cap(), tc.max)
+		}
+		if _, err := n.Write(make([]byte, tc.max+1)); err != ErrValueTooLong {
+			t.Errorf("MTUs %d, %d: %d octets: %v", tc.rxMTU, tc.txMTU, tc.max+1, err)
+		}
+		if err := s.Notify(c, make([]byte, tc.max+1)); err != ErrValueTooLong {
+			t.Errorf("MTUs %d, %d: %d octets: %v", tc.rxMTU, tc.txMTU, tc.max+1, err)
+		}
+		if _, err := n.Write(make([]byte, tc.max)); err != nil {
+			t.Errorf("MTUs %d, %d: %d octets: %v", tc.rxMTU, tc.txMTU, tc.max, err)
+		}
+		if b := <-conn.tx; len(b) != 3+tc.max {
+			t.Errorf("MTUs %d, %d: notified % X", tc.rxMTU, tc.txMTU, b)
+		}
+		conn.Close()
+	}
+}
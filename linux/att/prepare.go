@@ -0,0 +1,81 @@
+package att
+
+import "github.com/go-ble/ble"
+
+// maxPrepWrites is the maximum number of the values in the prepare queue of a
+// client [Vol 3, Part F, 3.4.6.1].
+const maxPrepWrites = 64
+
+// prepWrite is a part of an attribute value, which is prepared to be written.
+type prepWrite struct {
+	a      *attr
+	offset int
+	data   []byte
+}
+
+// prepare appends a part of the value of a to the prepare queue. The queue is
+// shared by all the bearers of the client.
+func (c *conn) prepare(a *attr, offset int, data []byte) ble.ATTError {
+	c.muPrep.Lock()
+	defer c.muPrep.Unlock()
+	if len(c.prep) >= maxPrepWrites {
+		return ble.ErrPrepQueueFull
+	}
+	c.prep = append(c.prep, prepWrite{
+		a:      a,
+		offset: offset,
+		data:   append([]byte(nil), data...),
+	})
+	return ble.ErrSuccess
+}
+
+// takePrepared removes and returns all the values in the prepare queue.
+func (c *conn) takePrepared() []prepWrite {
+	c.muPrep.Lock()
+	defer c.muPrep.Unlock()
+	q := c.prep
+	c.prep = nil
+	return q
+}
+
+// mergePrepared validates the prepared values, and merges the contiguous ones
+// of each attribute into a single write. The offsets and the lengths are only
+// validated when the writes are executed [Vol 3, Part F, 3.4.6.3]. It returns
+// the handle in error, if any of them is invalid, so none is written.
+func mergePrepared(q []prepWrite) ([]prepWrite, uint16, ble.ATTError) {
+	// The writes of an attribute are in the order they were prepared, and the
+	// attributes are in the order they were first prepared.
+	var ws []prepWrite
+	last := make(map[*attr]int)
+	for _, p := range q {
+		switch {
+		case p.offset > maxValueLen:
+			return nil, p.a.h, ble.ErrInvalidOffset
+		case p.offset+len(p.data) > maxValueLen:
+			return nil, p.a.h, ble.ErrInvalAttrValueLen
+		}
+		if i, ok := last[p.a]; ok && ws[i].offset+len(ws[i].data) == p.offset {
+			ws[i].data = append(ws[i].data, p.data...)
+			continue
+		}
+		last[p.a] = len(ws)
+		ws = append(ws, p)
+	}
+	return ws, 0, ble.ErrSuccess
+}
+
+// validateWrite checks the permissions of the attribute against the security
+// state of the link, which may have changed since the value was prepared, and
+// validates the value with the handler, if it implements ble.WriteValidator.
+func (s *Server) validateWrite(w prepWrite) ble.ATTError {
+	if w.a.wh == nil {
+		return ble.ErrWriteNotPerm
+	}
+	if e := s.checkSecurity(w.a, true); e != ble.ErrSuccess {
+		return e
+	}
+	if v, ok := w.a.wh.(ble.WriteValidator); ok {
+		return v.ValidateWrite(ble.NewRequest(s.conn, w.data, w.offset))
+	}
+	return ble.ErrSuccess
+}
@@ -0,0 +1,160 @@
+package att
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/go-ble/ble"
+)
+
+// logWriter is a WriteHandler, which logs the writes, and validates the
+// values if it's a validating one.
+type logWriter struct {
+	name string
+	log  *[]string
+}
+
+func (w logWriter) ServeWrite(req ble.Request, rsp ble.ResponseWriter) {
+	*w.log = append(*w.log, fmt.Sprintf("%s@%d:%s", w.name, req.Offset(), req.Data()))
+}
+
+type validatingWriter struct{ logWriter }
+
+func (w validatingWriter) ValidateWrite(req ble.Request) ble.ATTError {
+	if bytes.Contains(req.Data(), []byte("bad")) {
+		return ble.ErrInvalAttrValueLen
+	}
+	return ble.ErrSuccess
+}
+
+// newPrepareServer returns a server of the characteristics of the handlers,
+// whose value handles are 3, 5, 7...
+func newPrepareServer(t *testing.T, hs ...ble.WriteHandler) *Server {
+	t.Helper()
+	svc := ble.NewService(ble.UUID16(0x1800))
+	for i, h := range hs {
+		svc.NewCharacteristic(ble.UUID16(0x2a00 + uint16(i))).HandleWrite(h)
+	}
+	s, _ := newTestServer(t, []*ble.Service{svc}, ble.DefaultMTU)
+	return s
+}
+
+// prepare sends a Prepare Write Request, which must succeed.
+func prepare(t *testing.T, s *Server, h uint16, offset int, v string) {
+	t.Helper()
+	req := append([]byte{PrepareWriteRequestCode, byte(h), byte(h >> 8), byte(offset), byte(offset >> 8)}, v...)
+	if rsp := s.handleRequest(req); !bytes.Equal(rsp[1:], req[1:]) || rsp[0] != PrepareWriteResponseCode {
+		t.Fatalf("response % X", rsp)
+	}
+}
+
+func TestExecuteWrite(t *testing.T) {
+	var log []string
+	a, b := logWriter{"a", &log}, logWriter{"b", &log}
+	for _, tc := range []struct {
+		name    string
+		prepare func(t *testing.T, s *Server)
+		rsp     []byte
+		log     string
+	}{
+		{
+			name: "merged",
+			prepare: func(t *testing.T, s *Server) {
+				prepare(t, s, 3, 0, "hello ")
+				prepare(t, s, 5, 0, "x")
+				prepare(t, s, 3, 6, "world")
+			},
+			rsp: []byte{ExecuteWriteResponseCode},
+			log: "[a@0:hello world b@0:x]",
+		},
+		{
+			// The writes of an attribute are merged only if they're
+			// contiguous, so the ones after a gap are written separately.
+			name: "gap",
+			prepare: func(t *testing.T, s *Server) {
+				prepare(t, s, 3, 0, "ab")
+				prepare(t, s, 3, 4, "ef")
+				prepare(t, s, 3, 6, "gh")
+			},
+			rsp: []byte{ExecuteWriteResponseCode},
+			log: "[a@0:ab a@4:efgh]",
+		},
+		{
+			name: "too long",
+			prepare: func(t *testing.T, s *Server) {
+				prepare(t, s, 5, 0, "x")
+				for off := 0; off < 600; off += 200 {
+					prepare(t, s, 3, off, string(bytes.Repeat([]byte{'a'}, 200)))
+				}
+			},
+			rsp: newErrorResponse(ExecuteWriteRequestCode, 3, ble.ErrInvalAttrValueLen),
+			log: "[]",
+		},
+		{
+			name: "invalid offset",
+			prepare: func(t *testing.T, s *Server) {
+				prepare(t, s, 3, 0, "x")
+				prepare(t, s, 5, 600, "x")
+			},
+			rsp: newErrorResponse(ExecuteWriteRequestCode, 5, ble.ErrInvalidOffset),
+			log: "[]",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			log = nil
+			s := newPrepareServer(t, a, b)
+			tc.prepare(t, s)
+			if rsp := s.handleRequest([]byte{ExecuteWriteRequestCode, 0x01}); !bytes.Equal(rsp, tc.rsp) {
+				t.Errorf("response % X, want % X", rsp, tc.rsp)
+			}
+			if fmt.Sprint(log) != tc.log {
+				t.Errorf("written %v, want %s", log, tc.log)
+			}
+			// The queue is cleared, whether the writes succeed or fail.
+			log = nil
+			s.handleRequest([]byte{ExecuteWriteRequestCode, 0x01})
+			if len(log) != 0 {
+				t.Errorf("written again %v", log)
+			}
+		})
+	}
+}
+
+func TestExecuteWriteValidated(t *testing.T) {
+	var log []string
+	a := validatingWriter{logWriter{"a", &log}}
+	b := validatingWriter{logWriter{"b", &log}}
+	s := newPrepareServer(t, a, b)
+
+	// The second write is rejected, so neither is written.
+	prepare(t, s, 3, 0, "good")
+	prepare(t, s, 5, 0, "bad")
+	want := newErrorResponse(ExecuteWriteRequestCode, 5, ble.ErrInvalAttrValueLen)
+	if rsp := s.handleRequest([]byte{ExecuteWriteRequestCode, 0x01}); !bytes.Equal(rsp, want) {
+		t.Errorf("response % X, want % X", rsp, want)
+	}
+	if len(log) != 0 {
+		t.Errorf("written %v", log)
+	}
+
+	// The merged value is validated, rather than each part of it.
+	prepare(t, s, 3, 0, "good")
+	prepare(t, s, 5, 0, "ba")
+	prepare(t, s, 5, 2, "d")
+	if rsp := s.handleRequest([]byte{ExecuteWriteRequestCode, 0x01}); !bytes.Equal(rsp, want) {
+		t.Errorf("response % X, want % X", rsp, want)
+	}
+	if len(log) != 0 {
+		t.Errorf("written %v", log)
+	}
+
+	prepare(t, s, 3, 0, "good")
+	prepare(t, s, 5, 0, "fine")
+	if rsp := s.handleRequest([]byte{ExecuteWriteRequestCode, 0x01}); rsp[0] != ExecuteWriteResponseCode {
+		t.Errorf("response % X", rsp)
+	}
+	if fmt.Sprint(log) != "[a@0:good b@0:fine]" {
+		t.Errorf("written %v", log)
+	}
+}
@@ -5,17 +5,29 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/crypto"
 )
 
+// conn holds the states of a client, which are shared by the servers of all
+// the ATT bearers of the connection.
 type conn struct {
 	ble.Conn
-	svr  *Server
-	cccs map[uint16]uint16
-	nn   map[uint16]ble.Notifier
-	in   map[uint16]ble.Notifier
+	svr *Server
+
+	// The subscriptions are kept by the characteristics, rather than the
+	// handles, which change when the services are updated.
+	mu   sync.Mutex // guards cccs, nn and in.
+	cccs map[*ble.Characteristic]uint16
+	nn   map[*ble.Characteristic]ble.Notifier
+	in   map[*ble.Characteristic]ble.Notifier
+
+	// The prepare queue of the client [Vol 3, Part F, 3.4.6].
+	muPrep sync.Mutex
+	prep   []prepWrite
 }
 
 // Server implements an ATT (Attribute Protocol) server.
@@ -23,6 +35,11 @@ type Server struct {
 	conn *conn
 	db   *DB
 
+	// l2c is the ATT bearer of the server, which is an Enhanced ATT bearer
+	// if enhanced is set. Otherwise, it's the same as conn.
+	l2c      ble.Conn
+	enhanced bool
+
 	// Refer to [Vol 3, Part F, 3.3.2 & 3.3.3] for the requirement of
 	// sequential request-response protocol, and transactions.
 	rxMTU     int
@@ -31,11 +48,19 @@ type Server struct {
 	chIndBuf  chan []byte
 	chConfirm chan bool
 
+	// The queues of the notifications and the indications to send, which are
+	// failed once chDone is closed. The notifications of the Notifiers aren't
+	// waited for, if queued is set by SetNotifyQueue.
+	chNotify   chan *outValue
+	chIndicate chan *outValue
+	policy     QueuePolicy
+	queued     bool
+	chDone     chan struct{}
+
 	dummyRspWriter ble.ResponseWriter
 
-	// Store a write handler for defer execute once receiving ExecuteWriteRequest
-	prepareWriteRequestAttr *attr
-	prepareWriteRequestData bytes.Buffer
+	// signer supplies the keys to verify Signed Write Commands with.
+	signer SigningKeyProvider
 }
 
 // NewServer returns an ATT (Attribute Protocol) server.
@@ -50,17 +75,22 @@ func NewServer(db *DB, l2c ble.Conn) (*Server, error) {
 	s := &Server{
 		conn: &conn{
 			Conn: l2c,
-			cccs: make(map[uint16]uint16),
-			in:   make(map[uint16]ble.Notifier),
-			nn:   make(map[uint16]ble.Notifier),
+			cccs: make(map[*ble.Characteristic]uint16),
+			in:   make(map[*ble.Characteristic]ble.Notifier),
+			nn:   make(map[*ble.Characteristic]ble.Notifier),
 		},
-		db: db,
+		db:  db,
+		l2c: l2c,
 
 		rxMTU:     mtu,
 		txBuf:     make([]byte, ble.DefaultMTU, ble.DefaultMTU),
 		chNotBuf:  make(chan []byte, 1),
 		chIndBuf:  make(chan []byte, 1),
-		chConfirm: make(chan bool),
+		chConfirm: make(chan bool, 1),
+
+		chNotify:   make(chan *outValue, defaultQueueSize),
+		chIndicate: make(chan *outValue, defaultQueueSize),
+		chDone:     make(chan struct{}),
 
 		dummyRspWriter: ble.NewResponseWriter(nil),
 	}
@@ -70,6 +100,41 @@ func NewServer(db *DB, l2c ble.Conn) (*Server, error) {
 	return s, nil
 }
 
+// NewBearer returns a server of an Enhanced ATT bearer of the same connection
+// [Vol 3, Part F, 3.2.11]. It shares the DB and the states of the client, such
+// as the CCCD values, with s. The ATT_MTU of the bearer is set by L2CAP, and
+// isn't exchanged.
+func (s *Server) NewBearer(l2c ble.Conn) (*Server, error) {
+	rxMTU, txMTU := l2c.RxMTU(), l2c.TxMTU()
+	if rxMTU < ble.DefaultMTU || rxMTU > ble.MaxMTU || txMTU < ble.DefaultMTU || txMTU > ble.MaxMTU {
+		return nil, fmt.Errorf("invalid MTU")
+	}
+	b := &Server{
+		conn:     s.conn,
+		db:       s.db,
+		l2c:      l2c,
+		enhanced: true,
+
+		rxMTU:     rxMTU,
+		txBuf:     make([]byte, txMTU, txMTU),
+		chNotBuf:  make(chan []byte, 1),
+		chIndBuf:  make(chan []byte, 1),
+		chConfirm: make(chan bool, 1),
+
+		chNotify:   make(chan *outValue, cap(s.chNotify)),
+		chIndicate: make(chan *outValue, cap(s.chIndicate)),
+		policy:     s.policy,
+		queued:     s.queued,
+		chDone:     make(chan struct{}),
+
+		dummyRspWriter: ble.NewResponseWriter(nil),
+		signer:         s.signer,
+	}
+	b.chNotBuf <- make([]byte, txMTU, txMTU)
+	b.chIndBuf <- make([]byte, txMTU, txMTU)
+	return b, nil
+}
+
 // notify sends notification to remote central.
 func (s *Server) notify(h uint16, data []byte) (int, error) {
 	// Acquire and reuse notifyBuffer. Release it after usage.
@@ -82,10 +147,36 @@ func (s *Server) notify(h uint16, data []byte) (int, error) {
 	buf := bytes.NewBuffer(rsp.AttributeValue())
 	buf.Reset()
 	if len(data) > buf.Cap() {
-		data = data[:buf.Cap()]
+		return 0, ErrValueTooLong
 	}
 	buf.Write(data)
-	return s.conn.Write(rsp[:3+buf.Len()])
+	return s.l2c.Write(rsp[:3+buf.Len()])
+}
+
+// NotifyMultiple sends the values of the attributes in a Multiple Handle Value
+// Notification [Vol 3, Part F, 3.4.7.4]. The client must support it, which it
+// declares in the Client Supported Features characteristic.
+func (s *Server) NotifyMultiple(handles []uint16, values [][]byte) error {
+	if len(handles) < 2 || len(handles) != len(values) {
+		return ErrInvalidArgument
+	}
+	// Acquire and reuse notifyBuffer. Release it after usage.
+	nBuf := <-s.chNotBuf
+	defer func() { s.chNotBuf <- nBuf }()
+
+	rsp := MultipleHandleValueNotification(nBuf)
+	rsp.SetAttributeOpcode()
+	n := 1
+	for i, h := range handles {
+		if n+4+len(values[i]) > len(nBuf) {
+			return ErrInvalidArgument
+		}
+		binary.LittleEndian.PutUint16(nBuf[n:], h)
+		binary.LittleEndian.PutUint16(nBuf[n+2:], uint16(len(values[i])))
+		n += 4 + copy(nBuf[n+4:], values[i])
+	}
+	_, err := s.l2c.Write(rsp[:n])
+	return err
 }
 
 // indicate sends indication to remote central.
@@ -100,10 +191,17 @@ func (s *Server) indicate(h uint16, data []byte) (int, error) {
 	buf := bytes.NewBuffer(rsp.AttributeValue())
 	buf.Reset()
 	if len(data) > buf.Cap() {
-		data = data[:buf.Cap()]
+		return 0, ErrValueTooLong
 	}
 	buf.Write(data)
-	n, err := s.conn.Write(rsp[:3+buf.Len()])
+
+	// The confirmation is buffered, as it may arrive before it's waited for.
+	// Drop a spurious one left from before, which isn't of this indication.
+	select {
+	case <-s.chConfirm:
+	default:
+	}
+	n, err := s.l2c.Write(rsp[:3+buf.Len()])
 	if err != nil {
 		return n, err
 	}
@@ -118,6 +216,79 @@ func (s *Server) indicate(h uint16, data []byte) (int, error) {
 	}
 }
 
+// Notify pushes the value of the characteristic to the client, as configured
+// in its CCCD. The value is indicated if the client has subscribed to the
+// indications, and it waits for the confirmation. Otherwise, it's notified.
+// It returns ErrNotSubscribed if the client has subscribed to neither.
+func (s *Server) Notify(c *ble.Characteristic, value []byte) error {
+	s.conn.mu.Lock()
+	ccc := s.conn.cccs[c]
+	s.conn.mu.Unlock()
+	var ch chan *outValue
+	switch {
+	case ccc&cccIndicate != 0:
+		ch = s.chIndicate
+	case ccc&cccNotify != 0:
+		ch = s.chNotify
+	default:
+		return ErrNotSubscribed
+	}
+	done := make(chan error, 1)
+	if err := s.enqueue(ch, c.ValueHandle, value, done); err != nil {
+		return err
+	}
+	return s.wait(done)
+}
+
+// UnsubscribeRemoved unsubscribes the client from the characteristics, which
+// are no longer in the DB, and closes their Notifiers. It's called once the
+// services of the DB are updated.
+func (s *Server) UnsubscribeRemoved() {
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	for c, ccc := range s.conn.cccs {
+		if !s.db.has(c) {
+			s.conn.unsubscribe(c, ccc)
+			delete(s.conn.cccs, c)
+		}
+	}
+}
+
+// unsubscribe closes the Notifiers of the subscriptions in ccc. The caller
+// must hold the lock.
+func (cn *conn) unsubscribe(c *ble.Characteristic, ccc uint16) {
+	if ccc&cccIndicate != 0 {
+		cn.in[c].Close()
+		delete(cn.in, c)
+	}
+	if ccc&cccNotify != 0 {
+		cn.nn[c].Close()
+		delete(cn.nn, c)
+	}
+}
+
+// CCC returns the value of the client's CCCD of the characteristic.
+func (s *Server) CCC(c *ble.Characteristic) uint16 {
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	return s.conn.cccs[c]
+}
+
+// SetCCC writes the value to the client's CCCD of the characteristic, as if
+// the client wrote it. It restores the configuration of a bonded client, which
+// persists across the connections [Vol 3, Part G, 3.3.3.3].
+func (s *Server) SetCCC(c *ble.Characteristic, v uint16) error {
+	if c.CCCD == nil || c.CCCD.WriteHandler == nil {
+		return ErrInvalidArgument
+	}
+	rsp := ble.NewResponseWriter(nil)
+	c.CCCD.WriteHandler.ServeWrite(ble.NewRequest(s.conn, []byte{byte(v), byte(v >> 8)}, 0), rsp)
+	if rsp.Status() != ble.ErrSuccess {
+		return rsp.Status()
+	}
+	return nil
+}
+
 // Loop accepts incoming ATT request, and respond response.
 func (s *Server) Loop() {
 	type sbuf struct {
@@ -128,15 +299,19 @@ func (s *Server) Loop() {
 	pool <- &sbuf{buf: make([]byte, s.rxMTU)}
 	pool <- &sbuf{buf: make([]byte, s.rxMTU)}
 
+	go s.sendNotifications()
+	go s.sendIndications()
+
 	seq := make(chan *sbuf)
 	go func() {
 		b := <-pool
 		for {
-			n, err := s.conn.Read(b.buf)
+			n, err := s.l2c.Read(b.buf)
 			if n == 0 || err != nil {
 				close(seq)
 				close(s.chConfirm)
-				_ = s.conn.Close()
+				close(s.chDone)
+				_ = s.l2c.Close()
 				return
 			}
 			if b.buf[0] == HandleValueConfirmationCode {
@@ -155,21 +330,22 @@ func (s *Server) Loop() {
 	for req := range seq {
 		if rsp := s.handleRequest(req.buf[:req.len]); rsp != nil {
 			if len(rsp) != 0 {
-				s.conn.Write(rsp)
+				s.l2c.Write(rsp)
 			}
 		}
 		pool <- req
 	}
-	for h, ccc := range s.conn.cccs {
+	if s.enhanced {
+		// The connection, and the client states, outlive the bearer.
+		return
+	}
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	for c, ccc := range s.conn.cccs {
 		if ccc != 0 {
 			logger.Info("cleanup", ble.ContextKeyCCC, fmt.Sprintf("0x%02X", ccc))
 		}
-		if ccc&cccIndicate != 0 {
-			s.conn.in[h].Close()
-		}
-		if ccc&cccNotify != 0 {
-			s.conn.nn[h].Close()
-		}
+		s.conn.unsubscribe(c, ccc)
 	}
 }
 
@@ -199,9 +375,12 @@ func (s *Server) handleRequest(b []byte) []byte {
 		resp = s.handlePrepareWriteRequest(b)
 	case ExecuteWriteRequestCode:
 		resp = s.handleExecuteWriteRequest(b)
-	case ReadMultipleRequestCode,
-		SignedWriteCommandCode:
-		fallthrough
+	case SignedWriteCommandCode:
+		s.handleSignedWriteCommand(b)
+	case ReadMultipleRequestCode:
+		resp = s.handleReadMultipleRequest(b)
+	case ReadMultipleVariableRequestCode:
+		resp = s.handleReadMultipleVariableRequest(b)
 	default:
 		resp = newErrorResponse(reqType, 0x0000, ble.ErrReqNotSupp)
 	}
@@ -219,6 +398,11 @@ func (s *Server) handleExchangeMTURequest(r ExchangeMTURequest) []byte {
 		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrInvalidPDU)
 	}
 
+	// The ATT_MTU of an Enhanced ATT bearer is set by L2CAP [Vol 3, Part F, 3.4.2].
+	if s.enhanced {
+		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrReqNotSupp)
+	}
+
 	txMTU := int(r.ClientRxMTU())
 	s.conn.SetTxMTU(txMTU)
 
@@ -356,18 +540,22 @@ func (s *Server) handleReadByTypeRequest(r ReadByTypeRequest) []byte {
 			continue
 		}
 		v := a.v
-		if v == nil {
+		e := ble.ErrSuccess
+		if v != nil {
+			e = s.checkSecurity(a, false)
+		} else {
 			buf2 := bytes.NewBuffer(make([]byte, 0, len(s.txBuf)-2))
-			if e := handleATT(a, s, r, ble.NewResponseWriter(buf2)); e != ble.ErrSuccess {
-				// Return if the first value read cause an error.
-				if dlen == 0 {
-					return newErrorResponse(r.AttributeOpcode(), r.StartingHandle(), e)
-				}
-				// Otherwise, skip to the next one.
-				break
-			}
+			e = handleATT(a, s, r, ble.NewResponseWriter(buf2))
 			v = buf2.Bytes()
 		}
+		if e != ble.ErrSuccess {
+			// Return if the first value read cause an error.
+			if dlen == 0 {
+				return newErrorResponse(r.AttributeOpcode(), r.StartingHandle(), e)
+			}
+			// Otherwise, skip to the next one.
+			break
+		}
 		if dlen == 0 {
 			// Found the first value.
 			dlen = 2 + len(v)
@@ -412,8 +600,11 @@ func (s *Server) handleReadRequest(r ReadRequest) []byte {
 		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), ble.ErrInvalidHandle)
 	}
 
-	// Simple case. Read-only, no-authorization, no-authentication.
+	// Simple case. Read-only, static value.
 	if a.v != nil {
+		if e := s.checkSecurity(a, false); e != ble.ErrSuccess {
+			return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
+		}
 		binary.Write(buf, binary.LittleEndian, a.v)
 		return rsp[:1+buf.Len()]
 	}
@@ -444,8 +635,11 @@ func (s *Server) handleReadBlobRequest(r ReadBlobRequest) []byte {
 	buf := bytes.NewBuffer(rsp.PartAttributeValue())
 	buf.Reset()
 
-	// Simple case. Read-only, no-authorization, no-authentication.
+	// Simple case. Read-only, static value.
 	if a.v != nil {
+		if e := s.checkSecurity(a, false); e != ble.ErrSuccess {
+			return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
+		}
 		binary.Write(buf, binary.LittleEndian, a.v)
 		return rsp[:1+buf.Len()]
 	}
@@ -458,6 +652,90 @@ func (s *Server) handleReadBlobRequest(r ReadBlobRequest) []byte {
 	return rsp[:1+buf.Len()]
 }
 
+// handle Read Multiple request. [Vol 3, Part F, 3.4.4.7 & 3.4.4.8]
+func (s *Server) handleReadMultipleRequest(r ReadMultipleRequest) []byte {
+	// Validate the request.
+	switch {
+	case len(r) < 5 || len(r)%2 != 1:
+		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrInvalidPDU)
+	}
+
+	rsp := ReadMultipleResponse(s.txBuf)
+	rsp.SetAttributeOpcode()
+	buf := bytes.NewBuffer(rsp.SetOfValues())
+	buf.Reset()
+
+	// The values are concatenated, and the response is truncated to
+	// (ATT_MTU - 1) octets.
+	for p := r.SetOfHandles(); len(p) >= 2; p = p[2:] {
+		h := binary.LittleEndian.Uint16(p)
+		v, e := s.readMultiple(r, h, buf.Cap())
+		if e != ble.ErrSuccess {
+			return newErrorResponse(r.AttributeOpcode(), h, e)
+		}
+		if n := buf.Cap() - buf.Len(); len(v) > n {
+			v = v[:n]
+		}
+		buf.Write(v)
+	}
+	return rsp[:1+buf.Len()]
+}
+
+// handle Read Multiple Variable request. [Vol 3, Part F, 3.4.4.11 & 3.4.4.12]
+func (s *Server) handleReadMultipleVariableRequest(r ReadMultipleVariableRequest) []byte {
+	// Validate the request.
+	switch {
+	case len(r) < 5 || len(r)%2 != 1:
+		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrInvalidPDU)
+	}
+
+	rsp := ReadMultipleVariableResponse(s.txBuf)
+	rsp.SetAttributeOpcode()
+	buf := bytes.NewBuffer(rsp.LengthValueTupleList())
+	buf.Reset()
+
+	// Each value is preceded by its full length, so the client can tell a
+	// value truncated to fit in (ATT_MTU - 1) octets, and read the rest.
+	for p := r.SetOfHandles(); len(p) >= 2; p = p[2:] {
+		h := binary.LittleEndian.Uint16(p)
+		v, e := s.readMultiple(r, h, maxValueLen)
+		if e != ble.ErrSuccess {
+			return newErrorResponse(r.AttributeOpcode(), h, e)
+		}
+		n := buf.Cap() - buf.Len() - 2
+		if n < 0 {
+			break
+		}
+		binary.Write(buf, binary.LittleEndian, uint16(len(v)))
+		if len(v) > n {
+			v = v[:n]
+		}
+		buf.Write(v)
+	}
+	return rsp[:1+buf.Len()]
+}
+
+// readMultiple reads up to n octets of the value of the attribute h for the
+// Read Multiple request r.
+func (s *Server) readMultiple(r []byte, h uint16, n int) ([]byte, ble.ATTError) {
+	a, ok := s.db.at(h)
+	if !ok {
+		return nil, ble.ErrInvalidHandle
+	}
+	// Simple case. Read-only, static value.
+	if a.v != nil {
+		if e := s.checkSecurity(a, false); e != ble.ErrSuccess {
+			return nil, e
+		}
+		return a.v, ble.ErrSuccess
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, n))
+	if e := handleATT(a, s, r, ble.NewResponseWriter(buf)); e != ble.ErrSuccess {
+		return nil, e
+	}
+	return buf.Bytes(), ble.ErrSuccess
+}
+
 // handle Read Blob request. [Vol 3, Part F, 3.4.4.9 & 3.4.4.10]
 func (s *Server) handleReadByGroupRequest(r ReadByGroupTypeRequest) []byte {
 	// Validate the request.
@@ -532,11 +810,12 @@ func (s *Server) handleWriteRequest(r WriteRequest) []byte {
 	return []byte{WriteResponseCode}
 }
 
+// handle Prepare Write request. [Vol 3, Part F, 3.4.6.1 & 3.4.6.2]
 func (s *Server) handlePrepareWriteRequest(r PrepareWriteRequest) []byte {
 	logger.Debug("handlePrepareWriteRequest ->", "r.AttributeHandle", r.AttributeHandle())
 	// Validate the request.
 	switch {
-	case len(r) < 3:
+	case len(r) < 5:
 		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrInvalidPDU)
 	}
 
@@ -545,40 +824,60 @@ func (s *Server) handlePrepareWriteRequest(r PrepareWriteRequest) []byte {
 		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), ble.ErrInvalidHandle)
 	}
 
-	// We don't support write to static value. Pass the request to upper layer.
-	if a == nil {
-		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), ble.ErrWriteNotPerm)
-	}
-
+	// The permissions are checked when the value is prepared, and the value is
+	// only written when the writes are executed.
 	if e := handleATT(a, s, r, ble.NewResponseWriter(nil)); e != ble.ErrSuccess {
 		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
 	}
+	if e := s.conn.prepare(a, int(r.ValueOffset()), r.PartAttributeValue()); e != ble.ErrSuccess {
+		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
+	}
 
-	// Convert and validate the response.
+	// The response echoes the request.
 	rsp := PrepareWriteResponse(r)
 	rsp.SetAttributeOpcode()
 	return rsp
 }
 
+// handle Execute Write request. [Vol 3, Part F, 3.4.6.3 & 3.4.6.4]
 func (s *Server) handleExecuteWriteRequest(r ExecuteWriteRequest) []byte {
 	// Validate the request.
 	switch {
 	case len(r) < 2:
 		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrInvalidPDU)
+	case r.Flags() > 1:
+		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrInvalidPDU)
 	}
 
-	switch r.Flags() {
-	case 0:
+	// The queue is cleared whether the writes are cancelled, executed or
+	// failed.
+	q := s.conn.takePrepared()
+	if r.Flags() == 0 {
 		// 0x00 – Cancel all prepared writes
-		s.prepareWriteRequestAttr = nil
-	case 1:
-		// 0x01 – Immediately write all pending prepared values
-		a := s.prepareWriteRequestAttr
-		if e := handleATT(a, s, r, ble.NewResponseWriter(nil)); e != ble.ErrSuccess {
-			return newErrorResponse(r.AttributeOpcode(), 0, e)
-		}
+		return []byte{ExecuteWriteResponseCode}
 	}
 
+	// 0x01 – Immediately write all pending prepared values
+	ws, h, e := mergePrepared(q)
+	if e != ble.ErrSuccess {
+		return newErrorResponse(r.AttributeOpcode(), h, e)
+	}
+	// The writes are all validated before any of them is served, as they're
+	// executed as a single atomic operation [Vol 3, Part F, 3.4.6.3]. Only a
+	// handler failing a write it has validated leaves the ones before written.
+	for _, w := range ws {
+		if e := s.validateWrite(w); e != ble.ErrSuccess {
+			return newErrorResponse(r.AttributeOpcode(), w.a.h, e)
+		}
+	}
+	for _, w := range ws {
+		rsp := ble.NewResponseWriter(nil)
+		rsp.SetStatus(ble.ErrSuccess)
+		w.a.wh.ServeWrite(ble.NewRequest(s.conn, w.data, w.offset), rsp)
+		if e := rsp.Status(); e != ble.ErrSuccess {
+			return newErrorResponse(r.AttributeOpcode(), w.a.h, e)
+		}
+	}
 	return []byte{ExecuteWriteResponseCode}
 }
 
@@ -605,6 +904,115 @@ func (s *Server) handleWriteCommand(r WriteCommand) []byte {
 	return nil
 }
 
+// secureConn is implemented by the connections which report the security state
+// of the link, such as hci.Conn.
+type secureConn interface {
+	Encrypted() bool
+	Authenticated() bool
+	KeySize() int
+}
+
+// checkSecurity checks the security state of the link against the permissions
+// of reading, or writing if write is true, the attribute. [Vol 3, Part C, 10.3.1]
+func (s *Server) checkSecurity(a *attr, write bool) ble.ATTError {
+	enc, authn := ble.PermReadEncrypt, ble.PermReadAuthenticate
+	if write {
+		enc, authn = ble.PermWriteEncrypt, ble.PermWriteAuthenticate
+	}
+	if a.perm&(enc|authn) != 0 {
+		var encrypted, authenticated bool
+		var keySize int
+		if c, ok := s.conn.Conn.(secureConn); ok {
+			encrypted, authenticated, keySize = c.Encrypted(), c.Authenticated(), c.KeySize()
+		}
+		switch {
+		case a.perm&authn != 0 && !authenticated:
+			return ble.ErrAuthentication
+		case !encrypted:
+			return ble.ErrInsuffEnc
+		case keySize < a.keySize:
+			return ble.ErrInsuffEncrKeySize
+		}
+	}
+	return s.checkAuthorization(a, write)
+}
+
+// checkAuthorization returns the error, if the client isn't authorized to read
+// or write the attribute.
+func (s *Server) checkAuthorization(a *attr, write bool) ble.ATTError {
+	authz := ble.PermReadAuthorize
+	if write {
+		authz = ble.PermWriteAuthorize
+	}
+	if a.perm&authz != 0 && (a.az == nil || !a.az.Authorize(s.conn, write)) {
+		return ble.ErrAuthorization
+	}
+	return ble.ErrSuccess
+}
+
+// SetSigningKeyProvider sets the provider of the keys to verify Signed Write
+// Commands with. Signed Write Commands are ignored without a provider.
+func (s *Server) SetSigningKeyProvider(p SigningKeyProvider) {
+	s.signer = p
+}
+
+// handle Signed Write command. [Vol 3, Part F, 3.4.5.4]
+func (s *Server) handleSignedWriteCommand(r SignedWriteCommand) []byte {
+	// Validate the request.
+	switch {
+	case len(r) < 3+signatureLen || s.signer == nil:
+		return nil
+	}
+
+	a, ok := s.db.at(r.AttributeHandle())
+	if !ok {
+		return nil
+	}
+
+	// Verify the signature and the sign counter, so the data is neither
+	// forged nor replayed. [Vol 3, Part C, 10.4.2]
+	csrk, next, authenticated, ok := s.signer.VerifyingKey(s.conn.Conn)
+	if !ok {
+		logger.Debug("server", "signed write", "no CSRK to verify with")
+		return nil
+	}
+	m := r[:len(r)-signatureLen]
+	var sig [signatureLen]byte
+	copy(sig[:], r[len(m):])
+	counter := binary.LittleEndian.Uint32(sig[:])
+	if want, err := crypto.Default.Sign(csrk, counter, m); err != nil || counter < next || want != sig {
+		logger.Debug("server", "signed write", fmt.Sprintf("invalid signature, counter: %d", counter))
+		return nil
+	}
+	s.signer.Verified(s.conn.Conn, counter)
+
+	if e := s.checkSignedSecurity(a, authenticated); e != ble.ErrSuccess {
+		logger.Debug("server", "signed write", fmt.Sprintf("handle 0x%04X: %v", a.h, e))
+		return nil
+	}
+	handleATT(a, s, r, s.dummyRspWriter)
+	return nil
+}
+
+// checkSignedSecurity checks the security of a Signed Write Command, signed
+// with a CSRK from authenticated pairing if authenticated is true, against the
+// permissions of writing the attribute. On the links not encrypted, the
+// signature takes the place of the authentication, as in LE security mode 2
+// [Vol 3, Part C, 10.2.2], but not of the encryption. On the encrypted links,
+// the security is checked as for the other writes.
+func (s *Server) checkSignedSecurity(a *attr, authenticated bool) ble.ATTError {
+	if c, ok := s.conn.Conn.(secureConn); ok && c.Encrypted() {
+		return s.checkSecurity(a, true)
+	}
+	switch {
+	case a.perm&ble.PermWriteEncrypt != 0:
+		return ble.ErrInsuffEnc
+	case a.perm&ble.PermWriteAuthenticate != 0 && !authenticated:
+		return ble.ErrAuthentication
+	}
+	return s.checkAuthorization(a, true)
+}
+
 func newErrorResponse(op byte, h uint16, s ble.ATTError) []byte {
 	r := ErrorResponse(make([]byte, 5))
 	r.SetAttributeOpcode()
@@ -620,51 +1028,52 @@ func handleATT(a *attr, s *Server, req []byte, rsp ble.ResponseWriter) ble.ATTEr
 	var data []byte
 	conn := s.conn
 	switch req[0] {
-	case ReadByTypeRequestCode:
+	case ReadByTypeRequestCode, ReadMultipleRequestCode, ReadMultipleVariableRequestCode:
 		fallthrough
 	case ReadRequestCode:
 		if a.rh == nil {
 			return ble.ErrReadNotPerm
 		}
+		if e := s.checkSecurity(a, false); e != ble.ErrSuccess {
+			return e
+		}
 		a.rh.ServeRead(ble.NewRequest(conn, data, offset), rsp)
 	case ReadBlobRequestCode:
 		if a.rh == nil {
 			return ble.ErrReadNotPerm
 		}
+		if e := s.checkSecurity(a, false); e != ble.ErrSuccess {
+			return e
+		}
 		offset = int(ReadBlobRequest(req).ValueOffset())
 		a.rh.ServeRead(ble.NewRequest(conn, data, offset), rsp)
 	case PrepareWriteRequestCode:
 		if a.wh == nil {
 			return ble.ErrWriteNotPerm
 		}
-		data = PrepareWriteRequest(req).PartAttributeValue()
-		logger.Debug("handleATT", "PartAttributeValue",
-			fmt.Sprintf("data: %x, offset: %d, %p\n", data, int(PrepareWriteRequest(req).ValueOffset()), s.prepareWriteRequestAttr))
-
-		if s.prepareWriteRequestAttr == nil {
-			s.prepareWriteRequestAttr = a
-			s.prepareWriteRequestData.Reset()
+		if e := s.checkSecurity(a, true); e != ble.ErrSuccess {
+			return e
 		}
-		s.prepareWriteRequestData.Write(data)
-
-	case ExecuteWriteRequestCode:
-		if a.wh == nil {
-			return ble.ErrWriteNotPerm
-		}
-		data = s.prepareWriteRequestData.Bytes()
-		a.wh.ServeWrite(ble.NewRequest(conn, data, offset), rsp)
-		s.prepareWriteRequestAttr = nil
 	case WriteRequestCode:
 		fallthrough
 	case WriteCommandCode:
 		if a.wh == nil {
 			return ble.ErrWriteNotPerm
 		}
+		if e := s.checkSecurity(a, true); e != ble.ErrSuccess {
+			return e
+		}
 		data = WriteRequest(req).AttributeValue()
 		a.wh.ServeWrite(ble.NewRequest(conn, data, offset), rsp)
-	// case SignedWriteCommandCode:
+	case SignedWriteCommandCode:
+		if a.wh == nil || !a.signed {
+			return ble.ErrWriteNotPerm
+		}
+		// The security is checked by handleSignedWriteCommand, along with
+		// the signature.
+		data = req[3 : len(req)-signatureLen]
+		a.wh.ServeWrite(ble.NewRequest(conn, data, offset), rsp)
 	// case ReadByGroupTypeRequestCode:
-	// case ReadMultipleRequestCode:
 	default:
 		return ble.ErrReqNotSupp
 	}
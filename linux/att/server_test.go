@@ -0,0 +1,243 @@
+package att
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/crypto"
+)
+
+// testConn is a ble.Conn, whose PDUs are exchanged over channels, as if the
+// client wrote to rx, and read from tx. It reports the security state of the
+// link as hci.Conn does.
+type testConn struct {
+	ctx          context.Context
+	rxMTU, txMTU int
+	rx, tx       chan []byte
+	done         chan struct{}
+	once         sync.Once
+
+	// onWrite, if set, is called with each PDU written, before Write returns.
+	onWrite func(b []byte)
+
+	encrypted, authenticated bool
+}
+
+func newTestConn() *testConn {
+	return &testConn{
+		ctx:   context.Background(),
+		rxMTU: ble.DefaultMTU,
+		txMTU: ble.DefaultMTU,
+		rx:    make(chan []byte),
+		tx:    make(chan []byte, 64),
+		done:  make(chan struct{}),
+	}
+}
+
+func (c *testConn) Read(b []byte) (int, error) {
+	select {
+	case p := <-c.rx:
+		return copy(b, p), nil
+	case <-c.done:
+		return 0, nil
+	}
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	select {
+	case c.tx <- append([]byte(nil), b...):
+		if c.onWrite != nil {
+			c.onWrite(b)
+		}
+		return len(b), nil
+	case <-c.done:
+		return 0, context.Canceled
+	}
+}
+
+func (c *testConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *testConn) Context() context.Context       { return c.ctx }
+func (c *testConn) SetContext(ctx context.Context) { c.ctx = ctx }
+func (c *testConn) LocalAddr() ble.Addr            { return ble.NewAddr("00:00:00:00:00:01") }
+func (c *testConn) RemoteAddr() ble.Addr           { return ble.NewAddr("00:00:00:00:00:02") }
+func (c *testConn) RxMTU() int                     { return c.rxMTU }
+func (c *testConn) SetRxMTU(mtu int)               { c.rxMTU = mtu }
+func (c *testConn) TxMTU() int                     { return c.txMTU }
+func (c *testConn) SetTxMTU(mtu int)               { c.txMTU = mtu }
+func (c *testConn) Disconnected() <-chan struct{}  { return c.done }
+func (c *testConn) Encrypted() bool                { return c.encrypted }
+func (c *testConn) Authenticated() bool            { return c.encrypted && c.authenticated }
+func (c *testConn) KeySize() int                   { return 16 }
+
+// send writes the request of the client, and returns the response.
+func (c *testConn) send(t *testing.T, req ...byte) []byte {
+	t.Helper()
+	c.rx <- req
+	select {
+	case rsp := <-c.tx:
+		return rsp
+	case <-time.After(time.Second):
+		t.Fatalf("no response to % X", req)
+		return nil
+	}
+}
+
+// newTestServer returns a server of the services over a testConn, which has
+// exchanged the ATT_MTU of mtu.
+func newTestServer(t *testing.T, ss []*ble.Service, mtu int) (*Server, *testConn) {
+	t.Helper()
+	c := newTestConn()
+	c.rxMTU = ble.MaxMTU
+	s, err := NewServer(NewDB(ss, 1), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtu != ble.DefaultMTU {
+		s.handleRequest([]byte{ExchangeMTURequestCode, byte(mtu), byte(mtu >> 8)})
+	}
+	return s, c
+}
+
+// testSigner is a SigningKeyProvider of a single CSRK.
+type testSigner struct {
+	csrk          [16]byte
+	next          uint32
+	authenticated bool
+}
+
+func (s *testSigner) SigningKey(ble.Conn) ([16]byte, uint32, bool) { return s.csrk, 0, false }
+
+func (s *testSigner) VerifyingKey(ble.Conn) ([16]byte, uint32, bool, bool) {
+	return s.csrk, s.next, s.authenticated, true
+}
+
+func (s *testSigner) Verified(_ ble.Conn, counter uint32) { s.next = counter + 1 }
+
+func TestSignedWriteSecurity(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		perm          ble.Permission
+		encrypted     bool
+		authenticated bool // the link, or the CSRK if the link isn't encrypted.
+		written       bool
+	}{
+		{"open", 0, false, false, true},
+		{"encrypt, plaintext", ble.PermWriteEncrypt, false, true, false},
+		{"encrypt, encrypted", ble.PermWriteEncrypt, true, false, true},
+		{"authenticate, unauthenticated CSRK", ble.PermWriteAuthenticate, false, false, false},
+		{"authenticate, authenticated CSRK", ble.PermWriteAuthenticate, false, true, true},
+		{"authenticate, unauthenticated link", ble.PermWriteAuthenticate, true, false, false},
+		{"authenticate, authenticated link", ble.PermWriteAuthenticate, true, true, true},
+		{"authenticate and encrypt, authenticated CSRK", ble.PermWriteEncrypt | ble.PermWriteAuthenticate, false, true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var written []byte
+			svc := ble.NewService(ble.UUID16(0x1800))
+			c := svc.NewCharacteristic(ble.UUID16(0x2a00))
+			c.Property |= ble.CharSignedWrite
+			c.Permission = tc.perm
+			c.HandleWrite(ble.WriteHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
+				written = req.Data()
+			}))
+			s, conn := newTestServer(t, []*ble.Service{svc}, ble.DefaultMTU)
+			conn.encrypted, conn.authenticated = tc.encrypted, tc.authenticated
+			signer := &testSigner{csrk: [16]byte{1, 2, 3}, authenticated: tc.authenticated}
+			s.SetSigningKeyProvider(signer)
+
+			m := []byte{SignedWriteCommandCode, byte(c.ValueHandle), byte(c.ValueHandle >> 8), 'v'}
+			sig, err := crypto.Default.Sign(signer.csrk, 0, m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rsp := s.handleRequest(append(m, sig[:]...)); rsp != nil {
+				t.Fatalf("response to a command: % X", rsp)
+			}
+			if (written != nil) != tc.written {
+				t.Errorf("written %q, want written %v", written, tc.written)
+			}
+			if signer.next != 1 {
+				t.Errorf("sign counter not recorded, next: %d", signer.next)
+			}
+		})
+	}
+}
+
+// newValueService returns a service of the characteristics of the values,
+// whose value handles are 3, 5, 7...
+func newValueService(values ...[]byte) *ble.Service {
+	svc := ble.NewService(ble.UUID16(0x1800))
+	for i, v := range values {
+		svc.NewCharacteristic(ble.UUID16(0x2a00 + uint16(i))).SetValue(v)
+	}
+	return svc
+}
+
+// seq returns n octets counting from b.
+func seq(b byte, n int) []byte {
+	v := make([]byte, n)
+	for i := range v {
+		v[i] = b + byte(i)
+	}
+	return v
+}
+
+func TestReadMultiple(t *testing.T) {
+	a, b := seq(0x10, 10), seq(0x40, 20)
+	s, _ := newTestServer(t, []*ble.Service{newValueService(a, b)}, ble.DefaultMTU)
+
+	// The values are concatenated, and truncated to ATT_MTU - 1 octets.
+	rsp := s.handleRequest([]byte{ReadMultipleRequestCode, 0x03, 0x00, 0x05, 0x00})
+	want := append([]byte{ReadMultipleResponseCode}, a...)
+	want = append(want, b[:ble.DefaultMTU-1-len(a)]...)
+	if !bytes.Equal(rsp, want) {
+		t.Errorf("response % X, want % X", rsp, want)
+	}
+}
+
+func TestReadMultipleVariable(t *testing.T) {
+	a, b, c := seq(0x10, 10), seq(0x40, 30), seq(0x80, 5)
+	s, _ := newTestServer(t, []*ble.Service{newValueService(a, b, c)}, ble.DefaultMTU)
+
+	// Each value is preceded by its full length. The last tuple which fits
+	// is truncated, and the ones after it are left out.
+	rsp := s.handleRequest([]byte{ReadMultipleVariableRequestCode, 0x03, 0x00, 0x05, 0x00, 0x07, 0x00})
+	want := append([]byte{ReadMultipleVariableResponseCode, byte(len(a)), 0}, a...)
+	want = append(want, byte(len(b)), 0)
+	want = append(want, b[:ble.DefaultMTU-len(want)]...)
+	if !bytes.Equal(rsp, want) {
+		t.Errorf("response % X, want % X", rsp, want)
+	}
+}
+
+func TestReadMultipleError(t *testing.T) {
+	svc := newValueService([]byte{1}, []byte{2})
+	svc.Characteristics[1].Permission = ble.PermReadEncrypt
+	s, _ := newTestServer(t, []*ble.Service{svc}, ble.DefaultMTU)
+
+	// The error is of the first handle which can't be read.
+	for _, op := range []byte{ReadMultipleRequestCode, ReadMultipleVariableRequestCode} {
+		for _, tc := range []struct {
+			req  []byte
+			h    uint16
+			code ble.ATTError
+		}{
+			{[]byte{op, 0x03, 0x00, 0x20, 0x00, 0x05, 0x00}, 0x0020, ble.ErrInvalidHandle},
+			{[]byte{op, 0x03, 0x00, 0x05, 0x00, 0x20, 0x00}, 0x0005, ble.ErrInsuffEnc},
+			{[]byte{op, 0x03, 0x00}, 0x0000, ble.ErrInvalidPDU},
+		} {
+			rsp := s.handleRequest(tc.req)
+			want := newErrorResponse(op, tc.h, tc.code)
+			if !bytes.Equal(rsp, want) {
+				t.Errorf("response to % X: % X, want % X", tc.req, rsp, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package att
+
+import (
+	"github.com/go-ble/ble"
+)
+
+// A SigningKeyProvider supplies the keys and the counters for data signing,
+// which authenticates the Signed Write Commands on unencrypted links.
+// [Vol 3, Part C, 10.4]
+type SigningKeyProvider interface {
+	// SigningKey returns the CSRK distributed by the local device to the
+	// peer device of conn, and the sign counter to sign the next data with.
+	// The provider increments the counter on each call. It returns ok false
+	// if no key is available.
+	SigningKey(conn ble.Conn) (csrk [16]byte, counter uint32, ok bool)
+
+	// VerifyingKey returns the CSRK distributed by the peer device of conn,
+	// and the smallest sign counter the peer device may sign the next data
+	// with. The authenticated is true if the CSRK was distributed in an
+	// authenticated (MITM protected) pairing, which is required by LE security
+	// mode 2 level 2 [Vol 3, Part C, 10.2.2]. It returns ok false if no key is
+	// available.
+	VerifyingKey(conn ble.Conn) (csrk [16]byte, counter uint32, authenticated, ok bool)
+
+	// Verified records the sign counter of the data verified from the peer
+	// device of conn, so the data can't be replayed.
+	Verified(conn ble.Conn, counter uint32)
+}
+
+// signatureLen is the length of the Authentication Signature; the sign
+// counter followed by the MAC.
+const signatureLen = 12
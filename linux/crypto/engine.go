@@ -0,0 +1,39 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+)
+
+// An Engine provides the AES-128 block cipher and the random number generator,
+// on which the security functions are built. The host implements it in
+// software, and the controller implements it with the LE Encrypt and LE Rand
+// commands [Vol 2, Part E, 7.8.22 & 7.8.23].
+type Engine interface {
+	// Encrypt encrypts the plaintext with the key using AES-128. The key,
+	// the plaintext and the result are most significant octet first.
+	Encrypt(key, plaintext [16]byte) ([16]byte, error)
+
+	// Rand fills b with random octets.
+	Rand(b []byte) error
+}
+
+// Software is the Engine implemented by the host, with crypto/aes and crypto/rand.
+var Software Engine = software{}
+
+type software struct{}
+
+func (software) Encrypt(key, plaintext [16]byte) ([16]byte, error) {
+	var r [16]byte
+	blk, err := aes.NewCipher(key[:])
+	if err != nil {
+		return r, err
+	}
+	blk.Encrypt(r[:], plaintext[:])
+	return r, nil
+}
+
+func (software) Rand(b []byte) error {
+	_, err := rand.Read(b)
+	return err
+}
@@ -0,0 +1,46 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+)
+
+// GenerateKey generates a P-256 key pair for LE Secure Connections pairing,
+// and returns the private key, along with the 64-octet public key in the
+// format of the Pairing Public Key PDU; the X and Y coordinates, each in
+// little-endian [Vol 3, Part H, 3.5.6].
+func GenerateKey() (*ecdh.PrivateKey, []byte, error) {
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Uncompressed point: 0x04 || X || Y, most significant octet first.
+	b := priv.PublicKey().Bytes()
+	return priv, append(reverse(b[1:33]), reverse(b[33:65])...), nil
+}
+
+// DHKey computes the 32-octet DHKey, in little-endian, from the local private
+// key and the remote public key in the format of the Pairing Public Key PDU.
+// It returns an error if the remote public key is not a valid point on the
+// curve, or is identical to the local one [Vol 3, Part H, 2.3.5.6.1].
+func DHKey(priv *ecdh.PrivateKey, pk []byte) ([]byte, error) {
+	if len(pk) != 64 {
+		return nil, errors.New("invalid public key length")
+	}
+	b := append([]byte{0x04}, reverse(pk[:32])...)
+	pub, err := ecdh.P256().NewPublicKey(append(b, reverse(pk[32:])...))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(pub.Bytes(), priv.PublicKey().Bytes()) {
+		// A remote device reflecting our own public key.
+		return nil, errors.New("remote public key is identical to the local one")
+	}
+	k, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	return reverse(k), nil
+}
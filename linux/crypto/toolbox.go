@@ -0,0 +1,239 @@
+// Package crypto implements the cryptographic toolbox of the Security Manager
+// [Vol 3, Part H, 2.2], which LE legacy pairing, LE Secure Connections
+// pairing, privacy and data signing are built on.
+//
+// The security functions are defined on values in the most significant octet
+// first order, while the values are transmitted least significant octet first.
+// Except for AESCMAC, all the functions take and return values in the
+// over-the-air (little-endian) order, so they can be used with the PDUs and
+// the HCI commands as is.
+package crypto
+
+import (
+	"encoding/binary"
+)
+
+// A Toolbox implements the security functions on an Engine.
+type Toolbox struct {
+	engine Engine
+}
+
+// New returns a Toolbox using the Engine e.
+func New(e Engine) *Toolbox {
+	return &Toolbox{engine: e}
+}
+
+// Default is the Toolbox using the Software engine.
+var Default = New(Software)
+
+// reverse returns a reversed copy of b.
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+func reverse16(b [16]byte) [16]byte {
+	var r [16]byte
+	copy(r[:], reverse(b[:]))
+	return r
+}
+
+func xor16(a, b [16]byte) [16]byte {
+	var r [16]byte
+	for i := range r {
+		r[i] = a[i] ^ b[i]
+	}
+	return r
+}
+
+// Rand fills b with random octets.
+func (t *Toolbox) Rand(b []byte) error {
+	return t.engine.Rand(b)
+}
+
+// Rand16 returns a 128-bit random value.
+func (t *Toolbox) Rand16() ([16]byte, error) {
+	var r [16]byte
+	err := t.engine.Rand(r[:])
+	return r, err
+}
+
+// E implements the security function e [Vol 3, Part H, 2.2.1].
+func (t *Toolbox) E(k, plaintext [16]byte) ([16]byte, error) {
+	r, err := t.engine.Encrypt(reverse16(k), reverse16(plaintext))
+	return reverse16(r), err
+}
+
+// Ah implements the random address hash function ah [Vol 3, Part H, 2.2.2].
+func (t *Toolbox) Ah(k [16]byte, r [3]byte) ([3]byte, error) {
+	// r' = padding || r
+	var p [16]byte
+	copy(p[:], r[:])
+	e, err := t.E(k, p)
+	var h [3]byte
+	copy(h[:], e[:3])
+	return h, err
+}
+
+// C1 implements the confirm value generation function c1 for LE legacy
+// pairing [Vol 3, Part H, 2.2.3]. preq and pres are the 7-octet Pairing
+// Request and Pairing Response PDUs.
+func (t *Toolbox) C1(k, r [16]byte, preq, pres []byte, iat, rat uint8, ia, ra [6]byte) ([16]byte, error) {
+	// p1 = pres || preq || rat' || iat'
+	var p1 [16]byte
+	p1[0] = iat
+	p1[1] = rat
+	copy(p1[2:9], preq)
+	copy(p1[9:16], pres)
+
+	// p2 = padding || ia || ra
+	var p2 [16]byte
+	copy(p2[0:6], ra[:])
+	copy(p2[6:12], ia[:])
+
+	e, err := t.E(k, xor16(r, p1))
+	if err != nil {
+		return e, err
+	}
+	return t.E(k, xor16(e, p2))
+}
+
+// S1 implements the key generation function s1 for LE legacy pairing
+// [Vol 3, Part H, 2.2.4].
+func (t *Toolbox) S1(k, r1, r2 [16]byte) ([16]byte, error) {
+	// r' = r1' || r2', the least significant 64 bits of each.
+	var r [16]byte
+	copy(r[0:8], r2[0:8])
+	copy(r[8:16], r1[0:8])
+	return t.E(k, r)
+}
+
+// AESCMAC implements the AES-CMAC function defined in RFC 4493
+// [Vol 3, Part H, 2.2.5]. Unlike the other functions, the key, the message
+// and the MAC are most significant octet first, as in the RFC.
+func (t *Toolbox) AESCMAC(k [16]byte, m []byte) ([16]byte, error) {
+	// Generate the subkeys K1 and K2.
+	var k1, k2 [16]byte
+	l, err := t.engine.Encrypt(k, [16]byte{})
+	if err != nil {
+		return l, err
+	}
+	shl := func(dst, src *[16]byte) {
+		var c byte
+		for i := 15; i >= 0; i-- {
+			dst[i] = src[i]<<1 | c
+			c = src[i] >> 7
+		}
+		if src[0]&0x80 != 0 {
+			dst[15] ^= 0x87
+		}
+	}
+	shl(&k1, &l)
+	shl(&k2, &k1)
+
+	n := (len(m) + 15) / 16
+	var last [16]byte
+	if n > 0 && len(m)%16 == 0 {
+		copy(last[:], m[(n-1)*16:])
+		last = xor16(last, k1)
+	} else {
+		if n == 0 {
+			n = 1
+		}
+		r := m[(n-1)*16:]
+		copy(last[:], r)
+		last[len(r)] = 0x80
+		last = xor16(last, k2)
+	}
+
+	var x, y [16]byte
+	for i := 0; i < n-1; i++ {
+		copy(y[:], m[i*16:])
+		if x, err = t.engine.Encrypt(k, xor16(x, y)); err != nil {
+			return x, err
+		}
+	}
+	return t.engine.Encrypt(k, xor16(x, last))
+}
+
+// cmac computes AES-CMAC with the key k over m[0] || m[1] || ..., where m[0]
+// is the most significant. The key, the values and the MAC are little-endian.
+func (t *Toolbox) cmac(k [16]byte, m ...[]byte) ([16]byte, error) {
+	var buf []byte
+	for _, v := range m {
+		buf = append(buf, reverse(v)...)
+	}
+	mac, err := t.AESCMAC(reverse16(k), buf)
+	return reverse16(mac), err
+}
+
+// F4 implements the confirm value generation function f4 for LE Secure
+// Connections [Vol 3, Part H, 2.2.6]. u and v are the 32-octet X coordinates
+// of the public keys.
+func (t *Toolbox) F4(u, v []byte, x [16]byte, z uint8) ([16]byte, error) {
+	return t.cmac(x, u, v, []byte{z})
+}
+
+// f5Salt is the SALT used in f5, and f5KeyID is the keyID "btle".
+var (
+	f5Salt  = [16]byte{0xbe, 0x83, 0x60, 0x5a, 0xdb, 0x0b, 0x37, 0x60, 0x38, 0xa5, 0xf5, 0xaa, 0x91, 0x83, 0x88, 0x6c}
+	f5KeyID = []byte{0x65, 0x6c, 0x74, 0x62}
+)
+
+// F5 implements the key generation function f5 for LE Secure Connections
+// [Vol 3, Part H, 2.2.7]. w is the 32-octet DHKey, and a1, a2 are the device
+// addresses, each followed by its address type. It returns the MacKey and the LTK.
+func (t *Toolbox) F5(w []byte, n1, n2 [16]byte, a1, a2 [7]byte) (macKey, ltk [16]byte, err error) {
+	k, err := t.cmac(f5Salt, w)
+	if err != nil {
+		return macKey, ltk, err
+	}
+	length := []byte{0x00, 0x01} // 256
+	if macKey, err = t.cmac(k, []byte{0x00}, f5KeyID, n1[:], n2[:], a1[:], a2[:], length); err != nil {
+		return macKey, ltk, err
+	}
+	ltk, err = t.cmac(k, []byte{0x01}, f5KeyID, n1[:], n2[:], a1[:], a2[:], length)
+	return macKey, ltk, err
+}
+
+// F6 implements the check value generation function f6 for LE Secure
+// Connections [Vol 3, Part H, 2.2.8]. ioCap is little-endian, as the other
+// values: the IO capability, the OOB data flag and the AuthReq, in that order.
+func (t *Toolbox) F6(w, n1, n2, r [16]byte, ioCap [3]byte, a1, a2 [7]byte) ([16]byte, error) {
+	return t.cmac(w, n1[:], n2[:], r[:], ioCap[:], a1[:], a2[:])
+}
+
+// G2 implements the numeric comparison value generation function g2 for LE
+// Secure Connections [Vol 3, Part H, 2.2.9]. The six least significant
+// decimal digits of the result are displayed to the user.
+func (t *Toolbox) G2(u, v []byte, x, y [16]byte) (uint32, error) {
+	r, err := t.cmac(x, u, v, y[:])
+	return binary.LittleEndian.Uint32(r[:4]), err
+}
+
+// H6 implements the link key conversion function h6 [Vol 3, Part H, 2.2.10].
+func (t *Toolbox) H6(w [16]byte, keyID uint32) ([16]byte, error) {
+	var id [4]byte
+	binary.LittleEndian.PutUint32(id[:], keyID)
+	return t.cmac(w, id[:])
+}
+
+// H7 implements the link key conversion function h7 [Vol 3, Part H, 2.2.11].
+func (t *Toolbox) H7(salt, w [16]byte) ([16]byte, error) {
+	return t.cmac(salt, w[:])
+}
+
+// Sign returns the signature of the message m with the CSRK and the sign
+// counter, which is the sign counter followed by the MAC [Vol 3, Part H, 2.4.5].
+func (t *Toolbox) Sign(csrk [16]byte, counter uint32, m []byte) ([12]byte, error) {
+	var sig [12]byte
+	binary.LittleEndian.PutUint32(sig[:4], counter)
+	mac, err := t.cmac(csrk, sig[:4], m)
+
+	// The MAC is the 64 most significant bits of the AES-CMAC output.
+	copy(sig[4:], mac[8:])
+	return sig, err
+}
@@ -0,0 +1,240 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// msb decodes a value written most significant octet first, as in the spec.
+func msb(s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// le decodes a value written most significant octet first, and returns it in
+// little-endian.
+func le(s string) []byte { return reverse(msb(s)) }
+
+func le16(s string) (r [16]byte) { copy(r[:], le(s)); return }
+func le7(s string) (r [7]byte)   { copy(r[:], le(s)); return }
+func le6(s string) (r [6]byte)   { copy(r[:], le(s)); return }
+func le3(s string) (r [3]byte)   { copy(r[:], le(s)); return }
+
+// Sample data of the security functions [Vol 3, Part H, Appendix D].
+var (
+	u  = le("20b003d2 f297be2c 5e2c83a7 e9f9a5b9 eff49111 acf4fddb cc030148 0e359de6")
+	v  = le("55188b3d 32f6bb9a 900afcfb eed4e72a 59cb9ac2 f19d7cfb 6b4fdd49 f47fc5fd")
+	n1 = le16("d5cb8454 d177733e ffffb2ec 712baeab")
+	n2 = le16("a6e8e7cc 25a75f6e 216583f7 ff3dc4cf")
+	a1 = le7("00561237 37bfce")
+	a2 = le7("00a71370 2dcfc1")
+	w  = le16("ec0234a3 57c8ad05 341010a6 0a397d9b")
+)
+
+// RFC 4493 examples of AES-CMAC, with the key k, over the first n octets of
+// the message m [Vol 3, Part H, D.1].
+var (
+	cmacK = msb("2b7e1516 28aed2a6 abf71588 09cf4f3c")
+	cmacM = msb("6bc1bee2 2e409f96 e93d7e11 7393172a ae2d8a57 1e03ac9c 9eb76fac 45af8e51" +
+		"30c81c46 a35ce411 e5fbc119 1a0a52ef f69f2445 df4f9b17 ad2b417b e66c3710")
+	cmacMACs = []struct {
+		n   int
+		mac string
+	}{
+		{0, "bb1d6929 e9593728 7fa37d12 9b756746"},
+		{16, "070a16b4 6b4d4144 f79bdd9d d04a287c"},
+		{40, "dfa66747 de9ae630 30ca3261 1497c827"},
+		{64, "51f0bebf 7e3b9d92 fc497417 79363cfe"},
+	}
+)
+
+func TestAESCMAC(t *testing.T) {
+	var k [16]byte
+	copy(k[:], cmacK)
+	for _, tc := range cmacMACs {
+		mac, err := Default.AESCMAC(k, cmacM[:tc.n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(mac[:], msb(tc.mac)) {
+			t.Errorf("AES-CMAC of %d octets: got %x, want %s", tc.n, mac, tc.mac)
+		}
+	}
+}
+
+func TestE(t *testing.T) {
+	// FIPS-197 example vector.
+	k := le16("000102030405060708090a0b0c0d0e0f")
+	p := le16("00112233445566778899aabbccddeeff")
+	r, err := Default.E(k, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := le16("69c4e0d86a7b0430d8cdb78070b4c55a"); r != want {
+		t.Errorf("e: got %x, want %x", r, want)
+	}
+}
+
+func TestAh(t *testing.T) {
+	h, err := Default.Ah(w, le3("708194"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := le3("0dfbaa"); h != want {
+		t.Errorf("ah: got %x, want %x", h, want)
+	}
+}
+
+func TestC1(t *testing.T) {
+	// Example in [Vol 3, Part H, 2.2.3].
+	preq := le("07071000000101")
+	pres := le("05000800000302")
+	r := le16("5783D521 56AD6F0E 6388274E C6702EE0")
+	c, err := Default.C1([16]byte{}, r, preq, pres, 0x01, 0x00, le6("A1A2A3A4A5A6"), le6("B1B2B3B4B5B6"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := le16("1e1e3fef 878988ea d2a74dc5 bef13b86"); c != want {
+		t.Errorf("c1: got %x, want %x", c, want)
+	}
+}
+
+func TestS1(t *testing.T) {
+	// Example in [Vol 3, Part H, 2.2.4].
+	r1 := le16("000F0E0D 0C0B0A09 11223344 55667788")
+	r2 := le16("01020304 05060708 99AABBCC DDEEFF00")
+	s, err := Default.S1([16]byte{}, r1, r2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := le16("9a1fe1f0 e8b0f49b 5b4216ae 796da062"); s != want {
+		t.Errorf("s1: got %x, want %x", s, want)
+	}
+}
+
+func TestF4(t *testing.T) {
+	r, err := Default.F4(u, v, n1, 0x00)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := le16("f2c916f1 07a9bd1c f1eda1be a974872d"); r != want {
+		t.Errorf("f4: got %x, want %x", r, want)
+	}
+}
+
+func TestF5(t *testing.T) {
+	dhKey := le("ec0234a3 57c8ad05 341010a6 0a397d9b 99796b13 b4f866f1 868d34f3 73bfa698")
+	macKey, ltk, err := Default.F5(dhKey, n1, n2, a1, a2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := le16("2965f176 a1084a02 fd3f6a20 ce636e20"); macKey != want {
+		t.Errorf("f5 MacKey: got %x, want %x", macKey, want)
+	}
+	if want := le16("69867911 69d7cd23 980522b5 94750a38"); ltk != want {
+		t.Errorf("f5 LTK: got %x, want %x", ltk, want)
+	}
+}
+
+func TestF6(t *testing.T) {
+	macKey := le16("2965f176 a1084a02 fd3f6a20 ce636e20")
+	r := le16("12a3343b b453bb54 08da42d2 0c2d0fc8")
+	var ioCap [3]byte
+	copy(ioCap[:], le("010102"))
+	e, err := Default.F6(macKey, n1, n2, r, ioCap, a1, a2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := le16("e3c47398 9cd0e8c5 d26c0b09 da958f61"); e != want {
+		t.Errorf("f6: got %x, want %x", e, want)
+	}
+}
+
+func TestG2(t *testing.T) {
+	g, err := Default.G2(u, v, n1, n2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g != 0x2f9ed5ba {
+		t.Errorf("g2: got %08x, want 2f9ed5ba", g)
+	}
+}
+
+func TestH6(t *testing.T) {
+	r, err := Default.H6(w, 0x6c656272) // "lebr"
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := le16("2d9ae102 e76dc91c e8d3a9e2 80b16399"); r != want {
+		t.Errorf("h6: got %x, want %x", r, want)
+	}
+}
+
+func TestH7(t *testing.T) {
+	salt := le16("00000000 00000000 00000000 746D7031") // "tmp1"
+	r, err := Default.H7(salt, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := le16("fb173597 c6a3c0ec d2998c2a 75a57011"); r != want {
+		t.Errorf("h7: got %x, want %x", r, want)
+	}
+}
+
+func TestSign(t *testing.T) {
+	// The signed data is the message followed by the sign counter, in the
+	// order of the PDU. Written most significant octet first, it's the sign
+	// counter followed by the message, which are taken from the AES-CMAC
+	// examples along with the CSRK. The MAC of the signature is the 64 most
+	// significant bits of the AES-CMAC output [Vol 3, Part H, 2.4.5].
+	var csrk [16]byte
+	copy(csrk[:], reverse(cmacK))
+	counter := binary.BigEndian.Uint32(cmacM[:4])
+	for _, tc := range cmacMACs {
+		if tc.n < 4 {
+			continue
+		}
+		sig, err := Default.Sign(csrk, counter, reverse(cmacM[4:tc.n]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := append(reverse(cmacM[:4]), reverse(msb(tc.mac)[:8])...)
+		if !bytes.Equal(sig[:], want) {
+			t.Errorf("signature of %d octets: got %x, want %x", tc.n, sig, want)
+		}
+	}
+}
+
+func TestDHKey(t *testing.T) {
+	privA, pkA, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	privB, pkB, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ka, err := DHKey(privA, pkB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := DHKey(privB, pkA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ka, kb) {
+		t.Errorf("DHKeys differ: %x, %x", ka, kb)
+	}
+	if _, err := DHKey(privA, pkA); err == nil {
+		t.Error("DHKey accepted the reflected public key")
+	}
+	if _, err := DHKey(privA, make([]byte, 64)); err == nil {
+		t.Error("DHKey accepted an invalid public key")
+	}
+}
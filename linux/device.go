@@ -37,6 +37,11 @@ func NewDeviceWithNameAndHandler(name string, handler ble.NotifyHandler, opts ..
 		dev.Close()
 		return nil, errors.Wrap(err, "can't create server")
 	}
+	// The bonded clients keep their subscriptions to Service Changed.
+	if err := srv.SetServiceChangedStore(dev); err != nil {
+		dev.Close()
+		return nil, errors.Wrap(err, "can't load Service Changed")
+	}
 
 	// mtu := ble.DefaultMTU
 	mtu := ble.MaxMTU // TODO: get this from user using Option.
@@ -66,15 +71,35 @@ func loop(dev *hci.HCI, s *gatt.Server, mtu int) {
 		l2c.SetContext(context.WithValue(l2c.Context(), ble.ContextKeyCCC, make(map[uint16]uint16)))
 		l2c.SetRxMTU(mtu)
 
-		s.Lock()
-		as, err := att.NewServer(s.DB(), l2c)
-		s.Unlock()
+		as, err := s.NewATTServer(l2c)
 		if err != nil {
 			log.Printf("can't create ATT server: %s", err)
 			continue
 
 		}
+		as.SetSigningKeyProvider(dev.SigningKeyProvider())
 		go as.Loop()
+		if c, ok := l2c.(*hci.Conn); ok {
+			go serveBearers(c, as)
+		}
+	}
+}
+
+// serveBearers serves the Enhanced ATT bearers of the connection, until it
+// disconnects.
+func serveBearers(c *hci.Conn, as *att.Server) {
+	for {
+		b, err := c.AcceptBearer()
+		if err != nil {
+			return
+		}
+		bs, err := as.NewBearer(b)
+		if err != nil {
+			log.Printf("can't create ATT server of bearer: %s", err)
+			b.Close()
+			continue
+		}
+		go bs.Loop()
 	}
 }
 
@@ -100,6 +125,18 @@ func (d *Device) SetServices(svcs []*ble.Service) error {
 	return d.Server.SetServices(svcs)
 }
 
+// Notify pushes the value of the characteristic to all the subscribed clients,
+// and returns the result of each.
+func (d *Device) Notify(c *ble.Characteristic, value []byte) []gatt.NotifyResult {
+	return d.Server.Notify(c, value)
+}
+
+// NotifyPeer pushes the value of the characteristic to the subscribed client
+// of the address.
+func (d *Device) NotifyPeer(a ble.Addr, c *ble.Characteristic, value []byte) error {
+	return d.Server.NotifyPeer(a, c, value)
+}
+
 // Stop stops gatt server.
 func (d *Device) Stop() error {
 	return d.HCI.Close()
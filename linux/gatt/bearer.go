@@ -0,0 +1,55 @@
+package gatt
+
+import (
+	"errors"
+
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/att"
+)
+
+// bearer is an ATT bearer of the client, on which the requests are sequential.
+type bearer struct {
+	ac   *att.Client
+	conn ble.Conn
+}
+
+// AddBearer adds an Enhanced ATT bearer of the connection [Vol 3, Part F, 3.2.11],
+// such as one opened with hci.Conn.OpenBearers. The reads and the writes of the
+// characteristics and the descriptors are distributed across the bearers, so
+// the requests of concurrent goroutines don't wait for each other.
+func (p *Client) AddBearer(l2c ble.Conn) error {
+	p.muBearers.Lock()
+	defer p.muBearers.Unlock()
+	if p.bearers >= maxBearers {
+		return errors.New("too many bearers")
+	}
+	ac := att.NewClient(l2c, p)
+	go ac.Loop()
+	p.bearers++
+	p.chIdle <- &bearer{ac: ac, conn: l2c}
+	return nil
+}
+
+// acquire waits for and takes an idle bearer. The Enhanced ATT bearers closed
+// are discarded.
+func (p *Client) acquire() *bearer {
+	for {
+		b := <-p.chIdle
+		if b.ac == p.ac {
+			return b
+		}
+		select {
+		case <-b.conn.Disconnected():
+			p.muBearers.Lock()
+			p.bearers--
+			p.muBearers.Unlock()
+		default:
+			return b
+		}
+	}
+}
+
+// release puts the bearer back.
+func (p *Client) release(b *bearer) {
+	p.chIdle <- b
+}
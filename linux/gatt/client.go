@@ -15,14 +15,20 @@ const (
 	cccIndicate = 0x0002
 )
 
+// maxBearers is the maximum number of the ATT bearers of a client.
+const maxBearers = 32
+
 // NewClient returns a GATT Client.
 func NewClient(conn ble.Conn) (*Client, error) {
 	p := &Client{
-		subs: make(map[uint16]*sub),
-		conn: conn,
+		subs:   make(map[uint16]*sub),
+		conn:   conn,
+		chIdle: make(chan *bearer, maxBearers),
 	}
 	p.ac = att.NewClient(conn, p)
 	go p.ac.Loop()
+	p.chIdle <- &bearer{ac: p.ac, conn: conn}
+	p.bearers = 1
 	return p, nil
 }
 
@@ -36,6 +42,22 @@ type Client struct {
 
 	ac   *att.Client
 	conn ble.Conn
+	kp   KeyProvider
+
+	// chIdle holds the bearers not in use, including the unenhanced ATT
+	// bearer of ac. The reads and the writes are distributed across them.
+	chIdle    chan *bearer
+	muBearers sync.Mutex
+	bearers   int
+
+	// muEnc serializes raising the security of the link.
+	muEnc sync.Mutex
+
+	// muPrep serializes the prepared writes, whose queue on the server is
+	// shared by the bearers.
+	muPrep sync.Mutex
+
+	signer att.SigningKeyProvider
 }
 
 // Addr returns the address of the client.
@@ -206,9 +228,15 @@ func (p *Client) DiscoverDescriptors(filter []ble.UUID, c *ble.Characteristic) (
 
 // ReadCharacteristic reads a characteristic value from a server. [Vol 3, Part G, 4.8.1]
 func (p *Client) ReadCharacteristic(c *ble.Characteristic) ([]byte, error) {
-	p.Lock()
-	defer p.Unlock()
-	val, err := p.ac.Read(c.ValueHandle)
+	p.RLock()
+	defer p.RUnlock()
+	b := p.acquire()
+	defer p.release(b)
+	var val []byte
+	err := p.secure(func() (err error) {
+		val, err = b.ac.Read(c.ValueHandle)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -219,44 +247,186 @@ func (p *Client) ReadCharacteristic(c *ble.Characteristic) ([]byte, error) {
 
 // ReadLongCharacteristic reads a characteristic value which is longer than the MTU. [Vol 3, Part G, 4.8.3]
 func (p *Client) ReadLongCharacteristic(c *ble.Characteristic) ([]byte, error) {
-	p.Lock()
-	defer p.Unlock()
+	p.RLock()
+	defer p.RUnlock()
+	b := p.acquire()
+	defer p.release(b)
+	buffer, err := p.readLong(b, c.ValueHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Value = buffer
+	return buffer, nil
+}
 
+// readLong reads the value of the attribute h, which can be longer than the MTU.
+func (p *Client) readLong(b *bearer, h uint16) ([]byte, error) {
 	// The maximum length of an attribute value shall be 512 octects [Vol 3, 3.2.9]
 	buffer := make([]byte, 0, 512)
 
-	read, err := p.ac.Read(c.ValueHandle)
+	var read []byte
+	err := p.secure(func() (err error) {
+		read, err = b.ac.Read(h)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	buffer = append(buffer, read...)
 
-	for len(read) >= p.conn.TxMTU()-1 {
-		if read, err = p.ac.ReadBlob(c.ValueHandle, uint16(len(buffer))); err != nil {
+	for len(read) >= b.conn.TxMTU()-1 {
+		err := p.secure(func() (err error) {
+			read, err = b.ac.ReadBlob(h, uint16(len(buffer)))
+			return err
+		})
+		if err != nil {
 			return nil, err
 		}
 		buffer = append(buffer, read...)
 	}
-
-	c.Value = buffer
 	return buffer, nil
 }
 
+// ReadMultipleCharacteristics reads the values of two or more characteristics
+// in a single request, and returns them concatenated. Only the values of known
+// fixed sizes can be read, except the last one. [Vol 3, Part G, 4.8.4]
+func (p *Client) ReadMultipleCharacteristics(cs []*ble.Characteristic) ([]byte, error) {
+	p.RLock()
+	defer p.RUnlock()
+	b := p.acquire()
+	defer p.release(b)
+	hs := make([]uint16, len(cs))
+	for i, c := range cs {
+		hs[i] = c.ValueHandle
+	}
+	var val []byte
+	err := p.secure(func() (err error) {
+		val, err = b.ac.ReadMultiple(hs)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), val...), nil
+}
+
+// ReadMultipleVariableCharacteristics reads the values of the characteristics,
+// which can have variable lengths, and returns them in the same order. They are
+// read with as few requests as the MTU allows. The values truncated to fit in
+// a response are read with the Read Blob requests. If the server doesn't
+// support the request, the values are read one by one. [Vol 3, Part G, 4.8.5]
+func (p *Client) ReadMultipleVariableCharacteristics(cs []*ble.Characteristic) ([][]byte, error) {
+	p.RLock()
+	defer p.RUnlock()
+	b := p.acquire()
+	defer p.release(b)
+
+	vals := make([][]byte, len(cs))
+	variable := true
+	for i := 0; i < len(cs); {
+		max := (b.conn.TxMTU() - 1) / 2
+		if !variable || len(cs)-i < 2 || max < 2 {
+			v, err := p.readLong(b, cs[i].ValueHandle)
+			if err != nil {
+				return nil, err
+			}
+			vals[i] = v
+			i++
+			continue
+		}
+
+		hs := make([]uint16, 0, max)
+		for _, c := range cs[i:] {
+			if len(hs) == max {
+				break
+			}
+			hs = append(hs, c.ValueHandle)
+		}
+		var rsp []byte
+		err := p.secure(func() (err error) {
+			rsp, err = b.ac.ReadMultipleVariable(hs)
+			return err
+		})
+		if err == ble.ErrReqNotSupp {
+			variable = false
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// The tuples are in the order of the handles, and only the last one
+		// can be truncated.
+		n := 0
+		for ; n < len(hs) && len(rsp) >= 2; n++ {
+			l := int(binary.LittleEndian.Uint16(rsp))
+			v := rsp[2:]
+			if len(v) > l {
+				v = v[:l]
+			}
+			rsp = rsp[2+len(v):]
+			vals[i+n] = append(make([]byte, 0, l), v...)
+			for len(vals[i+n]) < l {
+				var read []byte
+				err := p.secure(func() (err error) {
+					read, err = b.ac.ReadBlob(hs[n], uint16(len(vals[i+n])))
+					return err
+				})
+				if err != nil {
+					return nil, err
+				}
+				if len(read) == 0 {
+					break
+				}
+				vals[i+n] = append(vals[i+n], read...)
+			}
+		}
+		if n == 0 {
+			return nil, att.ErrInvalidResponse
+		}
+		i += n
+	}
+
+	for i, c := range cs {
+		c.Value = vals[i]
+	}
+	return vals, nil
+}
+
 // WriteCharacteristic writes a characteristic value to a server. [Vol 3, Part G, 4.9.3]
 func (p *Client) WriteCharacteristic(c *ble.Characteristic, v []byte, noRsp bool) error {
-	p.Lock()
-	defer p.Unlock()
+	p.RLock()
+	defer p.RUnlock()
+	b := p.acquire()
+	defer p.release(b)
 	if noRsp {
-		return p.ac.WriteCommand(c.ValueHandle, v)
+		if ok, err := p.signedWrite(b.ac, c, v); ok {
+			return err
+		}
+		return b.ac.WriteCommand(c.ValueHandle, v)
 	}
-	return p.ac.Write(c.ValueHandle, v)
+	return p.secure(func() error { return b.ac.Write(c.ValueHandle, v) })
+}
+
+// WriteLongCharacteristic writes a characteristic value which is longer than the MTU. [Vol 3, Part G, 4.9.4]
+func (p *Client) WriteLongCharacteristic(c *ble.Characteristic, v []byte) error {
+	p.RLock()
+	defer p.RUnlock()
+	return p.writePrepared([]prepWrite{{h: c.ValueHandle, v: v}})
 }
 
 // ReadDescriptor reads a characteristic descriptor from a server. [Vol 3, Part G, 4.12.1]
 func (p *Client) ReadDescriptor(d *ble.Descriptor) ([]byte, error) {
-	p.Lock()
-	defer p.Unlock()
-	val, err := p.ac.Read(d.Handle)
+	p.RLock()
+	defer p.RUnlock()
+	b := p.acquire()
+	defer p.release(b)
+	var val []byte
+	err := p.secure(func() (err error) {
+		val, err = b.ac.Read(d.Handle)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -267,9 +437,11 @@ func (p *Client) ReadDescriptor(d *ble.Descriptor) ([]byte, error) {
 
 // WriteDescriptor writes a characteristic descriptor to a server. [Vol 3, Part G, 4.12.3]
 func (p *Client) WriteDescriptor(d *ble.Descriptor, v []byte) error {
-	p.Lock()
-	defer p.Unlock()
-	return p.ac.Write(d.Handle, v)
+	p.RLock()
+	defer p.RUnlock()
+	b := p.acquire()
+	defer p.release(b)
+	return p.secure(func() error { return b.ac.Write(d.Handle, v) })
 }
 
 // ReadRSSI retrieves the current RSSI value of remote peripheral. [Vol 2, Part E, 7.5.4]
@@ -340,7 +512,7 @@ func (p *Client) setHandlers(cccdh, vh, flag uint16, h ble.NotificationHandler)
 	} else {
 		s.iHandler = h
 	}
-	return p.ac.Write(s.cccdh, v)
+	return p.secure(func() error { return p.ac.Write(s.cccdh, v) })
 }
 
 // ClearSubscriptions clears all subscriptions to notifications and indications.
@@ -349,7 +521,7 @@ func (p *Client) ClearSubscriptions() error {
 	defer p.Unlock()
 	zero := make([]byte, 2)
 	for vh, s := range p.subs {
-		if err := p.ac.Write(s.cccdh, zero); err != nil {
+		if err := p.secure(func() error { return p.ac.Write(s.cccdh, zero) }); err != nil {
 			return err
 		}
 		delete(p.subs, vh)
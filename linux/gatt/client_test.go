@@ -0,0 +1,172 @@
+package gatt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/att"
+)
+
+// pipeConn is an end of a ble.Conn, whose PDUs are read by the other end.
+type pipeConn struct {
+	ctx    context.Context
+	local  ble.Addr
+	remote ble.Addr
+	rx     chan []byte
+	peer   *pipeConn
+
+	// The ends are closed together.
+	done chan struct{}
+	once *sync.Once
+
+	mu           sync.Mutex
+	rxMTU, txMTU int
+}
+
+// newConnPair returns the ends of the client, and the server, of a connection.
+func newConnPair() (*pipeConn, *pipeConn) {
+	done, once := make(chan struct{}), &sync.Once{}
+	c := &pipeConn{
+		ctx:    context.Background(),
+		local:  ble.NewAddr("00:00:00:00:00:01"),
+		remote: ble.NewAddr("00:00:00:00:00:02"),
+		rx:     make(chan []byte, 16),
+		done:   done,
+		once:   once,
+		rxMTU:  ble.DefaultMTU,
+		txMTU:  ble.DefaultMTU,
+	}
+	s := &pipeConn{
+		ctx:    context.Background(),
+		local:  c.remote,
+		remote: c.local,
+		rx:     make(chan []byte, 16),
+		done:   done,
+		once:   once,
+		rxMTU:  ble.DefaultMTU,
+		txMTU:  ble.DefaultMTU,
+	}
+	c.peer, s.peer = s, c
+	return c, s
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	select {
+	case p := <-c.rx:
+		return copy(b, p), nil
+	case <-c.done:
+		return 0, io.EOF
+	}
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	select {
+	case c.peer.rx <- append([]byte(nil), b...):
+		return len(b), nil
+	case <-c.done:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (c *pipeConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *pipeConn) Context() context.Context       { return c.ctx }
+func (c *pipeConn) SetContext(ctx context.Context) { c.ctx = ctx }
+func (c *pipeConn) LocalAddr() ble.Addr            { return c.local }
+func (c *pipeConn) RemoteAddr() ble.Addr           { return c.remote }
+func (c *pipeConn) Disconnected() <-chan struct{}  { return c.done }
+
+func (c *pipeConn) RxMTU() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rxMTU
+}
+
+func (c *pipeConn) SetRxMTU(mtu int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rxMTU = mtu
+}
+
+func (c *pipeConn) TxMTU() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.txMTU
+}
+
+func (c *pipeConn) SetTxMTU(mtu int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.txMTU = mtu
+}
+
+// serveDB serves the services over the server end of a new connection, and
+// returns the client of the other end.
+func serveDB(t *testing.T, ss []*ble.Service) *Client {
+	t.Helper()
+	cc, sc := newConnPair()
+	as, err := att.NewServer(att.NewDB(ss, 1), sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go as.Loop()
+	cln, err := NewClient(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cln
+}
+
+func TestReadMultipleVariableCharacteristics(t *testing.T) {
+	// The second value is truncated in the response at the default ATT_MTU,
+	// and the third one is left out.
+	values := [][]byte{
+		bytes.Repeat([]byte{0x11}, 10),
+		bytes.Repeat([]byte{0x22}, 60),
+		bytes.Repeat([]byte{0x33}, 5),
+	}
+	var offsets []int
+	svc := ble.NewService(ble.UUID16(0x1800))
+	for i, v := range values {
+		i, v := i, v
+		c := svc.NewCharacteristic(ble.UUID16(0x2a00 + uint16(i)))
+		c.HandleRead(ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
+			if i == 1 {
+				offsets = append(offsets, req.Offset())
+			}
+			v := v[req.Offset():]
+			if len(v) > rsp.Cap() {
+				v = v[:rsp.Cap()]
+			}
+			rsp.Write(v)
+		}))
+	}
+	cln := serveDB(t, []*ble.Service{svc})
+	defer cln.conn.Close()
+
+	cs := make([]*ble.Characteristic, len(values))
+	for i, c := range svc.Characteristics {
+		cs[i] = &ble.Characteristic{UUID: c.UUID, ValueHandle: c.ValueHandle}
+	}
+	vals, err := cln.ReadMultipleVariableCharacteristics(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range values {
+		if !bytes.Equal(vals[i], v) || !bytes.Equal(cs[i].Value, v) {
+			t.Errorf("value %d: % X, want % X", i, vals[i], v)
+		}
+	}
+	// The rest of the truncated value is read with Read Blob requests.
+	if want := []int{0, 8, 30, 52}; fmt.Sprint(offsets) != fmt.Sprint(want) {
+		t.Errorf("value 1 read at offsets %v, want %v", offsets, want)
+	}
+}
@@ -0,0 +1,101 @@
+package gatt
+
+import (
+	"fmt"
+
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/att"
+)
+
+// A KeyProvider supplies the key to encrypt the link with, when the server
+// rejects a request for insufficient security.
+type KeyProvider interface {
+	// LongTermKey returns the LTK distributed by, or generated with, the
+	// peer device of conn, and the EDIV and Rand identifying it. It returns
+	// ok false if no key is available.
+	LongTermKey(conn ble.Conn) (ltk [16]byte, ediv uint16, rand uint64, ok bool)
+}
+
+// KeyProviderFunc is an adapter to allow the use of ordinary functions as KeyProviders.
+type KeyProviderFunc func(conn ble.Conn) (ltk [16]byte, ediv uint16, rand uint64, ok bool)
+
+// LongTermKey returns f(conn).
+func (f KeyProviderFunc) LongTermKey(conn ble.Conn) (ltk [16]byte, ediv uint16, rand uint64, ok bool) {
+	return f(conn)
+}
+
+// SecurityError is returned when the server requires a higher security of the
+// link, and the client can't encrypt the link for having no key to do so.
+type SecurityError struct {
+	Err ble.ATTError // The error returned by the server.
+}
+
+func (e *SecurityError) Error() string {
+	return fmt.Sprintf("security required: %s", e.Err)
+}
+
+// An encrypter is a connection which can encrypt the link as a master, such as hci.Conn.
+type encrypter interface {
+	StartEncryption(ltk [16]byte, ediv uint16, rand uint64) error
+}
+
+// SetKeyProvider enables raising the security of the link when the server
+// rejects a request for insufficient authentication or encryption. The client
+// encrypts the link with the key supplied by kp, and retries the request once.
+// A nil kp disables it, which is the default.
+func (p *Client) SetKeyProvider(kp KeyProvider) {
+	p.Lock()
+	defer p.Unlock()
+	p.kp = kp
+}
+
+// SetSigningKeyProvider enables writing the characteristics supporting signed
+// write with Signed Write Commands on unencrypted links, which are signed with
+// the keys supplied by sp. A nil sp disables it, which is the default.
+func (p *Client) SetSigningKeyProvider(sp att.SigningKeyProvider) {
+	p.Lock()
+	defer p.Unlock()
+	p.signer = sp
+}
+
+// signedWrite writes the value of a characteristic with a Signed Write Command,
+// if the characteristic supports it, and the link is not encrypted. It returns
+// false if the value is not written. [Vol 3, Part G, 4.9.2]
+func (p *Client) signedWrite(ac *att.Client, c *ble.Characteristic, v []byte) (bool, error) {
+	if p.signer == nil || c.Property&ble.CharSignedWrite == 0 {
+		return false, nil
+	}
+	// Data signing shall not be used on encrypted links. [Vol 3, Part C, 10.4]
+	if e, ok := p.conn.(interface{ Encrypted() bool }); ok && e.Encrypted() {
+		return false, nil
+	}
+	csrk, counter, ok := p.signer.SigningKey(p.conn)
+	if !ok {
+		return false, nil
+	}
+	return true, ac.SignedWrite(c.ValueHandle, v, csrk, counter)
+}
+
+// secure runs the request f, and retries it once after encrypting the link,
+// if the server rejects it for insufficient security. [Vol 3, Part C, 10.3.2]
+func (p *Client) secure(f func() error) error {
+	err := f()
+	if p.kp == nil || (err != ble.ErrAuthentication && err != ble.ErrInsuffEnc) {
+		return err
+	}
+	e, ok := p.conn.(encrypter)
+	if !ok {
+		return &SecurityError{Err: err.(ble.ATTError)}
+	}
+	// The requests on the other bearers might be raising it concurrently.
+	p.muEnc.Lock()
+	defer p.muEnc.Unlock()
+	ltk, ediv, rand, ok := p.kp.LongTermKey(p.conn)
+	if !ok {
+		return &SecurityError{Err: err.(ble.ATTError)}
+	}
+	if err := e.StartEncryption(ltk, ediv, rand); err != nil {
+		return fmt.Errorf("can't encrypt link: %s", err)
+	}
+	return f()
+}
@@ -1,6 +1,7 @@
 package gatt
 
 import (
+	"fmt"
 	"log"
 	"sync"
 
@@ -15,10 +16,16 @@ func NewServerWithName(name string) (*Server, error) {
 
 // NewServerWithNameAndHandler allow to specify a custom NotifyHandler
 func NewServerWithNameAndHandler(name string, notifyHandler ble.NotifyHandler) (*Server, error) {
+	defaults := defaultServicesWithHandler(name, notifyHandler)
 	return &Server{
-		name: name,
-		svcs: defaultServicesWithHandler(name, notifyHandler),
-		db:   att.NewDB(defaultServices(name), uint16(1)),
+		name:     name,
+		defaults: defaults,
+		sc:       defaults[1].Characteristics[0],
+		svcs:     defaults,
+		db:       att.NewDB(defaults, uint16(1)), // ble attrs start at 1
+		conns:    make(map[*att.Server]ble.Conn),
+		scBonds:  make(map[string]*ServiceChanged),
+		scSaves:  make(map[string]*ServiceChanged),
 	}, nil
 }
 
@@ -32,45 +39,330 @@ type Server struct {
 	sync.Mutex
 	name string
 
+	// defaults are the GAP and the GATT services, and sc is the Service
+	// Changed characteristic of the latter.
+	defaults []*ble.Service
+	sc       *ble.Characteristic
+
 	svcs []*ble.Service
 	db   *att.DB
+
+	// scBonds are the disconnected bonded clients, which have subscribed to
+	// Service Changed, by their identity addresses [Vol 3, Part G, 7.1]. They
+	// persist in scStore, if it's set.
+	scBonds map[string]*ServiceChanged
+	scStore ServiceChangedStore
+
+	// scSaves are the states to save in scStore, or nil to remove, by the
+	// addresses. They're saved once the lock is released, and muSave keeps
+	// the saves in order.
+	scSaves map[string]*ServiceChanged
+	muSave  sync.Mutex
+
+	// conns are the ATT servers of the connected clients.
+	muConns sync.Mutex
+	conns   map[*att.Server]ble.Conn
+
+	// The notification queues of the ATT servers, if they are set.
+	queueSize   int
+	queuePolicy att.QueuePolicy
+}
+
+// ServiceChanged is the state of a bonded client, which has subscribed to
+// Service Changed. The subscription persists across the connections, and the
+// range of the handles changed while the client is disconnected is indicated
+// once it reconnects [Vol 3, Part G, 7.1].
+type ServiceChanged struct {
+	// Changed is set if the handles from Start to End have changed.
+	Changed    bool
+	Start, End uint16
+}
+
+// A ServiceChangedStore persists the Service Changed states of the bonded
+// clients along with their bonds, such as the BondStore of the HCI.
+type ServiceChangedStore interface {
+	// LoadServiceChanged returns the states of the bonded clients, which have
+	// subscribed to Service Changed, by their identity addresses.
+	LoadServiceChanged() (map[string]ServiceChanged, error)
+
+	// SaveServiceChanged stores the state of the bonded client of the identity
+	// address, or removes it if sc is nil. It does nothing if the client isn't
+	// bonded.
+	SaveServiceChanged(addr string, sc *ServiceChanged) error
+}
+
+// bondedConn is implemented by the connections, which know if the peer is
+// bonded.
+type bondedConn interface {
+	// Bonded returns a channel, which is closed once the link is encrypted
+	// with the keys of the bond with the peer.
+	Bonded() <-chan struct{}
+
+	// IdentityAddr returns the identity address of the peer, or the address
+	// of the connection if it isn't known.
+	IdentityAddr() ble.Addr
+}
+
+// NotifyResult is the result of pushing a value to a client.
+type NotifyResult struct {
+	Conn ble.Conn
+	Err  error
 }
 
 // AddService ...
 func (s *Server) AddService(svc *ble.Service) error {
 	s.Lock()
-	defer s.Unlock()
 	s.svcs = append(s.svcs, svc)
-	s.db = att.NewDB(s.svcs, uint16(1)) // ble attrs start at 1
+	s.update()
+	s.Unlock()
+	s.flushServiceChanged()
 	return nil
 }
 
 // RemoveAllServices ...
 func (s *Server) RemoveAllServices() error {
 	s.Lock()
-	defer s.Unlock()
-	s.svcs = defaultServices(s.name)
-	s.db = att.NewDB(s.svcs, uint16(1)) // ble attrs start at 1
+	s.svcs = append([]*ble.Service(nil), s.defaults...)
+	s.update()
+	s.Unlock()
+	s.flushServiceChanged()
 	return nil
 }
 
 // SetServices ...
 func (s *Server) SetServices(svcs []*ble.Service) error {
+	s.Lock()
+	s.svcs = append(append([]*ble.Service(nil), s.defaults...), svcs...)
+	s.update()
+	s.Unlock()
+	s.flushServiceChanged()
+	return nil
+}
+
+// update applies the services to the DB, which the connected clients see right
+// away. The range of the handles changed is indicated to the clients, which
+// have subscribed to Service Changed, and kept for the bonded ones until they
+// reconnect [Vol 3, Part G, 7.1]. The caller must hold the lock, and flush the
+// states of the bonded clients once it's released.
+func (s *Server) update() {
+	start, end, changed := s.db.Update(s.svcs)
+	if !changed {
+		return
+	}
+	for a, p := range s.scBonds {
+		if !p.Changed || start < p.Start {
+			p.Start = start
+		}
+		if !p.Changed || end > p.End {
+			p.End = end
+		}
+		p.Changed = true
+		s.saveServiceChanged(a, p)
+	}
+	s.muConns.Lock()
+	for as := range s.conns {
+		as.UnsubscribeRemoved()
+	}
+	s.muConns.Unlock()
+	// The indications wait for the confirmations of the clients.
+	go s.Notify(s.sc, serviceChangedValue(start, end))
+}
+
+// SetServiceChangedStore sets the store, which the Service Changed states of
+// the bonded clients persist in, and loads the states from it.
+func (s *Server) SetServiceChangedStore(store ServiceChangedStore) error {
+	m, err := store.LoadServiceChanged()
+	if err != nil {
+		return err
+	}
 	s.Lock()
 	defer s.Unlock()
-	s.svcs = append(defaultServices(s.name), svcs...)
-	s.db = att.NewDB(s.svcs, uint16(1)) // ble attrs start at 1
+	s.scStore = store
+	for a, sc := range m {
+		sc := sc
+		s.scBonds[a] = &sc
+	}
 	return nil
 }
 
+// saveServiceChanged records the state of the bonded client to save, or to
+// remove if sc is nil. The caller must hold the lock, and call
+// flushServiceChanged once it's released.
+func (s *Server) saveServiceChanged(addr string, sc *ServiceChanged) {
+	if s.scStore == nil {
+		return
+	}
+	if sc != nil {
+		c := *sc
+		sc = &c
+	}
+	s.scSaves[addr] = sc
+}
+
+// flushServiceChanged saves the states recorded by saveServiceChanged, without
+// holding the lock while the store is written. The states recorded later are
+// saved later, so the store is left with the latest ones.
+func (s *Server) flushServiceChanged() {
+	s.muSave.Lock()
+	defer s.muSave.Unlock()
+	s.Lock()
+	saves, store := s.scSaves, s.scStore
+	s.scSaves = make(map[string]*ServiceChanged)
+	s.Unlock()
+	for a, sc := range saves {
+		if err := store.SaveServiceChanged(a, sc); err != nil {
+			log.Printf("can't save Service Changed of %s: %s", a, err)
+		}
+	}
+}
+
+// serviceChangedValue returns the value of Service Changed, which is the range
+// of the handles affected [Vol 3, Part G, 7.1].
+func serviceChangedValue(start, end uint16) []byte {
+	return []byte{byte(start), byte(start >> 8), byte(end), byte(end >> 8)}
+}
+
 // DB ...
 func (s *Server) DB() *att.DB {
 	return s.db
 }
 
-func defaultServices(name string) []*ble.Service {
-	return defaultServicesWithHandler(name, nil)
+// NewATTServer returns the ATT server of the connection, which serves the DB.
+// The values of the characteristics can be pushed to the client until the
+// connection is closed.
+func (s *Server) NewATTServer(l2c ble.Conn) (*att.Server, error) {
+	s.Lock()
+	as, err := att.NewServer(s.db, l2c)
+	if err == nil && s.queueSize > 0 {
+		err = as.SetNotifyQueue(s.queueSize, s.queuePolicy)
+	}
+	s.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	s.muConns.Lock()
+	s.conns[as] = l2c
+	s.muConns.Unlock()
+	go func() {
+		if bc, ok := l2c.(bondedConn); ok {
+			s.serveBonded(as, l2c, bc)
+		}
+		<-l2c.Disconnected()
+		s.muConns.Lock()
+		delete(s.conns, as)
+		s.muConns.Unlock()
+	}()
+	return as, nil
+}
+
+// serveBonded keeps the subscription of a bonded client to Service Changed,
+// until it disconnects. The client is only known to be the bonded one, once
+// the link is encrypted with the keys of the bond.
+func (s *Server) serveBonded(as *att.Server, l2c ble.Conn, bc bondedConn) {
+	select {
+	case <-bc.Bonded():
+	case <-l2c.Disconnected():
+		return
+	}
+	key := bc.IdentityAddr().String()
+	s.Lock()
+	p := s.scBonds[key]
+	delete(s.scBonds, key)
+	s.Unlock()
+	if p != nil {
+		if err := as.SetCCC(s.sc, cccIndicate); err != nil {
+			log.Printf("can't restore Service Changed of %s: %s", key, err)
+		}
+		if p.Changed {
+			go as.Notify(s.sc, serviceChangedValue(p.Start, p.End))
+		}
+	}
+
+	<-l2c.Disconnected()
+	var sc *ServiceChanged
+	s.Lock()
+	if as.CCC(s.sc)&cccIndicate != 0 {
+		sc = &ServiceChanged{}
+		s.scBonds[key] = sc
+	}
+	s.saveServiceChanged(key, sc)
+	s.Unlock()
+	s.flushServiceChanged()
+}
+
+// SetNotifyQueue sets the size of the queues of the notifications and the
+// indications of each client, and what's done when one is full. It applies to
+// the clients connected afterwards. The notifications written by the
+// NotifyHandlers are then only queued, without waiting for them to be sent.
+func (s *Server) SetNotifyQueue(size int, policy att.QueuePolicy) error {
+	if size < 1 || policy < att.QueueBlock || policy > att.QueueError {
+		return att.ErrInvalidArgument
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.queueSize, s.queuePolicy = size, policy
+	return nil
 }
+
+// Notify pushes the value of the characteristic to all the clients, which have
+// subscribed to it. Each client is notified or indicated as configured in its
+// CCCD, and the indications wait for the confirmations. It returns the results
+// of the subscribed clients.
+func (s *Server) Notify(c *ble.Characteristic, value []byte) []NotifyResult {
+	s.muConns.Lock()
+	rs := make([]NotifyResult, 0, len(s.conns))
+	ass := make([]*att.Server, 0, len(s.conns))
+	for as, l2c := range s.conns {
+		rs = append(rs, NotifyResult{Conn: l2c})
+		ass = append(ass, as)
+	}
+	s.muConns.Unlock()
+
+	var wg sync.WaitGroup
+	for i, as := range ass {
+		wg.Add(1)
+		go func(r *NotifyResult, as *att.Server) {
+			defer wg.Done()
+			r.Err = as.Notify(c, value)
+		}(&rs[i], as)
+	}
+	wg.Wait()
+
+	n := 0
+	for _, r := range rs {
+		if r.Err != att.ErrNotSubscribed {
+			rs[n] = r
+			n++
+		}
+	}
+	return rs[:n]
+}
+
+// NotifyPeer pushes the value of the characteristic to the client of the
+// address, as Notify does. The client is matched by its identity address, if
+// it's known, so a bonded client using private addresses can be targeted, or
+// by the address of the connection. It returns att.ErrNotSubscribed if the
+// client hasn't subscribed to it.
+func (s *Server) NotifyPeer(a ble.Addr, c *ble.Characteristic, value []byte) error {
+	s.muConns.Lock()
+	var as *att.Server
+	for x, l2c := range s.conns {
+		if bc, ok := l2c.(bondedConn); ok && bc.IdentityAddr().String() == a.String() {
+			as = x
+			break
+		}
+		if l2c.RemoteAddr().String() == a.String() {
+			as = x
+			break
+		}
+	}
+	s.muConns.Unlock()
+	if as == nil {
+		return fmt.Errorf("%s isn't connected", a)
+	}
+	return as.Notify(c, value)
+}
+
 func defaultServicesWithHandler(name string, handler ble.NotifyHandler) []*ble.Service {
 	// https://developer.bluetooth.org/gatt/characteristics/Pages/CharacteristicViewer.aspx?u=org.bluetooth.characteristic.ble.appearance.xml
 	var gapCharAppearanceGenericComputer = []byte{0x00, 0x80}
@@ -82,23 +374,9 @@ func defaultServicesWithHandler(name string, handler ble.NotifyHandler) []*ble.S
 	gapSvc.NewCharacteristic(ble.ReconnectionAddrUUID).SetValue([]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
 	gapSvc.NewCharacteristic(ble.PeferredParamsUUID).SetValue([]byte{0x06, 0x00, 0x06, 0x00, 0x00, 0x00, 0xd0, 0x07})
 
+	// The Service Changed indications are sent by the server, when the
+	// services are changed. The handler, if any, is run on subscription.
 	gattSvc := ble.NewService(ble.GATTUUID)
-	var indicationHandler ble.NotifyHandlerFunc
-	indicationHandler = defaultHanderFunc
-	if handler != nil {
-		indicationHandler = handler.ServeNotify
-	}
-	gattSvc.NewCharacteristic(ble.ServiceChangedUUID).HandleIndicate(indicationHandler)
+	gattSvc.NewCharacteristic(ble.ServiceChangedUUID).HandleIndicate(handler)
 	return []*ble.Service{gapSvc, gattSvc}
 }
-
-func defaultHanderFunc(r ble.Request, n ble.Notifier) {
-	log.Printf("TODO: indicate client when the services are changed")
-	for {
-		select {
-		case <-n.Context().Done():
-			log.Printf("count: Notification unsubscribed")
-			return
-		}
-	}
-}
@@ -0,0 +1,313 @@
+package gatt
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/att"
+)
+
+// bondedPipe is the server end of a connection, whose peer is bonded, and
+// known by its identity address.
+type bondedPipe struct {
+	*pipeConn
+	identity ble.Addr
+	bonded   chan struct{}
+}
+
+func (c *bondedPipe) Bonded() <-chan struct{} { return c.bonded }
+func (c *bondedPipe) IdentityAddr() ble.Addr  { return c.identity }
+
+// newNotifyServer returns a server of a characteristic, which can be notified
+// and indicated.
+func newNotifyServer(t *testing.T) (*Server, *ble.Characteristic) {
+	t.Helper()
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := ble.NewService(ble.UUID16(0x1800))
+	c := svc.NewCharacteristic(ble.UUID16(0x2a00))
+	c.HandleNotify(nil)
+	c.HandleIndicate(nil)
+	if err := s.AddService(svc); err != nil {
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+// connect serves the server end of a connection, whose client has written
+// ccc to the CCCD of c.
+func connect(t *testing.T, s *Server, l2c ble.Conn, c *ble.Characteristic, ccc uint16) *att.Server {
+	t.Helper()
+	as, err := s.NewATTServer(l2c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go as.Loop()
+	if ccc != 0 {
+		if err := as.SetCCC(c, ccc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return as
+}
+
+// receive returns the next PDU sent to the client end of a connection.
+func receive(t *testing.T, c *pipeConn) []byte {
+	t.Helper()
+	select {
+	case b := <-c.rx:
+		return b
+	case <-time.After(time.Second):
+		t.Fatal("nothing received")
+		return nil
+	}
+}
+
+// waitConns waits until n clients are connected to the server.
+func waitConns(t *testing.T, s *Server, n int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		s.muConns.Lock()
+		m := len(s.conns)
+		s.muConns.Unlock()
+		if m == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("clients not %d", n)
+}
+
+func TestNotify(t *testing.T) {
+	s, c := newNotifyServer(t)
+	cn, sn := newConnPair()
+	ci, si := newConnPair()
+	cx, sx := newConnPair()
+	for _, p := range []*pipeConn{cn, ci, cx} {
+		defer p.Close()
+	}
+	connect(t, s, sn, c, cccNotify)
+	connect(t, s, si, c, cccIndicate)
+	connect(t, s, sx, c, 0)
+
+	done := make(chan []NotifyResult, 1)
+	go func() { done <- s.Notify(c, []byte{1, 2}) }()
+	vh := byte(c.ValueHandle)
+	if b := receive(t, cn); !bytes.Equal(b, []byte{att.HandleValueNotificationCode, vh, 0, 1, 2}) {
+		t.Errorf("notification % X", b)
+	}
+	if b := receive(t, ci); !bytes.Equal(b, []byte{att.HandleValueIndicationCode, vh, 0, 1, 2}) {
+		t.Errorf("indication % X", b)
+	}
+
+	// The indication waits for the confirmation.
+	select {
+	case rs := <-done:
+		t.Fatalf("returned before the confirmation: %v", rs)
+	case <-time.After(50 * time.Millisecond):
+	}
+	ci.Write([]byte{att.HandleValueConfirmationCode})
+	var rs []NotifyResult
+	select {
+	case rs = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("not returned after the confirmation")
+	}
+
+	// Only the subscribed clients have results.
+	if len(rs) != 2 {
+		t.Fatalf("results %v, want 2", rs)
+	}
+	for _, r := range rs {
+		if (r.Conn != sn && r.Conn != si) || r.Err != nil {
+			t.Errorf("result %v", r)
+		}
+	}
+	select {
+	case b := <-cx.rx:
+		t.Errorf("unsubscribed client received % X", b)
+	default:
+	}
+}
+
+func TestNotifyPeer(t *testing.T) {
+	s, c := newNotifyServer(t)
+	cb, sb := newConnPair()
+	defer cb.Close()
+	rpa := ble.NewAddr("4a:00:00:00:00:01")
+	identity := ble.NewAddr("00:11:22:33:44:55")
+	sb.remote = rpa
+	connect(t, s, &bondedPipe{pipeConn: sb, identity: identity, bonded: make(chan struct{})}, c, cccNotify)
+	cx, sx := newConnPair()
+	defer cx.Close()
+	connect(t, s, sx, c, 0)
+
+	// The bonded client is targeted by its identity address, as well as the
+	// private address of the connection.
+	for _, a := range []ble.Addr{identity, rpa} {
+		if err := s.NotifyPeer(a, c, []byte{1}); err != nil {
+			t.Fatalf("%s: %v", a, err)
+		}
+		if b := receive(t, cb); b[0] != att.HandleValueNotificationCode {
+			t.Errorf("%s: received % X", a, b)
+		}
+	}
+	if err := s.NotifyPeer(sx.RemoteAddr(), c, []byte{1}); err != att.ErrNotSubscribed {
+		t.Errorf("unsubscribed client: %v", err)
+	}
+	if err := s.NotifyPeer(ble.NewAddr("00:11:22:33:44:66"), c, []byte{1}); err == nil {
+		t.Error("unknown client notified")
+	}
+
+	// The client isn't connected, once it disconnects.
+	cb.Close()
+	waitConns(t, s, 1)
+	if err := s.NotifyPeer(identity, c, []byte{1}); err == nil {
+		t.Error("disconnected client notified")
+	}
+}
+
+// memSCStore is a ServiceChangedStore in memory.
+type memSCStore struct {
+	sync.Mutex
+	m map[string]ServiceChanged
+}
+
+func (s *memSCStore) LoadServiceChanged() (map[string]ServiceChanged, error) {
+	s.Lock()
+	defer s.Unlock()
+	m := make(map[string]ServiceChanged)
+	for a, sc := range s.m {
+		m[a] = sc
+	}
+	return m, nil
+}
+
+func (s *memSCStore) SaveServiceChanged(addr string, sc *ServiceChanged) error {
+	s.Lock()
+	defer s.Unlock()
+	if sc == nil {
+		delete(s.m, addr)
+	} else {
+		s.m[addr] = *sc
+	}
+	return nil
+}
+
+func (s *memSCStore) get(addr string) (ServiceChanged, bool) {
+	s.Lock()
+	defer s.Unlock()
+	sc, ok := s.m[addr]
+	return sc, ok
+}
+
+// waitStored waits until the state of the client of addr is stored, or
+// removed if want is nil.
+func waitStored(t *testing.T, store *memSCStore, addr string, want *ServiceChanged) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		sc, ok := store.get(addr)
+		if want == nil && !ok || want != nil && ok && sc == *want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sc, ok := store.get(addr)
+	t.Fatalf("stored %+v, %v; want %+v", sc, ok, want)
+}
+
+func TestServiceChangedMerged(t *testing.T) {
+	mk := func(u uint16) *ble.Service {
+		svc := ble.NewService(ble.UUID16(u))
+		svc.NewCharacteristic(ble.UUID16(u + 1)).SetValue([]byte{1})
+		return svc
+	}
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := mk(0x1810), mk(0x1820), mk(0x1830)
+	s.SetServices([]*ble.Service{a, b, c})
+
+	const addr = "00:11:22:33:44:55"
+	store := &memSCStore{m: map[string]ServiceChanged{addr: {}}}
+	if err := s.SetServiceChangedStore(store); err != nil {
+		t.Fatal(err)
+	}
+
+	// The services replaced in place change their own handles only, and the
+	// ranges are merged until the client reconnects.
+	s.SetServices([]*ble.Service{a, mk(0x1840), c})
+	waitStored(t, store, addr, &ServiceChanged{true, b.Handle, b.EndHandle})
+	s.SetServices([]*ble.Service{mk(0x1850), mk(0x1840), c})
+	waitStored(t, store, addr, &ServiceChanged{true, a.Handle, b.EndHandle})
+
+	// The new last service changes the group of the old one.
+	s.AddService(mk(0x1860))
+	waitStored(t, store, addr, &ServiceChanged{true, a.Handle, 0xFFFF})
+}
+
+func TestServiceChangedBonded(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := ble.NewAddr("00:11:22:33:44:55")
+	addr := identity.String()
+	store := &memSCStore{m: map[string]ServiceChanged{addr: {true, 0x0020, 0x0030}}}
+	if err := s.SetServiceChangedStore(store); err != nil {
+		t.Fatal(err)
+	}
+
+	cc, sc := newConnPair()
+	bonded := make(chan struct{})
+	as := connect(t, s, &bondedPipe{pipeConn: sc, identity: identity, bonded: bonded}, nil, 0)
+
+	// The subscription isn't restored, until the link is encrypted with the
+	// keys of the bond.
+	time.Sleep(50 * time.Millisecond)
+	if ccc := as.CCC(s.sc); ccc != 0 {
+		t.Fatalf("CCC 0x%04X restored before bonded", ccc)
+	}
+	close(bonded)
+	b := receive(t, cc)
+	vh := s.sc.ValueHandle
+	if want := []byte{att.HandleValueIndicationCode, byte(vh), byte(vh >> 8), 0x20, 0, 0x30, 0}; !bytes.Equal(b, want) {
+		t.Errorf("indication % X, want % X", b, want)
+	}
+	cc.Write([]byte{att.HandleValueConfirmationCode})
+	if ccc := as.CCC(s.sc); ccc != cccIndicate {
+		t.Errorf("CCC 0x%04X restored", ccc)
+	}
+
+	// The subscription persists, once the client disconnects.
+	cc.Close()
+	waitStored(t, store, addr, &ServiceChanged{})
+
+	// It's removed, once the client unsubscribes.
+	cc, sc = newConnPair()
+	bonded = make(chan struct{})
+	close(bonded)
+	as = connect(t, s, &bondedPipe{pipeConn: sc, identity: identity, bonded: bonded}, nil, 0)
+	for i := 0; i < 100 && as.CCC(s.sc) != cccIndicate; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	h := s.sc.ValueHandle + 1 // The CCCD is the only descriptor.
+	cc.Write([]byte{att.WriteRequestCode, byte(h), byte(h >> 8), 0, 0})
+	if b := receive(t, cc); b[0] != att.WriteResponseCode {
+		t.Fatalf("response % X", b)
+	}
+	cc.Close()
+	waitStored(t, store, addr, nil)
+	s.Lock()
+	_, ok := s.scBonds[addr]
+	s.Unlock()
+	if ok {
+		t.Error("unsubscribed client kept")
+	}
+}
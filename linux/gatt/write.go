@@ -0,0 +1,106 @@
+package gatt
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	"github.com/go-ble/ble"
+)
+
+// ErrWriteCorrupted means the value echoed by the server doesn't match the one
+// prepared to be written, so the prepared writes are cancelled.
+var ErrWriteCorrupted = errors.New("prepared value corrupted")
+
+// prepWrite is a value to write with Prepare Write Requests.
+type prepWrite struct {
+	h uint16
+	v []byte
+}
+
+// writePrepared writes the values with Prepare Write Requests, which carry the
+// parts fitting in the MTU, and executes them together. The parts echoed by the
+// server are verified, and the writes are cancelled if any is corrupted.
+// [Vol 3, Part G, 4.9.4 & 4.9.5]
+func (p *Client) writePrepared(ws []prepWrite) error {
+	// The prepare queue of the server is shared by all the bearers.
+	p.muPrep.Lock()
+	defer p.muPrep.Unlock()
+	b := p.acquire()
+	defer p.release(b)
+	if err := p.prepare(b, ws); err != nil {
+		b.ac.ExecuteWrite(0x00)
+		return err
+	}
+	return b.ac.ExecuteWrite(0x01)
+}
+
+// prepare queues the values on the server.
+func (p *Client) prepare(b *bearer, ws []prepWrite) error {
+	n := b.conn.TxMTU() - 5
+	for _, w := range ws {
+		for off := 0; off == 0 || off < len(w.v); off += n {
+			part := w.v[off:]
+			if len(part) > n {
+				part = part[:n]
+			}
+			var h, o uint16
+			var echo []byte
+			err := p.secure(func() (err error) {
+				h, o, echo, err = b.ac.PrepareWrite(w.h, uint16(off), part)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if h != w.h || int(o) != off || !bytes.Equal(echo, part) {
+				return ErrWriteCorrupted
+			}
+		}
+	}
+	return nil
+}
+
+// BeginReliableWrite starts a transaction of writes to several characteristics, which are written together. [Vol 3, Part G, 4.9.5]
+func (p *Client) BeginReliableWrite() (ble.ReliableWrite, error) {
+	return &reliableWrite{p: p}, nil
+}
+
+// reliableWrite implements ble.ReliableWrite. The values are queued locally,
+// and prepared on the server only when they are committed.
+type reliableWrite struct {
+	p  *Client
+	mu sync.Mutex
+	ws []prepWrite
+}
+
+// Write queues a value to write to a characteristic.
+func (r *reliableWrite) Write(c *ble.Characteristic, v []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ws = append(r.ws, prepWrite{h: c.ValueHandle, v: append([]byte(nil), v...)})
+	return nil
+}
+
+// Commit writes all the queued values, and none of them if any is corrupted.
+// The transaction is empty afterwards.
+func (r *reliableWrite) Commit() error {
+	r.mu.Lock()
+	ws := r.ws
+	r.ws = nil
+	r.mu.Unlock()
+	if len(ws) == 0 {
+		return nil
+	}
+	r.p.RLock()
+	defer r.p.RUnlock()
+	return r.p.writePrepared(ws)
+}
+
+// Cancel discards all the queued values.
+func (r *reliableWrite) Cancel() error {
+	r.mu.Lock()
+	r.ws = nil
+	r.mu.Unlock()
+	return nil
+}
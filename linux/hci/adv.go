@@ -33,6 +33,9 @@ type Advertisement struct {
 	i  int
 	sr *Advertisement
 
+	// res resolves the address of the advertiser.
+	res *resolver
+
 	// cached packets.
 	p *adv.Packet
 }
@@ -101,7 +104,7 @@ func (a *Advertisement) RSSI() int {
 func (a *Advertisement) Addr() ble.Addr {
 	b := a.e.Address(a.i)
 	addr := net.HardwareAddr([]byte{b[5], b[4], b[3], b[2], b[1], b[0]})
-	if a.e.AddressType(a.i) == 1 {
+	if a.e.AddressType(a.i)&0x01 == 1 {
 		return RandomAddress{addr}
 	}
 	return addr
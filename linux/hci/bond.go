@@ -0,0 +1,539 @@
+package hci
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/go-ble/ble/linux/gatt"
+	"github.com/pkg/errors"
+)
+
+// ErrBondNotFound is returned by a BondStore if the peer device is not bonded.
+var ErrBondNotFound = errors.New("bond not found")
+
+// Bond holds the keys exchanged with a bonded peer device.
+type Bond struct {
+	// AddrType and Addr are the identity address of the peer device.
+	// AddrType is 0x00 for a public address, and 0x01 for a static random
+	// address. Addr is in the over-the-air (little-endian) order.
+	AddrType uint8
+	Addr     [6]byte
+
+	Local  Keys // Keys distributed by the local device.
+	Remote Keys // Keys distributed by the peer device.
+
+	// ServiceChanged is the state of the subscription of the peer device to
+	// Service Changed, or nil if it hasn't subscribed [Vol 3, Part G, 7.1].
+	ServiceChanged *gatt.ServiceChanged
+}
+
+// A BondStore persists the bonds with peer devices.
+type BondStore interface {
+	// Load returns the bond with the peer device of the specified identity
+	// address, or ErrBondNotFound.
+	Load(addrType uint8, addr [6]byte) (*Bond, error)
+
+	// Save stores the bond, replacing the existing one with the same peer device.
+	Save(b *Bond) error
+
+	// Delete removes the bond with the peer device of the specified identity address.
+	Delete(addrType uint8, addr [6]byte) error
+
+	// Bonds returns all the bonds in the store.
+	Bonds() ([]*Bond, error)
+}
+
+// LocalIdentity is the identity of the local device, which the bonded peer
+// devices know it by. It has to persist along with the bonds, or the peer
+// devices can't resolve the private addresses of the device once it restarts.
+type LocalIdentity struct {
+	IRK [16]byte
+
+	// StaticAddr is the static address generated for the device, if any. It's
+	// in the over-the-air (little-endian) order.
+	StaticAddr [6]byte
+}
+
+// An IdentityStore persists the identity of the local device. The BondStores
+// implementing it keep the identity along with the bonds.
+type IdentityStore interface {
+	// LoadIdentity returns the identity of the local device, or nil if none
+	// has been saved.
+	LoadIdentity() (*LocalIdentity, error)
+
+	// SaveIdentity stores the identity of the local device.
+	SaveIdentity(id *LocalIdentity) error
+}
+
+// bondKey identifies a bond by the identity address of the peer device.
+type bondKey struct {
+	addrType uint8
+	addr     [6]byte
+}
+
+// MemoryBondStore is a BondStore which keeps the bonds in memory only.
+type MemoryBondStore struct {
+	sync.Mutex
+	bonds map[bondKey]Bond
+	id    *LocalIdentity
+}
+
+// NewMemoryBondStore returns an empty MemoryBondStore.
+func NewMemoryBondStore() *MemoryBondStore {
+	return &MemoryBondStore{bonds: make(map[bondKey]Bond)}
+}
+
+// Load returns the bond with the peer device of the specified identity address.
+func (s *MemoryBondStore) Load(addrType uint8, addr [6]byte) (*Bond, error) {
+	s.Lock()
+	defer s.Unlock()
+	b, ok := s.bonds[bondKey{addrType, addr}]
+	if !ok {
+		return nil, ErrBondNotFound
+	}
+	return &b, nil
+}
+
+// Save stores the bond, replacing the existing one with the same peer device.
+func (s *MemoryBondStore) Save(b *Bond) error {
+	s.Lock()
+	defer s.Unlock()
+	s.bonds[bondKey{b.AddrType, b.Addr}] = *b
+	return nil
+}
+
+// Delete removes the bond with the peer device of the specified identity address.
+func (s *MemoryBondStore) Delete(addrType uint8, addr [6]byte) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.bonds, bondKey{addrType, addr})
+	return nil
+}
+
+// Bonds returns all the bonds in the store.
+func (s *MemoryBondStore) Bonds() ([]*Bond, error) {
+	s.Lock()
+	defer s.Unlock()
+	bonds := make([]*Bond, 0, len(s.bonds))
+	for _, b := range s.bonds {
+		b := b
+		bonds = append(bonds, &b)
+	}
+	return bonds, nil
+}
+
+// LoadIdentity returns the identity of the local device, or nil.
+func (s *MemoryBondStore) LoadIdentity() (*LocalIdentity, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.id == nil {
+		return nil, nil
+	}
+	id := *s.id
+	return &id, nil
+}
+
+// SaveIdentity stores the identity of the local device.
+func (s *MemoryBondStore) SaveIdentity(id *LocalIdentity) error {
+	s.Lock()
+	defer s.Unlock()
+	c := *id
+	s.id = &c
+	return nil
+}
+
+// LoadServiceChanged returns the Service Changed states of the bonded peer
+// devices, which have subscribed to it, by their identity addresses. It
+// implements gatt.ServiceChangedStore.
+func (h *HCI) LoadServiceChanged() (map[string]gatt.ServiceChanged, error) {
+	bonds, err := h.bonds.Bonds()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]gatt.ServiceChanged)
+	for _, b := range bonds {
+		if b.ServiceChanged != nil {
+			m[addrString(b.Addr)] = *b.ServiceChanged
+		}
+	}
+	return m, nil
+}
+
+// SaveServiceChanged stores the Service Changed state of the bonded peer
+// device of the identity address, or removes it if sc is nil.
+func (h *HCI) SaveServiceChanged(addr string, sc *gatt.ServiceChanged) error {
+	bonds, err := h.bonds.Bonds()
+	if err != nil {
+		return err
+	}
+	for _, b := range bonds {
+		if addrString(b.Addr) != addr {
+			continue
+		}
+		b.ServiceChanged = nil
+		if sc != nil {
+			c := *sc
+			b.ServiceChanged = &c
+		}
+		return h.bonds.Save(b)
+	}
+	return nil
+}
+
+// FileBondStore is a BondStore which persists the bonds, and the identity of
+// the local device, to a JSON file.
+// The keys are written in plain text, so the file is created readable by
+// the owner only.
+type FileBondStore struct {
+	sync.Mutex
+	path string
+}
+
+// NewFileBondStore returns a FileBondStore persisting to the file at path.
+// The file is created on the first Save, if it doesn't exist.
+func NewFileBondStore(path string) *FileBondStore {
+	return &FileBondStore{path: path}
+}
+
+// Load returns the bond with the peer device of the specified identity address.
+func (s *FileBondStore) Load(addrType uint8, addr [6]byte) (*Bond, error) {
+	s.Lock()
+	defer s.Unlock()
+	f, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	b, ok := f.bonds[bondKey{addrType, addr}]
+	if !ok {
+		return nil, ErrBondNotFound
+	}
+	return b, nil
+}
+
+// Save stores the bond, replacing the existing one with the same peer device.
+func (s *FileBondStore) Save(b *Bond) error {
+	s.Lock()
+	defer s.Unlock()
+	f, err := s.read()
+	if err != nil {
+		return err
+	}
+	f.bonds[bondKey{b.AddrType, b.Addr}] = b
+	return s.write(f)
+}
+
+// Delete removes the bond with the peer device of the specified identity address.
+func (s *FileBondStore) Delete(addrType uint8, addr [6]byte) error {
+	s.Lock()
+	defer s.Unlock()
+	f, err := s.read()
+	if err != nil {
+		return err
+	}
+	k := bondKey{addrType, addr}
+	if _, ok := f.bonds[k]; !ok {
+		return nil
+	}
+	delete(f.bonds, k)
+	return s.write(f)
+}
+
+// Bonds returns all the bonds in the store.
+func (s *FileBondStore) Bonds() ([]*Bond, error) {
+	s.Lock()
+	defer s.Unlock()
+	f, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	r := make([]*Bond, 0, len(f.bonds))
+	for _, b := range f.bonds {
+		r = append(r, b)
+	}
+	return r, nil
+}
+
+// LoadIdentity returns the identity of the local device, or nil.
+func (s *FileBondStore) LoadIdentity() (*LocalIdentity, error) {
+	s.Lock()
+	defer s.Unlock()
+	f, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return f.id, nil
+}
+
+// SaveIdentity stores the identity of the local device.
+func (s *FileBondStore) SaveIdentity(id *LocalIdentity) error {
+	s.Lock()
+	defer s.Unlock()
+	f, err := s.read()
+	if err != nil {
+		return err
+	}
+	c := *id
+	f.id = &c
+	return s.write(f)
+}
+
+// bondFile is the content of the file of a FileBondStore.
+type bondFile struct {
+	id    *LocalIdentity
+	bonds map[bondKey]*Bond
+}
+
+func (s *FileBondStore) read() (*bondFile, error) {
+	f := &bondFile{bonds: make(map[bondKey]*Bond)}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read bond store")
+	}
+	var jf jsonBondFile
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		// The files without the local identity are an array of the bonds.
+		err = json.Unmarshal(data, &jf.Bonds)
+	} else {
+		err = json.Unmarshal(data, &jf)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "can't parse bond store")
+	}
+	if jf.Identity != nil {
+		if f.id, err = jf.Identity.identity(); err != nil {
+			return nil, errors.Wrap(err, "can't parse bond store")
+		}
+	}
+	for _, jb := range jf.Bonds {
+		b, err := jb.bond()
+		if err != nil {
+			return nil, errors.Wrap(err, "can't parse bond store")
+		}
+		f.bonds[bondKey{b.AddrType, b.Addr}] = b
+	}
+	return f, nil
+}
+
+// write replaces the file atomically, so a crash never leaves it truncated.
+func (s *FileBondStore) write(bf *bondFile) error {
+	jf := jsonBondFile{Bonds: make([]jsonBond, 0, len(bf.bonds))}
+	if bf.id != nil {
+		jf.Identity = newJSONIdentity(bf.id)
+	}
+	for _, b := range bf.bonds {
+		jf.Bonds = append(jf.Bonds, newJSONBond(b))
+	}
+	// Keep the file stable, regardless of the order of the map.
+	sort.Slice(jf.Bonds, func(i, j int) bool {
+		if jf.Bonds[i].Addr != jf.Bonds[j].Addr {
+			return jf.Bonds[i].Addr < jf.Bonds[j].Addr
+		}
+		return jf.Bonds[i].AddrType < jf.Bonds[j].AddrType
+	})
+	data, err := json.MarshalIndent(jf, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "can't write bond store")
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Wrap(err, "can't write bond store")
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "can't write bond store")
+	}
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "can't write bond store")
+	}
+	return nil
+}
+
+// jsonBondFile is the representation of the file of a FileBondStore.
+type jsonBondFile struct {
+	Identity *jsonIdentity `json:"identity,omitempty"`
+	Bonds    []jsonBond    `json:"bonds"`
+}
+
+// jsonIdentity is the representation of a LocalIdentity in the file.
+type jsonIdentity struct {
+	IRK        string `json:"irk"`
+	StaticAddr string `json:"staticAddr,omitempty"`
+}
+
+func newJSONIdentity(id *LocalIdentity) *jsonIdentity {
+	j := &jsonIdentity{IRK: hex.EncodeToString(id.IRK[:])}
+	if id.StaticAddr != ([6]byte{}) {
+		j.StaticAddr = addrString(id.StaticAddr)
+	}
+	return j
+}
+
+func (j jsonIdentity) identity() (*LocalIdentity, error) {
+	id := &LocalIdentity{}
+	b, err := hex.DecodeString(j.IRK)
+	if err != nil || len(b) != 16 {
+		return nil, fmt.Errorf("invalid key %q", j.IRK)
+	}
+	copy(id.IRK[:], b)
+	if j.StaticAddr != "" {
+		if id.StaticAddr, err = parseAddr(j.StaticAddr); err != nil {
+			return nil, err
+		}
+	}
+	return id, nil
+}
+
+// jsonBond is the representation of a Bond in the file. Addresses are
+// written in the conventional notation, and keys in hex.
+type jsonBond struct {
+	AddrType       uint8               `json:"addrType"`
+	Addr           string              `json:"addr"`
+	Local          jsonKeys            `json:"local"`
+	Remote         jsonKeys            `json:"remote"`
+	ServiceChanged *jsonServiceChanged `json:"serviceChanged,omitempty"`
+}
+
+// jsonServiceChanged is the representation of the Service Changed state of a
+// bonded peer device.
+type jsonServiceChanged struct {
+	Changed bool   `json:"changed"`
+	Start   uint16 `json:"start,omitempty"`
+	End     uint16 `json:"end,omitempty"`
+}
+
+type jsonKeys struct {
+	LTK               string `json:"ltk,omitempty"`
+	EDIV              uint16 `json:"ediv,omitempty"`
+	Rand              uint64 `json:"rand,omitempty"`
+	IRK               string `json:"irk,omitempty"`
+	IDAddrType        uint8  `json:"idAddrType,omitempty"`
+	IDAddr            string `json:"idAddr,omitempty"`
+	CSRK              string `json:"csrk,omitempty"`
+	SignCounter       uint32 `json:"signCounter,omitempty"`
+	Dist              uint8  `json:"dist"`
+	KeySize           int    `json:"keySize"`
+	Authenticated     bool   `json:"authenticated"`
+	SecureConnections bool   `json:"secureConnections"`
+}
+
+func newJSONBond(b *Bond) jsonBond {
+	j := jsonBond{
+		AddrType: b.AddrType,
+		Addr:     addrString(b.Addr),
+		Local:    newJSONKeys(&b.Local),
+		Remote:   newJSONKeys(&b.Remote),
+	}
+	if sc := b.ServiceChanged; sc != nil {
+		j.ServiceChanged = &jsonServiceChanged{Changed: sc.Changed, Start: sc.Start, End: sc.End}
+	}
+	return j
+}
+
+func newJSONKeys(k *Keys) jsonKeys {
+	j := jsonKeys{
+		Dist:              k.Dist,
+		KeySize:           k.KeySize,
+		Authenticated:     k.Authenticated,
+		SecureConnections: k.SecureConnections,
+	}
+	if k.Dist&keyDistEncKey != 0 || k.SecureConnections {
+		j.LTK = hex.EncodeToString(k.LTK[:])
+		j.EDIV, j.Rand = k.EDIV, k.Rand
+	}
+	if k.Dist&keyDistIDKey != 0 {
+		j.IRK = hex.EncodeToString(k.IRK[:])
+		j.IDAddrType = k.IDAddrType
+		j.IDAddr = addrString(k.IDAddr)
+	}
+	if k.Dist&keyDistSignKey != 0 {
+		j.CSRK = hex.EncodeToString(k.CSRK[:])
+		j.SignCounter = k.SignCounter
+	}
+	return j
+}
+
+func (j jsonBond) bond() (*Bond, error) {
+	b := &Bond{AddrType: j.AddrType}
+	var err error
+	if b.Addr, err = parseAddr(j.Addr); err != nil {
+		return nil, err
+	}
+	if err := j.Local.keys(&b.Local); err != nil {
+		return nil, err
+	}
+	if err := j.Remote.keys(&b.Remote); err != nil {
+		return nil, err
+	}
+	if sc := j.ServiceChanged; sc != nil {
+		b.ServiceChanged = &gatt.ServiceChanged{Changed: sc.Changed, Start: sc.Start, End: sc.End}
+	}
+	return b, nil
+}
+
+func (j jsonKeys) keys(k *Keys) error {
+	*k = Keys{
+		EDIV:              j.EDIV,
+		Rand:              j.Rand,
+		IDAddrType:        j.IDAddrType,
+		SignCounter:       j.SignCounter,
+		Dist:              j.Dist,
+		KeySize:           j.KeySize,
+		Authenticated:     j.Authenticated,
+		SecureConnections: j.SecureConnections,
+	}
+	for _, f := range []struct {
+		s string
+		k *[16]byte
+	}{{j.LTK, &k.LTK}, {j.IRK, &k.IRK}, {j.CSRK, &k.CSRK}} {
+		if f.s == "" {
+			continue
+		}
+		b, err := hex.DecodeString(f.s)
+		if err != nil || len(b) != 16 {
+			return fmt.Errorf("invalid key %q", f.s)
+		}
+		copy(f.k[:], b)
+	}
+	if j.IDAddr != "" {
+		a, err := parseAddr(j.IDAddr)
+		if err != nil {
+			return err
+		}
+		k.IDAddr = a
+	}
+	return nil
+}
+
+// addrString returns the conventional notation of an address in the
+// over-the-air (little-endian) order.
+func addrString(a [6]byte) string {
+	return net.HardwareAddr([]byte{a[5], a[4], a[3], a[2], a[1], a[0]}).String()
+}
+
+// parseAddr parses an address in the conventional notation, and returns it in
+// the over-the-air (little-endian) order.
+func parseAddr(s string) ([6]byte, error) {
+	b, err := net.ParseMAC(s)
+	if err != nil || len(b) != 6 {
+		return [6]byte{}, fmt.Errorf("invalid address %q", s)
+	}
+	return [6]byte{b[5], b[4], b[3], b[2], b[1], b[0]}, nil
+}
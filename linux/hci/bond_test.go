@@ -0,0 +1,428 @@
+package hci
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/go-ble/ble/linux/gatt"
+)
+
+// testBonds are the bonds with the keys of each distribution.
+var testBonds = []*Bond{
+	{
+		AddrType: 0x00,
+		Addr:     [6]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06},
+		Local: Keys{
+			LTK:     [16]byte{0x11, 0x12},
+			EDIV:    0x1234,
+			Rand:    0x0102030405060708,
+			Dist:    keyDistEncKey,
+			KeySize: 16,
+		},
+		Remote: Keys{
+			LTK:         [16]byte{0x21, 0x22},
+			EDIV:        0x4321,
+			Rand:        0x0807060504030201,
+			IRK:         [16]byte{0x31, 0x32},
+			IDAddrType:  0x00,
+			IDAddr:      [6]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06},
+			CSRK:        [16]byte{0x41, 0x42},
+			SignCounter: 7,
+			Dist:        keyDistEncKey | keyDistIDKey | keyDistSignKey,
+			KeySize:     16,
+		},
+	},
+	{
+		AddrType: 0x01,
+		Addr:     [6]byte{0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0xCF},
+		Local: Keys{
+			LTK:               [16]byte{0x51, 0x52},
+			KeySize:           16,
+			Authenticated:     true,
+			SecureConnections: true,
+		},
+		Remote: Keys{
+			LTK:               [16]byte{0x51, 0x52},
+			IRK:               [16]byte{0x61, 0x62},
+			IDAddrType:        0x01,
+			IDAddr:            [6]byte{0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0xCF},
+			Dist:              keyDistIDKey,
+			KeySize:           16,
+			Authenticated:     true,
+			SecureConnections: true,
+		},
+		ServiceChanged: &gatt.ServiceChanged{Changed: true, Start: 0x0010, End: 0xFFFF},
+	},
+}
+
+// tempDir returns a new temporary directory.
+func tempDir(t *testing.T) string {
+	d, err := ioutil.TempDir("", "bond")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// bondStores returns a BondStore of each kind, and a function which returns
+// the one reopened, as if the device restarted. The file is kept in d.
+func bondStores(d string) []struct {
+	name   string
+	s      BondStore
+	reopen func() BondStore
+} {
+	path := filepath.Join(d, "bonds.json")
+	m := NewMemoryBondStore()
+	return []struct {
+		name   string
+		s      BondStore
+		reopen func() BondStore
+	}{
+		{"memory", m, func() BondStore { return m }},
+		{"file", NewFileBondStore(path), func() BondStore { return NewFileBondStore(path) }},
+	}
+}
+
+func sortBonds(bs []*Bond) {
+	sort.Slice(bs, func(i, j int) bool { return bs[i].AddrType < bs[j].AddrType })
+}
+
+func TestBondStore(t *testing.T) {
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+	for _, tc := range bondStores(d) {
+		t.Run(tc.name, func(t *testing.T) {
+			s := tc.s
+			if _, err := s.Load(0x00, testBonds[0].Addr); err != ErrBondNotFound {
+				t.Fatalf("Load of an empty store: got %v, want %v", err, ErrBondNotFound)
+			}
+			for _, b := range testBonds {
+				if err := s.Save(b); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s = tc.reopen()
+			for _, want := range testBonds {
+				got, err := s.Load(want.AddrType, want.Addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("Load: got %+v, want %+v", got, want)
+				}
+			}
+			bs, err := s.Bonds()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sortBonds(bs)
+			if !reflect.DeepEqual(bs, testBonds) {
+				t.Fatalf("Bonds: got %+v, want %+v", bs, testBonds)
+			}
+
+			// Save replaces the bond of the same identity address.
+			b := *testBonds[0]
+			b.Remote.SignCounter = 8
+			if err := s.Save(&b); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := tc.reopen().Load(b.AddrType, b.Addr); err != nil || got.Remote.SignCounter != 8 {
+				t.Fatalf("Load after Save: got %+v, %v", got, err)
+			}
+
+			// The same address of a different type is another device.
+			if _, err := s.Load(0x01, testBonds[0].Addr); err != ErrBondNotFound {
+				t.Fatalf("Load of another address type: got %v, want %v", err, ErrBondNotFound)
+			}
+
+			if err := s.Delete(b.AddrType, b.Addr); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete(b.AddrType, b.Addr); err != nil {
+				t.Fatalf("Delete of a missing bond: %v", err)
+			}
+			s = tc.reopen()
+			if _, err := s.Load(b.AddrType, b.Addr); err != ErrBondNotFound {
+				t.Fatalf("Load after Delete: got %v, want %v", err, ErrBondNotFound)
+			}
+			if bs, _ := s.Bonds(); len(bs) != 1 {
+				t.Fatalf("Bonds after Delete: got %d, want 1", len(bs))
+			}
+		})
+	}
+}
+
+func TestIdentityStore(t *testing.T) {
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+	for _, tc := range bondStores(d) {
+		t.Run(tc.name, func(t *testing.T) {
+			s := tc.s.(IdentityStore)
+			if id, err := s.LoadIdentity(); id != nil || err != nil {
+				t.Fatalf("LoadIdentity of an empty store: got %+v, %v", id, err)
+			}
+			want := &LocalIdentity{
+				IRK:        [16]byte{0x71, 0x72, 0x73},
+				StaticAddr: [6]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0xC6},
+			}
+			if err := s.SaveIdentity(want); err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.s.Save(testBonds[0]); err != nil {
+				t.Fatal(err)
+			}
+			id, err := tc.reopen().(IdentityStore).LoadIdentity()
+			if err != nil || !reflect.DeepEqual(id, want) {
+				t.Fatalf("LoadIdentity: got %+v, %v, want %+v", id, err, want)
+			}
+			if _, err := tc.reopen().Load(testBonds[0].AddrType, testBonds[0].Addr); err != nil {
+				t.Fatalf("Load with the identity: %v", err)
+			}
+		})
+	}
+}
+
+func TestFileBondStoreWrite(t *testing.T) {
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, "bonds.json")
+	s := NewFileBondStore(path)
+	for _, b := range testBonds {
+		if err := s.Save(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The file is replaced with a temporary one, which isn't left behind.
+	fs, err := ioutil.ReadDir(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 1 || fs[0].Name() != "bonds.json" {
+		t.Fatalf("files in the directory: %v", fs)
+	}
+	if m := fs[0].Mode().Perm(); m&0077 != 0 {
+		t.Fatalf("file mode %v, want readable by the owner only", m)
+	}
+
+	// A corrupted file fails the operations, instead of losing the bonds.
+	if err := ioutil.WriteFile(path, []byte("[{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(testBonds[0]); err == nil {
+		t.Fatal("Save to a corrupted file succeeded")
+	}
+	if _, err := s.Bonds(); err == nil {
+		t.Fatal("Bonds of a corrupted file succeeded")
+	}
+}
+
+// TestFileBondStoreJSON checks the files written by the earlier versions are
+// still read, and the format written doesn't change.
+func TestServiceChangedStore(t *testing.T) {
+	h := &HCI{bonds: NewMemoryBondStore()}
+	for _, b := range testBonds {
+		if err := h.bonds.Save(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(want map[string]gatt.ServiceChanged) {
+		t.Helper()
+		m, err := h.LoadServiceChanged()
+		if err != nil || !reflect.DeepEqual(m, want) {
+			t.Fatalf("LoadServiceChanged: got %+v, %v, want %+v", m, err, want)
+		}
+	}
+	a0, a1 := "06:05:04:03:02:01", "cf:0e:0d:0c:0b:0a"
+	check(map[string]gatt.ServiceChanged{a1: *testBonds[1].ServiceChanged})
+
+	if err := h.SaveServiceChanged(a0, &gatt.ServiceChanged{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SaveServiceChanged(a1, nil); err != nil {
+		t.Fatal(err)
+	}
+	check(map[string]gatt.ServiceChanged{a0: {}})
+
+	// The keys of the bond are kept.
+	b, err := h.bonds.Load(testBonds[0].AddrType, testBonds[0].Addr)
+	if err != nil || b.Remote != testBonds[0].Remote {
+		t.Fatalf("Load: got %+v, %v", b, err)
+	}
+
+	// The peer devices not bonded are ignored.
+	if err := h.SaveServiceChanged("01:02:03:04:05:06", &gatt.ServiceChanged{}); err != nil {
+		t.Fatal(err)
+	}
+	check(map[string]gatt.ServiceChanged{a0: {}})
+}
+
+func TestFileBondStoreJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		id    *LocalIdentity
+		bonds []*Bond
+	}{
+		{
+			name:  "empty",
+			data:  "[]",
+			bonds: []*Bond{},
+		},
+		{
+			name: "array",
+			data: `[
+  {
+    "addrType": 1,
+    "addr": "cf:0e:0d:0c:0b:0a",
+    "local": {
+      "ltk": "51520000000000000000000000000000",
+      "dist": 0,
+      "keySize": 16,
+      "authenticated": true,
+      "secureConnections": true
+    },
+    "remote": {
+      "ltk": "51520000000000000000000000000000",
+      "irk": "61620000000000000000000000000000",
+      "idAddrType": 1,
+      "idAddr": "cf:0e:0d:0c:0b:0a",
+      "dist": 2,
+      "keySize": 16,
+      "authenticated": true,
+      "secureConnections": true
+    },
+    "serviceChanged": {
+      "changed": true,
+      "start": 16,
+      "end": 65535
+    }
+  }
+]`,
+			bonds: testBonds[1:],
+		},
+		{
+			name: "identity",
+			data: `{
+  "identity": {
+    "irk": "71727300000000000000000000000000",
+    "staticAddr": "c6:05:04:03:02:01"
+  },
+  "bonds": [
+    {
+      "addrType": 0,
+      "addr": "06:05:04:03:02:01",
+      "local": {
+        "ltk": "11120000000000000000000000000000",
+        "ediv": 4660,
+        "rand": 72623859790382856,
+        "dist": 1,
+        "keySize": 16,
+        "authenticated": false,
+        "secureConnections": false
+      },
+      "remote": {
+        "ltk": "21220000000000000000000000000000",
+        "ediv": 17185,
+        "rand": 578437695752307201,
+        "irk": "31320000000000000000000000000000",
+        "idAddr": "06:05:04:03:02:01",
+        "csrk": "41420000000000000000000000000000",
+        "signCounter": 7,
+        "dist": 7,
+        "keySize": 16,
+        "authenticated": false,
+        "secureConnections": false
+      }
+    }
+  ]
+}`,
+			id: &LocalIdentity{
+				IRK:        [16]byte{0x71, 0x72, 0x73},
+				StaticAddr: [6]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0xC6},
+			},
+			bonds: testBonds[:1],
+		},
+	}
+	d := tempDir(t)
+	defer os.RemoveAll(d)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(d, tc.name+".json")
+			if err := ioutil.WriteFile(path, []byte(tc.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			s := NewFileBondStore(path)
+			bs, err := s.Bonds()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sortBonds(bs)
+			if !reflect.DeepEqual(bs, tc.bonds) {
+				t.Fatalf("Bonds: got %+v, want %+v", bs, tc.bonds)
+			}
+			id, err := s.LoadIdentity()
+			if err != nil || !reflect.DeepEqual(id, tc.id) {
+				t.Fatalf("LoadIdentity: got %+v, %v, want %+v", id, err, tc.id)
+			}
+			if tc.id == nil {
+				return
+			}
+
+			// Rewriting the file keeps the format.
+			if err := s.SaveIdentity(tc.id); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tc.data {
+				t.Fatalf("file written:\n%s\nwant:\n%s", data, tc.data)
+			}
+		})
+	}
+}
+
+// TestLocalIdentity checks the device restarted with the same bond store has
+// the same IRK and generated static address.
+func TestLocalIdentity(t *testing.T) {
+	s := NewMemoryBondStore()
+	start := func(opts ...func(*HCI)) *HCI {
+		h, err := NewHCI()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.SetBondStore(s)
+		h.SetStaticAddress(nil)
+		for _, o := range opts {
+			o(h)
+		}
+		if err := h.initIdentity(); err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	h1 := start()
+	h2 := start()
+	if h1.IRK() != h2.IRK() {
+		t.Fatal("IRK changed on restart")
+	}
+	if h1.own.static != h2.own.static || h1.own.static == ([6]byte{}) {
+		t.Fatalf("static address changed on restart: %X, %X", h1.own.static, h2.own.static)
+	}
+
+	// The IRK set explicitly replaces the saved one.
+	irk := [16]byte{0x81, 0x82}
+	if h := start(func(h *HCI) { h.SetIRK(irk) }); h.IRK() != irk {
+		t.Fatal("IRK set is not used")
+	}
+	if h := start(); h.IRK() != irk || h.own.static != h1.own.static {
+		t.Fatal("IRK set is not saved")
+	}
+}
@@ -5,70 +5,263 @@ import (
 	"sync"
 )
 
-// Pool ...
+// Pool is the ACL data packet buffers of the controller, which are shared by
+// the connections [Vol 2, Part E, 4.1.1]. When the clients of the connections
+// are waiting for the buffers, the buffers are allotted to them in round robin,
+// so a connection sending bulk data doesn't starve the others.
 type Pool struct {
-	sync.Mutex
+	mu sync.Mutex
 
-	sz  int
-	cnt int
-	ch  chan *bytes.Buffer
+	sz   int
+	cnt  int
+	free []*bytes.Buffer
+
+	// waiting are the clients waiting for a buffer, in the order of their
+	// turns. last is the client allotted a buffer most recently.
+	waiting []*Client
+	last    *Client
 }
 
 // NewPool ...
 func NewPool(sz int, cnt int) *Pool {
-	ch := make(chan *bytes.Buffer, cnt)
-	for len(ch) < cnt {
-		ch <- bytes.NewBuffer(make([]byte, sz))
+	p := &Pool{sz: sz, cnt: cnt, free: make([]*bytes.Buffer, 0, cnt)}
+	for len(p.free) < cnt {
+		p.free = append(p.free, bytes.NewBuffer(make([]byte, sz)))
 	}
-	return &Pool{sz: sz, cnt: cnt, ch: ch}
+	return p
 }
 
-// Client ...
+// Client is a connection sending ACL data packets with the buffers of a Pool.
+// A client has at most one Get in progress.
 type Client struct {
-	p    *Pool
+	p *Pool
+
+	// sent are the buffers sent, and not completed by the controller yet.
 	sent chan *bytes.Buffer
+
+	// weight is the number of buffers allotted in a row to the client, while
+	// others are waiting. burst counts them.
+	weight int
+	burst  int
+
+	// limit is the maximum number of buffers the client holds, and depth is
+	// the maximum number of PDUs queued for sending. Zero means no limit.
+	limit int
+	depth int
+
+	closed bool
+	grant  chan *bytes.Buffer
+	stats  TxStats
 }
 
 // NewClient ...
 func NewClient(p *Pool) *Client {
-	return &Client{p: p, sent: make(chan *bytes.Buffer, p.cnt)}
+	return &Client{
+		p:      p,
+		sent:   make(chan *bytes.Buffer, p.cnt),
+		weight: 1,
+		grant:  make(chan *bytes.Buffer, 1),
+	}
 }
 
-// LockPool ...
-func (c *Client) LockPool() {
-	c.p.Lock()
+// Get returns a buffer from the shared buffer pool, once it's the turn of the
+// client. It returns nil, if the client is closed by PutAll.
+func (c *Client) Get() *bytes.Buffer {
+	return c.get(nil, nil)
 }
 
-// UnlockPool ...
-func (c *Client) UnlockPool() {
-	c.p.Unlock()
-}
+// get is like Get, but it also returns nil, if done or expired is closed
+// before it's the turn of the client.
+func (c *Client) get(done, expired <-chan struct{}) *bytes.Buffer {
+	p := c.p
+	p.mu.Lock()
+	if c.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	if len(p.waiting) == 0 && len(p.free) > 0 && c.eligible() {
+		c.burst = 1
+		b := p.take(c)
+		p.mu.Unlock()
+		return b
+	}
 
-// Get returns a buffer from the shared buffer pool.
-func (c *Client) Get() *bytes.Buffer {
-	b := <-c.p.ch
-	b.Reset()
-	c.sent <- b
-	return b
+	// Keep the turn, if the client was just allotted a buffer, and hasn't
+	// used up its weight. Otherwise, wait for the next round.
+	if p.last == c && c.burst < c.weight {
+		p.waiting = append(p.waiting, nil)
+		copy(p.waiting[1:], p.waiting)
+		p.waiting[0] = c
+	} else {
+		c.burst = 0
+		p.waiting = append(p.waiting, c)
+	}
+	c.stats.Stalls++
+	p.dispatch()
+	p.mu.Unlock()
+
+	select {
+	case b := <-c.grant:
+		return b
+	case <-done:
+	case <-expired:
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, w := range p.waiting {
+		if w == c {
+			p.remove(i)
+			return nil
+		}
+	}
+	// It's been allotted a buffer meanwhile.
+	return <-c.grant
 }
 
 // Put puts the oldest sent buffer back to the shared pool.
 func (c *Client) Put() {
+	p := c.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	select {
 	case b := <-c.sent:
-		c.p.ch <- b
+		p.free = append(p.free, b)
+		c.stats.InFlight--
+		p.dispatch()
 	default:
 	}
 }
 
-// PutAll puts all the sent buffers back to the shared pool.
+// PutAll puts all the sent buffers back to the shared pool, and closes the
+// client. A Get in progress, or called afterwards, returns nil.
 func (c *Client) PutAll() {
-	for {
-		select {
-		case b := <-c.sent:
-			c.p.ch <- b
-		default:
-			return
+	p := c.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c.closed = true
+	for i, w := range p.waiting {
+		if w == c {
+			p.remove(i)
+			c.grant <- nil
+			break
+		}
+	}
+	// A buffer granted to the Get in progress, but not taken yet, is taken
+	// back along with the sent ones, and the Get returns nil.
+	select {
+	case b := <-c.grant:
+		if b != nil {
+			c.stats.Packets--
+		}
+		c.grant <- nil
+	default:
+	}
+	for len(c.sent) > 0 {
+		p.free = append(p.free, <-c.sent)
+	}
+	c.stats.InFlight = 0
+	if p.last == c {
+		p.last = nil
+	}
+	p.dispatch()
+}
+
+// eligible returns true if the client can hold one more buffer.
+func (c *Client) eligible() bool {
+	return c.limit == 0 || len(c.sent) < c.limit
+}
+
+// queue counts a PDU queued for sending. It returns false, if the queue is full.
+func (c *Client) queue() bool {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	if c.depth > 0 && c.stats.Queued >= c.depth {
+		c.stats.Dropped++
+		return false
+	}
+	c.stats.Queued++
+	return true
+}
+
+// dequeue counts a PDU sent, or failed to be sent.
+func (c *Client) dequeue(sent bool) {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	c.stats.Queued--
+	if sent {
+		c.stats.PDUs++
+	}
+}
+
+// take allots a free buffer to the client. The caller must hold the lock.
+func (p *Pool) take(c *Client) *bytes.Buffer {
+	b := p.free[len(p.free)-1]
+	p.free = p.free[:len(p.free)-1]
+	b.Reset()
+	c.sent <- b
+	c.stats.InFlight++
+	c.stats.Packets++
+	p.last = c
+	return b
+}
+
+// dispatch allots the free buffers to the waiting clients in their turns,
+// skipping the ones holding as many buffers as their limits. The caller must
+// hold the lock.
+func (p *Pool) dispatch() {
+	for i := 0; i < len(p.waiting) && len(p.free) > 0; {
+		c := p.waiting[i]
+		if !c.eligible() {
+			i++
+			continue
 		}
+		p.remove(i)
+		c.burst++
+		c.grant <- p.take(c)
+	}
+}
+
+// remove removes the i-th waiting client, without allocating.
+func (p *Pool) remove(i int) {
+	copy(p.waiting[i:], p.waiting[i+1:])
+	p.waiting[len(p.waiting)-1] = nil
+	p.waiting = p.waiting[:len(p.waiting)-1]
+}
+
+// bufPool recycles the buffers of the ACL packets and the L2CAP PDUs received,
+// and of the signaling packets sent, so the data path doesn't allocate them
+// for each packet.
+type bufPool chan []byte
+
+const (
+	bufPoolSize = 64   // The number of the buffers kept for reuse.
+	bufMinSize  = 1024 // The minimum capacity of the buffers allocated.
+)
+
+func newBufPool() bufPool {
+	return make(bufPool, bufPoolSize)
+}
+
+// get returns a buffer of n bytes from the pool, or allocates one if none
+// of the pool is large enough.
+func (p bufPool) get(n int) []byte {
+	select {
+	case b := <-p:
+		if cap(b) >= n {
+			return b[:n]
+		}
+	default:
+	}
+	if n < bufMinSize {
+		return make([]byte, n, bufMinSize)
+	}
+	return make([]byte, n)
+}
+
+// put puts the buffer back to the pool. It mustn't be used afterwards.
+func (p bufPool) put(b []byte) {
+	select {
+	case p <- b:
+	default:
 	}
 }
@@ -0,0 +1,33 @@
+package hci
+
+import "testing"
+
+func TestPutAllGranted(t *testing.T) {
+	p := NewPool(27, 1)
+	a, b := NewClient(p), NewClient(p)
+	if a.Get() == nil {
+		t.Fatal("no buffer")
+	}
+
+	// The buffer is granted to b, as if its Get was waiting, but the Get
+	// hasn't taken it when b is closed.
+	p.mu.Lock()
+	p.waiting = append(p.waiting, b)
+	p.mu.Unlock()
+	a.Put()
+	b.PutAll()
+
+	// The Get returns nil, and the buffer is back in the pool only once.
+	if g := <-b.grant; g != nil {
+		t.Error("buffer granted to the closed client")
+	}
+	if len(p.free) != 1 || len(b.sent) != 0 || b.stats.InFlight != 0 {
+		t.Fatalf("free %d, sent %d, in flight %d", len(p.free), len(b.sent), b.stats.InFlight)
+	}
+	if b.Get() != nil {
+		t.Error("buffer got by the closed client")
+	}
+	if a.Get() == nil {
+		t.Error("buffer leaked")
+	}
+}
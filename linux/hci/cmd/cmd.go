@@ -29,3 +29,22 @@ func unmarshal(c commandRP, b []byte) error {
 	buf := bytes.NewBuffer(b)
 	return binary.Read(buf, binary.LittleEndian, c)
 }
+
+// Len returns the length of the command.
+func (c *HostNumberOfCompletedPackets) Len() int { return 1 + 4*len(c.ConnectionHandle) }
+
+// Marshal serializes the command parameters into binary form. The number of
+// handles is the length of ConnectionHandle, whose elements are followed by
+// the ones of HostNumOfCompletedPackets [Vol 2, Part E, 7.3.40].
+func (c *HostNumberOfCompletedPackets) Marshal(b []byte) error {
+	n := len(c.ConnectionHandle)
+	if len(b) < c.Len() || len(c.HostNumOfCompletedPackets) != n {
+		return io.ErrShortBuffer
+	}
+	b[0] = uint8(n)
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint16(b[1+2*i:], c.ConnectionHandle[i])
+		binary.LittleEndian.PutUint16(b[1+2*n+2*i:], c.HostNumOfCompletedPackets[i])
+	}
+	return nil
+}
@@ -0,0 +1,745 @@
+package hci
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-ble/ble"
+	"github.com/pkg/errors"
+)
+
+// Default parameters of the local endpoints of LE Credit Based Connection-
+// Oriented Channels. The MPS fits a K-frame in an LE Data Channel PDU with
+// the Data Length Extension.
+const (
+	DefaultChannelMTU     = 2048
+	DefaultChannelMPS     = 247
+	DefaultChannelCredits = 32
+)
+
+// Dynamically allocated CIDs and LE PSMs [Vol 3, Part A, 2.1 & 4.22].
+const (
+	cidDynamicFirst uint16 = 0x0040
+	cidDynamicLast  uint16 = 0x007F
+
+	psmFirst uint16 = 0x0001
+	psmLast  uint16 = 0x00FF
+)
+
+// Results of LE Credit Based Connection Response and Credit Based Connection
+// Response [Vol 3, Part A, 4.23 & 4.26].
+const (
+	cocSuccess               = 0x0000
+	cocPSMNotSupported       = 0x0002
+	cocNoResources           = 0x0004
+	cocInsuffAuthentication  = 0x0005
+	cocInsuffAuthorization   = 0x0006
+	cocInsuffEncrKeySize     = 0x0007
+	cocInsuffEncryption      = 0x0008
+	cocInvalidSourceCID      = 0x0009
+	cocSourceCIDAllocated    = 0x000A
+	cocUnacceptableParameter = 0x000B
+	cocInvalidParameters     = 0x000C
+)
+
+var cocResultName = map[uint16]string{
+	cocPSMNotSupported:       "LE_PSM not supported",
+	cocNoResources:           "no resources available",
+	cocInsuffAuthentication:  "insufficient authentication",
+	cocInsuffAuthorization:   "insufficient authorization",
+	cocInsuffEncrKeySize:     "insufficient encryption key size",
+	cocInsuffEncryption:      "insufficient encryption",
+	cocInvalidSourceCID:      "invalid Source CID",
+	cocSourceCIDAllocated:    "Source CID already allocated",
+	cocUnacceptableParameter: "unacceptable parameters",
+	cocInvalidParameters:     "invalid parameters",
+}
+
+// ChannelError is returned when the remote device refuses to open a channel.
+type ChannelError uint16
+
+func (e ChannelError) Error() string {
+	if s, ok := cocResultName[uint16(e)]; ok {
+		return "l2cap: " + s
+	}
+	return fmt.Sprintf("l2cap: connection refused (0x%04X)", uint16(e))
+}
+
+// timeoutError is returned by the I/O of a channel, after its deadline.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "l2cap: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// ChannelAddr is the address of an endpoint of a channel.
+type ChannelAddr struct {
+	Addr ble.Addr
+	PSM  uint16
+}
+
+// Network returns the name of the network.
+func (a ChannelAddr) Network() string { return "l2cap" }
+
+func (a ChannelAddr) String() string { return fmt.Sprintf("%s/0x%02X", a.Addr, a.PSM) }
+
+// Channel is an LE Credit Based Connection-Oriented Channel [Vol 3, Part A, 10.2],
+// which implements net.Conn. Writes are sent as SDUs of up to the MTU of the
+// remote device, and reads return the data of the SDUs received in order.
+type Channel struct {
+	conn *Conn
+	psm  uint16
+
+	// scid is the local CID, and dcid is the remote CID.
+	scid uint16
+	dcid uint16
+
+	// enhanced is set if the channel uses the Enhanced Credit Based Flow
+	// Control Mode, whose MTU and MPS can be reconfigured.
+	enhanced bool
+
+	// Parameters of the local and the remote endpoints. The local ones are
+	// guarded by muRx, and the remote ones by muCredits.
+	rxMTU, rxMPS int
+	txMTU, txMPS int
+
+	// muTx serializes the writes, so the K-frames of an SDU are sent in order.
+	muTx      sync.Mutex
+	muCredits sync.Mutex
+	txCredits int
+	chCredit  chan struct{}
+
+	// sdu is the SDU being reassembled, in a buffer from the pool, and frames
+	// counts its K-frames, whose credits are given back once the SDU is read.
+	// rxCredits is the number of K-frames the remote device can send.
+	muRx      sync.Mutex
+	sdu       []byte
+	sduLen    int
+	frames    int
+	rxCredits int
+	chSDU     chan rxSDU
+
+	// muRead serializes the reads. rd is the rest of the SDU being read,
+	// which has rdFrames K-frames. rdBuf is put back to the pool once the
+	// SDU is read.
+	muRead   sync.Mutex
+	rd       []byte
+	rdBuf    []byte
+	rdFrames int
+
+	rdDeadline deadline
+	wrDeadline deadline
+
+	closeOnce sync.Once
+	chClosed  chan struct{}
+}
+
+type rxSDU struct {
+	b      []byte
+	frames int
+}
+
+func newChannel(c *Conn, psm uint16, mtu int) *Channel {
+	h := c.hci
+	return &Channel{
+		conn:       c,
+		psm:        psm,
+		rxMTU:      mtu,
+		rxMPS:      h.chMPS,
+		rxCredits:  h.chCredits,
+		chCredit:   make(chan struct{}, 1),
+		chSDU:      make(chan rxSDU, h.chCredits),
+		rdDeadline: makeDeadline(),
+		wrDeadline: makeDeadline(),
+		chClosed:   make(chan struct{}),
+	}
+}
+
+// ChannelListener accepts the channels, which the remote devices open to an
+// LE_PSM, on any connection. It implements net.Listener.
+type ChannelListener struct {
+	h   *HCI
+	psm uint16
+
+	// eatt is set for the listener of the Enhanced ATT bearers, which accepts
+	// the channels in the Enhanced Credit Based Flow Control Mode only, on
+	// encrypted links only.
+	eatt bool
+
+	chAccept  chan *Channel
+	closeOnce sync.Once
+	chClosed  chan struct{}
+}
+
+// ListenChannel listens for the channels to the LE_PSM.
+func (h *HCI) ListenChannel(psm uint16) (*ChannelListener, error) {
+	if psm < psmFirst || psm > psmLast {
+		return nil, errors.Errorf("invalid LE_PSM 0x%04X", psm)
+	}
+	h.muListeners.Lock()
+	defer h.muListeners.Unlock()
+	if _, ok := h.listeners[psm]; ok {
+		return nil, errors.Errorf("LE_PSM 0x%04X is in use", psm)
+	}
+	l := &ChannelListener{
+		h:        h,
+		psm:      psm,
+		chAccept: make(chan *Channel, 16),
+		chClosed: make(chan struct{}),
+	}
+	h.listeners[psm] = l
+	return l, nil
+}
+
+// AcceptChannel waits for and returns the next channel to the listener.
+func (l *ChannelListener) AcceptChannel() (*Channel, error) {
+	select {
+	case ch := <-l.chAccept:
+		return ch, nil
+	case <-l.chClosed:
+		return nil, errors.Wrap(io.ErrClosedPipe, "listener closed")
+	case <-l.h.done:
+		return nil, l.h.Error()
+	}
+}
+
+// Accept waits for and returns the next channel to the listener.
+func (l *ChannelListener) Accept() (net.Conn, error) {
+	ch, err := l.AcceptChannel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// Close stops listening. The channels already accepted are not closed.
+func (l *ChannelListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.h.muListeners.Lock()
+		delete(l.h.listeners, l.psm)
+		l.h.muListeners.Unlock()
+		close(l.chClosed)
+	})
+	return nil
+}
+
+// mtu returns the MTU of the local endpoints of the channels accepted.
+func (l *ChannelListener) mtu() int {
+	if l.eatt {
+		return l.h.bearerMTU()
+	}
+	return l.h.chMTU
+}
+
+// Addr returns the address of the listener.
+func (l *ChannelListener) Addr() net.Addr { return ChannelAddr{l.h.Addr(), l.psm} }
+
+// OpenChannel opens a channel to the LE_PSM of the remote device.
+func (c *Conn) OpenChannel(psm uint16) (*Channel, error) {
+	if psm < psmFirst || psm > psmLast {
+		return nil, errors.Errorf("invalid LE_PSM 0x%04X", psm)
+	}
+	ch := newChannel(c, psm, c.hci.chMTU)
+	if err := c.addChannel(ch); err != nil {
+		return nil, err
+	}
+	req := &LECreditBasedConnectionRequest{
+		LEPSM:          psm,
+		SourceCID:      ch.scid,
+		MTU:            uint16(ch.rxMTU),
+		MPS:            uint16(ch.rxMPS),
+		InitialCredits: uint16(ch.rxCredits),
+	}
+	var rsp LECreditBasedConnectionResponse
+	if err := c.Signal(req, &rsp); err != nil {
+		c.removeChannel(ch)
+		return nil, errors.Wrap(err, "can't open channel")
+	}
+	if rsp.Result != cocSuccess {
+		c.removeChannel(ch)
+		return nil, ChannelError(rsp.Result)
+	}
+	ch.dcid = rsp.DestinationCID
+
+	// The channel is established, but it's disconnected, rather than used
+	// with the invalid parameters [Vol 3, Part A, 4.23].
+	var err error
+	switch {
+	case rsp.DestinationCID < cidDynamicFirst || rsp.DestinationCID > cidDynamicLast:
+		err = errors.Errorf("invalid Destination CID 0x%04X", rsp.DestinationCID)
+	case rsp.MTU < 23 || rsp.MPS < 23 || rsp.MPS > 65533:
+		err = errors.Errorf("invalid MTU %d and MPS %d", rsp.MTU, rsp.MPS)
+	}
+	if err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+	ch.txMTU, ch.txMPS = int(rsp.MTU), int(rsp.MPS)
+	ch.addCredits(int(rsp.InitialCreditsCID))
+	return ch, nil
+}
+
+// addChannel allocates a local CID to the channel, and registers it.
+func (c *Conn) addChannel(ch *Channel) error {
+	c.muChans.Lock()
+	defer c.muChans.Unlock()
+	for cid := cidDynamicFirst; cid <= cidDynamicLast; cid++ {
+		if _, ok := c.chans[cid]; !ok {
+			ch.scid = cid
+			c.chans[cid] = ch
+			c.setHandler(cid, func(p []byte) error {
+				ch.handlePDU(p)
+				return nil
+			})
+			return nil
+		}
+	}
+	return errors.New("no CID available")
+}
+
+func (c *Conn) removeChannel(ch *Channel) {
+	c.muChans.Lock()
+	defer c.muChans.Unlock()
+	if c.chans[ch.scid] == ch {
+		delete(c.chans, ch.scid)
+		c.setHandler(ch.scid, nil)
+	}
+}
+
+// closeChannels closes the channels of the disconnected connection locally.
+func (c *Conn) closeChannels() {
+	c.muChans.Lock()
+	chs := make([]*Channel, 0, len(c.chans))
+	for _, ch := range c.chans {
+		chs = append(chs, ch)
+	}
+	c.muChans.Unlock()
+	for _, ch := range chs {
+		ch.shutdown()
+	}
+}
+
+// channel returns the channel of the local CID.
+func (c *Conn) channel(cid uint16) *Channel {
+	c.muChans.Lock()
+	defer c.muChans.Unlock()
+	return c.chans[cid]
+}
+
+// channelByRemote returns the channel of the remote CID.
+func (c *Conn) channelByRemote(cid uint16) *Channel {
+	c.muChans.Lock()
+	defer c.muChans.Unlock()
+	for _, ch := range c.chans {
+		if ch.dcid == cid {
+			return ch
+		}
+	}
+	return nil
+}
+
+// handleLECreditBasedConnectionRequest implements LE Credit Based Connection
+// Request (0x14) [Vol 3, Part A, 4.22].
+func (c *Conn) handleLECreditBasedConnectionRequest(s sigCmd) {
+	var req LECreditBasedConnectionRequest
+	if err := req.Unmarshal(s.data()); err != nil {
+		return
+	}
+	reply := func(rsp *LECreditBasedConnectionResponse) {
+		if _, err := c.sendResponse(SignalLECreditBasedConnectionResponse, s.id(), rsp); err != nil {
+			_ = logger.Error("sig", "can't send response", err)
+		}
+	}
+	refuse := func(result uint16) {
+		reply(&LECreditBasedConnectionResponse{Result: result})
+	}
+
+	c.hci.muListeners.Lock()
+	l := c.hci.listeners[req.LEPSM]
+	c.hci.muListeners.Unlock()
+	switch {
+	case l == nil || l.eatt:
+		refuse(cocPSMNotSupported)
+		return
+	case req.SourceCID < cidDynamicFirst || req.SourceCID > cidDynamicLast:
+		refuse(cocInvalidSourceCID)
+		return
+	case c.channelByRemote(req.SourceCID) != nil:
+		refuse(cocSourceCIDAllocated)
+		return
+	case req.MTU < 23 || req.MPS < 23 || req.MPS > 65533:
+		refuse(cocUnacceptableParameter)
+		return
+	}
+
+	ch := newChannel(c, req.LEPSM, l.mtu())
+	ch.dcid = req.SourceCID
+	ch.txMTU, ch.txMPS = int(req.MTU), int(req.MPS)
+	ch.addCredits(int(req.InitialCredits))
+	if err := c.addChannel(ch); err != nil {
+		refuse(cocNoResources)
+		return
+	}
+	select {
+	case l.chAccept <- ch:
+	default:
+		// The application isn't accepting the channels.
+		c.removeChannel(ch)
+		refuse(cocNoResources)
+		return
+	}
+	reply(&LECreditBasedConnectionResponse{
+		DestinationCID:    ch.scid,
+		MTU:               uint16(ch.rxMTU),
+		MPS:               uint16(ch.rxMPS),
+		InitialCreditsCID: uint16(ch.rxCredits),
+		Result:            cocSuccess,
+	})
+}
+
+// handleLEFlowControlCredit implements LE Flow Control Credit (0x16)
+// [Vol 3, Part A, 4.24].
+func (c *Conn) handleLEFlowControlCredit(s sigCmd) {
+	var req LEFlowControlCredit
+	if err := req.Unmarshal(s.data()); err != nil {
+		return
+	}
+	ch := c.channelByRemote(req.CID)
+	if ch == nil {
+		return
+	}
+	if !ch.addCredits(int(req.Credits)) {
+		// The credit count exceeds 65535 [Vol 3, Part A, 10.1].
+		go ch.Close()
+	}
+}
+
+// handleDisconnectChannel disconnects the channel on the Disconnection Request
+// from the remote device. It returns false if there's no such channel.
+func (c *Conn) handleDisconnectChannel(s sigCmd, req *DisconnectRequest) bool {
+	ch := c.channel(req.DestinationCID)
+	if ch == nil {
+		return false
+	}
+	if ch.dcid == req.SourceCID {
+		c.sendResponse(
+			SignalDisconnectResponse,
+			s.id(),
+			&DisconnectResponse{
+				DestinationCID: req.DestinationCID,
+				SourceCID:      req.SourceCID,
+			})
+		ch.shutdown()
+	}
+	// Otherwise, silently discard the request [Vol 3, Part A, 4.6].
+	return true
+}
+
+// addCredits adds credits to send K-frames. It returns false if the credit
+// count exceeds the maximum.
+func (ch *Channel) addCredits(n int) bool {
+	ch.muCredits.Lock()
+	ch.txCredits += n
+	ok := ch.txCredits <= 65535
+	ch.muCredits.Unlock()
+	select {
+	case ch.chCredit <- struct{}{}:
+	default:
+	}
+	return ok
+}
+
+// takeCredit waits for and takes a credit to send a K-frame.
+func (ch *Channel) takeCredit() error {
+	for {
+		ch.muCredits.Lock()
+		if ch.txCredits > 0 {
+			ch.txCredits--
+			ch.muCredits.Unlock()
+			return nil
+		}
+		ch.muCredits.Unlock()
+		select {
+		case <-ch.chCredit:
+		case <-ch.chClosed:
+			return io.ErrClosedPipe
+		case <-ch.conn.chDone:
+			return io.ErrClosedPipe
+		case <-ch.wrDeadline.wait():
+			return timeoutError{}
+		}
+	}
+}
+
+// handlePDU reassembles the SDUs from the K-frames [Vol 3, Part A, 3.4.3].
+func (ch *Channel) handlePDU(p pdu) {
+	ch.muRx.Lock()
+	defer ch.muRx.Unlock()
+	b := p.payload()
+	if len(b) > ch.rxMPS || ch.rxCredits == 0 {
+		_ = logger.Warn("l2cap", "K-frame exceeds MPS or credits", ch.scid)
+		go ch.Close()
+		return
+	}
+	ch.rxCredits--
+	if ch.sdu == nil {
+		if len(b) < 2 {
+			go ch.Close()
+			return
+		}
+		n := int(binary.LittleEndian.Uint16(b))
+		if n > ch.rxMTU {
+			_ = logger.Warn("l2cap", "SDU exceeds MTU", ch.scid)
+			go ch.Close()
+			return
+		}
+		ch.sdu, ch.sduLen, ch.frames, b = ch.conn.hci.bufs.get(n)[:0], n, 0, b[2:]
+	}
+	if len(ch.sdu)+len(b) > ch.sduLen {
+		_ = logger.Warn("l2cap", "K-frames exceed SDU length", ch.scid)
+		go ch.Close()
+		return
+	}
+	ch.sdu = append(ch.sdu, b...)
+	ch.frames++
+	if len(ch.sdu) < ch.sduLen {
+		return
+	}
+	// The channel buffers at most as many SDUs as the credits given.
+	ch.chSDU <- rxSDU{ch.sdu, ch.frames}
+	ch.sdu = nil
+}
+
+// giveCredits gives the credits of the K-frames read back to the remote device.
+func (ch *Channel) giveCredits(n int) error {
+	ch.muRx.Lock()
+	ch.rxCredits += n
+	ch.muRx.Unlock()
+	_, err := ch.conn.sendResponse(
+		SignalLEFlowControlCredit,
+		ch.conn.newSigID(),
+		&LEFlowControlCredit{CID: ch.scid, Credits: uint16(n)})
+	return err
+}
+
+// Read reads the data of the SDUs received.
+func (ch *Channel) Read(b []byte) (int, error) {
+	ch.muRead.Lock()
+	defer ch.muRead.Unlock()
+	if len(ch.rd) == 0 {
+		select {
+		case s := <-ch.chSDU:
+			ch.rd, ch.rdBuf, ch.rdFrames = s.b, s.b, s.frames
+		default:
+			select {
+			case s := <-ch.chSDU:
+				ch.rd, ch.rdBuf, ch.rdFrames = s.b, s.b, s.frames
+			case <-ch.chClosed:
+				return 0, io.EOF
+			case <-ch.conn.chDone:
+				return 0, io.EOF
+			case <-ch.rdDeadline.wait():
+				return 0, timeoutError{}
+			}
+		}
+	}
+	n := copy(b, ch.rd)
+	ch.rd = ch.rd[n:]
+	if len(ch.rd) == 0 && ch.rdBuf != nil {
+		ch.conn.hci.bufs.put(ch.rdBuf)
+		ch.rdBuf = nil
+	}
+	if len(ch.rd) == 0 && ch.rdFrames > 0 {
+		if err := ch.giveCredits(ch.rdFrames); err != nil {
+			return n, err
+		}
+		ch.rdFrames = 0
+	}
+	return n, nil
+}
+
+// Write sends the data in SDUs of up to the MTU of the remote device, each of
+// which is segmented into K-frames of up to the MPS of it [Vol 3, Part A, 7.3.2].
+func (ch *Channel) Write(b []byte) (int, error) {
+	ch.muTx.Lock()
+	defer ch.muTx.Unlock()
+	n := 0
+	for len(b) > 0 {
+		mtu, mps := ch.txParams()
+		sdu := b
+		if len(sdu) > mtu {
+			sdu = sdu[:mtu]
+		}
+		if err := ch.writeSDU(sdu, mps); err != nil {
+			return n, err
+		}
+		n += len(sdu)
+		b = b[len(sdu):]
+	}
+	return n, nil
+}
+
+// txParams returns the MTU and the MPS of the remote endpoint.
+func (ch *Channel) txParams() (int, int) {
+	ch.muCredits.Lock()
+	defer ch.muCredits.Unlock()
+	return ch.txMTU, ch.txMPS
+}
+
+func (ch *Channel) writeSDU(sdu []byte, mps int) error {
+	for first := true; first || len(sdu) > 0; first = false {
+		if err := ch.takeCredit(); err != nil {
+			return err
+		}
+		hlen := 4
+		if first {
+			hlen = 6 // The first K-frame has the SDU length field.
+		}
+		plen := len(sdu)
+		if plen > mps-(hlen-4) {
+			plen = mps - (hlen - 4)
+		}
+		var hdr [6]byte
+		binary.LittleEndian.PutUint16(hdr[0:2], uint16(hlen-4+plen))
+		binary.LittleEndian.PutUint16(hdr[2:4], ch.dcid)
+		if first {
+			binary.LittleEndian.PutUint16(hdr[4:6], uint16(len(sdu)))
+		}
+		if _, err := ch.conn.writePDU(hdr[:hlen], sdu[:plen]); err != nil {
+			return err
+		}
+		sdu = sdu[plen:]
+	}
+	return nil
+}
+
+// shutdown closes the channel locally.
+func (ch *Channel) shutdown() bool {
+	closed := false
+	ch.closeOnce.Do(func() {
+		ch.conn.removeChannel(ch)
+		close(ch.chClosed)
+		closed = true
+	})
+	return closed
+}
+
+// Close disconnects the channel [Vol 3, Part A, 4.6].
+func (ch *Channel) Close() error {
+	if !ch.shutdown() {
+		return nil
+	}
+	select {
+	case <-ch.conn.chDone:
+		return nil
+	default:
+	}
+	req := &DisconnectRequest{DestinationCID: ch.dcid, SourceCID: ch.scid}
+	return ch.conn.Signal(req, &DisconnectResponse{})
+}
+
+// Conn returns the connection the channel is on.
+func (ch *Channel) Conn() *Conn { return ch.conn }
+
+// PSM returns the LE_PSM of the channel.
+func (ch *Channel) PSM() uint16 { return ch.psm }
+
+// RxMTU returns the MTU of the local endpoint.
+func (ch *Channel) RxMTU() int {
+	ch.muRx.Lock()
+	defer ch.muRx.Unlock()
+	return ch.rxMTU
+}
+
+// TxMTU returns the MTU of the remote endpoint.
+func (ch *Channel) TxMTU() int {
+	mtu, _ := ch.txParams()
+	return mtu
+}
+
+// LocalAddr returns the address of the local endpoint.
+func (ch *Channel) LocalAddr() net.Addr { return ChannelAddr{ch.conn.LocalAddr(), ch.psm} }
+
+// RemoteAddr returns the address of the remote endpoint.
+func (ch *Channel) RemoteAddr() net.Addr { return ChannelAddr{ch.conn.RemoteAddr(), ch.psm} }
+
+// SetDeadline sets the read and write deadlines of the channel.
+func (ch *Channel) SetDeadline(t time.Time) error {
+	ch.rdDeadline.set(t)
+	ch.wrDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for the reads.
+func (ch *Channel) SetReadDeadline(t time.Time) error {
+	ch.rdDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for the writes.
+func (ch *Channel) SetWriteDeadline(t time.Time) error {
+	ch.wrDeadline.set(t)
+	return nil
+}
+
+// deadline is a channel closed when the deadline is reached, which can be
+// waited on along with the other events.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline, and unblocks the waiters if it has passed. A zero t
+// clears the deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer callback to close it.
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel, which is closed when the deadline is reached.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
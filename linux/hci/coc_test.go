@@ -0,0 +1,65 @@
+package hci
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+)
+
+// signalCode returns the code of the LE signaling packet in the ACL data
+// packet, if it's one.
+func signalCode(p []byte) (byte, bool) {
+	if len(p) < 10 || binary.LittleEndian.Uint16(p[7:]) != cidLESignal {
+		return 0, false
+	}
+	return p[9], true
+}
+
+func TestOpenChannelInvalidResponse(t *testing.T) {
+	// The response carries the DCID at p[13:15], the MTU at p[15:17], and the
+	// MPS at p[17:19].
+	for _, tc := range []struct {
+		name string
+		off  int
+		v    uint16
+	}{
+		{"fixed DCID", 13, 0x0001},
+		{"DCID out of range", 13, cidDynamicLast + 1},
+		{"MTU", 15, 22},
+		{"MPS too small", 17, 22},
+		{"MPS too large", 17, 65534},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cm, cs := newPipePair(t, nil, nil)
+			l, err := cs.hci.ListenChannel(0x0080)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			var mu sync.Mutex
+			var disconnected bool
+			skt := cm.hci.skt.(*pipeSkt)
+			skt.link.setTap(func(from *pipeSkt, p []byte) {
+				code, ok := signalCode(p)
+				switch {
+				case !ok:
+				case code == SignalLECreditBasedConnectionResponse && from != skt:
+					binary.LittleEndian.PutUint16(p[tc.off:], tc.v)
+				case code == SignalDisconnectRequest && from == skt:
+					mu.Lock()
+					disconnected = true
+					mu.Unlock()
+				}
+			})
+			if ch, err := cm.OpenChannel(0x0080); err == nil {
+				t.Fatalf("channel opened with MTU %d and MPS %d", ch.txMTU, ch.txMPS)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !disconnected {
+				t.Error("channel not disconnected")
+			}
+		})
+	}
+}
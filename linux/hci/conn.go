@@ -1,12 +1,13 @@
 package hci
 
 import (
-	"bytes"
 	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/go-ble/ble"
 	"github.com/go-ble/ble/linux/hci/cmd"
@@ -16,11 +17,22 @@ import (
 
 // Conn ...
 type Conn struct {
-	hci *HCI
-	ctx context.Context
+	hci   *HCI
+	muCtx sync.Mutex
+	ctx   context.Context
 
 	param evt.LEConnectionComplete
 
+	// The type and the address, in little-endian, which the local device
+	// used when the connection was created.
+	localType uint8
+	local     [6]byte
+
+	// The identity address of the peer device, if its address is resolved.
+	// Otherwise, the address of the peer device.
+	peerType uint8
+	peer     [6]byte
+
 	// While MTU is the maximum size of payload data that the upper layer (ATT)
 	// can accept, the MPS is the maximum PDU payload size this L2CAP implementation
 	// supports. When segmantation is not used, the MPS should be made to the same
@@ -44,7 +56,11 @@ type Conn struct {
 	sigRxMTU int
 	sigTxMTU int
 
-	sigSent chan []byte
+	// sigPending receives the responses to the outstanding signaling
+	// requests, by their identifiers. It's guarded by muSig, along with
+	// sigTxMTU and sigID.
+	muSig      sync.Mutex
+	sigPending map[uint8]chan sigCmd
 	// smpSent chan []byte
 
 	chInPkt chan packet
@@ -52,8 +68,15 @@ type Conn struct {
 
 	chDone chan struct{}
 	// Host to Controller Data Flow Control pkt-based Data flow control for LE-U [Vol 2, Part E, 4.1.1]
-	// chSentBufs tracks the HCI buffer occupied by this connection.
+	// txBuffer tracks the HCI buffer occupied by this connection, and chTx
+	// serializes the PDUs sent.
 	txBuffer *Client
+	chTx     chan struct{}
+
+	// rdDeadline and wrDeadline bound the reads and the writes of the ATT
+	// channel.
+	rdDeadline deadline
+	wrDeadline deadline
 
 	// sigID is used to match responses with signaling requests.
 	// The requesting device sets this field and the responding device uses the
@@ -61,8 +84,34 @@ type Conn struct {
 	// Identifier shall be used for each successive command. [Vol 3, Part A, 4]
 	sigID uint8
 
+	// chans are the LE Credit Based Connection-Oriented Channels on the
+	// connection, by the local CIDs.
+	muChans sync.Mutex
+	chans   map[uint16]*Channel
+
+	// handlers handle the PDUs received on the channels of the connection,
+	// by the CIDs.
+	muHandlers sync.RWMutex
+	handlers   map[uint16]PDUHandler
+
+	// chBearers queues the Enhanced ATT bearers opened by the remote device.
+	chBearers chan *Channel
+
 	// leFrame is set to be true when the LE Credit based flow control is used.
 	leFrame bool
+
+	// smp handles pairing and key distribution on the SMP channel.
+	smp *smp
+
+	// Security properties of the link.
+	muSec         sync.RWMutex
+	encrypted     bool
+	authenticated bool
+	keySize       int
+
+	// chBonded is closed once the link is encrypted with the keys of the bond.
+	chBonded   chan struct{}
+	bondedOnce sync.Once
 }
 
 func newConn(h *HCI, param evt.LEConnectionComplete) *Conn {
@@ -79,12 +128,30 @@ func newConn(h *HCI, param evt.LEConnectionComplete) *Conn {
 		sigRxMTU: ble.MaxMTU,
 		sigTxMTU: ble.DefaultMTU,
 
-		chInPkt: make(chan packet, 16),
+		sigPending: make(map[uint8]chan sigCmd),
+
+		chans:     make(map[uint16]*Channel),
+		chBearers: make(chan *Channel, ecfcMaxChannels),
+
+		chInPkt: make(chan packet, h.inQueue()),
 		chInPDU: make(chan pdu, 16),
 
-		txBuffer: NewClient(h.pool),
+		txBuffer: newTxClient(h),
+		chTx:     make(chan struct{}, 1),
+
+		rdDeadline: makeDeadline(),
+		wrDeadline: makeDeadline(),
 
-		chDone: make(chan struct{}),
+		chDone:   make(chan struct{}),
+		chBonded: make(chan struct{}),
+	}
+	c.localType, c.local = h.own.current(h.addr)
+	c.peerType, c.peer, _ = h.res.resolve(param.PeerAddressType(), param.PeerAddress())
+	c.smp = newSMP(c)
+	c.handlers = map[uint16]PDUHandler{
+		cidLEAtt:    c.handleATT,
+		cidLESignal: func(p []byte) error { return c.handleSignal(p) },
+		cidSMP:      func(p []byte) error { return c.handleSMP(p) },
 	}
 
 	go func() {
@@ -96,6 +163,7 @@ func newConn(h *HCI, param evt.LEConnectionComplete) *Conn {
 					_ = logger.Error("recombine failed: ", "err", err)
 				}
 				close(c.chInPDU)
+				close(c.smp.chIn)
 				return
 			}
 		}
@@ -103,21 +171,93 @@ func newConn(h *HCI, param evt.LEConnectionComplete) *Conn {
 	return c
 }
 
+// TxStats are the metrics of the ACL data sent on a connection.
+type TxStats struct {
+	Queued   int    // PDUs being sent, or waiting to be sent.
+	InFlight int    // ACL data packets not completed by the controller yet.
+	Packets  uint64 // ACL data packets sent.
+	PDUs     uint64 // PDUs sent.
+	Dropped  uint64 // PDUs refused, as the queue was full.
+	Stalls   uint64 // Times waited for a buffer of the controller.
+}
+
+// newTxClient returns the client of the ACL data packet buffers, with the
+// limits set by SetTxLimits.
+func newTxClient(h *HCI) *Client {
+	c := NewClient(h.pool)
+	c.depth, c.limit = h.txDepth, h.txLimit
+	return c
+}
+
+// TxStats returns the metrics of the ACL data sent on the connection.
+func (c *Conn) TxStats() TxStats {
+	c.txBuffer.p.mu.Lock()
+	defer c.txBuffer.p.mu.Unlock()
+	return c.txBuffer.stats
+}
+
+// SetTxWeight sets the number of the ACL data packet buffers allotted to the
+// connection in a row, while other connections are waiting for them. It's 1
+// by default.
+func (c *Conn) SetTxWeight(w int) error {
+	if w < 1 {
+		return errors.Errorf("invalid weight %d", w)
+	}
+	c.txBuffer.p.mu.Lock()
+	defer c.txBuffer.p.mu.Unlock()
+	c.txBuffer.weight = w
+	return nil
+}
+
 // Context returns the context that is used by this Conn.
 func (c *Conn) Context() context.Context {
+	c.muCtx.Lock()
+	defer c.muCtx.Unlock()
 	return c.ctx
 }
 
-// SetContext sets the context that is used by this Conn.
+// SetContext sets the context that is used by this Conn. The reads and the
+// writes return the error of the context, once it's done.
 func (c *Conn) SetContext(ctx context.Context) {
+	c.muCtx.Lock()
+	defer c.muCtx.Unlock()
 	c.ctx = ctx
 }
 
+// SetDeadline sets the read and write deadlines of the Conn.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.rdDeadline.set(t)
+	c.wrDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for the reads. A read after the deadline
+// returns an error, whose Timeout method returns true. A zero t means no
+// deadline.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.rdDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for the writes. A write, which hasn't
+// started sending the SDU before the deadline, returns an error, whose Timeout
+// method returns true. A zero t means no deadline.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.wrDeadline.set(t)
+	return nil
+}
+
 // Read copies re-assembled L2CAP PDUs into sdu.
 func (c *Conn) Read(sdu []byte) (n int, err error) {
-	p, ok := <-c.chInPDU
-	if !ok {
-		return 0, errors.Wrap(io.ErrClosedPipe, "input channel closed")
+	return c.ReadContext(c.Context(), sdu)
+}
+
+// ReadContext is like Read, but it returns the error of ctx, instead of the
+// one of the context of the Conn, once it's done.
+func (c *Conn) ReadContext(ctx context.Context, sdu []byte) (n int, err error) {
+	p, err := c.nextPDU(ctx)
+	if err != nil {
+		return 0, err
 	}
 	if len(p) == 0 {
 		return 0, errors.Wrap(io.ErrUnexpectedEOF, "received empty packet")
@@ -132,104 +272,166 @@ func (c *Conn) Read(sdu []byte) (n int, err error) {
 		data = leFrameHdr(p).payload()
 	}
 	if cap(sdu) < slen {
+		c.hci.bufs.put(p)
 		return 0, errors.Wrapf(io.ErrShortBuffer, "payload received exceeds sdu buffer")
 	}
-	buf := bytes.NewBuffer(sdu)
-	buf.Reset()
-	buf.Write(data)
-	for buf.Len() < slen {
-		p := <-c.chInPDU
-		buf.Write(p.payload())
+	sdu = sdu[:cap(sdu)]
+	n = copy(sdu, data)
+	c.hci.bufs.put(p)
+	for n < slen {
+		p, err := c.nextPDU(ctx)
+		if err != nil {
+			return n, err
+		}
+		n += copy(sdu[n:], p.payload())
+		c.hci.bufs.put(p)
 	}
 	return slen, nil
 }
 
+// nextPDU waits for the next PDU of the ATT channel, until the read deadline
+// or ctx is done.
+func (c *Conn) nextPDU(ctx context.Context) (pdu, error) {
+	var p pdu
+	var ok bool
+	select {
+	case p, ok = <-c.chInPDU:
+	default:
+		select {
+		case p, ok = <-c.chInPDU:
+		case <-c.rdDeadline.wait():
+			return nil, timeoutError{}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if !ok {
+		return nil, errors.Wrap(io.ErrClosedPipe, "input channel closed")
+	}
+	return p, nil
+}
+
 // Write breaks down a L2CAP SDU into segmants [Vol 3, Part A, 7.3.1]
 func (c *Conn) Write(sdu []byte) (int, error) {
+	return c.WriteContext(c.Context(), sdu)
+}
+
+// WriteContext is like Write, but it returns the error of ctx, instead of the
+// one of the context of the Conn, if ctx is done before the SDU is sent.
+func (c *Conn) WriteContext(ctx context.Context, sdu []byte) (int, error) {
 	if len(sdu) > c.txMTU {
 		return 0, errors.Wrap(io.ErrShortWrite, "payload exceeds mtu")
 	}
 
-	plen := len(sdu)
-	if plen > c.txMTU {
-		plen = c.txMTU
-	}
-	b := make([]byte, 4+plen)
-	binary.LittleEndian.PutUint16(b[0:2], uint16(len(sdu)))
-	binary.LittleEndian.PutUint16(b[2:4], cidLEAtt)
+	// The header is copied into the ACL packets along with the SDU, so it
+	// isn't allocated for each SDU.
+	var hdr [6]byte
+	hlen := 4
 	if c.leFrame {
-		binary.LittleEndian.PutUint16(b[4:6], uint16(len(sdu)))
-		copy(b[6:], sdu)
-	} else {
-		copy(b[4:], sdu)
+		hlen = 6
+		binary.LittleEndian.PutUint16(hdr[4:6], uint16(len(sdu)))
 	}
-	sent, err := c.writePDU(b)
-	if err != nil {
-		return sent, err
+	binary.LittleEndian.PutUint16(hdr[0:2], uint16(hlen-4+len(sdu)))
+	binary.LittleEndian.PutUint16(hdr[2:4], cidLEAtt)
+	return c.writePDUContext(ctx, &c.wrDeadline, hdr[:hlen], sdu)
+}
+
+// writePDU breaks down a L2CAP PDU, which is the header followed by the
+// payload, into fragments if it's larger than the HCI buffer size. [Vol 3, Part A, 7.2.1]
+// The PDUs of different connections are interleaved, as the buffers are
+// allotted to the connections in turn.
+func (c *Conn) writePDU(hdr, payload []byte) (int, error) {
+	return c.writePDUContext(nil, nil, hdr, payload)
+}
+
+// writePDUContext is like writePDU, but it gives up if ctx is done, or the
+// deadline dl is reached, before the PDU starts to be sent. Either can be nil.
+// Once started, the PDU is sent as a whole.
+func (c *Conn) writePDUContext(ctx context.Context, dl *deadline, hdr, payload []byte) (sent int, err error) {
+	if !c.txBuffer.queue() {
+		return 0, ErrTxQueueFull
 	}
-	sdu = sdu[plen:]
+	defer func() { c.txBuffer.dequeue(err == nil) }()
 
-	for len(sdu) > 0 {
-		plen := len(sdu)
-		if plen > c.txMTU {
-			plen = c.txMTU
-		}
-		n, err := c.writePDU(sdu[:plen])
-		sent += n
-		if err != nil {
-			return sent, err
-		}
-		sdu = sdu[plen:]
+	var done, expired <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	if dl != nil {
+		expired = dl.wait()
+	}
+
+	select {
+	case <-done:
+		return 0, ctx.Err()
+	case <-expired:
+		return 0, timeoutError{}
+	default:
 	}
-	return sent, nil
-}
 
-// writePDU breaks down a L2CAP PDU into fragments if it's larger than the HCI buffer size. [Vol 3, Part A, 7.2.1]
-func (c *Conn) writePDU(pdu []byte) (int, error) {
-	sent := 0
 	flags := uint16(pbfHostToControllerStart << 4) // ACL boundary flags
 
 	// All L2CAP fragments associated with an L2CAP PDU shall be processed for
 	// transmission by the Controller before any other L2CAP PDU for the same
 	// logical transport shall be processed.
-	c.txBuffer.LockPool()
-	defer c.txBuffer.UnlockPool()
+	select {
+	case c.chTx <- struct{}{}:
+	case <-c.chDone:
+		return 0, io.ErrClosedPipe
+	case <-done:
+		return 0, ctx.Err()
+	case <-expired:
+		return 0, timeoutError{}
+	}
+	defer func() { <-c.chTx }()
 
 	// Fail immediately if the connection is already closed
-	// Check this with the pool locked to avoid race conditions
-	// with handleDisconnectionComplete
 	select {
 	case <-c.chDone:
 		return 0, io.ErrClosedPipe
 	default:
 	}
 
-	for len(pdu) > 0 {
+	for len(hdr)+len(payload) > 0 {
 		// Get a buffer from our pre-allocated and flow-controlled pool.
-		pkt := c.txBuffer.Get() // ACL pkt
-		flen := len(pdu)        // fragment length
+		// It's nil, if the connection is closed while waiting for it, or
+		// the write is given up before the first fragment.
+		pkt := c.txBuffer.get(done, expired) // ACL pkt
+		if pkt == nil {
+			select {
+			case <-c.chDone:
+				return sent, io.ErrClosedPipe
+			case <-done:
+				return sent, ctx.Err()
+			default:
+				return sent, timeoutError{}
+			}
+		}
+		done, expired = nil, nil
+		flen := len(hdr) + len(payload) // fragment length
 		if flen > pkt.Cap()-1-4 {
 			flen = pkt.Cap() - 1 - 4
 		}
 
 		// Prepare the Headers
+		var h [5]byte
 
 		// HCI Header: pkt Type
-		if err := binary.Write(pkt, binary.LittleEndian, pktTypeACLData); err != nil {
-			return 0, err
-		}
+		h[0] = pktTypeACLData
 		// ACL Header: handle and flags
-		if err := binary.Write(pkt, binary.LittleEndian, c.param.ConnectionHandle()|(flags<<8)); err != nil {
-			return 0, err
-		}
+		binary.LittleEndian.PutUint16(h[1:3], c.param.ConnectionHandle()|(flags<<8))
 		// ACL Header: data len
-		if err := binary.Write(pkt, binary.LittleEndian, uint16(flen)); err != nil {
-			return 0, err
-		}
-		// Append payload
-		if err := binary.Write(pkt, binary.LittleEndian, pdu[:flen]); err != nil {
-			return 0, err
+		binary.LittleEndian.PutUint16(h[3:5], uint16(flen))
+		pkt.Write(h[:])
+
+		// Append the rest of the L2CAP header, and then the payload.
+		n := flen
+		if n > len(hdr) {
+			n = len(hdr)
 		}
+		pkt.Write(hdr[:n])
+		pkt.Write(payload[:flen-n])
+		hdr, payload = hdr[n:], payload[flen-n:]
 
 		// Flush the pkt to HCI
 		select {
@@ -244,7 +446,6 @@ func (c *Conn) writePDU(pdu []byte) (int, error) {
 		sent += flen
 
 		flags = (pbfContinuing << 4) // Set "continuing" in the boundary flags for the rest of fragments, if any.
-		pdu = pdu[flen:]             // Advence the point
 	}
 	return sent, nil
 }
@@ -266,32 +467,107 @@ func (c *Conn) recombine() error {
 	}
 
 	// If this pkt is not a complete PDU, and we'll be receiving more
-	// fragments, re-allocate the whole PDU (including Header).
+	// fragments, re-combine the whole PDU (including Header) in a buffer from
+	// the pool. Otherwise, the PDU is handled in the buffer of the pkt.
+	buf := []byte(pkt)
+	n := 1 // The number of the packets.
 	if len(p.payload()) < p.dlen() {
-		p = make([]byte, 0, 4+p.dlen())
-		p = append(p, pdu(pkt.data())...)
-	}
-	for len(p) < 4+p.dlen() {
-		if pkt, ok = <-c.chInPkt; !ok || (pkt.pbf()&pbfContinuing) == 0 {
-			return io.ErrUnexpectedEOF
+		buf = append(c.hci.bufs.get(4 + p.dlen())[:0], p...)
+		c.hci.bufs.put(pkt)
+		for len(buf) < 4+pdu(buf).dlen() {
+			if pkt, ok = <-c.chInPkt; !ok || (pkt.pbf()&pbfContinuing) == 0 {
+				return io.ErrUnexpectedEOF
+			}
+			buf = append(buf, pkt.data()...)
+			c.hci.bufs.put(pkt)
+			n++
 		}
-		p = append(p, pdu(pkt.data())...)
+		p = pdu(buf)
 	}
+	defer c.hci.bufs.put(buf)
 
-	// TODO: support dynamic or assigned channels for LE-Frames.
-	switch p.cid() {
-	case cidLEAtt:
-		c.chInPDU <- p
-	case cidLESignal:
-		c.handleSignal(p)
-	case cidSMP:
-		c.handleSMP(p)
-	default:
+	// The packets are completed once the PDU is handled, which may wait for
+	// the upper layer to consume the PDUs received earlier.
+	defer c.hci.completePackets(c.param.ConnectionHandle(), n)
+
+	c.muHandlers.RLock()
+	f := c.handlers[p.cid()]
+	c.muHandlers.RUnlock()
+	if f == nil {
 		logger.Info("recombine()", "unrecognized CID", fmt.Sprintf("%04X, [%X]", p.cid(), p))
+		return nil
+	}
+	if err := f(p); err != nil {
+		_ = logger.Error("recombine()", "handle PDU", fmt.Sprintf("%04X, %v", p.cid(), err))
 	}
 	return nil
 }
 
+// A PDUHandler handles the PDUs received on an L2CAP channel. The PDU is a
+// complete B-frame, including the Basic L2CAP header [Vol 3, Part A, 3.1].
+// It's called from the goroutine receiving the PDUs of the connection, and
+// shouldn't block. The PDU is only valid until the handler returns, as its
+// buffer is reused for the PDUs received later.
+type PDUHandler func(p []byte) error
+
+// HandleFixedChannel registers the handler of the PDUs received on the fixed
+// channel of the CID [Vol 3, Part A, 2.1]. The channels of ATT, the signaling
+// and SMP are handled by the Conn. A nil handler unregisters the one of the
+// CID, which must be done before replacing it.
+func (c *Conn) HandleFixedChannel(cid uint16, f PDUHandler) error {
+	if cid == 0x0000 || cid >= cidDynamicFirst {
+		return errors.Errorf("invalid fixed channel CID 0x%04X", cid)
+	}
+	c.muHandlers.Lock()
+	defer c.muHandlers.Unlock()
+	if f == nil {
+		delete(c.handlers, cid)
+		return nil
+	}
+	if _, ok := c.handlers[cid]; ok {
+		return errors.Errorf("fixed channel 0x%04X is already handled", cid)
+	}
+	c.handlers[cid] = f
+	return nil
+}
+
+// WriteFixedChannel sends the payload in a B-frame on the fixed channel of
+// the CID. The payload isn't segmented, and can't exceed 65535 bytes.
+func (c *Conn) WriteFixedChannel(cid uint16, b []byte) error {
+	if cid == 0x0000 || cid >= cidDynamicFirst {
+		return errors.Errorf("invalid fixed channel CID 0x%04X", cid)
+	}
+	if len(b) > 0xFFFF {
+		return errors.Wrap(io.ErrShortWrite, "payload exceeds the B-frame")
+	}
+	var hdr [4]byte
+	binary.LittleEndian.PutUint16(hdr[0:2], uint16(len(b)))
+	binary.LittleEndian.PutUint16(hdr[2:4], cid)
+	_, err := c.writePDU(hdr[:], b)
+	return err
+}
+
+// setHandler registers the handler of the channel of the CID, or unregisters
+// it if f is nil.
+func (c *Conn) setHandler(cid uint16, f PDUHandler) {
+	c.muHandlers.Lock()
+	defer c.muHandlers.Unlock()
+	if f == nil {
+		delete(c.handlers, cid)
+		return
+	}
+	c.handlers[cid] = f
+}
+
+// handleATT passes the PDUs of the ATT channel to Read, which puts their
+// buffers back to the pool.
+func (c *Conn) handleATT(p []byte) error {
+	b := c.hci.bufs.get(len(p))
+	copy(b, p)
+	c.chInPDU <- b
+	return nil
+}
+
 // Disconnected returns a receiving channel, which is closed when the connection disconnects.
 func (c *Conn) Disconnected() <-chan struct{} {
 	return c.chDone
@@ -312,8 +588,9 @@ func (c *Conn) Close() error {
 	}
 }
 
-// LocalAddr returns local device's MAC address.
-func (c *Conn) LocalAddr() ble.Addr { return c.hci.Addr() }
+// LocalAddr returns the device address, which the local device used when the
+// connection was created.
+func (c *Conn) LocalAddr() ble.Addr { return addrOf(c.localType, c.local) }
 
 // RemoteAddr returns remote device's MAC address.
 func (c *Conn) RemoteAddr() ble.Addr {
@@ -321,6 +598,11 @@ func (c *Conn) RemoteAddr() ble.Addr {
 	return net.HardwareAddr([]byte{a[5], a[4], a[3], a[2], a[1], a[0]})
 }
 
+// IdentityAddr returns the identity address of the remote device, if it's known
+// from pairing, or its resolvable private address is resolved. Otherwise, it
+// returns the same address as RemoteAddr.
+func (c *Conn) IdentityAddr() ble.Addr { return addrOf(c.identity()) }
+
 // RxMTU returns the MTU which the upper layer is capable of accepting.
 func (c *Conn) RxMTU() int { return c.rxMTU }
 
@@ -0,0 +1,95 @@
+package hci
+
+import (
+	"io"
+	"testing"
+
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/hci/evt"
+)
+
+// benchSkt is a socket, which discards the packets written, and returns the
+// packet rx for each read, as if the controller received it over and over.
+type benchSkt struct {
+	c    *Conn
+	rx   []byte
+	done chan struct{}
+}
+
+func (s *benchSkt) Read(b []byte) (int, error) {
+	if s.rx == nil {
+		<-s.done
+	}
+	select {
+	case <-s.done:
+		return 0, io.EOF
+	default:
+		return copy(b, s.rx), nil
+	}
+}
+
+func (s *benchSkt) Write(b []byte) (int, error) {
+	// The controller completes the packet right away.
+	s.c.txBuffer.Put()
+	return len(b), nil
+}
+
+func (s *benchSkt) Close() error { return nil }
+
+// newBenchConn returns a connection of the handle 0x0040 on an HCI, whose
+// socket is skt.
+func newBenchConn(b *testing.B, skt *benchSkt) *Conn {
+	h, err := NewHCI()
+	if err != nil {
+		b.Fatal(err)
+	}
+	h.skt = skt
+	h.pool = NewPool(1+4+27, 8)
+	param := evt.LEConnectionComplete([]byte{
+		0x01, 0x00, 0x40, 0x00, roleSlave, 0x00, 1, 2, 3, 4, 5, 6,
+		0x06, 0x00, 0x00, 0x00, 0x48, 0x00, 0x00,
+	})
+	c := newConn(h, param)
+	skt.c = c
+	h.conns[0x0040] = c
+	go h.sktLoop()
+	return c
+}
+
+// BenchmarkConnWrite measures sending a notification, which is fragmented
+// into 2 ACL packets.
+func BenchmarkConnWrite(b *testing.B) {
+	skt := &benchSkt{done: make(chan struct{})}
+	defer close(skt.done)
+	c := newBenchConn(b, skt)
+	ntf := make([]byte, 3+20)
+	ntf[0] = 0x1B // Handle Value Notification
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Write(ntf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkConnRead measures receiving a notification in an ACL packet.
+func BenchmarkConnRead(b *testing.B) {
+	rx := []byte{
+		pktTypeACLData, 0x40, pbfControllerToHostStart << 4, 4 + 3 + 20, 0x00, // HCI and ACL headers.
+		3 + 20, 0x00, byte(cidLEAtt), 0x00, // L2CAP header.
+		0x1B, 0x10, 0x00, // Handle Value Notification of the handle 0x0010.
+	}
+	rx = append(rx, make([]byte, 20)...)
+	skt := &benchSkt{rx: rx, done: make(chan struct{})}
+	defer close(skt.done)
+	c := newBenchConn(b, skt)
+	buf := make([]byte, ble.DefaultMTU)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if n, err := c.Read(buf); err != nil || n != 3+20 {
+			b.Fatal(n, err)
+		}
+	}
+}
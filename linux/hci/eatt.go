@@ -0,0 +1,120 @@
+package hci
+
+import (
+	"context"
+
+	"github.com/go-ble/ble"
+	"github.com/pkg/errors"
+)
+
+// psmEATT is the SPSM of the Enhanced ATT bearers [Assigned Numbers, 2.4].
+const psmEATT = 0x0027
+
+// bearer is an Enhanced ATT bearer [Vol 3, Part F, 3.2.11], which implements
+// ble.Conn with a channel in the Enhanced Credit Based Flow Control Mode.
+type bearer struct {
+	*Channel
+}
+
+// Context returns the context of the connection.
+func (b bearer) Context() context.Context { return b.conn.Context() }
+
+// SetContext sets the context of the connection.
+func (b bearer) SetContext(ctx context.Context) { b.conn.SetContext(ctx) }
+
+// LocalAddr returns the address of the local device.
+func (b bearer) LocalAddr() ble.Addr { return b.conn.LocalAddr() }
+
+// RemoteAddr returns the address of the remote device.
+func (b bearer) RemoteAddr() ble.Addr { return b.conn.RemoteAddr() }
+
+// RxMTU returns the ATT_MTU of the bearer, which is the smaller of the MTUs
+// of the endpoints of the channel [Vol 3, Part F, 3.2.8].
+func (b bearer) RxMTU() int { return b.mtu() }
+
+// TxMTU returns the ATT_MTU of the bearer.
+func (b bearer) TxMTU() int { return b.mtu() }
+
+// SetRxMTU does nothing, since the ATT_MTU of the bearer is set by L2CAP.
+func (b bearer) SetRxMTU(mtu int) {}
+
+// SetTxMTU does nothing, since the ATT_MTU of the bearer is set by L2CAP.
+func (b bearer) SetTxMTU(mtu int) {}
+
+// Disconnected returns a receiving channel, which is closed when the bearer
+// is closed, or the connection disconnects.
+func (b bearer) Disconnected() <-chan struct{} { return b.chClosed }
+
+func (b bearer) mtu() int {
+	rx, tx := b.Channel.RxMTU(), b.Channel.TxMTU()
+	if tx < rx {
+		return tx
+	}
+	return rx
+}
+
+// bearerMTU returns the MTU of the local endpoints of the bearers, which is
+// at most the maximum ATT_MTU.
+func (h *HCI) bearerMTU() int {
+	if h.chMTU > ble.MaxMTU {
+		return ble.MaxMTU
+	}
+	return h.chMTU
+}
+
+// initBearers listens for the Enhanced ATT bearers, if they're enabled.
+func (h *HCI) initBearers() error {
+	if h.eatt == 0 {
+		return nil
+	}
+	l, err := h.ListenChannel(psmEATT)
+	if err != nil {
+		return errors.Wrap(err, "can't listen for enhanced ATT bearers")
+	}
+	l.eatt = true
+	go h.acceptBearers(l)
+	return nil
+}
+
+// acceptBearers passes the bearers accepted to their connections.
+func (h *HCI) acceptBearers(l *ChannelListener) {
+	for {
+		ch, err := l.AcceptChannel()
+		if err != nil {
+			return
+		}
+		select {
+		case ch.conn.chBearers <- ch:
+		default:
+			_ = logger.Warn("eatt", "too many pending bearers", ch.scid)
+			go ch.Close()
+		}
+	}
+}
+
+// OpenBearers opens up to n Enhanced ATT bearers to the GATT server of the
+// remote device, which can be added to a GATT client. The link must be
+// encrypted.
+func (c *Conn) OpenBearers(n int) ([]ble.Conn, error) {
+	chs, err := c.openChannels(psmEATT, n, c.hci.bearerMTU())
+	if err != nil {
+		return nil, errors.Wrap(err, "can't open bearers")
+	}
+	bs := make([]ble.Conn, len(chs))
+	for i, ch := range chs {
+		bs[i] = bearer{ch}
+	}
+	return bs, nil
+}
+
+// AcceptBearer waits for and returns the next Enhanced ATT bearer, which the
+// GATT client of the remote device opens, so the ATT server of the connection
+// can serve it. The bearers are accepted only if they're enabled with SetEATT.
+func (c *Conn) AcceptBearer() (ble.Conn, error) {
+	select {
+	case ch := <-c.chBearers:
+		return bearer{ch}, nil
+	case <-c.chDone:
+		return nil, ErrDisconnected
+	}
+}
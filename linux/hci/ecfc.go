@@ -0,0 +1,284 @@
+package hci
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Limits of the Enhanced Credit Based Flow Control Mode [Vol 3, Part A, 4.25].
+const (
+	ecfcMaxChannels = 5
+	ecfcMinMTU      = 64
+	ecfcMinMPS      = 64
+	ecfcMaxMPS      = 65533
+)
+
+// Results of Credit Based Reconfigure Response [Vol 3, Part A, 4.28].
+const (
+	reconfSuccess            = 0x0000
+	reconfMTUReduced         = 0x0001
+	reconfMPSReduced         = 0x0002
+	reconfInvalidCID         = 0x0003
+	reconfUnacceptableParams = 0x0004
+)
+
+var reconfResultName = map[uint16]string{
+	reconfMTUReduced:         "reduction in size of MTU not allowed",
+	reconfMPSReduced:         "reduction in size of MPS not allowed for more than one channel",
+	reconfInvalidCID:         "one or more Destination CIDs invalid",
+	reconfUnacceptableParams: "other unacceptable parameters",
+}
+
+// OpenChannels opens up to n channels to the SPSM of the remote device at
+// once, using the Enhanced Credit Based Flow Control Mode [Vol 3, Part A, 10.2].
+// It returns the channels opened, which may be fewer than n, if the remote
+// device refuses some of them. It returns an error, if all are refused.
+func (c *Conn) OpenChannels(psm uint16, n int) ([]*Channel, error) {
+	if psm < psmFirst || psm > psmLast {
+		return nil, errors.Errorf("invalid SPSM 0x%04X", psm)
+	}
+	return c.openChannels(psm, n, c.hci.chMTU)
+}
+
+// openChannels opens up to n channels, whose local endpoints have the MTU.
+func (c *Conn) openChannels(psm uint16, n int, mtu int) ([]*Channel, error) {
+	if n < 1 || n > ecfcMaxChannels {
+		return nil, errors.Errorf("invalid number of channels %d", n)
+	}
+	if mtu < ecfcMinMTU || c.hci.chMPS < ecfcMinMPS {
+		return nil, errors.Errorf("MTU and MPS must be at least %d", ecfcMinMTU)
+	}
+
+	chs := make([]*Channel, 0, n)
+	req := &CreditBasedConnectionRequest{SPSM: psm}
+	for i := 0; i < n; i++ {
+		ch := newChannel(c, psm, mtu)
+		ch.enhanced = true
+		if err := c.addChannel(ch); err != nil {
+			for _, ch := range chs {
+				c.removeChannel(ch)
+			}
+			return nil, err
+		}
+		chs = append(chs, ch)
+		req.SourceCID = append(req.SourceCID, ch.scid)
+	}
+	req.MTU, req.MPS = uint16(chs[0].rxMTU), uint16(chs[0].rxMPS)
+	req.InitialCredits = uint16(chs[0].rxCredits)
+
+	var rsp CreditBasedConnectionResponse
+	if err := c.Signal(req, &rsp); err != nil {
+		for _, ch := range chs {
+			c.removeChannel(ch)
+		}
+		return nil, errors.Wrap(err, "can't open channels")
+	}
+
+	// The Destination CIDs are in the order of the Source CIDs, and are 0x0000
+	// for the channels refused [Vol 3, Part A, 4.26].
+	var opened []*Channel
+	for i, ch := range chs {
+		if i >= len(rsp.DestinationCID) || rsp.DestinationCID[i] == 0x0000 {
+			c.removeChannel(ch)
+			continue
+		}
+		ch.dcid = rsp.DestinationCID[i]
+		ch.txMTU, ch.txMPS = int(rsp.MTU), int(rsp.MPS)
+		ch.addCredits(int(rsp.InitialCredits))
+		opened = append(opened, ch)
+	}
+	if len(opened) == 0 {
+		result := rsp.Result
+		if result == cocSuccess {
+			result = cocNoResources
+		}
+		return nil, ChannelError(result)
+	}
+	if rsp.Result != cocSuccess {
+		_ = logger.Warn("l2cap", "some channels refused", ChannelError(rsp.Result))
+	}
+	return opened, nil
+}
+
+// ReconfigureChannels increases the MTU, and changes the MPS of the local
+// endpoints of the channels, which are opened with OpenChannels or accepted
+// from a Credit Based Connection Request [Vol 3, Part A, 4.27]. The MPS can be
+// decreased only if a single channel is reconfigured.
+func (c *Conn) ReconfigureChannels(mtu, mps int, chs ...*Channel) error {
+	switch {
+	case len(chs) < 1 || len(chs) > ecfcMaxChannels:
+		return errors.Errorf("invalid number of channels %d", len(chs))
+	case mtu < ecfcMinMTU || mtu > 65535:
+		return errors.Errorf("invalid MTU %d", mtu)
+	case mps < ecfcMinMPS || mps > ecfcMaxMPS:
+		return errors.Errorf("invalid MPS %d", mps)
+	case c.hci.chCredits < (mtu+2+mps-1)/mps:
+		return errors.Errorf("%d credits can't carry an SDU of MTU %d", c.hci.chCredits, mtu)
+	}
+	req := &CreditBasedReconfigureRequest{MTU: uint16(mtu), MPS: uint16(mps)}
+	for _, ch := range chs {
+		if ch.conn != c || !ch.enhanced {
+			return errors.Errorf("channel 0x%04X can't be reconfigured", ch.scid)
+		}
+		ch.muRx.Lock()
+		rxMTU, rxMPS := ch.rxMTU, ch.rxMPS
+		ch.muRx.Unlock()
+		if mtu < rxMTU {
+			return errors.Errorf("MTU can't be reduced from %d", rxMTU)
+		}
+		if mps < rxMPS && len(chs) > 1 {
+			return errors.New("MPS can't be reduced for more than one channel")
+		}
+		req.DestinationCID = append(req.DestinationCID, ch.scid)
+	}
+
+	// Be ready to receive the SDUs of the new MTU, and the K-frames of the old
+	// MPS until the remote device responds.
+	old := make([][2]int, len(chs))
+	for i, ch := range chs {
+		ch.muRx.Lock()
+		old[i] = [2]int{ch.rxMTU, ch.rxMPS}
+		ch.rxMTU = mtu
+		if mps > ch.rxMPS {
+			ch.rxMPS = mps
+		}
+		ch.muRx.Unlock()
+	}
+	var rsp CreditBasedReconfigureResponse
+	err := c.Signal(req, &rsp)
+	if err == nil && rsp.Result != reconfSuccess {
+		err = errors.Errorf("l2cap: reconfiguration failed: %s", reconfResultName[rsp.Result])
+	}
+	for i, ch := range chs {
+		ch.muRx.Lock()
+		if err != nil {
+			ch.rxMTU, ch.rxMPS = old[i][0], old[i][1]
+		} else {
+			ch.rxMPS = mps
+		}
+		ch.muRx.Unlock()
+	}
+	return errors.Wrap(err, "can't reconfigure channels")
+}
+
+// handleCreditBasedConnectionRequest implements Credit Based Connection
+// Request (0x17) [Vol 3, Part A, 4.25].
+func (c *Conn) handleCreditBasedConnectionRequest(s sigCmd) {
+	var req CreditBasedConnectionRequest
+	if err := req.Unmarshal(s.data()); err != nil {
+		return
+	}
+	// The response carries no more Destination CIDs than the channels that
+	// can be requested, even if the request is refused for carrying more.
+	n := len(req.SourceCID)
+	if n > ecfcMaxChannels {
+		n = ecfcMaxChannels
+	}
+	rsp := &CreditBasedConnectionResponse{
+		DestinationCID: make([]uint16, n),
+	}
+	defer func() {
+		if _, err := c.sendResponse(SignalCreditBasedConnectionResponse, s.id(), rsp); err != nil {
+			_ = logger.Error("sig", "can't send response", err)
+		}
+	}()
+
+	c.hci.muListeners.Lock()
+	l := c.hci.listeners[req.SPSM]
+	c.hci.muListeners.Unlock()
+	switch {
+	case len(req.SourceCID) < 1 || len(req.SourceCID) > ecfcMaxChannels,
+		req.MTU < ecfcMinMTU || req.MPS < ecfcMinMPS || req.MPS > ecfcMaxMPS:
+		rsp.Result = cocInvalidParameters
+		return
+	case l == nil:
+		rsp.Result = cocPSMNotSupported
+		return
+	case l.eatt && !c.Encrypted():
+		rsp.Result = cocInsuffEncryption
+		return
+	}
+
+	// Accept each channel, and report the reason of the first refusal.
+	refuse := func(result uint16) {
+		if rsp.Result == cocSuccess {
+			rsp.Result = result
+		}
+	}
+	for i, scid := range req.SourceCID {
+		switch {
+		case scid < cidDynamicFirst || scid > cidDynamicLast:
+			refuse(cocInvalidSourceCID)
+			continue
+		case c.channelByRemote(scid) != nil:
+			refuse(cocSourceCIDAllocated)
+			continue
+		}
+		ch := newChannel(c, req.SPSM, l.mtu())
+		ch.enhanced = true
+		ch.dcid = scid
+		ch.txMTU, ch.txMPS = int(req.MTU), int(req.MPS)
+		ch.addCredits(int(req.InitialCredits))
+		if err := c.addChannel(ch); err != nil {
+			refuse(cocNoResources)
+			continue
+		}
+		select {
+		case l.chAccept <- ch:
+		default:
+			// The application isn't accepting the channels.
+			c.removeChannel(ch)
+			refuse(cocNoResources)
+			continue
+		}
+		rsp.DestinationCID[i] = ch.scid
+		rsp.MTU, rsp.MPS = uint16(ch.rxMTU), uint16(ch.rxMPS)
+		rsp.InitialCredits = uint16(ch.rxCredits)
+	}
+}
+
+// handleCreditBasedReconfigureRequest implements Credit Based Reconfigure
+// Request (0x19) [Vol 3, Part A, 4.27].
+func (c *Conn) handleCreditBasedReconfigureRequest(s sigCmd) {
+	var req CreditBasedReconfigureRequest
+	if err := req.Unmarshal(s.data()); err != nil {
+		return
+	}
+	rsp := &CreditBasedReconfigureResponse{Result: reconfSuccess}
+	defer func() {
+		if _, err := c.sendResponse(SignalCreditBasedReconfigureResponse, s.id(), rsp); err != nil {
+			_ = logger.Error("sig", "can't send response", err)
+		}
+	}()
+
+	if len(req.DestinationCID) < 1 || len(req.DestinationCID) > ecfcMaxChannels ||
+		req.MTU < ecfcMinMTU || req.MPS < ecfcMinMPS || req.MPS > ecfcMaxMPS {
+		rsp.Result = reconfUnacceptableParams
+		return
+	}
+	// The Destination CIDs are the endpoints on the remote device.
+	chs := make([]*Channel, 0, len(req.DestinationCID))
+	for _, cid := range req.DestinationCID {
+		ch := c.channelByRemote(cid)
+		if ch == nil || !ch.enhanced {
+			rsp.Result = reconfInvalidCID
+			return
+		}
+		chs = append(chs, ch)
+	}
+	for _, ch := range chs {
+		mtu, mps := ch.txParams()
+		if int(req.MTU) < mtu {
+			rsp.Result = reconfMTUReduced
+			return
+		}
+		if int(req.MPS) < mps && len(chs) > 1 {
+			rsp.Result = reconfMPSReduced
+			return
+		}
+	}
+	for _, ch := range chs {
+		ch.muCredits.Lock()
+		ch.txMTU, ch.txMPS = int(req.MTU), int(req.MPS)
+		ch.muCredits.Unlock()
+	}
+}
@@ -0,0 +1,44 @@
+package hci
+
+import (
+	"testing"
+
+	"github.com/go-ble/ble"
+)
+
+func TestCreditBasedConnectionTooManyChannels(t *testing.T) {
+	cm, cs := newPipePair(t, nil, nil)
+	l, err := cs.hci.ListenChannel(0x0080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The request doesn't fit in the default MTUsig, but does in the one of
+	// the slave.
+	cm.muSig.Lock()
+	cm.sigTxMTU = ble.MaxMTU
+	cm.muSig.Unlock()
+	req := &CreditBasedConnectionRequest{
+		SPSM:           0x0080,
+		MTU:            ecfcMinMTU,
+		MPS:            ecfcMinMPS,
+		InitialCredits: 1,
+		SourceCID:      []uint16{0x40, 0x41, 0x42, 0x43, 0x44, 0x45},
+	}
+	var rsp CreditBasedConnectionResponse
+	if err := cm.Signal(req, &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Result != cocInvalidParameters {
+		t.Errorf("result 0x%04X, want 0x%04X", rsp.Result, cocInvalidParameters)
+	}
+	if len(rsp.DestinationCID) != ecfcMaxChannels {
+		t.Errorf("%d Destination CIDs, want %d", len(rsp.DestinationCID), ecfcMaxChannels)
+	}
+	for i, cid := range rsp.DestinationCID {
+		if cid != 0 {
+			t.Errorf("Destination CID %d: 0x%04X, want 0", i, cid)
+		}
+	}
+}
@@ -9,6 +9,7 @@ var (
 	ErrBusyDialing     = errors.New("busy dialing")
 	ErrBusyListening   = errors.New("busy listening")
 	ErrInvalidAddr     = errors.New("invalid address")
+	ErrTxQueueFull     = errors.New("transmit queue full")
 )
 
 // HCI Command Errors  [Vol2, Part D, 1.3 ]
@@ -159,3 +160,54 @@ var errCmd = map[ErrCommand]string{
 	0x3F: "MAC Connection Failed",
 	0x40: "Coarse Clock Adjustment Rejected but Will Try to Adjust Using Clock Dragging",
 }
+
+// SMP errors
+var (
+	ErrDisconnected = errors.New("disconnected")
+	ErrSMPTimeout   = errors.New("smp timeout")
+)
+
+// Pairing Failed reasons [Vol 3, Part H, 3.5.5].
+const (
+	ErrSMPPasskeyEntryFailed         SMPError = 0x01 // Passkey Entry Failed
+	ErrSMPOOBNotAvailable            SMPError = 0x02 // OOB Not Available
+	ErrSMPAuthenticationRequirements SMPError = 0x03 // Authentication Requirements
+	ErrSMPConfirmValueFailed         SMPError = 0x04 // Confirm Value Failed
+	ErrSMPPairingNotSupported        SMPError = 0x05 // Pairing Not Supported
+	ErrSMPEncryptionKeySize          SMPError = 0x06 // Encryption Key Size
+	ErrSMPCommandNotSupported        SMPError = 0x07 // Command Not Supported
+	ErrSMPUnspecified                SMPError = 0x08 // Unspecified Reason
+	ErrSMPRepeatedAttempts           SMPError = 0x09 // Repeated Attempts
+	ErrSMPInvalidParameters          SMPError = 0x0A // Invalid Parameters
+	ErrSMPDHKeyCheckFailed           SMPError = 0x0B // DHKey Check Failed
+	ErrSMPNumericComparisonFailed    SMPError = 0x0C // Numeric Comparison Failed
+	ErrSMPBREDRPairingInProgress     SMPError = 0x0D // BR/EDR pairing in progress
+	ErrSMPCrossTransportNotAllowed   SMPError = 0x0E // Cross-transport Key Derivation/Generation not allowed
+)
+
+// SMPError is the reason of a failed pairing [Vol 3, Part H, 3.5.5].
+type SMPError byte
+
+func (e SMPError) Error() string {
+	if s, ok := errSMP[e]; ok {
+		return "pairing failed: " + s
+	}
+	return "pairing failed: reserved reason"
+}
+
+var errSMP = map[SMPError]string{
+	0x01: "Passkey Entry Failed",
+	0x02: "OOB Not Available",
+	0x03: "Authentication Requirements",
+	0x04: "Confirm Value Failed",
+	0x05: "Pairing Not Supported",
+	0x06: "Encryption Key Size",
+	0x07: "Command Not Supported",
+	0x08: "Unspecified Reason",
+	0x09: "Repeated Attempts",
+	0x0A: "Invalid Parameters",
+	0x0B: "DHKey Check Failed",
+	0x0C: "Numeric Comparison Failed",
+	0x0D: "BR/EDR pairing in progress",
+	0x0E: "Cross-transport Key Derivation/Generation not allowed",
+}
@@ -0,0 +1,137 @@
+package hci
+
+import (
+	"sync"
+
+	"github.com/go-ble/ble/linux/hci/cmd"
+)
+
+const (
+	// DefaultHostBuffers is the number of the ACL data packets, which the
+	// host buffers by default.
+	DefaultHostBuffers = 64
+
+	// hostACLDataLen is the maximum data length of the ACL data packets,
+	// which fit in the buffer of sktLoop.
+	hostACLDataLen = 4096 - 1 - 4
+
+	// hostMaxHandles is the maximum number of handles, which a Host Number
+	// Of Completed Packets command can carry.
+	hostMaxHandles = (255 - 1) / 4
+)
+
+// hostFlow implements the flow control of the ACL data packets from the
+// controller to the host [Vol 2, Part E, 4.2]. The controller sends at most
+// bufs packets, which the host hasn't reported as completed yet. The packets
+// are completed once they're handled by the upper layers, and reported in
+// batches.
+type hostFlow struct {
+	sync.Mutex
+	bufs    int
+	enabled bool
+
+	// pending are the completed packets not reported yet, by the handles.
+	pending map[uint16]int
+	total   int
+
+	// cmd and b are reused by the reports.
+	cmd cmd.HostNumberOfCompletedPackets
+	b   [4 + 255]byte
+}
+
+// initHostFlow enables the host flow control, if the host buffers are set.
+// The host works without it, if the controller doesn't support it.
+func (h *HCI) initHostFlow() {
+	f := &h.flow
+	f.Lock()
+	bufs := f.bufs
+	f.Unlock()
+	if bufs == 0 {
+		return
+	}
+	err := h.Send(&cmd.HostBufferSize{
+		HostACLDataPacketLength:    hostACLDataLen,
+		HostTotalNumACLDataPackets: uint16(bufs),
+	}, nil)
+	if err == nil {
+		err = h.Send(&cmd.SetControllerToHostFlowControl{FlowControlEnable: 0x01}, nil)
+	}
+	if err != nil {
+		_ = logger.Warn("flow", "host flow control is not available", err)
+		return
+	}
+	f.Lock()
+	f.enabled = true
+	f.pending = make(map[uint16]int)
+	f.Unlock()
+}
+
+// inQueue returns the size of the queue of the ACL data packets received on a
+// connection, which holds all the packets the controller sends, if the host
+// flow control is enabled. So handling them never blocks sktLoop.
+func (h *HCI) inQueue() int {
+	f := &h.flow
+	f.Lock()
+	defer f.Unlock()
+	if f.enabled && f.bufs > 16 {
+		return f.bufs
+	}
+	return 16
+}
+
+// completePackets completes n ACL data packets received on the connection of
+// the handle. They're reported to the controller, once a quarter of the host
+// buffers are completed.
+func (h *HCI) completePackets(handle uint16, n int) {
+	f := &h.flow
+	f.Lock()
+	defer f.Unlock()
+	if !f.enabled || n == 0 {
+		return
+	}
+	f.pending[handle] += n
+	f.total += n
+	if f.total < f.bufs/4 {
+		return
+	}
+
+	c := &f.cmd
+	c.ConnectionHandle = c.ConnectionHandle[:0]
+	c.HostNumOfCompletedPackets = c.HostNumOfCompletedPackets[:0]
+	for handle, n := range f.pending {
+		if n == 0 || len(c.ConnectionHandle) == hostMaxHandles {
+			continue
+		}
+		c.ConnectionHandle = append(c.ConnectionHandle, handle)
+		c.HostNumOfCompletedPackets = append(c.HostNumOfCompletedPackets, uint16(n))
+		f.pending[handle] = 0
+		f.total -= n
+	}
+
+	// The command is sent regardless of the command flow control, and the
+	// controller doesn't respond to it normally [Vol 2, Part E, 7.3.40].
+	b := f.b[:4+c.Len()]
+	b[0] = pktTypeCommand
+	b[1], b[2] = byte(c.OpCode()), byte(c.OpCode()>>8)
+	b[3] = byte(c.Len())
+	if err := c.Marshal(b[4:]); err != nil {
+		_ = logger.Error("flow", "can't marshal completed packets", err)
+		return
+	}
+	if _, err := h.skt.Write(b); err != nil {
+		_ = logger.Error("flow", "can't report completed packets", err)
+	}
+}
+
+// forgetPackets forgets the completed packets of a disconnected handle, which
+// the controller considers reported [Vol 2, Part E, 4.3].
+func (h *HCI) forgetPackets(handle uint16) {
+	f := &h.flow
+	f.Lock()
+	defer f.Unlock()
+	if !f.enabled {
+		return
+	}
+	f.total -= f.pending[handle]
+	delete(f.pending, handle)
+}
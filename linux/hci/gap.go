@@ -12,8 +12,9 @@ import (
 	"github.com/pkg/errors"
 )
 
-// Addr ...
-func (h *HCI) Addr() ble.Addr { return h.addr }
+// Addr returns the device address currently used by the local device, which
+// is a random address, if a static or private address is used.
+func (h *HCI) Addr() ble.Addr { return addrOf(h.own.current(h.addr)) }
 
 // SetAdvHandler ...
 func (h *HCI) SetAdvHandler(ah ble.AdvHandler) error {
@@ -23,6 +24,8 @@ func (h *HCI) SetAdvHandler(ah ble.AdvHandler) error {
 
 // Scan starts scanning.
 func (h *HCI) Scan(allowDup bool) error {
+	h.own.op.RLock()
+	defer h.own.op.RUnlock()
 	h.params.scanEnable.FilterDuplicates = 1
 	if allowDup {
 		h.params.scanEnable.FilterDuplicates = 0
@@ -35,6 +38,8 @@ func (h *HCI) Scan(allowDup bool) error {
 
 // StopScanning stops scanning.
 func (h *HCI) StopScanning() error {
+	h.own.op.RLock()
+	defer h.own.op.RUnlock()
 	h.params.scanEnable.LEScanEnable = 0
 	return h.Send(&h.params.scanEnable, nil)
 }
@@ -172,8 +177,16 @@ func (h *HCI) AdvertiseIBeacon(u ble.UUID, major, minor uint16, pwr int8) error
 
 // StopAdvertising stops advertising.
 func (h *HCI) StopAdvertising() error {
+	h.own.op.RLock()
+	defer h.own.op.RUnlock()
+	h.params.Lock()
 	h.params.advEnable.AdvertisingEnable = 0
-	return h.Send(&h.params.advEnable, nil)
+	h.params.Unlock()
+	err := h.Send(&h.params.advEnable, nil)
+	if err == nil {
+		h.setAdvertising(false)
+	}
+	return err
 }
 
 // Accept starts advertising and accepts connection.
@@ -184,7 +197,7 @@ func (h *HCI) Accept() (ble.Conn, error) {
 	}
 	select {
 	case <-h.done:
-		return nil, h.err
+		return nil, h.Error()
 	case c := <-h.chSlaveConn:
 		return c, nil
 	case <-tmo:
@@ -198,10 +211,30 @@ func (h *HCI) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
 	if err != nil {
 		return nil, ErrInvalidAddr
 	}
-	h.params.connParams.PeerAddress = [6]byte{b[5], b[4], b[3], b[2], b[1], b[0]}
+	typ, addr := uint8(0x00), [6]byte{b[5], b[4], b[3], b[2], b[1], b[0]}
 	if _, ok := a.(RandomAddress); ok {
-		h.params.connParams.PeerAddressType = 1
+		typ = 0x01
+	}
+
+	// Connect to the device of an identity address with the address it's
+	// currently using, which the controller resolves if it can. Otherwise,
+	// find an advertisement from the device first.
+	if id, ok := h.res.lookup(typ, addr); ok {
+		h.res.Lock()
+		controller := h.res.controller
+		h.res.Unlock()
+		if controller {
+			typ |= 0x02 // Public or Random (static) Identity Address [Vol 2, Part E, 7.8.12]
+		} else if typ, addr, err = h.find(ctx, id); err != nil {
+			return nil, errors.Wrap(err, "can't find device of identity address")
+		}
 	}
+	h.params.connParams.PeerAddressType = typ
+	h.params.connParams.PeerAddress = addr
+
+	// Hold the random address until the connection is created or canceled.
+	h.own.op.RLock()
+	defer h.own.op.RUnlock()
 	if err = h.Send(&h.params.connParams, nil); err != nil {
 		return nil, err
 	}
@@ -216,9 +249,9 @@ func (h *HCI) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
 	case <-tmo:
 		return h.cancelDial()
 	case <-h.done:
-		return nil, h.err
+		return nil, h.Error()
 	case c := <-h.chMasterConn:
-		return gatt.NewClient(c)
+		return h.newClient(c)
 
 	}
 }
@@ -233,15 +266,66 @@ func (h *HCI) cancelDial() (ble.Client, error) {
 	// The connection has been established, the cancel command
 	// failed with ErrDisallowed.
 	if err == ErrDisallowed {
-		return gatt.NewClient(<-h.chMasterConn)
+		return h.newClient(<-h.chMasterConn)
 	}
 	return nil, errors.Wrap(err, "cancel connection failed")
 }
 
+// newClient encrypts the link with the bonded keys, if the peer device is
+// bonded, and returns a GATT client of the connection.
+func (h *HCI) newClient(c *Conn) (ble.Client, error) {
+	if b := c.bond(); b != nil {
+		if err := c.encryptBonded(b); err != nil {
+			// The peer device might have lost the bond. Leave the link
+			// unencrypted, and let the user pair again if needed.
+			_ = logger.Error("dial", "can't encrypt with bonded keys", err)
+		}
+	}
+	cln, err := gatt.NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+	if h.eatt > 0 && c.Encrypted() {
+		bs, err := c.OpenBearers(h.eatt)
+		if err != nil {
+			_ = logger.Warn("dial", "can't open enhanced ATT bearers", err)
+		}
+		for _, b := range bs {
+			if err := cln.AddBearer(b); err != nil {
+				_ = logger.Error("dial", "can't add enhanced ATT bearer", err)
+				b.Close()
+			}
+		}
+	}
+	if h.keyProvider != nil {
+		cln.SetKeyProvider(h.keyProvider)
+	}
+	if h.signer != nil {
+		cln.SetSigningKeyProvider(h.signer)
+	}
+	return cln, nil
+}
+
 // Advertise starts advertising.
 func (h *HCI) Advertise() error {
+	h.own.op.RLock()
+	defer h.own.op.RUnlock()
+	h.params.Lock()
 	h.params.advEnable.AdvertisingEnable = 1
-	return h.Send(&h.params.advEnable, nil)
+	h.params.Unlock()
+	err := h.Send(&h.params.advEnable, nil)
+	if err == nil {
+		h.setAdvertising(true)
+	}
+	return err
+}
+
+// setAdvertising records whether advertising is enabled on the controller,
+// which differs from the requested state while a connection is accepted.
+func (h *HCI) setAdvertising(on bool) {
+	h.params.Lock()
+	h.params.advertising = on
+	h.params.Unlock()
 }
 
 // SetAdvertisement sets advertising data and scanResp.
@@ -10,6 +10,9 @@ import (
 	"time"
 
 	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/att"
+	"github.com/go-ble/ble/linux/crypto"
+	"github.com/go-ble/ble/linux/gatt"
 	"github.com/go-ble/ble/linux/hci/cmd"
 	"github.com/go-ble/ble/linux/hci/evt"
 	"github.com/go-ble/ble/linux/hci/socket"
@@ -46,6 +49,7 @@ func NewHCI(opts ...ble.Option) (*HCI, error) {
 		muSent:    &sync.Mutex{},
 
 		evth: map[int]handlerFn{},
+		bufs: newBufPool(),
 		subh: map[int]handlerFn{},
 
 		muConns:      &sync.Mutex{},
@@ -53,9 +57,26 @@ func NewHCI(opts ...ble.Option) (*HCI, error) {
 		chMasterConn: make(chan *Conn),
 		chSlaveConn:  make(chan *Conn),
 
+		muListeners: &sync.Mutex{},
+		listeners:   make(map[uint16]*ChannelListener),
+		chMTU:       DefaultChannelMTU,
+		chMPS:       DefaultChannelMPS,
+		chCredits:   DefaultChannelCredits,
+
 		done: make(chan bool),
 	}
 	h.params.init()
+	h.smp.init()
+	h.flow.bufs = DefaultHostBuffers
+	irk, err := crypto.Default.Rand16()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't generate IRK")
+	}
+	h.irk = irk
+	h.bonds = NewMemoryBondStore()
+	h.res.src = bondIRKs{h}
+	h.signer = &bondSigner{}
+	h.toolbox = crypto.Default
 	if err := h.Option(opts...); err != nil {
 		return nil, errors.Wrap(err, "can't set options")
 	}
@@ -69,6 +90,42 @@ type HCI struct {
 
 	params params
 
+	// smp holds the local pairing features, and irk is the Identity
+	// Resolving Key distributed in pairing.
+	smp    smpParams
+	irk    [16]byte
+	irkSet bool // irk is set with SetIRK.
+
+	// own manages the device address of the local device, and res resolves
+	// the addresses of the peer devices.
+	own ownAddr
+	res resolver
+
+	// bonds persists the keys of bonded peer devices.
+	bonds BondStore
+
+	// keyProvider supplies the keys to raise the security of the links of
+	// the GATT clients, if set.
+	keyProvider gatt.KeyProvider
+
+	// signer supplies the keys for signing and verifying Signed Write Commands.
+	signer att.SigningKeyProvider
+
+	// listeners accept the LE Credit Based Connection-Oriented Channels
+	// to their LE_PSMs, and the channels are opened with the parameters.
+	muListeners *sync.Mutex
+	listeners   map[uint16]*ChannelListener
+	chMTU       int
+	chMPS       int
+	chCredits   int
+
+	// eatt is the number of the Enhanced ATT bearers the GATT clients open.
+	// The bearers opened by the remote clients are accepted, if it's set.
+	eatt int
+
+	// toolbox implements the security functions used in pairing.
+	toolbox *crypto.Toolbox
+
 	skt io.ReadWriteCloser
 	id  int
 
@@ -105,6 +162,17 @@ type HCI struct {
 	// Minimum 27 bytes. 4 bytes of L2CAP Header, and 23 bytes Payload from upper layer (ATT)
 	pool *Pool
 
+	// txDepth and txLimit are the limits of the PDUs queued, and the buffers
+	// held by each connection. Zero means no limit.
+	txDepth int
+	txLimit int
+
+	// bufs recycles the buffers of the ACL data path.
+	bufs bufPool
+
+	// flow reports the ACL data packets handled by the host.
+	flow hostFlow
+
 	// L2CAP connections
 	muConns      *sync.Mutex
 	conns        map[uint16]*Conn
@@ -117,8 +185,10 @@ type HCI struct {
 	dialerTmo   time.Duration
 	listenerTmo time.Duration
 
-	err  error
-	done chan bool
+	// err is the error which failed the HCI, or the last event handler.
+	muErr sync.Mutex
+	err   error
+	done  chan bool
 }
 
 // Init ...
@@ -128,16 +198,16 @@ func (h *HCI) Init() error {
 	h.evth[evt.CommandStatusCode] = h.handleCommandStatus
 	h.evth[evt.DisconnectionCompleteCode] = h.handleDisconnectionComplete
 	h.evth[evt.NumberOfCompletedPacketsCode] = h.handleNumberOfCompletedPackets
+	h.evth[evt.EncryptionChangeCode] = h.handleEncryptionChange
+	h.evth[evt.EncryptionKeyRefreshCompleteCode] = h.handleEncryptionKeyRefreshComplete
 
 	h.subh[evt.LEAdvertisingReportSubCode] = h.handleLEAdvertisingReport
 	h.subh[evt.LEConnectionCompleteSubCode] = h.handleLEConnectionComplete
 	h.subh[evt.LEConnectionUpdateCompleteSubCode] = h.handleLEConnectionUpdateComplete
 	h.subh[evt.LELongTermKeyRequestSubCode] = h.handleLELongTermKeyRequest
-	// evt.EncryptionChangeCode:                     todo),
 	// evt.ReadRemoteVersionInformationCompleteCode: todo),
 	// evt.HardwareErrorCode:                        todo),
 	// evt.DataBufferOverflowCode:                   todo),
-	// evt.EncryptionKeyRefreshCompleteCode:         todo),
 	// evt.AuthenticatedPayloadTimeoutExpiredCode:   todo),
 	// evt.LEReadRemoteUsedFeaturesCompleteSubCode:   todo),
 	// evt.LERemoteConnectionParameterRequestSubCode: todo),
@@ -154,11 +224,22 @@ func (h *HCI) Init() error {
 	if err := h.init(); err != nil {
 		return err
 	}
+	h.initHostFlow()
 
 	// Pre-allocate buffers with additional head room for lower layer headers.
 	// HCI header (1 Byte) + ACL Data Header (4 bytes) + L2CAP PDU (or fragment)
 	h.pool = NewPool(1+4+h.bufSize, h.bufCnt-1)
 
+	if err := h.initIdentity(); err != nil {
+		return err
+	}
+	if err := h.initAddress(); err != nil {
+		return err
+	}
+	h.initResolvingList()
+	if err := h.initBearers(); err != nil {
+		return err
+	}
 	h.Send(&h.params.advParams, nil)
 	h.Send(&h.params.scanParams, nil)
 	return nil
@@ -171,9 +252,18 @@ func (h *HCI) Close() error {
 
 // Error ...
 func (h *HCI) Error() error {
+	h.muErr.Lock()
+	defer h.muErr.Unlock()
 	return h.err
 }
 
+// setErr sets the error returned by Error.
+func (h *HCI) setErr(err error) {
+	h.muErr.Lock()
+	h.err = err
+	h.muErr.Unlock()
+}
+
 // Option sets the options specified.
 func (h *HCI) Option(opts ...ble.Option) error {
 	var err error
@@ -222,7 +312,7 @@ func (h *HCI) init() error {
 	WriteLEHostSupportRP := cmd.WriteLEHostSupportRP{}
 	h.Send(&cmd.WriteLEHostSupport{LESupportedHost: 1, SimultaneousLEHost: 0}, &WriteLEHostSupportRP)
 
-	return h.err
+	return h.Error()
 }
 
 // Send ...
@@ -241,8 +331,8 @@ func (h *HCI) Send(c Command, r CommandRP) error {
 }
 
 func (h *HCI) send(c Command) ([]byte, error) {
-	if h.err != nil {
-		return nil, h.err
+	if err := h.Error(); err != nil {
+		return nil, err
 	}
 	p := &pkt{c, make(chan []byte)}
 	b := <-h.chCmdBufs
@@ -275,7 +365,7 @@ func (h *HCI) send(c Command) ([]byte, error) {
 		err = fmt.Errorf("hci: no response to command, hci connection failed")
 		ret = nil
 	case <-h.done:
-		err = h.err
+		err = h.Error()
 		ret = nil
 	case b := <-p.done:
 		err = nil
@@ -300,12 +390,20 @@ func (h *HCI) sktLoop() {
 		n, err := h.skt.Read(b)
 		if n == 0 || err != nil {
 			if err == io.EOF {
-				h.err = err //callers depend on detecting io.EOF, don't wrap it.
+				h.setErr(err) //callers depend on detecting io.EOF, don't wrap it.
 			} else {
-				h.err = fmt.Errorf("skt: %s", err)
+				h.setErr(fmt.Errorf("skt: %s", err))
 			}
 			return
 		}
+		if b[0] == pktTypeACLData {
+			// The ACL data packets are passed in the buffers from the pool,
+			// which the connections put back once they're handled.
+			p := h.bufs.get(n - 1)
+			copy(p, b[1:n])
+			_ = h.handleACL(p)
+			continue
+		}
 		p := make([]byte, n)
 		copy(p, b)
 		if err := h.handlePkt(p); err != nil {
@@ -322,7 +420,7 @@ func (h *HCI) sktLoop() {
 }
 
 func (h *HCI) close(err error) error {
-	h.err = err
+	h.setErr(err)
 	if h.skt != nil {
 		return h.skt.Close()
 	}
@@ -355,6 +453,8 @@ func (h *HCI) handleACL(b []byte) error {
 	h.muConns.Unlock()
 	if !ok {
 		_ = logger.Warn("invalid connection handle on ACL packet", "handle", handle)
+		h.bufs.put(b)
+		h.completePackets(handle, 1)
 		return nil
 	}
 	c.chInPkt <- b
@@ -372,10 +472,10 @@ func (h *HCI) handleEvt(b []byte) error {
 		}
 	}
 	if plen != len(b[2:]) {
-		h.err = fmt.Errorf("invalid event packet: % X", b)
+		h.setErr(fmt.Errorf("invalid event packet: % X", b))
 	}
 	if f := h.evth[code]; f != nil {
-		h.err = f(b[2:])
+		h.setErr(f(b[2:]))
 		return nil
 	}
 	if code == 0xff { // Ignore vendor events
@@ -393,11 +493,16 @@ func (h *HCI) handleLEMeta(b []byte) error {
 }
 
 func (h *HCI) handleLEAdvertisingReport(b []byte) error {
-	if h.advHandler == nil {
+	e := evt.LEAdvertisingReport(b)
+	for i := 0; i < int(e.NumReports()); i++ {
+		if t := e.EventType(i); t == evtTypAdvInd || t == evtTypAdvDirectInd {
+			h.res.found(e.AddressType(i), e.Address(i))
+		}
+	}
+	if h.advHandler == nil || h.adHist == nil {
 		return nil
 	}
 
-	e := evt.LEAdvertisingReport(b)
 	for i := 0; i < int(e.NumReports()); i++ {
 		var a *Advertisement
 		switch e.EventType(i) {
@@ -432,6 +537,7 @@ func (h *HCI) handleLEAdvertisingReport(b []byte) error {
 		default:
 			a = newAdvertisement(e, i)
 		}
+		a.res = &h.res
 		go h.advHandler(a)
 	}
 
@@ -493,7 +599,6 @@ func (h *HCI) handleLEConnectionComplete(b []byte) error {
 		return nil
 	}
 	if e.Status() == 0x00 {
-		h.chSlaveConn <- c
 		// When a controller accepts a connection, it moves from advertising
 		// state to idle/ready state. Host needs to explicitly ask the
 		// controller to re-enable advertising. Note that the host was most
@@ -503,11 +608,13 @@ func (h *HCI) handleLEConnectionComplete(b []byte) error {
 		// The re-enabling might failed or ignored by the controller, if
 		// it had reached the maximum number of concurrent connections.
 		// So we also re-enable the advertising when a connection disconnected
-		h.params.RLock()
+		h.params.Lock()
+		h.params.advertising = false
 		if h.params.advEnable.AdvertisingEnable == 1 {
-			go h.Send(&cmd.LESetAdvertiseEnable{0}, nil)
+			go h.Send(&cmd.LESetAdvertiseEnable{AdvertisingEnable: 0}, nil)
 		}
-		h.params.RUnlock()
+		h.params.Unlock()
+		h.chSlaveConn <- c
 	}
 	if h.connectedHandler != nil {
 		h.connectedHandler(e)
@@ -515,6 +622,19 @@ func (h *HCI) handleLEConnectionComplete(b []byte) error {
 	return nil
 }
 
+// resumeAdvertising re-enables advertising after a connection, unless it has
+// been stopped since.
+func (h *HCI) resumeAdvertising() {
+	h.own.op.RLock()
+	defer h.own.op.RUnlock()
+	h.params.RLock()
+	adv := h.params.advEnable.AdvertisingEnable == 1
+	h.params.RUnlock()
+	if adv && h.Send(&h.params.advEnable, nil) == nil {
+		h.setAdvertising(true)
+	}
+}
+
 func (h *HCI) handleLEConnectionUpdateComplete(b []byte) error {
 	return nil
 }
@@ -529,30 +649,26 @@ func (h *HCI) handleDisconnectionComplete(b []byte) error {
 		return fmt.Errorf("disconnecting an invalid handle %04X", e.ConnectionHandle())
 	}
 	close(c.chInPkt)
+	close(c.chDone)
+	h.forgetPackets(e.ConnectionHandle())
+	c.closeChannels()
+	if s, ok := h.signer.(*bondSigner); ok {
+		s.forget(c, true)
+	}
 
 	if c.param.Role() == roleSlave {
 		// Re-enable advertising, if it was advertising. Refer to the
 		// handleLEConnectionComplete() for details.
 		// This may failed with ErrCommandDisallowed, if the controller
 		// was actually in advertising state. It does no harm though.
-		h.params.RLock()
-		if h.params.advEnable.AdvertisingEnable == 1 {
-			go h.Send(&h.params.advEnable, nil)
-		}
-		h.params.RUnlock()
-	} else {
-		// remote peripheral disconnected
-		close(c.chDone)
+		go h.resumeAdvertising()
 	}
 	// When a connection disconnects, all the sent packets and weren't acked yet
 	// will be recycled. [Vol2, Part E 4.1.1]
 	//
-	// must be done with the pool locked to avoid race conditions where
-	// writePDU is in progress and does a Get from the pool after this completes,
-	// leaking a buffer from the main pool.
-	c.txBuffer.LockPool()
+	// The client is closed as well, so a writePDU in progress doesn't Get a
+	// buffer from the pool after this completes, leaking it from the pool.
 	c.txBuffer.PutAll()
-	c.txBuffer.UnlockPool()
 	if h.disconnectedHandler != nil {
 		h.disconnectedHandler(e)
 	}
@@ -579,9 +695,42 @@ func (h *HCI) handleNumberOfCompletedPackets(b []byte) error {
 
 func (h *HCI) handleLELongTermKeyRequest(b []byte) error {
 	e := evt.LELongTermKeyRequest(b)
-	return h.Send(&cmd.LELongTermKeyRequestNegativeReply{
-		ConnectionHandle: e.ConnectionHandle(),
-	}, nil)
+	h.muConns.Lock()
+	c, found := h.conns[e.ConnectionHandle()]
+	h.muConns.Unlock()
+	if !found {
+		// Don't block the sktLoop, which delivers the command complete.
+		go h.Send(&cmd.LELongTermKeyRequestNegativeReply{
+			ConnectionHandle: e.ConnectionHandle(),
+		}, nil)
+		return nil
+	}
+	go c.handleLongTermKeyRequest(e.EncryptionDiversifier(), e.RandomNumber())
+	return nil
+}
+
+func (h *HCI) handleEncryptionChange(b []byte) error {
+	e := evt.EncryptionChange(b)
+	h.muConns.Lock()
+	c, found := h.conns[e.ConnectionHandle()]
+	h.muConns.Unlock()
+	if !found {
+		return nil
+	}
+	c.handleEncryptionChange(e.Status(), e.EncryptionEnabled() != 0)
+	return nil
+}
+
+func (h *HCI) handleEncryptionKeyRefreshComplete(b []byte) error {
+	e := evt.EncryptionKeyRefreshComplete(b)
+	h.muConns.Lock()
+	c, found := h.conns[e.ConnectionHandle()]
+	h.muConns.Unlock()
+	if !found {
+		return nil
+	}
+	c.handleEncryptionChange(e.Status(), true)
+	return nil
 }
 
 func (h *HCI) setAllowedCommands(n int) {
@@ -2,10 +2,16 @@ package hci
 
 import (
 	"errors"
-	"github.com/go-ble/ble/linux/hci/evt"
+	"fmt"
+	"net"
 	"time"
 
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/att"
+	"github.com/go-ble/ble/linux/crypto"
+	"github.com/go-ble/ble/linux/gatt"
 	"github.com/go-ble/ble/linux/hci/cmd"
+	"github.com/go-ble/ble/linux/hci/evt"
 )
 
 // SetDeviceID sets HCI device ID.
@@ -65,3 +71,179 @@ func (h *HCI) SetPeripheralRole() error {
 func (h *HCI) SetCentralRole() error {
 	return errors.New("Not supported")
 }
+
+// SetPairingAgent sets the agent, which involves the application in pairing.
+func (h *HCI) SetPairingAgent(a ble.PairingAgent) error {
+	h.smp.agent = a
+	return nil
+}
+
+// SetSecureConnections enables or disables LE Secure Connections pairing,
+// which is enabled by default. Disabling it works around peer devices with
+// broken implementations.
+func (h *HCI) SetSecureConnections(enable bool) error {
+	h.smp.noSC = !enable
+	return nil
+}
+
+// SetSecureConnectionsOnly enables or disables Secure Connections Only Mode,
+// in which LE legacy pairing is rejected.
+func (h *HCI) SetSecureConnectionsOnly(only bool) error {
+	h.smp.scOnly = only
+	return nil
+}
+
+// SetControllerCrypto makes the security functions used in pairing perform
+// AES-128 and generate random numbers with the controller, instead of the host.
+func (h *HCI) SetControllerCrypto(enable bool) error {
+	h.toolbox = crypto.Default
+	if enable {
+		h.toolbox = crypto.New(controllerEngine{h})
+	}
+	return nil
+}
+
+// SetStaticAddress makes the device advertise, scan and initiate connections
+// with a static device address, which is also the identity address of the
+// device. A nil addr generates a random one when the device is initialized.
+func (h *HCI) SetStaticAddress(addr net.HardwareAddr) error {
+	var a [6]byte
+	if addr != nil {
+		if len(addr) != 6 || addr[0]&0xC0 != 0xC0 {
+			return ErrInvalidAddr
+		}
+		a = reverse6(addr)
+	}
+	h.own.mu.Lock()
+	h.own.mode, h.own.static = addrStatic, a
+	h.own.mu.Unlock()
+	return nil
+}
+
+// SetPrivacy makes the device advertise, scan and initiate connections with
+// resolvable private addresses generated from its IRK. A new address is
+// generated every timeout, or every DefaultRPATimeout if timeout is zero.
+func (h *HCI) SetPrivacy(timeout time.Duration) error {
+	switch {
+	case timeout < 0:
+		return fmt.Errorf("invalid timeout %v", timeout)
+	case timeout == 0:
+		timeout = DefaultRPATimeout
+	}
+	h.own.mu.Lock()
+	h.own.mode, h.own.timeout = addrResolvable, timeout
+	h.own.mu.Unlock()
+	return nil
+}
+
+// SetIRK sets the Identity Resolving Key of the device. Peer devices resolve
+// the private addresses with the IRK distributed in pairing, so it has to
+// persist along with the bonds. By default, the one saved in the bond store,
+// if it's an IdentityStore, is used. Otherwise, it's randomly generated.
+func (h *HCI) SetIRK(irk [16]byte) error {
+	h.irk, h.irkSet = irk, true
+	return nil
+}
+
+// SetIRKSource sets the source of the IRKs, with which the resolvable private
+// addresses of the peer devices are resolved to their identity addresses. By
+// default, the IRKs distributed by the bonded devices are used.
+func (h *HCI) SetIRKSource(s IRKSource) error {
+	h.res.Lock()
+	h.res.src = s
+	h.res.Unlock()
+	h.res.reset()
+	return nil
+}
+
+// SetAddressResolution makes the controller resolve the resolvable private
+// addresses with its resolving list, in addition to the host. It falls back
+// to the host only, if the controller doesn't support it.
+func (h *HCI) SetAddressResolution(enable bool) error {
+	h.res.Lock()
+	h.res.controller = enable
+	h.res.Unlock()
+	return nil
+}
+
+// SetChannelParams sets the MTU, the MPS and the initial credits of the local
+// endpoints of the channels. The credits must be enough to receive an SDU of
+// the MTU.
+func (h *HCI) SetChannelParams(mtu, mps, credits int) error {
+	switch {
+	case mtu < 23 || mtu > 65535:
+		return fmt.Errorf("invalid MTU %d", mtu)
+	case mps < 23 || mps > 65533:
+		return fmt.Errorf("invalid MPS %d", mps)
+	case credits < (mtu+2+mps-1)/mps || credits > 65535:
+		return fmt.Errorf("invalid credits %d", credits)
+	}
+	h.chMTU, h.chMPS, h.chCredits = mtu, mps, credits
+	return nil
+}
+
+// SetTxLimits sets the limits of the connections sending ACL data. A write
+// fails with ErrTxQueueFull, if depth PDUs are already queued on the
+// connection. A connection holds at most inflight ACL data packet buffers of
+// the controller, so a peer device not completing packets doesn't tie up all
+// of them. Zero means no limit, which is the default.
+func (h *HCI) SetTxLimits(depth, inflight int) error {
+	if depth < 0 || inflight < 0 {
+		return fmt.Errorf("invalid limits %d, %d", depth, inflight)
+	}
+	h.txDepth, h.txLimit = depth, inflight
+	return nil
+}
+
+// SetHostBuffers sets the number of the ACL data packets, which the host
+// buffers with the flow control from the controller to the host. The
+// controller sends no more packets, until the upper layers consume the ones
+// received. Zero disables the flow control. It's DefaultHostBuffers by
+// default.
+func (h *HCI) SetHostBuffers(n int) error {
+	if n < 0 || n > 65535 {
+		return fmt.Errorf("invalid host buffers %d", n)
+	}
+	h.flow.Lock()
+	h.flow.bufs = n
+	h.flow.Unlock()
+	return nil
+}
+
+// SetEATT enables the Enhanced ATT bearers [Vol 3, Part F, 3.2.11] on encrypted
+// links. The device accepts the bearers opened by the remote GATT clients, and
+// the GATT clients of the device open n bearers, in addition to the unenhanced
+// ATT bearer. It's disabled with n 0, which is the default.
+func (h *HCI) SetEATT(n int) error {
+	if n < 0 || n > ecfcMaxChannels {
+		return fmt.Errorf("invalid number of bearers %d", n)
+	}
+	h.eatt = n
+	return nil
+}
+
+// SetBondStore sets the store persisting the keys of bonded devices. The keys
+// are kept in memory only by default, and not kept at all with a nil store.
+// If the store is an IdentityStore, the IRK and the generated static address
+// of the device are kept in it as well.
+func (h *HCI) SetBondStore(s BondStore) error {
+	h.bonds = s
+	h.res.reset()
+	return nil
+}
+
+// SetKeyProvider sets the provider of the keys, with which the GATT clients
+// encrypt the link and retry, when a server rejects a request for insufficient
+// authentication or encryption.
+func (h *HCI) SetKeyProvider(kp gatt.KeyProvider) error {
+	h.keyProvider = kp
+	return nil
+}
+
+// SetSigningKeyProvider sets the provider of the keys for signing and verifying
+// Signed Write Commands. By default, the CSRKs distributed in pairing are used,
+// and a nil provider disables data signing.
+func (h *HCI) SetSigningKeyProvider(p att.SigningKeyProvider) error {
+	h.signer = p
+	return nil
+}
@@ -9,9 +9,10 @@ import (
 type params struct {
 	sync.RWMutex
 
-	advEnable  cmd.LESetAdvertiseEnable
-	scanEnable cmd.LESetScanEnable
-	connCancel cmd.LECreateConnectionCancel
+	advEnable   cmd.LESetAdvertiseEnable
+	advertising bool // advertising is enabled on the controller.
+	scanEnable  cmd.LESetScanEnable
+	connCancel  cmd.LECreateConnectionCancel
 
 	advData    cmd.LESetAdvertisingData
 	scanResp   cmd.LESetScanResponseData
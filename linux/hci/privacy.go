@@ -0,0 +1,288 @@
+package hci
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/hci/cmd"
+	"github.com/pkg/errors"
+)
+
+// Modes of the device address, with which the local device advertises, scans
+// and initiates connections [Vol 6, Part B, 1.3].
+const (
+	addrPublic     = iota // Public Device Address.
+	addrStatic            // Static Device Address.
+	addrResolvable        // Resolvable Private Address.
+)
+
+// DefaultRPATimeout is the default interval, at which the resolvable private
+// address is regenerated [Vol 3, Part C, Appendix A].
+const DefaultRPATimeout = 15 * time.Minute
+
+// ownAddr manages the device address of the local device.
+type ownAddr struct {
+	// op is held for reading while advertising, scanning or initiating is
+	// being enabled, and for writing while the random address is changed,
+	// which the controller disallows in any of the states [Vol 2, Part E, 7.8.4].
+	op sync.RWMutex
+
+	mu      sync.Mutex
+	mode    int
+	static  [6]byte // in little-endian, as the HCI commands.
+	random  [6]byte // current random address, in little-endian.
+	timeout time.Duration
+}
+
+// IRK returns the Identity Resolving Key of the local device, which generates
+// the resolvable private addresses, and is distributed in pairing.
+func (h *HCI) IRK() [16]byte { return h.irk }
+
+// current returns the type and the address, in little-endian, currently used
+// by the local device.
+func (o *ownAddr) current(public net.HardwareAddr) (uint8, [6]byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.mode == addrPublic {
+		return 0x00, reverse6(public)
+	}
+	return 0x01, o.random
+}
+
+// identity returns the identity address type and the identity address, in
+// little-endian, of the local device [Vol 3, Part C, 15.1.1].
+func (o *ownAddr) identity(public net.HardwareAddr) (uint8, [6]byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.mode == addrStatic {
+		return 0x01, o.static
+	}
+	return 0x00, reverse6(public)
+}
+
+// reverse6 returns the address a in little-endian.
+func reverse6(a []byte) [6]byte {
+	var r [6]byte
+	for i := 0; i < len(r) && i < len(a); i++ {
+		r[i] = a[len(a)-1-i]
+	}
+	return r
+}
+
+// randomStatic generates a static address [Vol 6, Part B, 1.3.2.1].
+func (h *HCI) randomStatic() ([6]byte, error) {
+	var a [6]byte
+	for {
+		if err := h.toolbox.Rand(a[:]); err != nil {
+			return a, err
+		}
+		a[5] |= 0xC0 // The two most significant bits are 0b11.
+		if !uniform(a[:]) {
+			return a, nil
+		}
+	}
+}
+
+// randomResolvable generates a resolvable private address from the local IRK
+// [Vol 6, Part B, 1.3.2.2].
+func (h *HCI) randomResolvable() ([6]byte, error) {
+	var a [6]byte
+	for {
+		var prand [3]byte
+		if err := h.toolbox.Rand(prand[:]); err != nil {
+			return a, err
+		}
+		prand[2] = prand[2]&0x3F | 0x40 // The two most significant bits are 0b01.
+		copy(a[3:], prand[:])
+		if uniform(a[3:]) {
+			continue
+		}
+		hash, err := h.toolbox.Ah(h.irk, prand)
+		if err != nil {
+			return a, err
+		}
+		copy(a[:3], hash[:])
+		return a, nil
+	}
+}
+
+// uniform reports whether the random bits of b, which are all but the two
+// most significant bits, are all 0s or all 1s, which is not allowed.
+func uniform(b []byte) bool {
+	n := len(b) - 1
+	zeros, ones := b[n]&0x3F == 0x00, b[n]&0x3F == 0x3F
+	for _, v := range b[:n] {
+		zeros = zeros && v == 0x00
+		ones = ones && v == 0xFF
+	}
+	return zeros || ones
+}
+
+// initIdentity restores the IRK and the generated static address of the local
+// device from the bond store, or saves them in it, so the bonded peer devices
+// still recognize the device once it restarts. The IRK set with SetIRK, and a
+// static address set explicitly, take precedence over the saved ones.
+func (h *HCI) initIdentity() error {
+	s, ok := h.bonds.(IdentityStore)
+	if !ok {
+		return nil
+	}
+	saved, err := s.LoadIdentity()
+	if err != nil {
+		return errors.Wrap(err, "can't load local identity")
+	}
+	id := LocalIdentity{IRK: h.irk}
+	if saved != nil {
+		id = *saved
+	}
+	if h.irkSet || saved == nil {
+		id.IRK = h.irk
+	}
+
+	h.own.mu.Lock()
+	mode, static := h.own.mode, h.own.static
+	h.own.mu.Unlock()
+	if mode == addrStatic && static == ([6]byte{}) {
+		if id.StaticAddr == ([6]byte{}) {
+			if id.StaticAddr, err = h.randomStatic(); err != nil {
+				return errors.Wrap(err, "can't generate static address")
+			}
+		}
+		h.own.mu.Lock()
+		h.own.static = id.StaticAddr
+		h.own.mu.Unlock()
+	}
+
+	h.irk = id.IRK
+	if saved != nil && *saved == id {
+		return nil
+	}
+	if err := s.SaveIdentity(&id); err != nil {
+		return errors.Wrap(err, "can't save local identity")
+	}
+	return nil
+}
+
+// initAddress sets the random address and the own address type of the
+// advertising, scanning and initiating parameters, as the address mode.
+func (h *HCI) initAddress() error {
+	h.own.mu.Lock()
+	mode := h.own.mode
+	h.own.mu.Unlock()
+	if mode == addrPublic {
+		return nil
+	}
+	if mode == addrStatic && h.own.static == ([6]byte{}) {
+		a, err := h.randomStatic()
+		if err != nil {
+			return errors.Wrap(err, "can't generate static address")
+		}
+		h.own.mu.Lock()
+		h.own.static = a
+		h.own.mu.Unlock()
+	}
+	if err := h.setRandomAddress(); err != nil {
+		return err
+	}
+	h.params.Lock()
+	h.params.advParams.OwnAddressType = 0x01
+	h.params.scanParams.OwnAddressType = 0x01
+	h.params.connParams.OwnAddressType = 0x01
+	h.params.Unlock()
+	if mode == addrResolvable {
+		go h.rotateAddress()
+	}
+	return nil
+}
+
+// setRandomAddress generates the random address of the address mode, and sets
+// it to the controller. The caller must ensure advertising, scanning and
+// initiating are disabled.
+func (h *HCI) setRandomAddress() error {
+	h.own.mu.Lock()
+	mode, a := h.own.mode, h.own.static
+	h.own.mu.Unlock()
+	if mode == addrResolvable {
+		var err error
+		if a, err = h.randomResolvable(); err != nil {
+			return errors.Wrap(err, "can't generate resolvable private address")
+		}
+	}
+	if err := h.Send(&cmd.LESetRandomAddress{RandomAddress: a}, nil); err != nil {
+		return errors.Wrap(err, "can't set random address")
+	}
+	h.own.mu.Lock()
+	h.own.random = a
+	h.own.mu.Unlock()
+	return nil
+}
+
+// rotateAddress regenerates the resolvable private address periodically,
+// until the device is closed.
+func (h *HCI) rotateAddress() {
+	t := time.NewTicker(h.own.timeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-t.C:
+		}
+		if err := h.changeAddress(); err != nil {
+			_ = logger.Error("privacy", "can't change resolvable private address", err)
+		}
+	}
+}
+
+// changeAddress changes the random address.
+func (h *HCI) changeAddress() error {
+	return h.idle(h.setRandomAddress)
+}
+
+// idle calls f with advertising and scanning disabled, and restarts them
+// afterward. Pending connection creations defer the call until they complete.
+// This is required to change the random address and the resolving list.
+// Advertising is restarted only if the controller was advertising, which it
+// stops once a connection is accepted.
+func (h *HCI) idle(f func() error) error {
+	h.own.op.Lock()
+	defer h.own.op.Unlock()
+
+	h.params.RLock()
+	adv := h.params.advertising
+	scan := h.params.scanEnable.LEScanEnable == 1
+	h.params.RUnlock()
+	if adv {
+		if err := h.Send(&cmd.LESetAdvertiseEnable{AdvertisingEnable: 0}, nil); err != nil {
+			return errors.Wrap(err, "can't stop advertising")
+		}
+	}
+	if scan {
+		if err := h.Send(&cmd.LESetScanEnable{LEScanEnable: 0}, nil); err != nil {
+			return errors.Wrap(err, "can't stop scanning")
+		}
+	}
+	err := f()
+	if scan {
+		if err := h.Send(&h.params.scanEnable, nil); err != nil {
+			return errors.Wrap(err, "can't restart scanning")
+		}
+	}
+	if adv {
+		if err := h.Send(&h.params.advEnable, nil); err != nil {
+			return errors.Wrap(err, "can't restart advertising")
+		}
+	}
+	return err
+}
+
+// addrOf returns the address a of the type, in little-endian, as ble.Addr.
+func addrOf(typ uint8, a [6]byte) ble.Addr {
+	addr := net.HardwareAddr([]byte{a[5], a[4], a[3], a[2], a[1], a[0]})
+	if typ&0x01 == 0x01 {
+		return RandomAddress{addr}
+	}
+	return addr
+}
@@ -0,0 +1,69 @@
+package hci
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/go-ble/ble/linux/hci/evt"
+)
+
+// waitAdvertising waits until the controller has been sent the values of LE
+// Set Advertising Enable.
+func waitAdvertising(t *testing.T, skt *pipeSkt, want ...byte) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if bytes.Equal(skt.advertising(), want) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("advertising enable % X, want % X", skt.advertising(), want)
+}
+
+func TestIdleAdvertising(t *testing.T) {
+	_, cs := newPipePair(t, nil, nil)
+	h := cs.hci
+	skt := h.skt.(*pipeSkt)
+	if err := h.Advertise(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.changeAddress(); err != nil {
+		t.Fatal(err)
+	}
+	// Advertising is restarted after the address is changed.
+	waitAdvertising(t, skt, 1, 0, 1)
+
+	// The controller stops advertising once it accepts a connection, and the
+	// address change doesn't restart it.
+	b := []byte{evt.LEConnectionCompleteSubCode, 0, 0x41, 0x00, roleSlave, 0, 1, 2, 3, 4, 5, 6, 6, 0, 0, 0, 0x48, 0, 0}
+	skt.event(evtLEMeta, b...)
+	<-h.chSlaveConn
+	waitAdvertising(t, skt, 1, 0, 1, 0)
+	if err := h.changeAddress(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	waitAdvertising(t, skt, 1, 0, 1, 0)
+
+	// It's resumed once the connection is disconnected.
+	skt.event(evt.DisconnectionCompleteCode, 0, 0x41, 0x00, 0x13)
+	waitAdvertising(t, skt, 1, 0, 1, 0, 1)
+	if err := h.changeAddress(); err != nil {
+		t.Fatal(err)
+	}
+	waitAdvertising(t, skt, 1, 0, 1, 0, 1, 0, 1)
+}
+
+func TestSetPrivacy(t *testing.T) {
+	h, err := NewHCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetPrivacy(-time.Second); err == nil {
+		t.Error("negative timeout accepted")
+	}
+	if err := h.SetPrivacy(0); err != nil || h.own.timeout != DefaultRPATimeout {
+		t.Errorf("timeout %v, %v; want %v", h.own.timeout, err, DefaultRPATimeout)
+	}
+}
@@ -0,0 +1,322 @@
+package hci
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/crypto"
+	"github.com/go-ble/ble/linux/hci/cmd"
+	"github.com/pkg/errors"
+)
+
+// Identity is the identity address of a peer device, along with the IRK the
+// peer device generates its resolvable private addresses with.
+type Identity struct {
+	// AddrType is 0x00 for a public address, and 0x01 for a static random
+	// address. Addr is in the over-the-air (little-endian) order.
+	AddrType uint8
+	Addr     [6]byte
+	IRK      [16]byte
+}
+
+// An IRKSource supplies the identities of the peer devices, with which the
+// resolvable private addresses are resolved.
+type IRKSource interface {
+	IRKs() ([]Identity, error)
+}
+
+// IRKSourceFunc is an adapter to allow the use of ordinary functions as IRKSource.
+type IRKSourceFunc func() ([]Identity, error)
+
+// IRKs returns f().
+func (f IRKSourceFunc) IRKs() ([]Identity, error) { return f() }
+
+// bondIRKs is the default IRKSource, which supplies the IRKs distributed by
+// the bonded devices.
+type bondIRKs struct {
+	h *HCI
+}
+
+func (s bondIRKs) IRKs() ([]Identity, error) {
+	if s.h.bonds == nil {
+		return nil, nil
+	}
+	bonds, err := s.h.bonds.Bonds()
+	if err != nil {
+		return nil, err
+	}
+	var ids []Identity
+	for _, b := range bonds {
+		if b.Remote.Dist&keyDistIDKey != 0 {
+			ids = append(ids, Identity{AddrType: b.AddrType, Addr: b.Addr, IRK: b.Remote.IRK})
+		}
+	}
+	return ids, nil
+}
+
+// maxResolved bounds the number of the addresses cached by a resolver.
+const maxResolved = 256
+
+// resolver resolves the resolvable private addresses of the peer devices
+// [Vol 6, Part B, 1.3.2.3]. It's used in the event handlers, so it always
+// uses the host implementation of the security functions.
+type resolver struct {
+	sync.Mutex
+	src IRKSource
+
+	// ids are the identities loaded from src, and resolved caches the index
+	// of the identity each address resolves to, or -1. gen counts the resets,
+	// so the identities loaded before one are discarded.
+	ids      []Identity
+	loaded   bool
+	gen      int
+	resolved map[[6]byte]int
+
+	// controller is set if the controller resolves the addresses with its
+	// resolving list.
+	controller bool
+
+	// wait is the identity a connection creation is waiting for an
+	// advertisement from, and chFound receives the address of it.
+	wait    *Identity
+	chFound chan [6]byte
+}
+
+// isRPA reports whether the address is a resolvable private address.
+func isRPA(typ uint8, a [6]byte) bool {
+	return typ == 0x01 && a[5]&0xC0 == 0x40
+}
+
+// load loads the identities from the source, unless they're loaded. The
+// source, which may read the bond store, is called without holding the lock,
+// so the event handlers aren't blocked on it.
+func (r *resolver) load() {
+	r.Lock()
+	src, gen := r.src, r.gen
+	loaded := r.loaded
+	r.Unlock()
+	if loaded || src == nil {
+		return
+	}
+	ids, err := src.IRKs()
+	if err != nil {
+		_ = logger.Error("resolver", "can't load IRKs", err)
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.gen == gen && !r.loaded {
+		r.ids, r.loaded, r.resolved = ids, err == nil, make(map[[6]byte]int)
+	}
+}
+
+// reset discards the loaded identities and the resolved addresses, so the
+// identities are loaded from the source again.
+func (r *resolver) reset() {
+	r.Lock()
+	defer r.Unlock()
+	r.ids, r.loaded, r.resolved = nil, false, nil
+	r.gen++
+}
+
+// lookup returns the identity with the identity address.
+func (r *resolver) lookup(typ uint8, a [6]byte) (Identity, bool) {
+	r.load()
+	r.Lock()
+	defer r.Unlock()
+	for _, id := range r.ids {
+		if id.AddrType == typ && id.Addr == a {
+			return id, true
+		}
+	}
+	return Identity{}, false
+}
+
+// resolve returns the identity address of the address, if it's a resolvable
+// private address generated with one of the IRKs, or if it has been resolved
+// by the controller. Otherwise, it returns the address as is.
+func (r *resolver) resolve(typ uint8, a [6]byte) (uint8, [6]byte, bool) {
+	if typ == 0x02 || typ == 0x03 {
+		// Resolved by the controller [Vol 2, Part E, 7.7.65.2].
+		return typ & 0x01, a, true
+	}
+	if !isRPA(typ, a) {
+		return typ, a, false
+	}
+	r.load()
+	r.Lock()
+	defer r.Unlock()
+	ids := r.ids
+	i, ok := r.resolved[a]
+	if !ok {
+		i = -1
+		for j := range ids {
+			if matchRPA(ids[j].IRK, a) {
+				i = j
+				break
+			}
+		}
+		if len(r.resolved) >= maxResolved {
+			r.resolved = make(map[[6]byte]int)
+		}
+		if r.resolved != nil {
+			r.resolved[a] = i
+		}
+	}
+	if i < 0 {
+		return typ, a, false
+	}
+	return ids[i].AddrType, ids[i].Addr, true
+}
+
+// matchRPA reports whether the resolvable private address a is generated with
+// the irk.
+func matchRPA(irk [16]byte, a [6]byte) bool {
+	hash, err := crypto.Default.Ah(irk, [3]byte{a[3], a[4], a[5]})
+	return err == nil && hash == [3]byte{a[0], a[1], a[2]}
+}
+
+// found checks if the advertisement is from the identity a connection creation
+// is waiting for.
+func (r *resolver) found(typ uint8, a [6]byte) {
+	r.Lock()
+	id := r.wait
+	r.Unlock()
+	if id == nil {
+		return
+	}
+	if (typ == id.AddrType && a == id.Addr) || (isRPA(typ, a) && matchRPA(id.IRK, a)) {
+		select {
+		case r.chFound <- a:
+		default:
+		}
+	}
+}
+
+// find scans for a connectable advertisement from the identity, and returns
+// the address it's currently using.
+func (h *HCI) find(ctx context.Context, id Identity) (uint8, [6]byte, error) {
+	h.own.op.RLock()
+	defer h.own.op.RUnlock()
+
+	ch := make(chan [6]byte, 1)
+	h.res.Lock()
+	h.res.wait, h.res.chFound = &id, ch
+	h.res.Unlock()
+	defer func() {
+		h.res.Lock()
+		h.res.wait, h.res.chFound = nil, nil
+		h.res.Unlock()
+	}()
+
+	// Scan, unless the application has been scanning already.
+	h.params.RLock()
+	scanning := h.params.scanEnable.LEScanEnable == 1
+	h.params.RUnlock()
+	if !scanning {
+		if err := h.Send(&cmd.LESetScanEnable{LEScanEnable: 1}, nil); err != nil {
+			return 0, [6]byte{}, errors.Wrap(err, "can't start scanning")
+		}
+		defer h.Send(&cmd.LESetScanEnable{LEScanEnable: 0}, nil)
+	}
+
+	var tmo <-chan time.Time
+	if h.dialerTmo != time.Duration(0) {
+		tmo = time.After(h.dialerTmo)
+	}
+	select {
+	case a := <-ch:
+		if a == id.Addr {
+			return id.AddrType, a, nil
+		}
+		return 0x01, a, nil
+	case <-ctx.Done():
+		return 0, [6]byte{}, ctx.Err()
+	case <-tmo:
+		return 0, [6]byte{}, errors.New("can't find the device")
+	case <-h.done:
+		return 0, [6]byte{}, h.Error()
+	}
+}
+
+// loadResolvingList replaces the resolving list of the controller with the
+// identities, and enables the address resolution [Vol 6, Part B, 6.9].
+func (h *HCI) loadResolvingList() error {
+	if err := h.Send(&cmd.LESetAddressResolutionEnable{AddressResolutionEnable: 0}, nil); err != nil {
+		return errors.Wrap(err, "can't disable address resolution")
+	}
+	if err := h.Send(&cmd.LEClearResolvingList{}, nil); err != nil {
+		return errors.Wrap(err, "can't clear resolving list")
+	}
+	var rp cmd.LEReadResolvingListSizeRP
+	if err := h.Send(&cmd.LEReadResolvingListSize{}, &rp); err != nil {
+		return errors.Wrap(err, "can't read resolving list size")
+	}
+	h.res.load()
+	h.res.Lock()
+	ids := h.res.ids
+	h.res.Unlock()
+	if len(ids) > int(rp.ResolvingListSize) {
+		_ = logger.Warn("resolver", "resolving list is full", len(ids))
+		ids = ids[:rp.ResolvingListSize]
+	}
+	for _, id := range ids {
+		c := &cmd.LEAddDeviceToResolvingList{
+			PeerIdentityAddressType: id.AddrType,
+			PeerIdentityAddress:     id.Addr,
+			PeerIRK:                 id.IRK,
+			LocalIRK:                h.irk,
+		}
+		if err := h.Send(c, nil); err != nil {
+			return errors.Wrap(err, "can't add device to resolving list")
+		}
+	}
+	if err := h.Send(&cmd.LESetAddressResolutionEnable{AddressResolutionEnable: 1}, nil); err != nil {
+		return errors.Wrap(err, "can't enable address resolution")
+	}
+	return nil
+}
+
+// initResolvingList loads the resolving list, if the address resolution in
+// the controller is enabled. It falls back to the resolution in the host, if
+// the controller doesn't support it.
+func (h *HCI) initResolvingList() {
+	h.res.Lock()
+	enabled := h.res.controller
+	h.res.Unlock()
+	if !enabled {
+		return
+	}
+	if err := h.loadResolvingList(); err != nil {
+		_ = logger.Warn("resolver", "address resolution in controller is not available", err)
+		h.res.Lock()
+		h.res.controller = false
+		h.res.Unlock()
+	}
+}
+
+// ReloadIRKs reloads the identities of the peer devices from the IRK source.
+// It's called when pairing distributes a new IRK, and should be called when
+// the application changes the identities of the source.
+func (h *HCI) ReloadIRKs() error {
+	h.res.reset()
+	h.res.Lock()
+	enabled := h.res.controller
+	h.res.Unlock()
+	if !enabled {
+		return nil
+	}
+	return h.idle(h.loadResolvingList)
+}
+
+// IdentityAddr returns the identity address of the advertiser, if it's using a
+// resolvable private address generated with a known IRK. Otherwise, it returns
+// the same address as Addr.
+func (a *Advertisement) IdentityAddr() ble.Addr {
+	typ, addr := a.e.AddressType(a.i), a.e.Address(a.i)
+	if a.res != nil {
+		typ, addr, _ = a.res.resolve(typ, addr)
+	}
+	return addrOf(typ, addr)
+}
@@ -0,0 +1,63 @@
+package hci
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-ble/ble/linux/crypto"
+)
+
+func TestResolverLoad(t *testing.T) {
+	id := Identity{AddrType: 0x00, Addr: [6]byte{1, 2, 3, 4, 5, 6}, IRK: [16]byte{0xEC, 0x02}}
+	hash, err := crypto.Default.Ah(id.IRK, [3]byte{0x11, 0x22, 0x43})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpa := [6]byte{hash[0], hash[1], hash[2], 0x11, 0x22, 0x43}
+
+	// The first load is held up, and the identities it returns are replaced
+	// by the reset.
+	loading, release := make(chan struct{}), make(chan struct{})
+	loads := 0
+	r := &resolver{}
+	r.src = IRKSourceFunc(func() ([]Identity, error) {
+		loads++
+		if loads == 1 {
+			close(loading)
+			<-release
+			return nil, nil
+		}
+		return []Identity{id}, nil
+	})
+	done := make(chan [6]byte)
+	go func() {
+		_, a, _ := r.resolve(0x01, rpa)
+		done <- a
+	}()
+	<-loading
+
+	// The resolver isn't locked while the source is loading.
+	unlocked := make(chan struct{})
+	go func() {
+		r.found(0x01, rpa)
+		r.reset()
+		close(unlocked)
+	}()
+	select {
+	case <-unlocked:
+	case <-time.After(time.Second):
+		t.Fatal("resolver locked while loading")
+	}
+	close(release)
+	if a := <-done; a != rpa {
+		t.Errorf("resolved to % X with the identities before the reset", a)
+	}
+
+	typ, a, ok := r.resolve(0x01, rpa)
+	if !ok || typ != id.AddrType || a != id.Addr {
+		t.Errorf("resolved to %d, % X, %v; want %d, % X", typ, a, ok, id.AddrType, id.Addr)
+	}
+	if loads != 2 {
+		t.Errorf("loaded %d times, want 2", loads)
+	}
+}
@@ -0,0 +1,166 @@
+package hci
+
+import (
+	"math"
+	"sync"
+
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/att"
+)
+
+// SigningKeyProvider returns the provider of the keys for signing and verifying
+// Signed Write Commands, or nil if data signing is disabled.
+func (h *HCI) SigningKeyProvider() att.SigningKeyProvider {
+	return h.signer
+}
+
+// signSaveInterval is the number of the sign counters, which are used or
+// verified between the saves of a bond. The counters are kept in memory, and
+// saved once the connection is closed.
+const signSaveInterval = 64
+
+// bondSigner is the default SigningKeyProvider, which supplies the CSRKs
+// distributed with the bonded peer device, or in the pairing of the connection
+// if it's not bonded. The sign counters of bonded devices are persisted along
+// with the bond, so the signed data can't be replayed across connections.
+//
+// The local counters are saved ahead of their use, so none is used again once
+// the device restarts. The remote counters verified since the last save may be
+// accepted again, if the device restarts without closing the connection.
+type bondSigner struct {
+	sync.Mutex
+	bonds map[*Conn]*signBond
+}
+
+// signBond is the bond of a connection, whose sign counters are updated in
+// memory, and saved in batches.
+type signBond struct {
+	b *Bond
+
+	// leased is the local counter saved in the store. The counters below it
+	// are used without saving the bond.
+	leased uint32
+
+	// verified is the number of the remote counters verified since the last save.
+	verified int
+}
+
+// SigningKey returns the local CSRK, and the sign counter of the next data.
+func (s *bondSigner) SigningKey(conn ble.Conn) (csrk [16]byte, counter uint32, ok bool) {
+	s.update(conn, func(local, remote *Keys, sb *signBond) bool {
+		if local.Dist&keyDistSignKey == 0 {
+			return false
+		}
+		csrk, counter, ok = local.CSRK, local.SignCounter, true
+		if counter == math.MaxUint32 {
+			// The counter can't be incremented, so the key is retired once
+			// it's used with the last one.
+			local.Dist &^= keyDistSignKey
+			return true
+		}
+		local.SignCounter++
+		return sb != nil && counter >= sb.leased
+	})
+	return
+}
+
+// VerifyingKey returns the remote CSRK, and the smallest acceptable sign counter.
+// The CSRK is authenticated, if the STK or the LTK of the pairing which
+// distributed it is.
+func (s *bondSigner) VerifyingKey(conn ble.Conn) (csrk [16]byte, counter uint32, authenticated, ok bool) {
+	s.update(conn, func(local, remote *Keys, sb *signBond) bool {
+		if remote.Dist&keyDistSignKey == 0 {
+			return false
+		}
+		csrk, counter, authenticated, ok = remote.CSRK, remote.SignCounter, remote.Authenticated, true
+		return false
+	})
+	return
+}
+
+// Verified records the sign counter of the verified data.
+func (s *bondSigner) Verified(conn ble.Conn, counter uint32) {
+	s.update(conn, func(local, remote *Keys, sb *signBond) bool {
+		if counter == math.MaxUint32 {
+			// No counter is greater, so the key is retired.
+			remote.Dist &^= keyDistSignKey
+			return true
+		}
+		remote.SignCounter = counter + 1
+		if sb == nil {
+			return false
+		}
+		sb.verified++
+		return sb.verified >= signSaveInterval
+	})
+}
+
+// update calls f with the keys of the connection, and the bond of them if the
+// peer device is bonded. The bond is saved if f returns true.
+func (s *bondSigner) update(conn ble.Conn, f func(local, remote *Keys, sb *signBond) bool) {
+	c, ok := conn.(*Conn)
+	if !ok {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	sb, ok := s.bonds[c]
+	if !ok {
+		if b := c.bond(); b != nil {
+			sb = &signBond{b: b, leased: b.Local.SignCounter}
+			if s.bonds == nil {
+				s.bonds = make(map[*Conn]*signBond)
+			}
+			s.bonds[c] = sb
+		}
+	}
+	if sb != nil {
+		if f(&sb.b.Local, &sb.b.Remote, sb) {
+			s.save(c, sb, true)
+		}
+		return
+	}
+	c.smp.Lock()
+	defer c.smp.Unlock()
+	if c.smp.local != nil && c.smp.remote != nil {
+		f(c.smp.local, c.smp.remote, nil)
+	}
+}
+
+// save saves the sign counters of the bond. If lease is true, the local
+// counter saved is ahead of the one in use by signSaveInterval. The counters
+// are saved to the bond in the store, only if it has the same keys.
+func (s *bondSigner) save(c *Conn, sb *signBond, lease bool) {
+	b := sb.b
+	cur, err := c.hci.bonds.Load(b.AddrType, b.Addr)
+	if err != nil || cur.Local.CSRK != b.Local.CSRK || cur.Remote.CSRK != b.Remote.CSRK {
+		// The bond is deleted, or replaced by a new pairing.
+		delete(s.bonds, c)
+		return
+	}
+	counter := uint64(b.Local.SignCounter)
+	if lease {
+		counter += signSaveInterval
+		if counter > math.MaxUint32 {
+			counter = math.MaxUint32
+		}
+	}
+	cur.Local.SignCounter, cur.Local.Dist = uint32(counter), b.Local.Dist
+	cur.Remote.SignCounter, cur.Remote.Dist = b.Remote.SignCounter, b.Remote.Dist
+	if err := c.hci.bonds.Save(cur); err != nil {
+		_ = logger.Error("sign", "can't save bond", err)
+		return
+	}
+	sb.leased, sb.verified = uint32(counter), 0
+}
+
+// forget saves the sign counters of the connection, if save is true, and
+// stops keeping them.
+func (s *bondSigner) forget(c *Conn, save bool) {
+	s.Lock()
+	defer s.Unlock()
+	if sb, ok := s.bonds[c]; ok && save {
+		s.save(c, sb, false)
+	}
+	delete(s.bonds, c)
+}
@@ -1,7 +1,6 @@
 package hci
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -13,6 +12,8 @@ import (
 // Signal ...
 type Signal interface {
 	Code() int
+	Len() int
+	MarshalTo([]byte)
 	Marshal() ([]byte, error)
 	Unmarshal([]byte) error
 }
@@ -24,85 +25,167 @@ func (s sigCmd) id() uint8    { return s[1] }
 func (s sigCmd) len() int     { return int(binary.LittleEndian.Uint16(s[2:4])) }
 func (s sigCmd) data() []byte { return s[4 : 4+s.len()] }
 
-// Signal ...
-func (c *Conn) Signal(req Signal, rsp Signal) error {
-	data, err := req.Marshal()
-	if err != nil {
-		return err
-	}
-	buf := bytes.NewBuffer(make([]byte, 0))
-	if err := binary.Write(buf, binary.LittleEndian, uint16(4+len(data))); err != nil {
-		return err
-	}
-	if err := binary.Write(buf, binary.LittleEndian, cidLESignal); err != nil {
-		return err
-	}
+// sigRTX is the Response Timeout eXpired timer of the signaling requests,
+// whose initial value is between 1 and 60 seconds [Vol 3, Part A, 6.2.1].
+const sigRTX = 30 * time.Second
 
-	if err := binary.Write(buf, binary.LittleEndian, uint8(req.Code())); err != nil {
-		return err
+// Reasons of Command Reject [Vol 3, Part A, 4.1].
+const (
+	sigNotUnderstood  = 0x0000
+	sigMTUExceeded    = 0x0001
+	sigInvalidCID     = 0x0002
+	sigMinMTU         = 23 // The minimum MTUsig of LE-U.
+	sigMaxOutstanding = 255
+)
+
+// sigResponses are the codes of the signaling responses.
+var sigResponses = map[int]bool{
+	SignalCommandReject:                     true,
+	SignalDisconnectResponse:                true,
+	SignalConnectionParameterUpdateResponse: true,
+	SignalLECreditBasedConnectionResponse:   true,
+	SignalCreditBasedConnectionResponse:     true,
+	SignalCreditBasedReconfigureResponse:    true,
+}
+
+// SignalError is returned when the remote device rejects a signaling request
+// with a Command Reject.
+type SignalError uint16
+
+func (e SignalError) Error() string {
+	switch e {
+	case sigNotUnderstood:
+		return "l2cap: command not understood"
+	case sigMTUExceeded:
+		return "l2cap: signaling MTU exceeded"
+	case sigInvalidCID:
+		return "l2cap: invalid CID in request"
 	}
-	if err := binary.Write(buf, binary.LittleEndian, uint8(c.sigID)); err != nil {
-		return err
+	return fmt.Sprintf("l2cap: command rejected (0x%04X)", uint16(e))
+}
+
+// newSigID returns the identifier of a new signaling command, which is never
+// 0x00 [Vol 3, Part A, 4].
+func (c *Conn) newSigID() uint8 {
+	c.muSig.Lock()
+	defer c.muSig.Unlock()
+	return c.nextSigID()
+}
+
+// nextSigID returns an identifier, which is not used by the outstanding
+// requests. The caller must hold muSig, and ensure there's one available.
+func (c *Conn) nextSigID() uint8 {
+	for {
+		c.sigID++
+		if _, ok := c.sigPending[c.sigID]; c.sigID != 0 && !ok {
+			return c.sigID
+		}
 	}
-	if err := binary.Write(buf, binary.LittleEndian, uint16(len(data))); err != nil {
-		return err
+}
+
+// Signal sends the signaling request, and waits for the response. Several
+// requests can be outstanding at a time, which are told apart by their
+// identifiers [Vol 3, Part A, 4].
+func (c *Conn) Signal(req Signal, rsp Signal) error {
+	ch := make(chan sigCmd, 1)
+	c.muSig.Lock()
+	if 4+req.Len() > c.sigTxMTU {
+		c.muSig.Unlock()
+		return SignalError(sigMTUExceeded)
 	}
-	if err := binary.Write(buf, binary.LittleEndian, data); err != nil {
-		return err
+	if len(c.sigPending) >= sigMaxOutstanding {
+		c.muSig.Unlock()
+		return errors.New("too many outstanding signaling requests")
 	}
+	id := c.nextSigID()
+	c.sigPending[id] = ch
+	c.muSig.Unlock()
+	defer func() {
+		c.muSig.Lock()
+		delete(c.sigPending, id)
+		c.muSig.Unlock()
+	}()
 
-	c.sigSent = make(chan []byte)
-	defer close(c.sigSent)
-	if _, err := c.writePDU(buf.Bytes()); err != nil {
+	if _, err := c.sendResponse(uint8(req.Code()), id, req); err != nil {
 		return err
 	}
 	var s sigCmd
 	select {
-	case s = <-c.sigSent:
-	case <-time.After(time.Second):
-		// TODO: Find the proper timed out defined in spec, if any.
+	case s = <-ch:
+	case <-time.After(sigRTX):
 		return errors.New("signaling request timed out")
+	case <-c.chDone:
+		return ErrDisconnected
 	}
 
-	if s.code() != req.Code() {
-		return errors.New("mismatched signaling response")
+	if s.code() == SignalCommandReject {
+		return c.handleCommandReject(s)
 	}
-	if s.id() != c.sigID {
-		return errors.New("mismatched signaling id")
+	if s.code() != req.Code()+1 {
+		return errors.New("mismatched signaling response")
 	}
-	c.sigID++
 	if rsp == nil {
 		return nil
 	}
 	return rsp.Unmarshal(s.data())
 }
 
-func (c *Conn) sendResponse(code uint8, id uint8, r Signal) (int, error) {
-	data, err := r.Marshal()
-	if err != nil {
-		return 0, err
-	}
-	buf := bytes.NewBuffer(make([]byte, 0))
-	if err := binary.Write(buf, binary.LittleEndian, uint16(4+len(data))); err != nil {
-		return 0, err
-	}
-	if err := binary.Write(buf, binary.LittleEndian, cidLESignal); err != nil {
-		return 0, err
+// handleCommandReject returns the error of the Command Reject, which the
+// remote device responds to a request with. The signaling MTU is updated to
+// the one of the remote device, if it's exceeded [Vol 3, Part A, 4.1].
+func (c *Conn) handleCommandReject(s sigCmd) error {
+	var r CommandReject
+	if err := r.Unmarshal(s.data()); err != nil {
+		return err
 	}
-	if err := binary.Write(buf, binary.LittleEndian, code); err != nil {
-		return 0, err
+	if r.Reason == sigMTUExceeded && len(r.Data) >= 2 {
+		if mtu := int(binary.LittleEndian.Uint16(r.Data)); mtu >= sigMinMTU {
+			c.muSig.Lock()
+			c.sigTxMTU = mtu
+			c.muSig.Unlock()
+		}
 	}
-	if err := binary.Write(buf, binary.LittleEndian, id); err != nil {
-		return 0, err
+	return SignalError(r.Reason)
+}
+
+// handleResponse passes the response to the outstanding request of the same
+// identifier. The responses without a matching request are dropped, and the
+// requests not supported are rejected.
+func (c *Conn) handleResponse(s sigCmd) {
+	if !sigResponses[s.code()] {
+		c.sendResponse(
+			SignalCommandReject,
+			s.id(),
+			&CommandReject{
+				Reason: sigNotUnderstood,
+			})
+		return
 	}
-	if err := binary.Write(buf, binary.LittleEndian, uint16(len(data))); err != nil {
-		return 0, err
+	c.muSig.Lock()
+	ch, ok := c.sigPending[s.id()]
+	delete(c.sigPending, s.id())
+	c.muSig.Unlock()
+	if !ok {
+		logger.Debug("sig", "drop", fmt.Sprintf("unexpected response [%X]", []byte(s)))
+		return
 	}
-	if err := binary.Write(buf, binary.LittleEndian, data); err != nil {
-		return 0, err
+	// The buffer of the PDU is reused once it's handled.
+	ch <- append(sigCmd(nil), s...)
+}
+
+func (c *Conn) sendResponse(code uint8, id uint8, r Signal) (int, error) {
+	n := r.Len()
+	b := c.hci.bufs.get(4 + 4 + n)
+	defer c.hci.bufs.put(b)
+	binary.LittleEndian.PutUint16(b[0:2], uint16(4+n))
+	binary.LittleEndian.PutUint16(b[2:4], cidLESignal)
+	b[4], b[5] = code, id
+	binary.LittleEndian.PutUint16(b[6:8], uint16(n))
+	r.MarshalTo(b[8:])
+	if logger.IsDebug() {
+		logger.Debug("sig", "send", fmt.Sprintf("[%X]", b))
 	}
-	logger.Debug("sig", "send", fmt.Sprintf("[%X]", buf.Bytes()))
-	return c.writePDU(buf.Bytes())
+	return c.writePDU(b[:4], b[4:])
 }
 
 func (c *Conn) handleSignal(p pdu) error {
@@ -135,23 +218,15 @@ func (c *Conn) handleSignal(p pdu) error {
 		case SignalConnectionParameterUpdateRequest:
 			c.handleConnectionParameterUpdateRequest(s)
 		case SignalLECreditBasedConnectionRequest:
-			c.LECreditBasedConnectionRequest(s)
+			c.handleLECreditBasedConnectionRequest(s)
 		case SignalLEFlowControlCredit:
-			c.LEFlowControlCredit(s)
+			c.handleLEFlowControlCredit(s)
+		case SignalCreditBasedConnectionRequest:
+			c.handleCreditBasedConnectionRequest(s)
+		case SignalCreditBasedReconfigureRequest:
+			c.handleCreditBasedReconfigureRequest(s)
 		default:
-			// Check if it's a response to a sent command.
-			select {
-			case c.sigSent <- s:
-				continue
-			default:
-			}
-
-			c.sendResponse(
-				SignalCommandReject,
-				s.id(),
-				&CommandReject{
-					Reason: 0x0000, // Command not understood.
-				})
+			c.handleResponse(s)
 		}
 		s = s[4+s.len():] // advance to next the packet.
 
@@ -165,17 +240,21 @@ func (c *Conn) handleDisconnectRequest(s sigCmd) {
 	if err := req.Unmarshal(s.data()); err != nil {
 		return
 	}
+	if c.handleDisconnectChannel(s, &req) {
+		return
+	}
 
 	// Send Command Reject when the DCID is unrecognized.
 	if req.DestinationCID != cidLEAtt {
+		// The local and the remote endpoints of the request.
 		endpoints := make([]byte, 4)
-		binary.LittleEndian.PutUint16(endpoints, req.SourceCID)
 		binary.LittleEndian.PutUint16(endpoints, req.DestinationCID)
+		binary.LittleEndian.PutUint16(endpoints[2:], req.SourceCID)
 		c.sendResponse(
 			SignalCommandReject,
 			s.id(),
 			&CommandReject{
-				Reason: 0x0002, // Invalid CID in request
+				Reason: sigInvalidCID,
 				Data:   endpoints,
 			})
 		return
@@ -242,13 +321,3 @@ func (c *Conn) handleConnectionParameterUpdateRequest(s sigCmd) {
 			Result: 0, // Accept.
 		})
 }
-
-// LECreditBasedConnectionRequest ...
-func (c *Conn) LECreditBasedConnectionRequest(s sigCmd) {
-	// TODO:
-}
-
-// LEFlowControlCredit ...
-func (c *Conn) LEFlowControlCredit(s sigCmd) {
-	// TODO:
-}
@@ -1,8 +1,8 @@
 package hci
 
 import (
-	"bytes"
 	"encoding/binary"
+	"io"
 )
 
 // SignalCommandReject is the code of Command Reject signaling packet.
@@ -17,18 +17,31 @@ type CommandReject struct {
 // Code returns the event code of the command.
 func (s CommandReject) Code() int { return 0x01 }
 
+// Len returns the length of the command parameters.
+func (s *CommandReject) Len() int { return 2 + len(s.Data) }
+
+// MarshalTo serializes the command parameters into b, which has at least
+// Len() bytes.
+func (s *CommandReject) MarshalTo(b []byte) {
+	binary.LittleEndian.PutUint16(b[0:], s.Reason)
+	copy(b[2:], s.Data)
+}
+
 // Marshal serializes the command parameters into binary form.
 func (s *CommandReject) Marshal() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0))
-	if err := binary.Write(buf, binary.LittleEndian, s); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	b := make([]byte, s.Len())
+	s.MarshalTo(b)
+	return b, nil
 }
 
 // Unmarshal de-serializes the binary data and stores the result in the receiver.
 func (s *CommandReject) Unmarshal(b []byte) error {
-	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, s)
+	if len(b) < 2 {
+		return io.ErrUnexpectedEOF
+	}
+	s.Reason = binary.LittleEndian.Uint16(b[0:])
+	s.Data = append([]byte(nil), b[2:]...)
+	return nil
 }
 
 // SignalDisconnectRequest is the code of Disconnect Request signaling packet.
@@ -43,18 +56,31 @@ type DisconnectRequest struct {
 // Code returns the event code of the command.
 func (s DisconnectRequest) Code() int { return 0x06 }
 
+// Len returns the length of the command parameters.
+func (s *DisconnectRequest) Len() int { return 4 }
+
+// MarshalTo serializes the command parameters into b, which has at least
+// Len() bytes.
+func (s *DisconnectRequest) MarshalTo(b []byte) {
+	binary.LittleEndian.PutUint16(b[0:], s.DestinationCID)
+	binary.LittleEndian.PutUint16(b[2:], s.SourceCID)
+}
+
 // Marshal serializes the command parameters into binary form.
 func (s *DisconnectRequest) Marshal() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0))
-	if err := binary.Write(buf, binary.LittleEndian, s); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	b := make([]byte, s.Len())
+	s.MarshalTo(b)
+	return b, nil
 }
 
 // Unmarshal de-serializes the binary data and stores the result in the receiver.
 func (s *DisconnectRequest) Unmarshal(b []byte) error {
-	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, s)
+	if len(b) < 4 {
+		return io.ErrUnexpectedEOF
+	}
+	s.DestinationCID = binary.LittleEndian.Uint16(b[0:])
+	s.SourceCID = binary.LittleEndian.Uint16(b[2:])
+	return nil
 }
 
 // SignalDisconnectResponse is the code of Disconnect Response signaling packet.
@@ -69,18 +95,31 @@ type DisconnectResponse struct {
 // Code returns the event code of the command.
 func (s DisconnectResponse) Code() int { return 0x07 }
 
+// Len returns the length of the command parameters.
+func (s *DisconnectResponse) Len() int { return 4 }
+
+// MarshalTo serializes the command parameters into b, which has at least
+// Len() bytes.
+func (s *DisconnectResponse) MarshalTo(b []byte) {
+	binary.LittleEndian.PutUint16(b[0:], s.DestinationCID)
+	binary.LittleEndian.PutUint16(b[2:], s.SourceCID)
+}
+
 // Marshal serializes the command parameters into binary form.
 func (s *DisconnectResponse) Marshal() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0))
-	if err := binary.Write(buf, binary.LittleEndian, s); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	b := make([]byte, s.Len())
+	s.MarshalTo(b)
+	return b, nil
 }
 
 // Unmarshal de-serializes the binary data and stores the result in the receiver.
 func (s *DisconnectResponse) Unmarshal(b []byte) error {
-	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, s)
+	if len(b) < 4 {
+		return io.ErrUnexpectedEOF
+	}
+	s.DestinationCID = binary.LittleEndian.Uint16(b[0:])
+	s.SourceCID = binary.LittleEndian.Uint16(b[2:])
+	return nil
 }
 
 // SignalConnectionParameterUpdateRequest is the code of Connection Parameter Update Request signaling packet.
@@ -97,18 +136,35 @@ type ConnectionParameterUpdateRequest struct {
 // Code returns the event code of the command.
 func (s ConnectionParameterUpdateRequest) Code() int { return 0x12 }
 
+// Len returns the length of the command parameters.
+func (s *ConnectionParameterUpdateRequest) Len() int { return 8 }
+
+// MarshalTo serializes the command parameters into b, which has at least
+// Len() bytes.
+func (s *ConnectionParameterUpdateRequest) MarshalTo(b []byte) {
+	binary.LittleEndian.PutUint16(b[0:], s.IntervalMin)
+	binary.LittleEndian.PutUint16(b[2:], s.IntervalMax)
+	binary.LittleEndian.PutUint16(b[4:], s.SlaveLatency)
+	binary.LittleEndian.PutUint16(b[6:], s.TimeoutMultiplier)
+}
+
 // Marshal serializes the command parameters into binary form.
 func (s *ConnectionParameterUpdateRequest) Marshal() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0))
-	if err := binary.Write(buf, binary.LittleEndian, s); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	b := make([]byte, s.Len())
+	s.MarshalTo(b)
+	return b, nil
 }
 
 // Unmarshal de-serializes the binary data and stores the result in the receiver.
 func (s *ConnectionParameterUpdateRequest) Unmarshal(b []byte) error {
-	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, s)
+	if len(b) < 8 {
+		return io.ErrUnexpectedEOF
+	}
+	s.IntervalMin = binary.LittleEndian.Uint16(b[0:])
+	s.IntervalMax = binary.LittleEndian.Uint16(b[2:])
+	s.SlaveLatency = binary.LittleEndian.Uint16(b[4:])
+	s.TimeoutMultiplier = binary.LittleEndian.Uint16(b[6:])
+	return nil
 }
 
 // SignalConnectionParameterUpdateResponse is the code of Connection Parameter Update Response signaling packet.
@@ -122,18 +178,29 @@ type ConnectionParameterUpdateResponse struct {
 // Code returns the event code of the command.
 func (s ConnectionParameterUpdateResponse) Code() int { return 0x13 }
 
+// Len returns the length of the command parameters.
+func (s *ConnectionParameterUpdateResponse) Len() int { return 2 }
+
+// MarshalTo serializes the command parameters into b, which has at least
+// Len() bytes.
+func (s *ConnectionParameterUpdateResponse) MarshalTo(b []byte) {
+	binary.LittleEndian.PutUint16(b[0:], s.Result)
+}
+
 // Marshal serializes the command parameters into binary form.
 func (s *ConnectionParameterUpdateResponse) Marshal() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0))
-	if err := binary.Write(buf, binary.LittleEndian, s); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	b := make([]byte, s.Len())
+	s.MarshalTo(b)
+	return b, nil
 }
 
 // Unmarshal de-serializes the binary data and stores the result in the receiver.
 func (s *ConnectionParameterUpdateResponse) Unmarshal(b []byte) error {
-	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, s)
+	if len(b) < 2 {
+		return io.ErrUnexpectedEOF
+	}
+	s.Result = binary.LittleEndian.Uint16(b[0:])
+	return nil
 }
 
 // SignalLECreditBasedConnectionRequest is the code of LE Credit Based Connection Request signaling packet.
@@ -151,18 +218,37 @@ type LECreditBasedConnectionRequest struct {
 // Code returns the event code of the command.
 func (s LECreditBasedConnectionRequest) Code() int { return 0x14 }
 
+// Len returns the length of the command parameters.
+func (s *LECreditBasedConnectionRequest) Len() int { return 10 }
+
+// MarshalTo serializes the command parameters into b, which has at least
+// Len() bytes.
+func (s *LECreditBasedConnectionRequest) MarshalTo(b []byte) {
+	binary.LittleEndian.PutUint16(b[0:], s.LEPSM)
+	binary.LittleEndian.PutUint16(b[2:], s.SourceCID)
+	binary.LittleEndian.PutUint16(b[4:], s.MTU)
+	binary.LittleEndian.PutUint16(b[6:], s.MPS)
+	binary.LittleEndian.PutUint16(b[8:], s.InitialCredits)
+}
+
 // Marshal serializes the command parameters into binary form.
 func (s *LECreditBasedConnectionRequest) Marshal() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0))
-	if err := binary.Write(buf, binary.LittleEndian, s); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	b := make([]byte, s.Len())
+	s.MarshalTo(b)
+	return b, nil
 }
 
 // Unmarshal de-serializes the binary data and stores the result in the receiver.
 func (s *LECreditBasedConnectionRequest) Unmarshal(b []byte) error {
-	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, s)
+	if len(b) < 10 {
+		return io.ErrUnexpectedEOF
+	}
+	s.LEPSM = binary.LittleEndian.Uint16(b[0:])
+	s.SourceCID = binary.LittleEndian.Uint16(b[2:])
+	s.MTU = binary.LittleEndian.Uint16(b[4:])
+	s.MPS = binary.LittleEndian.Uint16(b[6:])
+	s.InitialCredits = binary.LittleEndian.Uint16(b[8:])
+	return nil
 }
 
 // SignalLECreditBasedConnectionResponse is the code of LE Credit Based Connection Response signaling packet.
@@ -180,18 +266,37 @@ type LECreditBasedConnectionResponse struct {
 // Code returns the event code of the command.
 func (s LECreditBasedConnectionResponse) Code() int { return 0x15 }
 
+// Len returns the length of the command parameters.
+func (s *LECreditBasedConnectionResponse) Len() int { return 10 }
+
+// MarshalTo serializes the command parameters into b, which has at least
+// Len() bytes.
+func (s *LECreditBasedConnectionResponse) MarshalTo(b []byte) {
+	binary.LittleEndian.PutUint16(b[0:], s.DestinationCID)
+	binary.LittleEndian.PutUint16(b[2:], s.MTU)
+	binary.LittleEndian.PutUint16(b[4:], s.MPS)
+	binary.LittleEndian.PutUint16(b[6:], s.InitialCreditsCID)
+	binary.LittleEndian.PutUint16(b[8:], s.Result)
+}
+
 // Marshal serializes the command parameters into binary form.
 func (s *LECreditBasedConnectionResponse) Marshal() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0))
-	if err := binary.Write(buf, binary.LittleEndian, s); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	b := make([]byte, s.Len())
+	s.MarshalTo(b)
+	return b, nil
 }
 
 // Unmarshal de-serializes the binary data and stores the result in the receiver.
 func (s *LECreditBasedConnectionResponse) Unmarshal(b []byte) error {
-	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, s)
+	if len(b) < 10 {
+		return io.ErrUnexpectedEOF
+	}
+	s.DestinationCID = binary.LittleEndian.Uint16(b[0:])
+	s.MTU = binary.LittleEndian.Uint16(b[2:])
+	s.MPS = binary.LittleEndian.Uint16(b[4:])
+	s.InitialCreditsCID = binary.LittleEndian.Uint16(b[6:])
+	s.Result = binary.LittleEndian.Uint16(b[8:])
+	return nil
 }
 
 // SignalLEFlowControlCredit is the code of LE Flow Control Credit signaling packet.
@@ -206,16 +311,218 @@ type LEFlowControlCredit struct {
 // Code returns the event code of the command.
 func (s LEFlowControlCredit) Code() int { return 0x16 }
 
+// Len returns the length of the command parameters.
+func (s *LEFlowControlCredit) Len() int { return 4 }
+
+// MarshalTo serializes the command parameters into b, which has at least
+// Len() bytes.
+func (s *LEFlowControlCredit) MarshalTo(b []byte) {
+	binary.LittleEndian.PutUint16(b[0:], s.CID)
+	binary.LittleEndian.PutUint16(b[2:], s.Credits)
+}
+
 // Marshal serializes the command parameters into binary form.
 func (s *LEFlowControlCredit) Marshal() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0))
-	if err := binary.Write(buf, binary.LittleEndian, s); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	b := make([]byte, s.Len())
+	s.MarshalTo(b)
+	return b, nil
 }
 
 // Unmarshal de-serializes the binary data and stores the result in the receiver.
 func (s *LEFlowControlCredit) Unmarshal(b []byte) error {
-	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, s)
+	if len(b) < 4 {
+		return io.ErrUnexpectedEOF
+	}
+	s.CID = binary.LittleEndian.Uint16(b[0:])
+	s.Credits = binary.LittleEndian.Uint16(b[2:])
+	return nil
+}
+
+// SignalCreditBasedConnectionRequest is the code of Credit Based Connection Request signaling packet.
+const SignalCreditBasedConnectionRequest = 0x17
+
+// CreditBasedConnectionRequest implements Credit Based Connection Request (0x17) [Vol 3, Part A, 4.25].
+type CreditBasedConnectionRequest struct {
+	SPSM           uint16
+	MTU            uint16
+	MPS            uint16
+	InitialCredits uint16
+	SourceCID      []uint16
+}
+
+// Code returns the event code of the command.
+func (s CreditBasedConnectionRequest) Code() int { return 0x17 }
+
+// Len returns the length of the command parameters.
+func (s *CreditBasedConnectionRequest) Len() int { return 8 + 2*len(s.SourceCID) }
+
+// MarshalTo serializes the command parameters into b, which has at least
+// Len() bytes.
+func (s *CreditBasedConnectionRequest) MarshalTo(b []byte) {
+	binary.LittleEndian.PutUint16(b[0:], s.SPSM)
+	binary.LittleEndian.PutUint16(b[2:], s.MTU)
+	binary.LittleEndian.PutUint16(b[4:], s.MPS)
+	binary.LittleEndian.PutUint16(b[6:], s.InitialCredits)
+	for i, v := range s.SourceCID {
+		binary.LittleEndian.PutUint16(b[8+2*i:], v)
+	}
+}
+
+// Marshal serializes the command parameters into binary form.
+func (s *CreditBasedConnectionRequest) Marshal() ([]byte, error) {
+	b := make([]byte, s.Len())
+	s.MarshalTo(b)
+	return b, nil
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (s *CreditBasedConnectionRequest) Unmarshal(b []byte) error {
+	if len(b) < 8 {
+		return io.ErrUnexpectedEOF
+	}
+	s.SPSM = binary.LittleEndian.Uint16(b[0:])
+	s.MTU = binary.LittleEndian.Uint16(b[2:])
+	s.MPS = binary.LittleEndian.Uint16(b[4:])
+	s.InitialCredits = binary.LittleEndian.Uint16(b[6:])
+	s.SourceCID = make([]uint16, (len(b)-8)/2)
+	for i := range s.SourceCID {
+		s.SourceCID[i] = binary.LittleEndian.Uint16(b[8+2*i:])
+	}
+	return nil
+}
+
+// SignalCreditBasedConnectionResponse is the code of Credit Based Connection Response signaling packet.
+const SignalCreditBasedConnectionResponse = 0x18
+
+// CreditBasedConnectionResponse implements Credit Based Connection Response (0x18) [Vol 3, Part A, 4.26].
+type CreditBasedConnectionResponse struct {
+	MTU            uint16
+	MPS            uint16
+	InitialCredits uint16
+	Result         uint16
+	DestinationCID []uint16
+}
+
+// Code returns the event code of the command.
+func (s CreditBasedConnectionResponse) Code() int { return 0x18 }
+
+// Len returns the length of the command parameters.
+func (s *CreditBasedConnectionResponse) Len() int { return 8 + 2*len(s.DestinationCID) }
+
+// MarshalTo serializes the command parameters into b, which has at least
+// Len() bytes.
+func (s *CreditBasedConnectionResponse) MarshalTo(b []byte) {
+	binary.LittleEndian.PutUint16(b[0:], s.MTU)
+	binary.LittleEndian.PutUint16(b[2:], s.MPS)
+	binary.LittleEndian.PutUint16(b[4:], s.InitialCredits)
+	binary.LittleEndian.PutUint16(b[6:], s.Result)
+	for i, v := range s.DestinationCID {
+		binary.LittleEndian.PutUint16(b[8+2*i:], v)
+	}
+}
+
+// Marshal serializes the command parameters into binary form.
+func (s *CreditBasedConnectionResponse) Marshal() ([]byte, error) {
+	b := make([]byte, s.Len())
+	s.MarshalTo(b)
+	return b, nil
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (s *CreditBasedConnectionResponse) Unmarshal(b []byte) error {
+	if len(b) < 8 {
+		return io.ErrUnexpectedEOF
+	}
+	s.MTU = binary.LittleEndian.Uint16(b[0:])
+	s.MPS = binary.LittleEndian.Uint16(b[2:])
+	s.InitialCredits = binary.LittleEndian.Uint16(b[4:])
+	s.Result = binary.LittleEndian.Uint16(b[6:])
+	s.DestinationCID = make([]uint16, (len(b)-8)/2)
+	for i := range s.DestinationCID {
+		s.DestinationCID[i] = binary.LittleEndian.Uint16(b[8+2*i:])
+	}
+	return nil
+}
+
+// SignalCreditBasedReconfigureRequest is the code of Credit Based Reconfigure Request signaling packet.
+const SignalCreditBasedReconfigureRequest = 0x19
+
+// CreditBasedReconfigureRequest implements Credit Based Reconfigure Request (0x19) [Vol 3, Part A, 4.27].
+type CreditBasedReconfigureRequest struct {
+	MTU            uint16
+	MPS            uint16
+	DestinationCID []uint16
+}
+
+// Code returns the event code of the command.
+func (s CreditBasedReconfigureRequest) Code() int { return 0x19 }
+
+// Len returns the length of the command parameters.
+func (s *CreditBasedReconfigureRequest) Len() int { return 4 + 2*len(s.DestinationCID) }
+
+// MarshalTo serializes the command parameters into b, which has at least
+// Len() bytes.
+func (s *CreditBasedReconfigureRequest) MarshalTo(b []byte) {
+	binary.LittleEndian.PutUint16(b[0:], s.MTU)
+	binary.LittleEndian.PutUint16(b[2:], s.MPS)
+	for i, v := range s.DestinationCID {
+		binary.LittleEndian.PutUint16(b[4+2*i:], v)
+	}
+}
+
+// Marshal serializes the command parameters into binary form.
+func (s *CreditBasedReconfigureRequest) Marshal() ([]byte, error) {
+	b := make([]byte, s.Len())
+	s.MarshalTo(b)
+	return b, nil
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (s *CreditBasedReconfigureRequest) Unmarshal(b []byte) error {
+	if len(b) < 4 {
+		return io.ErrUnexpectedEOF
+	}
+	s.MTU = binary.LittleEndian.Uint16(b[0:])
+	s.MPS = binary.LittleEndian.Uint16(b[2:])
+	s.DestinationCID = make([]uint16, (len(b)-4)/2)
+	for i := range s.DestinationCID {
+		s.DestinationCID[i] = binary.LittleEndian.Uint16(b[4+2*i:])
+	}
+	return nil
+}
+
+// SignalCreditBasedReconfigureResponse is the code of Credit Based Reconfigure Response signaling packet.
+const SignalCreditBasedReconfigureResponse = 0x1A
+
+// CreditBasedReconfigureResponse implements Credit Based Reconfigure Response (0x1A) [Vol 3, Part A, 4.28].
+type CreditBasedReconfigureResponse struct {
+	Result uint16
+}
+
+// Code returns the event code of the command.
+func (s CreditBasedReconfigureResponse) Code() int { return 0x1A }
+
+// Len returns the length of the command parameters.
+func (s *CreditBasedReconfigureResponse) Len() int { return 2 }
+
+// MarshalTo serializes the command parameters into b, which has at least
+// Len() bytes.
+func (s *CreditBasedReconfigureResponse) MarshalTo(b []byte) {
+	binary.LittleEndian.PutUint16(b[0:], s.Result)
+}
+
+// Marshal serializes the command parameters into binary form.
+func (s *CreditBasedReconfigureResponse) Marshal() ([]byte, error) {
+	b := make([]byte, s.Len())
+	s.MarshalTo(b)
+	return b, nil
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (s *CreditBasedReconfigureResponse) Unmarshal(b []byte) error {
+	if len(b) < 2 {
+		return io.ErrUnexpectedEOF
+	}
+	s.Result = binary.LittleEndian.Uint16(b[0:])
+	return nil
 }
@@ -1,9 +1,15 @@
 package hci
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/crypto"
+	"github.com/go-ble/ble/linux/hci/cmd"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -23,26 +29,272 @@ const (
 	pairingKeypress          = 0x0E // Pairing Keypress Notification LE-U
 )
 
-func (c *Conn) sendSMP(p pdu) error {
-	buf := bytes.NewBuffer(make([]byte, 0))
-	if err := binary.Write(buf, binary.LittleEndian, uint16(4+len(p))); err != nil {
-		return err
+// AuthReq flags [Vol 3, Part H, 3.5.1].
+const (
+	authReqBonding = 0x01 // Bonding_Flags: Bonding
+	authReqMITM    = 0x04 // MITM protection requested
+	authReqSC      = 0x08 // LE Secure Connections pairing supported
+)
+
+// Key distribution flags [Vol 3, Part H, 3.6.1].
+const (
+	keyDistEncKey  = 0x01 // LTK, EDIV and Rand (legacy pairing)
+	keyDistIDKey   = 0x02 // IRK and Identity Address
+	keyDistSignKey = 0x04 // CSRK
+)
+
+const (
+	// smpTimeout is the SMP transaction timeout [Vol 3, Part H, 3.4].
+	smpTimeout = 30 * time.Second
+
+	// Encryption key sizes in octets [Vol 3, Part H, 2.3.4].
+	minKeySize = 7
+	maxKeySize = 16
+)
+
+// Association models [Vol 3, Part H, 2.3.5.1].
+const (
+	justWorks          = iota // Just Works
+	passkeyInitDisplay        // Passkey Entry; initiator displays, responder inputs.
+	passkeyRespDisplay        // Passkey Entry; responder displays, initiator inputs.
+	passkeyBothInput          // Passkey Entry; both initiator and responder input.
+	numericComparison         // Numeric Comparison; LE Secure Connections only.
+	outOfBand                 // Out Of Band; LE legacy pairing only.
+)
+
+// pairingMethod maps the IO capabilities to the association model used in LE
+// legacy pairing, indexed by [responder][initiator] [Vol 3, Part H, 2.3.5.1].
+var pairingMethod = [5][5]int{
+	ble.IOCapDisplayOnly:     {justWorks, justWorks, passkeyRespDisplay, justWorks, passkeyRespDisplay},
+	ble.IOCapDisplayYesNo:    {justWorks, justWorks, passkeyRespDisplay, justWorks, passkeyRespDisplay},
+	ble.IOCapKeyboardOnly:    {passkeyInitDisplay, passkeyInitDisplay, passkeyBothInput, justWorks, passkeyInitDisplay},
+	ble.IOCapNoInputNoOutput: {justWorks, justWorks, justWorks, justWorks, justWorks},
+	ble.IOCapKeyboardDisplay: {passkeyInitDisplay, passkeyInitDisplay, passkeyRespDisplay, justWorks, passkeyInitDisplay},
+}
+
+// pairingMethodSC maps the IO capabilities to the association model used in LE
+// Secure Connections, indexed by [responder][initiator] [Vol 3, Part H, 2.3.5.1].
+var pairingMethodSC = [5][5]int{
+	ble.IOCapDisplayOnly:     {justWorks, justWorks, passkeyRespDisplay, justWorks, passkeyRespDisplay},
+	ble.IOCapDisplayYesNo:    {justWorks, numericComparison, passkeyRespDisplay, justWorks, numericComparison},
+	ble.IOCapKeyboardOnly:    {passkeyInitDisplay, passkeyInitDisplay, passkeyBothInput, justWorks, passkeyInitDisplay},
+	ble.IOCapNoInputNoOutput: {justWorks, justWorks, justWorks, justWorks, justWorks},
+	ble.IOCapKeyboardDisplay: {passkeyInitDisplay, numericComparison, passkeyRespDisplay, justWorks, numericComparison},
+}
+
+// pairingFeatures implements the Pairing Request and Pairing Response PDUs [Vol 3, Part H, 3.5.1 & 3.5.2].
+type pairingFeatures []byte
+
+func (p pairingFeatures) ioCap() uint8       { return p[1] }
+func (p pairingFeatures) oobFlag() uint8     { return p[2] }
+func (p pairingFeatures) authReq() uint8     { return p[3] }
+func (p pairingFeatures) maxKeySize() uint8  { return p[4] }
+func (p pairingFeatures) initKeyDist() uint8 { return p[5] }
+func (p pairingFeatures) respKeyDist() uint8 { return p[6] }
+
+// scIOCap returns the IOcap used in f6; AuthReq, OOB data flag, and IO capability.
+func (p pairingFeatures) scIOCap() [3]byte { return [3]byte{p[1], p[2], p[3]} }
+
+// smpParams holds the local pairing features.
+type smpParams struct {
+	maxKeySize  uint8
+	initKeyDist uint8
+	respKeyDist uint8
+
+	// noSC disables LE Secure Connections pairing, and scOnly rejects LE
+	// legacy pairing (Secure Connections Only Mode).
+	noSC   bool
+	scOnly bool
+
+	// agent provides the IO capability and the authentication requirements,
+	// and involves the user in pairing. Without an agent, the device pairs
+	// and bonds with Just Works.
+	agent ble.PairingAgent
+}
+
+func (p *smpParams) init() {
+	p.maxKeySize = maxKeySize
+	p.initKeyDist = keyDistEncKey | keyDistIDKey | keyDistSignKey
+	p.respKeyDist = keyDistEncKey | keyDistIDKey | keyDistSignKey
+}
+
+// authReq returns the AuthReq flags of the local device.
+func (p *smpParams) authReq() uint8 {
+	authReq := uint8(authReqSC)
+	if p.noSC {
+		authReq = 0
 	}
-	if err := binary.Write(buf, binary.LittleEndian, cidSMP); err != nil {
-		return err
+	if p.agent == nil {
+		return authReq | authReqBonding
 	}
-	if err := binary.Write(buf, binary.LittleEndian, p); err != nil {
-		return err
+	mitm, bond := p.agent.AuthRequirements()
+	if bond {
+		authReq |= authReqBonding
+	}
+	if mitm {
+		authReq |= authReqMITM
+	}
+	return authReq
+}
+
+// Keys holds the keys distributed by one side of a pairing procedure.
+type Keys struct {
+	LTK  [16]byte // Long Term Key
+	EDIV uint16   // Encrypted Diversifier
+	Rand uint64   // Random Number
+
+	IRK        [16]byte // Identity Resolving Key
+	IDAddrType uint8    // Identity Address Type; 0x00: public, 0x01: static random.
+	IDAddr     [6]byte  // Identity Address
+
+	CSRK        [16]byte // Connection Signature Resolving Key
+	SignCounter uint32   // Sign counter of the next data signed with the CSRK.
+
+	// Dist indicates which of the keys above were distributed. In LE Secure
+	// Connections, the LTK is generated by both devices instead.
+	Dist uint8
+
+	KeySize           int  // Encryption key size in octets.
+	Authenticated     bool // The keys were generated with MITM protection.
+	SecureConnections bool // The keys were generated in LE Secure Connections pairing.
+}
+
+// match returns true if the LTK is identified by the EDIV and Rand. The LTK
+// generated in LE Secure Connections is identified by zero EDIV and Rand.
+func (k *Keys) match(ediv uint16, rand uint64) bool {
+	if k.SecureConnections {
+		return ediv == 0 && rand == 0
+	}
+	return k.Dist&keyDistEncKey != 0 && k.EDIV == ediv && k.Rand == rand
+}
+
+// features returns the Pairing Request or Response PDU of the local device,
+// along with the OOB data of the peer device, if available.
+func (s *smp) features(code uint8) (pairingFeatures, []byte) {
+	p := &s.c.hci.smp
+	ioCap, oobFlag, authReq := ble.IOCapNoInputNoOutput, uint8(0x00), p.authReq()
+	var oob []byte
+	if p.agent != nil {
+		ioCap = p.agent.IOCapability()
+		if tk, ok := p.agent.OOBData(s.c); ok && len(tk) == 16 {
+			// The OOB data is used in LE legacy pairing only.
+			oobFlag, oob = 0x01, tk
+			authReq &^= authReqSC
+		}
+	}
+	return pairingFeatures{code, uint8(ioCap), oobFlag, authReq, p.maxKeySize, p.initKeyDist, p.respKeyDist}, oob
+}
+
+// authorize asks the user whether to proceed the pairing requested by the peer device.
+func (s *smp) authorize() bool {
+	a := s.c.hci.smp.agent
+	return a == nil || a.AuthorizePairing(s.c)
+}
+
+// smp implements the Security Manager Protocol of a connection [Vol 3, Part H].
+type smp struct {
+	sync.Mutex
+	c *Conn
+
+	chIn   chan pdu
+	chPair chan chan error
+	chEnc  chan error
+
+	// stk is the STK of the ongoing LE legacy pairing, or the LTK generated
+	// in the ongoing LE Secure Connections pairing, which the slave replies
+	// to the controller upon LE Long Term Key Request.
+	stk *[16]byte
+
+	// local and remote keys distributed in the last pairing.
+	local  *Keys
+	remote *Keys
+
+	// bondLTK is set while the slave encrypts the link with the LTK of the
+	// bond, which the controller was replied with.
+	bondLTK bool
+
+	// timedOut is set when a SMP procedure timed out. No further SMP
+	// procedure shall be performed until a new link is established.
+	timedOut bool
+}
+
+func newSMP(c *Conn) *smp {
+	s := &smp{
+		c:      c,
+		chIn:   make(chan pdu, 16),
+		chPair: make(chan chan error),
+		chEnc:  make(chan error, 1),
+	}
+	go s.loop()
+	return s
+}
+
+// Pair performs pairing with the remote device, and returns when the link is
+// encrypted with the newly generated key. If the local device is a master, it
+// initiates the pairing. Otherwise, it sends a Security Request to the master,
+// which may encrypt the link with the keys of an existing bond instead.
+func (c *Conn) Pair() error {
+	ch := make(chan error, 1)
+	select {
+	case c.smp.chPair <- ch:
+	case <-c.chDone:
+		return errors.Wrap(ErrDisconnected, "can't pair")
+	}
+	return <-ch
+}
+
+// Encrypted returns true if the link is currently encrypted.
+func (c *Conn) Encrypted() bool {
+	c.muSec.RLock()
+	defer c.muSec.RUnlock()
+	return c.encrypted
+}
+
+// Authenticated returns true if the link is currently encrypted with an
+// authenticated (MITM protected) key.
+func (c *Conn) Authenticated() bool {
+	c.muSec.RLock()
+	defer c.muSec.RUnlock()
+	return c.encrypted && c.authenticated
+}
+
+// KeySize returns the size, in octets, of the key the link is currently
+// encrypted with, or 0 if the link is not encrypted or the size is unknown.
+func (c *Conn) KeySize() int {
+	c.muSec.RLock()
+	defer c.muSec.RUnlock()
+	if !c.encrypted {
+		return 0
+	}
+	return c.keySize
+}
+
+// Keys returns the keys distributed by the local and the remote device in the
+// last pairing procedure. It returns nil if the link has not been paired.
+func (c *Conn) Keys() (local, remote *Keys) {
+	c.smp.Lock()
+	defer c.smp.Unlock()
+	return c.smp.local, c.smp.remote
+}
+
+func (c *Conn) sendSMP(p pdu) error {
+	var hdr [4]byte
+	binary.LittleEndian.PutUint16(hdr[0:2], uint16(len(p)))
+	binary.LittleEndian.PutUint16(hdr[2:4], cidSMP)
+	_, err := c.writePDU(hdr[:], p)
+	if logger.IsDebug() {
+		logger.Debug("smp", "send", fmt.Sprintf("[%X%X]", hdr, []byte(p)))
 	}
-	_, err := c.writePDU(buf.Bytes())
-	logger.Debug("smp", "send", fmt.Sprintf("[%X]", buf.Bytes()))
 	return err
 }
 
 func (c *Conn) handleSMP(p pdu) error {
 	logger.Debug("smp", "recv", fmt.Sprintf("[%X]", p))
-	code := p[0]
-	switch code {
+	b := p.payload()
+	if len(b) == 0 {
+		return nil
+	}
+	switch b[0] {
 	case pairingRequest:
 	case pairingResponse:
 	case pairingConfirm:
@@ -61,7 +313,1050 @@ func (c *Conn) handleSMP(p pdu) error {
 		// If a packet is received with a reserved Code it shall be ignored. [Vol 3, Part H, 3.3]
 		return nil
 	}
-	// FIXME: work aound to the lack of SMP implementation - always return non-supported.
-	// C.5.1 Pairing Not Supported by Slave
-	return c.sendSMP([]byte{pairingFailed, 0x05})
+	// The buffer of the PDU is reused once it's handled.
+	select {
+	case c.smp.chIn <- pdu(append([]byte(nil), b...)):
+	default:
+		_ = logger.Error("smp", "recv", "can't enqueue incoming SMP packet")
+	}
+	return nil
+}
+
+// handleLongTermKeyRequest replies the controller with the key of the ongoing
+// pairing, or the LTK of the last pairing or the bond with the peer device,
+// if EDIV and Rand match.
+func (c *Conn) handleLongTermKeyRequest(ediv uint16, rand uint64) {
+	var ltk *[16]byte
+	s := c.smp
+	s.Lock()
+	switch {
+	case s.stk != nil && ediv == 0 && rand == 0:
+		ltk = s.stk
+	case s.local != nil && s.local.match(ediv, rand):
+		ltk = &s.local.LTK
+	}
+	s.bondLTK = false
+	s.Unlock()
+	if ltk == nil {
+		if b := c.bond(); b != nil && b.Local.match(ediv, rand) {
+			ltk = &b.Local.LTK
+			s.restore(b)
+			s.Lock()
+			s.bondLTK = true
+			s.Unlock()
+		}
+	}
+
+	if ltk == nil {
+		c.hci.Send(&cmd.LELongTermKeyRequestNegativeReply{
+			ConnectionHandle: c.param.ConnectionHandle(),
+		}, nil)
+		return
+	}
+	c.hci.Send(&cmd.LELongTermKeyRequestReply{
+		ConnectionHandle: c.param.ConnectionHandle(),
+		LongTermKey:      *ltk,
+	}, nil)
+}
+
+// handleEncryptionChange is called when the encryption of the link is changed or refreshed.
+func (c *Conn) handleEncryptionChange(status uint8, enabled bool) {
+	var err error
+	if status != 0x00 {
+		err = ErrCommand(status)
+	}
+	c.muSec.Lock()
+	if err == nil {
+		c.encrypted = enabled
+	}
+	c.muSec.Unlock()
+	c.smp.Lock()
+	bonded := c.smp.bondLTK && err == nil && enabled
+	c.smp.bondLTK = false
+	c.smp.Unlock()
+	if bonded {
+		c.setBonded()
+	}
+	select {
+	case c.smp.chEnc <- err:
+	default:
+	}
+}
+
+func (s *smp) loop() {
+	for {
+		select {
+		case p, ok := <-s.chIn:
+			if !ok {
+				return
+			}
+			s.handleIdle(p)
+		case ch := <-s.chPair:
+			ch <- s.pair()
+		}
+	}
+}
+
+// handleIdle handles the SMP packets received while there is no procedure in progress.
+func (s *smp) handleIdle(p pdu) {
+	var err error
+	switch p[0] {
+	case pairingRequest:
+		if s.c.param.Role() != roleSlave {
+			s.fail(ErrSMPCommandNotSupported)
+			return
+		}
+		if !s.authorize() {
+			s.fail(ErrSMPPairingNotSupported)
+			return
+		}
+		err = s.respond(pairingFeatures(p))
+	case securityRequest:
+		if s.c.param.Role() != roleMaster {
+			s.fail(ErrSMPCommandNotSupported)
+			return
+		}
+		// Encrypt the link with the bonded keys, if they meet the requested
+		// security, instead of pairing again [Vol 3, Part H, 2.4.6].
+		if b := s.c.bond(); b != nil && len(p) == 2 && (p[1]&authReqMITM == 0 || b.Remote.Authenticated) {
+			if err = s.c.encryptBonded(b); err == nil {
+				return
+			}
+			_ = logger.Error("smp", "can't encrypt with bonded keys", err)
+		}
+		if !s.authorize() {
+			s.fail(ErrSMPPairingNotSupported)
+			return
+		}
+		err = s.initiate()
+	case pairingFailed, pairingKeypress:
+		return
+	default:
+		s.fail(ErrSMPUnspecified)
+		return
+	}
+	if err != nil {
+		_ = logger.Error("smp", "pairing failed", err)
+	}
+}
+
+// pair performs a pairing procedure requested locally.
+func (s *smp) pair() error {
+	if s.c.param.Role() == roleMaster {
+		return s.initiate()
+	}
+	if err := s.check(); err != nil {
+		return err
+	}
+	s.drainEncryption()
+	if err := s.c.sendSMP([]byte{securityRequest, s.c.hci.smp.authReq()}); err != nil {
+		return err
+	}
+
+	// The master either starts pairing, or encrypts the link with the keys
+	// of an existing bond [Vol 3, Part H, 2.4.6].
+	tmo := time.NewTimer(smpTimeout)
+	defer tmo.Stop()
+	select {
+	case p, ok := <-s.chIn:
+		switch {
+		case !ok:
+			return ErrDisconnected
+		case p[0] == pairingFailed && len(p) == 2:
+			return SMPError(p[1])
+		case p[0] != pairingRequest:
+			return s.fail(ErrSMPUnspecified)
+		}
+		return s.respond(pairingFeatures(p))
+	case err := <-s.chEnc:
+		return err
+	case <-tmo.C:
+		s.Lock()
+		s.timedOut = true
+		s.Unlock()
+		return ErrSMPTimeout
+	}
+}
+
+// check returns an error if no further SMP procedure is allowed.
+func (s *smp) check() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.timedOut {
+		return ErrSMPTimeout
+	}
+	return nil
+}
+
+// recv waits for the next SMP packet of the specified code. The Keypress
+// Notifications, which the remote device may send at any time during the
+// passkey entry, are informational only, and dropped [Vol 3, Part H, 3.5.8].
+func (s *smp) recv(code uint8) ([]byte, error) {
+	tmo := time.NewTimer(smpTimeout)
+	defer tmo.Stop()
+	for {
+		select {
+		case p, ok := <-s.chIn:
+			if !ok {
+				return nil, ErrDisconnected
+			}
+			switch {
+			case p[0] == pairingFailed && len(p) == 2:
+				return nil, SMPError(p[1])
+			case p[0] == pairingKeypress && code != pairingKeypress:
+				logger.Debug("smp", "keypress", fmt.Sprintf("[%X]", []byte(p)))
+				continue
+			case p[0] != code:
+				return nil, s.fail(ErrSMPUnspecified)
+			case len(p) != smpLen[code]:
+				return nil, s.fail(ErrSMPInvalidParameters)
+			}
+			return p, nil
+		case <-tmo.C:
+			s.Lock()
+			s.timedOut = true
+			s.Unlock()
+			return nil, ErrSMPTimeout
+		}
+	}
+}
+
+// smpLen is the length of the SMP packets, including the code.
+var smpLen = map[uint8]int{
+	pairingRequest:           7,
+	pairingResponse:          7,
+	pairingConfirm:           17,
+	pairingRandom:            17,
+	pairingFailed:            2,
+	encryptionInformation:    17,
+	masterIdentification:     11,
+	identiInformation:        17,
+	identityAddreInformation: 8,
+	signingInformation:       17,
+	securityRequest:          2,
+	pairingPublicKey:         65,
+	pairingDHKeyCheck:        17,
+	pairingKeypress:          2,
+}
+
+// fail aborts the pairing by sending a Pairing Failed, and returns err.
+// The reason is err itself if it's a SMPError, or Unspecified Reason otherwise.
+func (s *smp) fail(err error) error {
+	s.Lock()
+	s.stk = nil
+	s.Unlock()
+	reason, ok := err.(SMPError)
+	if !ok {
+		reason = ErrSMPUnspecified
+	}
+	if err := s.c.sendSMP([]byte{pairingFailed, uint8(reason)}); err != nil {
+		return err
+	}
+	return err
+}
+
+// drainEncryption discards the stale encryption changes, if any.
+func (s *smp) drainEncryption() {
+	select {
+	case <-s.chEnc:
+	default:
+	}
+}
+
+// waitEncryption waits for the link to be encrypted.
+func (s *smp) waitEncryption() error {
+	tmo := time.NewTimer(smpTimeout)
+	defer tmo.Stop()
+	select {
+	case err := <-s.chEnc:
+		return err
+	case <-s.c.chDone:
+		return ErrDisconnected
+	case <-tmo.C:
+		return ErrSMPTimeout
+	}
+}
+
+// addrs returns the addresses and address types of the initiator and the responder.
+func (s *smp) addrs() (iat, rat uint8, ia, ra [6]byte) {
+	ltyp, local := s.c.localType, s.c.local
+	if s.c.param.Role() == roleMaster {
+		return ltyp, s.c.param.PeerAddressType(), local, s.c.param.PeerAddress()
+	}
+	return s.c.param.PeerAddressType(), ltyp, s.c.param.PeerAddress(), local
+}
+
+// method returns the association model of the pairing.
+func (s *smp) method(preq, pres, local pairingFeatures, sc bool) (int, error) {
+	if preq.ioCap() > uint8(ble.IOCapKeyboardDisplay) || pres.ioCap() > uint8(ble.IOCapKeyboardDisplay) {
+		return 0, ErrSMPInvalidParameters
+	}
+	// In LE legacy pairing, OOB is used if both devices have the OOB data.
+	// In LE Secure Connections, it's used if either device has the OOB data
+	// of the other, which we never generate [Vol 3, Part H, 2.3.5.1].
+	if !sc && preq.oobFlag() == 0x01 && pres.oobFlag() == 0x01 {
+		return outOfBand, nil
+	}
+	if sc && (preq.oobFlag() != 0x00 || pres.oobFlag() != 0x00) {
+		return 0, ErrSMPOOBNotAvailable
+	}
+	// Just Works is used if neither device requires MITM protection.
+	if (preq.authReq()|pres.authReq())&authReqMITM == 0 {
+		return justWorks, nil
+	}
+	m := pairingMethod[pres.ioCap()][preq.ioCap()]
+	if sc {
+		m = pairingMethodSC[pres.ioCap()][preq.ioCap()]
+	}
+	if m == justWorks && local.authReq()&authReqMITM != 0 {
+		// We require MITM protection, which can't be achieved with the IO capabilities.
+		return 0, ErrSMPAuthenticationRequirements
+	}
+	return m, nil
+}
+
+// passkey returns the passkey of Passkey Entry, which is either generated
+// and displayed to the user, or input by the user.
+func (s *smp) passkey(m int, initiator bool) (int, error) {
+	a := s.c.hci.smp.agent
+	if a == nil {
+		return 0, ErrSMPPasskeyEntryFailed
+	}
+	if (m == passkeyInitDisplay && initiator) || (m == passkeyRespDisplay && !initiator) {
+		passkey, err := randomPasskey(s.c.hci.toolbox)
+		if err != nil {
+			return 0, err
+		}
+		a.DisplayPasskey(s.c, uint32(passkey))
+		return passkey, nil
+	}
+	passkey, err := a.RequestPasskey(s.c)
+	if err != nil || passkey > 999999 {
+		return 0, ErrSMPPasskeyEntryFailed
+	}
+	return int(passkey), nil
+}
+
+// tk returns the Temporary Key of LE legacy pairing, involving the user if
+// Passkey Entry is used.
+func (s *smp) tk(m int, initiator bool, oob []byte) ([16]byte, error) {
+	var tk [16]byte
+	switch m {
+	case justWorks:
+		return tk, nil
+	case outOfBand:
+		copy(tk[:], oob)
+		return tk, nil
+	}
+	passkey, err := s.passkey(m, initiator)
+	if err != nil {
+		return tk, err
+	}
+	return passkeyTK(passkey), nil
+}
+
+// confirm asks the user to confirm the number displayed on both devices in Numeric Comparison.
+func (s *smp) confirm(number int) error {
+	if a := s.c.hci.smp.agent; a != nil && a.ConfirmNumber(s.c, uint32(number)) {
+		return nil
+	}
+	return ErrSMPNumericComparisonFailed
+}
+
+// negotiate validates the pairing features, and returns the association
+// model, the encryption key size, and whether LE Secure Connections is used.
+// local is either preq or pres, whichever the local device sent.
+func (s *smp) negotiate(preq, pres, local pairingFeatures) (m int, size int, sc bool, err error) {
+	size = int(preq.maxKeySize())
+	if int(pres.maxKeySize()) < size {
+		size = int(pres.maxKeySize())
+	}
+	if size < minKeySize || size > maxKeySize {
+		return 0, 0, false, ErrSMPEncryptionKeySize
+	}
+	sc = preq.authReq()&pres.authReq()&authReqSC != 0
+	if s.c.hci.smp.scOnly {
+		// Secure Connections Only Mode requires LE Secure Connections
+		// pairing with 128-bit encryption key [Vol 3, Part C, 10.2.4].
+		if !sc {
+			return 0, 0, false, ErrSMPAuthenticationRequirements
+		}
+		if size != maxKeySize {
+			return 0, 0, false, ErrSMPEncryptionKeySize
+		}
+	}
+	m, err = s.method(preq, pres, local, sc)
+	return m, size, sc, err
+}
+
+// send16 sends a SMP packet carrying a 128-bit value.
+func (s *smp) send16(code uint8, v [16]byte) error {
+	return s.c.sendSMP(append([]byte{code}, v[:]...))
+}
+
+// recv16 waits for a SMP packet carrying a 128-bit value.
+func (s *smp) recv16(code uint8) ([16]byte, error) {
+	var v [16]byte
+	b, err := s.recv(code)
+	if err != nil {
+		return v, err
+	}
+	copy(v[:], b[1:])
+	return v, nil
+}
+
+// initiate performs pairing as the initiator [Vol 3, Part H, 2.3].
+func (s *smp) initiate() error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	preq, oob := s.features(pairingRequest)
+	if err := s.c.sendSMP(pdu(preq)); err != nil {
+		return err
+	}
+	b, err := s.recv(pairingResponse)
+	if err != nil {
+		return err
+	}
+	pres := pairingFeatures(b)
+	m, size, sc, err := s.negotiate(preq, pres, preq)
+	if err != nil {
+		return s.fail(err)
+	}
+
+	var key [16]byte
+	if sc {
+		key, err = s.initiateSC(preq, pres, m)
+	} else {
+		key, err = s.initiateLegacy(preq, pres, m, oob)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Encrypt the link with the STK or LTK [Vol 3, Part H, 2.4.4.1].
+	key = maskKey(key, size)
+	if err := s.c.startEncryption(key, 0, 0); err != nil {
+		return s.fail(err)
+	}
+	auth := m != justWorks
+	s.c.setSecurity(size, auth)
+
+	initDist, respDist := pres.initKeyDist(), pres.respKeyDist()
+	if sc {
+		// EncKey is ignored in LE Secure Connections [Vol 3, Part H, 3.6.1].
+		initDist &^= keyDistEncKey
+		respDist &^= keyDistEncKey
+	}
+
+	// The slave distributes its keys first [Vol 3, Part H, 3.6.1].
+	remote, err := s.recvKeys(respDist)
+	if err != nil {
+		return err
+	}
+	local, err := s.sendKeys(initDist, size)
+	if err != nil {
+		return err
+	}
+	if sc {
+		local.LTK, remote.LTK = key, key
+	}
+	s.done(local, remote, size, auth, sc)
+	if preq.authReq()&pres.authReq()&authReqBonding != 0 {
+		s.c.saveBond(local, remote)
+	}
+	return nil
+}
+
+// initiateLegacy performs the phase 2 of LE legacy pairing as the initiator,
+// and returns the STK [Vol 3, Part H, 2.3.5].
+func (s *smp) initiateLegacy(preq, pres pairingFeatures, m int, oob []byte) ([16]byte, error) {
+	var stk [16]byte
+	tk, err := s.tk(m, true, oob)
+	if err != nil {
+		return stk, s.fail(err)
+	}
+
+	tb := s.c.hci.toolbox
+	iat, rat, ia, ra := s.addrs()
+	mrand, err := tb.Rand16()
+	if err != nil {
+		return stk, s.fail(err)
+	}
+	mconfirm, err := tb.C1(tk, mrand, preq, pres, iat, rat, ia, ra)
+	if err != nil {
+		return stk, s.fail(err)
+	}
+	if err := s.send16(pairingConfirm, mconfirm); err != nil {
+		return stk, err
+	}
+	sconfirm, err := s.recv16(pairingConfirm)
+	if err != nil {
+		return stk, err
+	}
+	if err := s.send16(pairingRandom, mrand); err != nil {
+		return stk, err
+	}
+	srand, err := s.recv16(pairingRandom)
+	if err != nil {
+		return stk, err
+	}
+	if c, err := tb.C1(tk, srand, preq, pres, iat, rat, ia, ra); err != nil || c != sconfirm {
+		return stk, s.fail(ErrSMPConfirmValueFailed)
+	}
+	if stk, err = tb.S1(tk, srand, mrand); err != nil {
+		return stk, s.fail(err)
+	}
+	return stk, nil
+}
+
+// initiateSC performs the phase 2 of LE Secure Connections pairing as the
+// initiator, and returns the LTK [Vol 3, Part H, 2.3.5.6].
+func (s *smp) initiateSC(preq, pres pairingFeatures, m int) ([16]byte, error) {
+	var ltk [16]byte
+	priv, pka, err := crypto.GenerateKey()
+	if err != nil {
+		return ltk, s.fail(err)
+	}
+	if err := s.c.sendSMP(append([]byte{pairingPublicKey}, pka...)); err != nil {
+		return ltk, err
+	}
+	b, err := s.recv(pairingPublicKey)
+	if err != nil {
+		return ltk, err
+	}
+	pkb := b[1:]
+	dhkey, err := crypto.DHKey(priv, pkb)
+	if err != nil {
+		return ltk, s.fail(ErrSMPDHKeyCheckFailed)
+	}
+
+	na, nb, r, err := s.authenticate(m, true, pka[:32], pkb[:32])
+	if err != nil {
+		return ltk, err
+	}
+
+	// Authentication stage 2 [Vol 3, Part H, 2.3.5.6.5].
+	tb := s.c.hci.toolbox
+	a1, a2 := s.scAddrs()
+	macKey, ltk, err := tb.F5(dhkey, na, nb, a1, a2)
+	if err != nil {
+		return ltk, s.fail(err)
+	}
+	ea, err := tb.F6(macKey, na, nb, r, preq.scIOCap(), a1, a2)
+	if err != nil {
+		return ltk, s.fail(err)
+	}
+	if err := s.send16(pairingDHKeyCheck, ea); err != nil {
+		return ltk, err
+	}
+	eb, err := s.recv16(pairingDHKeyCheck)
+	if err != nil {
+		return ltk, err
+	}
+	if e, err := tb.F6(macKey, nb, na, r, pres.scIOCap(), a2, a1); err != nil || e != eb {
+		return ltk, s.fail(ErrSMPDHKeyCheckFailed)
+	}
+	return ltk, nil
+}
+
+// authenticate performs the authentication stage 1 of LE Secure Connections
+// pairing, and returns the nonces Na and Nb, and the value used as both ra
+// and rb in the authentication stage 2 [Vol 3, Part H, 2.3.5.6.2 & 2.3.5.6.3].
+func (s *smp) authenticate(m int, initiator bool, pkax, pkbx []byte) (na, nb, r [16]byte, err error) {
+	if m == justWorks || m == numericComparison {
+		if na, nb, err = s.exchangeNonces(initiator, false, pkax, pkbx, 0); err != nil {
+			return na, nb, r, err
+		}
+		if m == numericComparison {
+			g, err := s.c.hci.toolbox.G2(pkax, pkbx, na, nb)
+			if err != nil {
+				return na, nb, r, s.fail(err)
+			}
+			if err := s.confirm(int(g % 1000000)); err != nil {
+				return na, nb, r, s.fail(err)
+			}
+		}
+		return na, nb, r, nil
+	}
+
+	passkey, err := s.passkey(m, initiator)
+	if err != nil {
+		return na, nb, r, s.fail(err)
+	}
+	// The passkey is committed bit by bit in 20 rounds.
+	for i := uint(0); i < 20; i++ {
+		ri := uint8(0x80 | (passkey>>i)&0x01)
+		if na, nb, err = s.exchangeNonces(initiator, true, pkax, pkbx, ri); err != nil {
+			return na, nb, r, err
+		}
+	}
+	return na, nb, passkeyTK(passkey), nil
+}
+
+// exchangeNonces performs a round of the commitment and nonce exchange of the
+// authentication stage 1. The initiator commits to its nonce only in Passkey Entry.
+func (s *smp) exchangeNonces(initiator, commitInit bool, pkax, pkbx []byte, ri uint8) (na, nb [16]byte, err error) {
+	tb := s.c.hci.toolbox
+	if initiator {
+		if na, err = tb.Rand16(); err != nil {
+			return na, nb, s.fail(err)
+		}
+		if commitInit {
+			ca, err := tb.F4(pkax, pkbx, na, ri)
+			if err != nil {
+				return na, nb, s.fail(err)
+			}
+			if err := s.send16(pairingConfirm, ca); err != nil {
+				return na, nb, err
+			}
+		}
+		cb, err := s.recv16(pairingConfirm)
+		if err != nil {
+			return na, nb, err
+		}
+		if err := s.send16(pairingRandom, na); err != nil {
+			return na, nb, err
+		}
+		if nb, err = s.recv16(pairingRandom); err != nil {
+			return na, nb, err
+		}
+		if c, err := tb.F4(pkbx, pkax, nb, ri); err != nil || c != cb {
+			return na, nb, s.fail(ErrSMPConfirmValueFailed)
+		}
+		return na, nb, nil
+	}
+
+	var ca [16]byte
+	if commitInit {
+		if ca, err = s.recv16(pairingConfirm); err != nil {
+			return na, nb, err
+		}
+	}
+	if nb, err = tb.Rand16(); err != nil {
+		return na, nb, s.fail(err)
+	}
+	cb, err := tb.F4(pkbx, pkax, nb, ri)
+	if err != nil {
+		return na, nb, s.fail(err)
+	}
+	if err := s.send16(pairingConfirm, cb); err != nil {
+		return na, nb, err
+	}
+	if na, err = s.recv16(pairingRandom); err != nil {
+		return na, nb, err
+	}
+	if commitInit {
+		if c, err := tb.F4(pkax, pkbx, na, ri); err != nil || c != ca {
+			return na, nb, s.fail(ErrSMPConfirmValueFailed)
+		}
+	}
+	return na, nb, s.send16(pairingRandom, nb)
+}
+
+// scAddrs returns the addresses of the initiator and the responder in the
+// format used by f5 and f6; the address followed by its type.
+func (s *smp) scAddrs() (a1, a2 [7]byte) {
+	iat, rat, ia, ra := s.addrs()
+	copy(a1[:], ia[:])
+	a1[6] = iat
+	copy(a2[:], ra[:])
+	a2[6] = rat
+	return a1, a2
+}
+
+// respond performs pairing as the responder [Vol 3, Part H, 2.3].
+func (s *smp) respond(preq pairingFeatures) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	if len(preq) != smpLen[pairingRequest] {
+		return s.fail(ErrSMPInvalidParameters)
+	}
+	pres, oob := s.features(pairingResponse)
+	pres[5] &= preq.initKeyDist()
+	pres[6] &= preq.respKeyDist()
+	m, size, sc, err := s.negotiate(preq, pres, pres)
+	if err != nil {
+		return s.fail(err)
+	}
+	if err := s.c.sendSMP(pdu(pres)); err != nil {
+		return err
+	}
+
+	var key [16]byte
+	var last pdu
+	if sc {
+		key, last, err = s.respondSC(preq, pres, m)
+	} else {
+		key, last, err = s.respondLegacy(preq, pres, m, oob)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The master will start encryption with the STK or LTK once it receives
+	// the last packet of the phase 2, and we reply the key upon the LE Long
+	// Term Key Request.
+	key = maskKey(key, size)
+	s.drainEncryption()
+	s.Lock()
+	s.stk = &key
+	s.Unlock()
+	if err := s.c.sendSMP(last); err != nil {
+		return err
+	}
+	err = s.waitEncryption()
+	s.Lock()
+	s.stk = nil
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	auth := m != justWorks
+	s.c.setSecurity(size, auth)
+
+	initDist, respDist := pres.initKeyDist(), pres.respKeyDist()
+	if sc {
+		// EncKey is ignored in LE Secure Connections [Vol 3, Part H, 3.6.1].
+		initDist &^= keyDistEncKey
+		respDist &^= keyDistEncKey
+	}
+	local, err := s.sendKeys(respDist, size)
+	if err != nil {
+		return err
+	}
+	remote, err := s.recvKeys(initDist)
+	if err != nil {
+		return err
+	}
+	if sc {
+		local.LTK, remote.LTK = key, key
+	}
+	s.done(local, remote, size, auth, sc)
+	if preq.authReq()&pres.authReq()&authReqBonding != 0 {
+		s.c.saveBond(local, remote)
+	}
+	return nil
+}
+
+// respondLegacy performs the phase 2 of LE legacy pairing as the responder,
+// and returns the STK along with the last packet to be sent [Vol 3, Part H, 2.3.5].
+func (s *smp) respondLegacy(preq, pres pairingFeatures, m int, oob []byte) ([16]byte, pdu, error) {
+	var stk [16]byte
+	tk, err := s.tk(m, false, oob)
+	if err != nil {
+		return stk, nil, s.fail(err)
+	}
+
+	mconfirm, err := s.recv16(pairingConfirm)
+	if err != nil {
+		return stk, nil, err
+	}
+	tb := s.c.hci.toolbox
+	iat, rat, ia, ra := s.addrs()
+	srand, err := tb.Rand16()
+	if err != nil {
+		return stk, nil, s.fail(err)
+	}
+	sconfirm, err := tb.C1(tk, srand, preq, pres, iat, rat, ia, ra)
+	if err != nil {
+		return stk, nil, s.fail(err)
+	}
+	if err := s.send16(pairingConfirm, sconfirm); err != nil {
+		return stk, nil, err
+	}
+	mrand, err := s.recv16(pairingRandom)
+	if err != nil {
+		return stk, nil, err
+	}
+	if c, err := tb.C1(tk, mrand, preq, pres, iat, rat, ia, ra); err != nil || c != mconfirm {
+		return stk, nil, s.fail(ErrSMPConfirmValueFailed)
+	}
+	if stk, err = tb.S1(tk, srand, mrand); err != nil {
+		return stk, nil, s.fail(err)
+	}
+	return stk, append(pdu{pairingRandom}, srand[:]...), nil
+}
+
+// respondSC performs the phase 2 of LE Secure Connections pairing as the
+// responder, and returns the LTK along with the last packet to be sent
+// [Vol 3, Part H, 2.3.5.6].
+func (s *smp) respondSC(preq, pres pairingFeatures, m int) ([16]byte, pdu, error) {
+	var ltk [16]byte
+	b, err := s.recv(pairingPublicKey)
+	if err != nil {
+		return ltk, nil, err
+	}
+	pka := b[1:]
+	priv, pkb, err := crypto.GenerateKey()
+	if err != nil {
+		return ltk, nil, s.fail(err)
+	}
+	dhkey, err := crypto.DHKey(priv, pka)
+	if err != nil {
+		return ltk, nil, s.fail(ErrSMPDHKeyCheckFailed)
+	}
+	if err := s.c.sendSMP(append([]byte{pairingPublicKey}, pkb...)); err != nil {
+		return ltk, nil, err
+	}
+
+	na, nb, r, err := s.authenticate(m, false, pka[:32], pkb[:32])
+	if err != nil {
+		return ltk, nil, err
+	}
+
+	// Authentication stage 2 [Vol 3, Part H, 2.3.5.6.5].
+	tb := s.c.hci.toolbox
+	a1, a2 := s.scAddrs()
+	macKey, ltk, err := tb.F5(dhkey, na, nb, a1, a2)
+	if err != nil {
+		return ltk, nil, s.fail(err)
+	}
+	ea, err := s.recv16(pairingDHKeyCheck)
+	if err != nil {
+		return ltk, nil, err
+	}
+	if e, err := tb.F6(macKey, na, nb, r, preq.scIOCap(), a1, a2); err != nil || e != ea {
+		return ltk, nil, s.fail(ErrSMPDHKeyCheckFailed)
+	}
+	eb, err := tb.F6(macKey, nb, na, r, pres.scIOCap(), a2, a1)
+	if err != nil {
+		return ltk, nil, s.fail(err)
+	}
+	return ltk, append(pdu{pairingDHKeyCheck}, eb[:]...), nil
+}
+
+// done records the keys of a completed pairing.
+func (s *smp) done(local, remote *Keys, size int, auth, sc bool) {
+	local.KeySize, remote.KeySize = size, size
+	local.Authenticated, remote.Authenticated = auth, auth
+	local.SecureConnections, remote.SecureConnections = sc, sc
+	s.Lock()
+	s.local, s.remote = local, remote
+	s.Unlock()
+}
+
+// restore records the keys of a bond, which the link is encrypted with.
+func (s *smp) restore(b *Bond) {
+	s.Lock()
+	s.local, s.remote = &b.Local, &b.Remote
+	s.Unlock()
+	s.c.setSecurity(b.Remote.KeySize, b.Remote.Authenticated)
+}
+
+// sendKeys distributes the local keys specified in dist [Vol 3, Part H, 3.6].
+func (s *smp) sendKeys(dist uint8, size int) (*Keys, error) {
+	k := &Keys{Dist: dist}
+	if dist&keyDistEncKey != 0 {
+		ltk, err := s.c.hci.toolbox.Rand16()
+		if err != nil {
+			return nil, err
+		}
+		k.LTK = maskKey(ltk, size)
+		r, err := s.c.hci.toolbox.Rand16()
+		if err != nil {
+			return nil, err
+		}
+		k.EDIV = binary.LittleEndian.Uint16(r[0:2])
+		k.Rand = binary.LittleEndian.Uint64(r[2:10])
+
+		if err := s.c.sendSMP(append([]byte{encryptionInformation}, k.LTK[:]...)); err != nil {
+			return nil, err
+		}
+		b := make([]byte, 11)
+		b[0] = masterIdentification
+		binary.LittleEndian.PutUint16(b[1:], k.EDIV)
+		binary.LittleEndian.PutUint64(b[3:], k.Rand)
+		if err := s.c.sendSMP(b); err != nil {
+			return nil, err
+		}
+	}
+	if dist&keyDistIDKey != 0 {
+		k.IRK = s.c.hci.irk
+		k.IDAddrType, k.IDAddr = s.c.hci.own.identity(s.c.hci.addr)
+		if err := s.c.sendSMP(append([]byte{identiInformation}, k.IRK[:]...)); err != nil {
+			return nil, err
+		}
+		b := append([]byte{identityAddreInformation, k.IDAddrType}, k.IDAddr[:]...)
+		if err := s.c.sendSMP(b); err != nil {
+			return nil, err
+		}
+	}
+	if dist&keyDistSignKey != 0 {
+		csrk, err := s.c.hci.toolbox.Rand16()
+		if err != nil {
+			return nil, err
+		}
+		k.CSRK = csrk
+		if err := s.c.sendSMP(append([]byte{signingInformation}, k.CSRK[:]...)); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// recvKeys receives the remote keys specified in dist [Vol 3, Part H, 3.6].
+func (s *smp) recvKeys(dist uint8) (*Keys, error) {
+	k := &Keys{Dist: dist}
+	if dist&keyDistEncKey != 0 {
+		b, err := s.recv(encryptionInformation)
+		if err != nil {
+			return nil, err
+		}
+		copy(k.LTK[:], b[1:])
+		if b, err = s.recv(masterIdentification); err != nil {
+			return nil, err
+		}
+		k.EDIV = binary.LittleEndian.Uint16(b[1:])
+		k.Rand = binary.LittleEndian.Uint64(b[3:])
+	}
+	if dist&keyDistIDKey != 0 {
+		b, err := s.recv(identiInformation)
+		if err != nil {
+			return nil, err
+		}
+		copy(k.IRK[:], b[1:])
+		if b, err = s.recv(identityAddreInformation); err != nil {
+			return nil, err
+		}
+		k.IDAddrType = b[1]
+		copy(k.IDAddr[:], b[2:])
+	}
+	if dist&keyDistSignKey != 0 {
+		b, err := s.recv(signingInformation)
+		if err != nil {
+			return nil, err
+		}
+		copy(k.CSRK[:], b[1:])
+	}
+	return k, nil
+}
+
+// startEncryption starts or refreshes the encryption of the link with the
+// specified key as a master, and waits for the encryption to complete.
+func (c *Conn) startEncryption(ltk [16]byte, ediv uint16, rand uint64) error {
+	c.smp.drainEncryption()
+	if err := c.hci.Send(&cmd.LEStartEncryption{
+		ConnectionHandle:     c.param.ConnectionHandle(),
+		RandomNumber:         rand,
+		EncryptedDiversifier: ediv,
+		LongTermKey:          ltk,
+	}, nil); err != nil {
+		return err
+	}
+	return c.smp.waitEncryption()
+}
+
+// StartEncryption encrypts the link, or refreshes its encryption, with the
+// specified LTK as a master, and waits for the encryption to complete. The
+// key is identified by EDIV and Rand, which are zero for the LTKs generated by
+// LE Secure Connections pairing. [Vol 2, Part E, 7.8.24]
+func (c *Conn) StartEncryption(ltk [16]byte, ediv uint16, rand uint64) error {
+	if c.param.Role() != roleMaster {
+		return errors.New("only the master can start encryption")
+	}
+	if b := c.bond(); b != nil && b.Remote.LTK == ltk {
+		return c.encryptBonded(b)
+	}
+	if err := c.startEncryption(ltk, ediv, rand); err != nil {
+		return err
+	}
+	// Take the properties of the key from the pairing in this connection,
+	// if it's the key. Otherwise, they are unknown.
+	c.smp.Lock()
+	r := c.smp.remote
+	c.smp.Unlock()
+	if r != nil && r.LTK == ltk {
+		c.setSecurity(r.KeySize, r.Authenticated)
+	} else {
+		c.setSecurity(0, false)
+	}
+	return nil
+}
+
+// setSecurity records the properties of the key the link is encrypted with.
+func (c *Conn) setSecurity(size int, auth bool) {
+	c.muSec.Lock()
+	defer c.muSec.Unlock()
+	c.keySize = size
+	c.authenticated = auth
+}
+
+// identity returns the identity address of the peer device.
+func (c *Conn) identity() (uint8, [6]byte) {
+	c.smp.Lock()
+	r := c.smp.remote
+	c.smp.Unlock()
+	if r != nil && r.Dist&keyDistIDKey != 0 {
+		return r.IDAddrType, r.IDAddr
+	}
+	return c.peerType, c.peer
+}
+
+// Bonded returns a channel, which is closed once the link is encrypted with
+// the keys of the bond with the peer device, either restored or just paired.
+// Only then the peer device is known to be the bonded one, rather than one
+// using its address.
+func (c *Conn) Bonded() <-chan struct{} { return c.chBonded }
+
+// setBonded records that the link is encrypted with the keys of the bond.
+func (c *Conn) setBonded() {
+	c.bondedOnce.Do(func() { close(c.chBonded) })
+}
+
+// bond returns the bond with the peer device, or nil if it's not bonded.
+func (c *Conn) bond() *Bond {
+	if c.hci.bonds == nil {
+		return nil
+	}
+	b, err := c.hci.bonds.Load(c.identity())
+	if err != nil {
+		if err != ErrBondNotFound {
+			_ = logger.Error("smp", "can't load bond", err)
+		}
+		return nil
+	}
+	return b
+}
+
+// saveBond stores the keys of a completed pairing as the bond with the peer device.
+func (c *Conn) saveBond(local, remote *Keys) {
+	if c.hci.bonds == nil {
+		return
+	}
+	b := &Bond{Local: *local, Remote: *remote}
+	b.AddrType, b.Addr = c.identity()
+	if s, ok := c.hci.signer.(*bondSigner); ok {
+		// The counters of the keys replaced aren't kept.
+		s.forget(c, false)
+	}
+	if err := c.hci.bonds.Save(b); err != nil {
+		_ = logger.Error("smp", "can't save bond", err)
+		return
+	}
+	c.setBonded()
+	if remote.Dist&keyDistIDKey != 0 {
+		// Resolve the addresses of the peer device with its new IRK.
+		go func() {
+			if err := c.hci.ReloadIRKs(); err != nil {
+				_ = logger.Error("smp", "can't reload IRKs", err)
+			}
+		}()
+	}
+}
+
+// encryptBonded encrypts the link with the LTK distributed by, or generated
+// with, the bonded peer device as a master.
+func (c *Conn) encryptBonded(b *Bond) error {
+	k := &b.Remote
+	if !k.SecureConnections && k.Dist&keyDistEncKey == 0 {
+		return errors.New("no LTK in bond")
+	}
+	if err := c.startEncryption(k.LTK, k.EDIV, k.Rand); err != nil {
+		return err
+	}
+	c.smp.restore(b)
+	c.setBonded()
+	return nil
 }
@@ -0,0 +1,71 @@
+package hci
+
+import (
+	"encoding/binary"
+
+	"github.com/go-ble/ble/linux/crypto"
+	"github.com/go-ble/ble/linux/hci/cmd"
+)
+
+// maskKey shortens a key to the negotiated encryption key size by zeroing
+// its most significant octets [Vol 3, Part H, 2.3.4].
+func maskKey(k [16]byte, size int) [16]byte {
+	for i := size; i < len(k); i++ {
+		k[i] = 0
+	}
+	return k
+}
+
+// randomPasskey returns a random passkey in the range of 000,000 to 999,999.
+func randomPasskey(tb *crypto.Toolbox) (int, error) {
+	var b [4]byte
+	if err := tb.Rand(b[:]); err != nil {
+		return 0, err
+	}
+	return int(binary.LittleEndian.Uint32(b[:]) % 1000000), nil
+}
+
+// passkeyTK returns the TK of a passkey [Vol 3, Part H, 2.3.5.3].
+func passkeyTK(passkey int) [16]byte {
+	var tk [16]byte
+	binary.LittleEndian.PutUint32(tk[:], uint32(passkey))
+	return tk
+}
+
+// controllerEngine is the crypto.Engine implemented by the controller, with
+// the LE Encrypt and LE Rand commands [Vol 2, Part E, 7.8.22 & 7.8.23].
+type controllerEngine struct {
+	h *HCI
+}
+
+// Encrypt encrypts the plaintext with the key using AES-128.
+func (e controllerEngine) Encrypt(key, plaintext [16]byte) ([16]byte, error) {
+	// The command parameters are least significant octet first.
+	c := &cmd.LEEncrypt{}
+	for i := 0; i < 16; i++ {
+		c.Key[i], c.PlaintextData[i] = key[15-i], plaintext[15-i]
+	}
+	var rp cmd.LEEncryptRP
+	var r [16]byte
+	if err := e.h.Send(c, &rp); err != nil {
+		return r, err
+	}
+	for i := 0; i < 16; i++ {
+		r[i] = rp.EncryptedData[15-i]
+	}
+	return r, nil
+}
+
+// Rand fills b with random octets, 8 octets at a time.
+func (e controllerEngine) Rand(b []byte) error {
+	for len(b) > 0 {
+		var rp cmd.LERandRP
+		if err := e.h.Send(&cmd.LERand{}, &rp); err != nil {
+			return err
+		}
+		var r [8]byte
+		binary.LittleEndian.PutUint64(r[:], rp.RandomNumber)
+		b = b[copy(b, r[:]):]
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+package hci
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/hci/evt"
+)
+
+// pipeSkt is the socket of a fake controller, which is connected to the one
+// of the peer device over a single LE link. It passes the ACL data packets to
+// the peer, and emulates the commands used in connections and encryption.
+type pipeSkt struct {
+	in     chan []byte
+	peer   *pipeSkt
+	link   *pipeLink
+	addr   [6]byte
+	closed chan struct{}
+	once   sync.Once
+
+	mu  sync.Mutex
+	adv []byte // The values of LE Set Advertising Enable.
+}
+
+// pipeLink is the state of the link shared by the controllers.
+type pipeLink struct {
+	sync.Mutex
+	handle    uint16
+	key       [16]byte // The key the master started the encryption with.
+	encrypted bool
+
+	// tap, if set, is called with each ACL data packet sent over the link,
+	// which it may modify, and the socket sending it.
+	tap func(from *pipeSkt, p []byte)
+}
+
+// setTap sets the tap of the ACL data packets.
+func (l *pipeLink) setTap(f func(from *pipeSkt, p []byte)) {
+	l.Lock()
+	l.tap = f
+	l.Unlock()
+}
+
+func (s *pipeSkt) Read(b []byte) (int, error) {
+	select {
+	case p := <-s.in:
+		return copy(b, p), nil
+	case <-s.closed:
+		return 0, io.EOF
+	}
+}
+
+func (s *pipeSkt) Write(b []byte) (int, error) {
+	p := append([]byte(nil), b...)
+	switch p[0] {
+	case pktTypeCommand:
+		go s.command(binary.LittleEndian.Uint16(p[1:]), p[4:4+int(p[3])])
+	case pktTypeACLData:
+		// The packets from the host to the controller are delivered as the
+		// ones from the controller to the host, and completed right away.
+		if p[2]>>4&0x3 == pbfHostToControllerStart {
+			p[2] = p[2]&0xcf | pbfControllerToHostStart<<4
+		}
+		s.link.Lock()
+		tap := s.link.tap
+		s.link.Unlock()
+		if tap != nil {
+			tap(s, p)
+		}
+		s.peer.push(p)
+		h := s.link.handle
+		go s.event(evt.NumberOfCompletedPacketsCode, 1, byte(h), byte(h>>8), 1, 0)
+	}
+	return len(b), nil
+}
+
+func (s *pipeSkt) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+func (s *pipeSkt) push(p []byte) {
+	select {
+	case s.in <- p:
+	case <-s.closed:
+	}
+}
+
+func (s *pipeSkt) event(code byte, params ...byte) {
+	s.push(append([]byte{pktTypeEvent, code, byte(len(params))}, params...))
+}
+
+func (s *pipeSkt) complete(op uint16, rp ...byte) {
+	s.event(evt.CommandCompleteCode, append([]byte{1, byte(op), byte(op >> 8)}, rp...)...)
+}
+
+func (s *pipeSkt) command(op uint16, params []byte) {
+	l := s.link
+	h := []byte{byte(l.handle), byte(l.handle >> 8)}
+	switch op {
+	case 0x1009: // Read BD_ADDR
+		s.complete(op, append([]byte{0}, s.addr[:]...)...)
+	case 0x1005: // Read Buffer Size
+		s.complete(op, 0, 27, 0, 0, 8, 0, 0, 0)
+	case 0x2002: // LE Read Buffer Size
+		s.complete(op, 0, 27, 0, 8)
+	case 0x200A: // LE Set Advertising Enable
+		s.mu.Lock()
+		s.adv = append(s.adv, params[0])
+		s.mu.Unlock()
+		s.complete(op, 0)
+	case 0x2019: // LE Enable Encryption
+		s.event(evt.CommandStatusCode, 0, 1, byte(op), byte(op>>8))
+		l.Lock()
+		copy(l.key[:], params[12:28])
+		l.Unlock()
+		// LE Long Term Key Request with the Rand and the EDIV.
+		s.peer.event(evtLEMeta, append([]byte{evt.LELongTermKeyRequestSubCode, h[0], h[1]}, params[2:12]...)...)
+	case 0x201A: // LE Long Term Key Request Reply
+		s.complete(op, 0, h[0], h[1])
+		l.Lock()
+		ok := string(params[2:18]) == string(l.key[:])
+		refresh := l.encrypted
+		l.encrypted = l.encrypted || ok
+		l.Unlock()
+		for _, x := range []*pipeSkt{s, s.peer} {
+			switch {
+			case !ok:
+				x.event(evt.EncryptionChangeCode, 0x3D, h[0], h[1], 0) // MIC Failure
+			case refresh:
+				x.event(evt.EncryptionKeyRefreshCompleteCode, 0, h[0], h[1])
+			default:
+				x.event(evt.EncryptionChangeCode, 0, h[0], h[1], 1)
+			}
+		}
+	case 0x201B: // LE Long Term Key Request Negative Reply
+		s.complete(op, 0, h[0], h[1])
+		s.peer.event(evt.EncryptionChangeCode, 0x06, h[0], h[1], 0) // PIN or Key Missing
+	default:
+		s.complete(op, make([]byte, 20)...)
+	}
+}
+
+// advertising returns the values of LE Set Advertising Enable sent so far.
+func (s *pipeSkt) advertising() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte(nil), s.adv...)
+}
+
+// initPipe initializes the HCI over the socket of a fake controller.
+func initPipe(t *testing.T, h *HCI, skt *pipeSkt) {
+	h.evth[evtLEMeta] = h.handleLEMeta
+	h.evth[evt.CommandCompleteCode] = h.handleCommandComplete
+	h.evth[evt.CommandStatusCode] = h.handleCommandStatus
+	h.evth[evt.DisconnectionCompleteCode] = h.handleDisconnectionComplete
+	h.evth[evt.NumberOfCompletedPacketsCode] = h.handleNumberOfCompletedPackets
+	h.evth[evt.EncryptionChangeCode] = h.handleEncryptionChange
+	h.evth[evt.EncryptionKeyRefreshCompleteCode] = h.handleEncryptionKeyRefreshComplete
+	h.subh[evt.LEConnectionCompleteSubCode] = h.handleLEConnectionComplete
+	h.subh[evt.LELongTermKeyRequestSubCode] = h.handleLELongTermKeyRequest
+	h.skt = skt
+	h.setAllowedCommands(1)
+	go h.sktLoop()
+	if err := h.init(); err != nil {
+		t.Fatal(err)
+	}
+	h.pool = NewPool(1+4+h.bufSize, h.bufCnt-1)
+}
+
+// evtLEMeta is the code of the LE Meta events.
+const evtLEMeta = 0x3E
+
+// newPipePair returns the master and the slave connections of two HCIs, which
+// are connected over a fake LE link. The options are applied to the HCIs of
+// the master and the slave respectively, before they are initialized.
+func newPipePair(t *testing.T, optM, optS func(*HCI)) (cm, cs *Conn) {
+	link := &pipeLink{handle: 0x0040}
+	sm := &pipeSkt{in: make(chan []byte, 256), link: link, addr: [6]byte{1, 2, 3, 4, 5, 6}, closed: make(chan struct{})}
+	ss := &pipeSkt{in: make(chan []byte, 256), link: link, addr: [6]byte{0xA, 0xB, 0xC, 0xD, 0xE, 0xF}, closed: make(chan struct{})}
+	sm.peer, ss.peer = ss, sm
+	newHCI := func(skt *pipeSkt, opt func(*HCI)) *HCI {
+		h, err := NewHCI()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opt != nil {
+			opt(h)
+		}
+		initPipe(t, h, skt)
+		return h
+	}
+	hm, hs := newHCI(sm, optM), newHCI(ss, optS)
+
+	// LE Connection Complete
+	connected := func(role byte, peer [6]byte) []byte {
+		b := []byte{evt.LEConnectionCompleteSubCode, 0, byte(link.handle), byte(link.handle >> 8), role, 0}
+		b = append(b, peer[:]...)
+		return append(b, 6, 0, 0, 0, 0x48, 0, 0)
+	}
+	// The master connection is closed, unless it's taken right away, as no
+	// one is dialing.
+	hm.chMasterConn = make(chan *Conn, 1)
+	sm.event(evtLEMeta, connected(roleMaster, ss.addr)...)
+	ss.event(evtLEMeta, connected(roleSlave, sm.addr)...)
+	return <-hm.chMasterConn, <-hs.chSlaveConn
+}
+
+// testAgent is a pairing agent, whose user interaction is done by functions.
+type testAgent struct {
+	ioCap   ble.IOCapability
+	display func(passkey uint32)
+	request func() (uint32, error)
+	confirm func(n uint32) bool
+}
+
+func (a *testAgent) IOCapability() ble.IOCapability            { return a.ioCap }
+func (a *testAgent) AuthRequirements() (mitm, bond bool)       { return true, true }
+func (a *testAgent) OOBData(c ble.Conn) ([]byte, bool)         { return nil, false }
+func (a *testAgent) AuthorizePairing(c ble.Conn) bool          { return true }
+func (a *testAgent) DisplayPasskey(c ble.Conn, passkey uint32) { a.display(passkey) }
+func (a *testAgent) RequestPasskey(c ble.Conn) (uint32, error) { return a.request() }
+func (a *testAgent) ConfirmNumber(c ble.Conn, n uint32) bool   { return a.confirm(n) }
+
+// waitKeys returns the keys of the last pairing of the connection, which the
+// slave sets once the link is encrypted.
+func waitKeys(t *testing.T, c *Conn) (local, remote *Keys) {
+	for i := 0; i < 100; i++ {
+		if local, remote = c.Keys(); local != nil {
+			return local, remote
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no keys")
+	return nil, nil
+}
+
+// testPair pairs the connections, and checks they're encrypted with the same
+// keys.
+func testPair(t *testing.T, cm, cs *Conn, sc, authenticated bool) {
+	if err := cm.Pair(); err != nil {
+		t.Fatal(err)
+	}
+	lm, rm := cm.Keys()
+	ls, rs := waitKeys(t, cs)
+	if !cm.Encrypted() || !cs.Encrypted() {
+		t.Fatal("link not encrypted")
+	}
+	if lm.LTK != rs.LTK || ls.LTK != rm.LTK {
+		t.Fatalf("keys mismatch: %+v %+v %+v %+v", lm, rs, ls, rm)
+	}
+	if rm.SecureConnections != sc || rm.Authenticated != authenticated {
+		t.Fatalf("SecureConnections %v, Authenticated %v", rm.SecureConnections, rm.Authenticated)
+	}
+}
+
+func noSC(h *HCI) { h.SetSecureConnections(false) }
+
+func TestPairLegacyJustWorks(t *testing.T) {
+	cm, cs := newPipePair(t, noSC, noSC)
+	testPair(t, cm, cs, false, false)
+}
+
+func TestPairLegacyPasskey(t *testing.T) {
+	passkey := make(chan uint32, 1)
+	var cm *Conn
+	keyboard := &testAgent{
+		ioCap: ble.IOCapKeyboardOnly,
+		request: func() (uint32, error) {
+			// Notify the keypresses while the passkey is entered, which the
+			// displaying device ignores [Vol 3, Part H, 3.5.8].
+			for _, n := range []byte{0x00, 0x01, 0x01, 0x02, 0x04} {
+				if err := cm.sendSMP(pdu{pairingKeypress, n}); err != nil {
+					return 0, err
+				}
+			}
+			return <-passkey, nil
+		},
+	}
+	display := &testAgent{
+		ioCap:   ble.IOCapDisplayOnly,
+		display: func(p uint32) { passkey <- p },
+	}
+	optM := func(h *HCI) { noSC(h); h.SetPairingAgent(keyboard) }
+	optS := func(h *HCI) { noSC(h); h.SetPairingAgent(display) }
+	var cs *Conn
+	cm, cs = newPipePair(t, optM, optS)
+	testPair(t, cm, cs, false, true)
+}
+
+func TestPairSCNumericComparison(t *testing.T) {
+	for _, accept := range []bool{true, false} {
+		nums := make(chan uint32, 2)
+		agent := func(accept bool) func(*HCI) {
+			return func(h *HCI) {
+				h.SetPairingAgent(&testAgent{
+					ioCap:   ble.IOCapDisplayYesNo,
+					confirm: func(n uint32) bool { nums <- n; return accept },
+				})
+			}
+		}
+		cm, cs := newPipePair(t, agent(true), agent(accept))
+		if !accept {
+			if err := cm.Pair(); err != ErrSMPNumericComparisonFailed {
+				t.Fatalf("got %v, want %v", err, ErrSMPNumericComparisonFailed)
+			}
+			continue
+		}
+		testPair(t, cm, cs, true, true)
+		if a, b := <-nums, <-nums; a != b {
+			t.Fatalf("compared %06d and %06d", a, b)
+		}
+	}
+}
+
+// smpCode returns the code of the SMP PDU in the ACL data packet, if it's one.
+// The SMP PDUs fit in a single packet of the fake controllers.
+func smpCode(p []byte) (byte, bool) {
+	if len(p) < 10 || binary.LittleEndian.Uint16(p[7:]) != cidSMP {
+		return 0, false
+	}
+	return p[9], true
+}
+
+func TestPairSCJustWorks(t *testing.T) {
+	cm, cs := newPipePair(t, nil, nil)
+	testPair(t, cm, cs, true, false)
+}
+
+func TestPairSCPasskey(t *testing.T) {
+	passkey := make(chan uint32, 1)
+	keyboard := &testAgent{
+		ioCap:   ble.IOCapKeyboardOnly,
+		request: func() (uint32, error) { return <-passkey, nil },
+	}
+	display := &testAgent{
+		ioCap:   ble.IOCapDisplayOnly,
+		display: func(p uint32) { passkey <- p },
+	}
+	cm, cs := newPipePair(t, func(h *HCI) { h.SetPairingAgent(keyboard) }, func(h *HCI) { h.SetPairingAgent(display) })
+
+	// Each device commits to a bit of the passkey in each of the 20 rounds
+	// [Vol 3, Part H, 2.3.5.6.3].
+	var mu sync.Mutex
+	sent := make(map[byte]int)
+	cm.hci.skt.(*pipeSkt).link.setTap(func(from *pipeSkt, p []byte) {
+		if code, ok := smpCode(p); ok {
+			mu.Lock()
+			sent[code]++
+			mu.Unlock()
+		}
+	})
+	testPair(t, cm, cs, true, true)
+	mu.Lock()
+	defer mu.Unlock()
+	if sent[pairingConfirm] != 40 || sent[pairingRandom] != 40 {
+		t.Errorf("%d confirms, and %d randoms; want 40 each", sent[pairingConfirm], sent[pairingRandom])
+	}
+}
+
+func TestPairSCDHKeyCheckFailed(t *testing.T) {
+	// Either device fails the pairing, if the check of the other one is
+	// wrong, and the link isn't encrypted.
+	for _, master := range []bool{true, false} {
+		cm, cs := newPipePair(t, nil, nil)
+		skt := cm.hci.skt.(*pipeSkt)
+		skt.link.setTap(func(from *pipeSkt, p []byte) {
+			if code, ok := smpCode(p); ok && code == pairingDHKeyCheck && (from == skt) == master {
+				p[10] ^= 0x01
+			}
+		})
+		if err := cm.Pair(); err != ErrSMPDHKeyCheckFailed {
+			t.Errorf("master %v: got %v, want %v", master, err, ErrSMPDHKeyCheckFailed)
+		}
+		if cm.Encrypted() || cs.Encrypted() {
+			t.Errorf("master %v: link encrypted", master)
+		}
+	}
+}
@@ -19,13 +19,15 @@ var (
 
 var cnt = 0
 
+func esc(s string) string {
+	s = strings.Replace(s, " ", "", -1)
+	s = strings.Replace(s, "/", "", -1)
+	s = strings.Replace(s, "_", "", -1)
+	return s
+}
+
 var funcMap = template.FuncMap{
-	"esc": func(s string) string {
-		s = strings.Replace(s, " ", "", -1)
-		s = strings.Replace(s, "/", "", -1)
-		s = strings.Replace(s, "_", "", -1)
-		return s
-	},
+	"esc": esc,
 	"reset": func() string {
 		cnt = 0
 		return ""
@@ -87,6 +89,87 @@ var funcMap = template.FuncMap{
 		}
 		return s
 	},
+	"siglen": func(fields []field) string {
+		// The length of the fixed fields, and the variable length one, which
+		// is the last one of a packet.
+		n, v := 0, ""
+		for _, f := range fields {
+			for k, t := range f {
+				switch t {
+				case "uint8":
+					n++
+				case "uint16":
+					n += 2
+				case "[]byte":
+					v = fmt.Sprintf(" + len(s.%s)", esc(k))
+				case "[]uint16":
+					v = fmt.Sprintf(" + 2*len(s.%s)", esc(k))
+				}
+			}
+		}
+		return fmt.Sprintf("%d%s", n, v)
+	},
+	"sigmarshal": func(fields []field) string {
+		var s string
+		n := 0
+		for _, f := range fields {
+			for k, t := range f {
+				switch t {
+				case "uint8":
+					s += fmt.Sprintf("\tb[%d] = s.%s\n", n, esc(k))
+					n++
+				case "uint16":
+					s += fmt.Sprintf("\tbinary.LittleEndian.PutUint16(b[%d:], s.%s)\n", n, esc(k))
+					n += 2
+				case "[]byte":
+					s += fmt.Sprintf("\tcopy(b[%d:], s.%s)\n", n, esc(k))
+				case "[]uint16":
+					s += fmt.Sprintf("\tfor i, v := range s.%s {\n", esc(k))
+					s += fmt.Sprintf("\t\tbinary.LittleEndian.PutUint16(b[%d+2*i:], v)\n\t}\n", n)
+				default:
+					s += fmt.Sprintf("XXX: %s, %s", k, t)
+				}
+			}
+		}
+		return s
+	},
+	"sigunmarshal": func(fields []field) string {
+		var s string
+		n := 0
+		for _, f := range fields {
+			for _, t := range f {
+				switch t {
+				case "uint8":
+					n++
+				case "uint16":
+					n += 2
+				}
+			}
+		}
+		s += fmt.Sprintf("\tif len(b) < %d {\n\t\treturn io.ErrUnexpectedEOF\n\t}\n", n)
+		n = 0
+		for _, f := range fields {
+			for k, t := range f {
+				switch t {
+				case "uint8":
+					s += fmt.Sprintf("\ts.%s = b[%d]\n", esc(k), n)
+					n++
+				case "uint16":
+					s += fmt.Sprintf("\ts.%s = binary.LittleEndian.Uint16(b[%d:])\n", esc(k), n)
+					n += 2
+				case "[]byte":
+					s += fmt.Sprintf("\ts.%s = append([]byte(nil), b[%d:]...)\n", esc(k), n)
+				case "[]uint16":
+					s += fmt.Sprintf("\ts.%s = make([]uint16, (len(b)-%d)/2)\n", esc(k), n)
+					s += fmt.Sprintf("\tfor i := range s.%s {\n", esc(k))
+					s += fmt.Sprintf("\t\ts.%s[i] = binary.LittleEndian.Uint16(b[%d+2*i:])\n\t}\n", esc(k), n)
+				default:
+					s += fmt.Sprintf("XXX: %s, %s", k, t)
+				}
+			}
+		}
+		return s
+	},
 	"getter": func(n, c, k, v string) string {
 		var s string
 		switch v {
@@ -284,7 +367,7 @@ func main() {
 		}
 		genEvt(b, w, t)
 	case "signal":
-		fmt.Fprintf(w, "package l2cap\n")
+		fmt.Fprintf(w, "package hci\n")
 		t, err := template.New(*tmpl).Funcs(funcMap).Parse(string(input("signal.tmpl")))
 		if err != nil {
 			log.Fatalf("parsing: %s", err)
@@ -19,6 +19,7 @@ type DeviceOption interface {
 	SetDisconnectedHandler(f func(evt.DisconnectionComplete)) error
 	SetPeripheralRole() error
 	SetCentralRole() error
+	SetPairingAgent(PairingAgent) error
 }
 
 // An Option is a configuration function, which configures the device.
@@ -101,3 +102,11 @@ func OptCentralRole() Option {
 		return nil
 	}
 }
+
+// OptPairingAgent sets the agent, which involves the application in pairing.
+func OptPairingAgent(a PairingAgent) Option {
+	return func(opt DeviceOption) error {
+		opt.SetPairingAgent(a)
+		return nil
+	}
+}
@@ -30,6 +30,19 @@ const (
 	CharExtended    Property = 0x80 // supports extended properties
 )
 
+// Permission is the security requirements of accessing an attribute value [Vol 3, Part F, 3.2.5].
+type Permission int
+
+// Attribute permission flags
+const (
+	PermReadEncrypt       Permission = 0x01 // read requires an encrypted link
+	PermReadAuthenticate  Permission = 0x02 // read requires an encrypted link with an authenticated key
+	PermReadAuthorize     Permission = 0x04 // read requires authorization
+	PermWriteEncrypt      Permission = 0x10 // write requires an encrypted link
+	PermWriteAuthenticate Permission = 0x20 // write requires an encrypted link, or a signature, with an authenticated key
+	PermWriteAuthorize    Permission = 0x40 // write requires authorization
+)
+
 // A Profile is composed of one or more services necessary to fulfill a use case.
 type Profile struct {
 	Services []*Service
@@ -117,7 +130,10 @@ func (s *Service) NewCharacteristic(u UUID) *Characteristic {
 type Characteristic struct {
 	UUID        UUID
 	Property    Property
-	Secure      Property // FIXME
+	Secure      Property   // properties which require an encrypted link
+	Permission  Permission // security requirements of accessing the value
+	MinKeySize  int        // minimum encryption key size, in octets, where encryption is required
+	Authorizer  Authorizer // authorizes the accesses which require authorization
 	Descriptors []*Descriptor
 	CCCD        *Descriptor
 
@@ -183,6 +199,7 @@ func (c *Characteristic) HandleWrite(h WriteHandler) {
 }
 
 // HandleNotify makes the characteristic support notify requests, and routes notification requests to h.
+// h can be nil, if the values are pushed to the subscribers by the server instead.
 // HandleNotify must be called before the containing service is added to a server.
 func (c *Characteristic) HandleNotify(h NotifyHandler) {
 	c.Property |= CharNotify
@@ -190,6 +207,7 @@ func (c *Characteristic) HandleNotify(h NotifyHandler) {
 }
 
 // HandleIndicate makes the characteristic support indicate requests, and routes notification requests to h.
+// h can be nil, if the values are pushed to the subscribers by the server instead.
 // HandleIndicate must be called before the containing service is added to a server.
 func (c *Characteristic) HandleIndicate(h NotifyHandler) {
 	c.Property |= CharIndicate
@@ -198,8 +216,11 @@ func (c *Characteristic) HandleIndicate(h NotifyHandler) {
 
 // Descriptor is a BLE descriptor
 type Descriptor struct {
-	UUID     UUID
-	Property Property
+	UUID       UUID
+	Property   Property
+	Permission Permission // security requirements of accessing the value
+	MinKeySize int        // minimum encryption key size, in octets, where encryption is required
+	Authorizer Authorizer // authorizes the accesses which require authorization
 
 	Handle uint16
 	Value  []byte